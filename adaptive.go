@@ -0,0 +1,83 @@
+package rfb
+
+import (
+	"image"
+	"slices"
+)
+
+// Kinds of rectangle content, for Server.AdaptiveEncoding.
+const (
+	contentSolid     = iota // a single colour
+	contentLowColour        // few enough colours for a palette
+	contentPhoto            // anything else
+)
+
+// adaptiveEncodings lists the encodings that suit each kind of content,
+// cheapest first, as TigerVNC ranks them: a Tight fill for solid
+// regions, ZRLE's palette runs for text and drawings, and Tight, with
+// JPEG if the client allows it, for photographic content. CoRRE is only
+// good at flat regions.
+var adaptiveEncodings = [...][]int32{
+	contentSolid:     {encodingTight, encodingTightPNG, encodingZRLE, encodingHextile, encodingCoRRE, encodingRaw},
+	contentLowColour: {encodingZRLE, encodingTight, encodingTightPNG, encodingHextile, encodingCoRRE, encodingRaw},
+	contentPhoto:     {encodingTight, encodingTightPNG, encodingZRLE, encodingHextile, encodingRaw},
+}
+
+// A plannedRect is a rectangle of an update and the encoding to send it
+// with.
+type plannedRect struct {
+	rect image.Rectangle
+	enc  int32
+	e    Encoder
+}
+
+// planRectsLocked picks the encodings for rects of img. Normally all
+// rectangles use the client's preferred encoding; with
+// Server.AdaptiveEncoding, each gets the cheapest encoding for its
+// content among those the client announced, unless the client prefers
+// an encoding the server doesn't rank, like Open H.264.
+func (c *Conn) planRectsLocked(img image.Image, rects []image.Rectangle) []plannedRect {
+	bounds := img.Bounds()
+	enc, e := c.rectEncoderLocked(bounds)
+	if !c.s.AdaptiveEncoding || !slices.Contains(adaptiveEncodings[contentSolid], enc) {
+		return planned(nil, enc, e, rects, bounds)
+	}
+	var plan []plannedRect
+	for _, r := range rects {
+		enc, e := int32(encodingRaw), c.encoderLocked(encodingRaw)
+		for _, a := range adaptiveEncodings[c.contentLocked(img, r)] {
+			if !c.supportsLocked(a) {
+				continue
+			}
+			if ae := c.usableEncoderLocked(a, bounds); ae != nil {
+				enc, e = a, ae
+				break
+			}
+		}
+		plan = planned(plan, enc, e, []image.Rectangle{r}, bounds)
+	}
+	return plan
+}
+
+// planned appends rects, split as encoder e requires, to plan.
+func planned(plan []plannedRect, enc int32, e Encoder, rects []image.Rectangle, bounds image.Rectangle) []plannedRect {
+	if s, ok := e.(RectSplitter); ok {
+		rects = s.SplitRects(rects, bounds)
+	}
+	for _, r := range rects {
+		plan = append(plan, plannedRect{r, enc, e})
+	}
+	return plan
+}
+
+// contentLocked classifies rect of img as the client will see it.
+func (c *Conn) contentLocked(img image.Image, rect image.Rectangle) int {
+	c.pixbuf = c.translateLocked(c.pixbuf[:0], img, rect)
+	switch {
+	case run(c.pixbuf) == len(c.pixbuf):
+		return contentSolid
+	case newPalette(c.pixbuf, maxPaletteSize) != nil:
+		return contentLowColour
+	}
+	return contentPhoto
+}
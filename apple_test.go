@@ -0,0 +1,209 @@
+package rfb_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// ardLogin performs the handshake of macOS's Screen Sharing up to the
+// SecurityResult, which it returns. Screen Sharing answers with the
+// version the server announced, and picks ARD among the security types.
+func ardLogin(t *testing.T, addr, user, password string) (net.Conn, uint32) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+	apple := string(buf) == "RFB 003.889\n"
+	nc.Write(buf)
+	if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+		t.Fatal(err)
+	}
+	types := make([]byte, buf[0])
+	if _, err := io.ReadFull(nc, types); err != nil {
+		t.Fatal(err)
+	}
+	if apple && !bytes.Equal(types, []byte{30}) || !bytes.Contains(types, []byte{30}) {
+		t.Fatalf("server offered security types %v; want ARD", types)
+	}
+	nc.Write([]byte{30})
+
+	var hdr struct{ Generator, KeyLen uint16 }
+	if err := binary.Read(nc, binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]byte, 2*int(hdr.KeyLen))
+	if _, err := io.ReadFull(nc, keys); err != nil {
+		t.Fatal(err)
+	}
+	p := new(big.Int).SetBytes(keys[:hdr.KeyLen])
+	serverPub := new(big.Int).SetBytes(keys[hdr.KeyLen:])
+	priv := big.NewInt(0x1234567)
+	pub := new(big.Int).Exp(big.NewInt(int64(hdr.Generator)), priv, p)
+	secret := new(big.Int).Exp(serverPub, priv, p).FillBytes(make([]byte, hdr.KeyLen))
+	key := md5.Sum(secret)
+	block, _ := aes.NewCipher(key[:])
+	creds := make([]byte, 128)
+	copy(creds, user)
+	copy(creds[64:], password)
+	for i := 0; i < len(creds); i += aes.BlockSize {
+		block.Encrypt(creds[i:], creds[i:])
+	}
+	nc.Write(append(creds, pub.FillBytes(make([]byte, hdr.KeyLen))...))
+
+	var status uint32
+	if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+		t.Fatal(err)
+	}
+	return nc, status
+}
+
+func TestAppleScreenSharing(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(64, 48)
+	s.AppleScreenSharing = &rfb.AppleScreenSharing{
+		Authenticate: func(user, password string) bool { return user == "alice" && password == "secret" },
+	}
+	go s.Serve(ln)
+	addr := ln.Addr().String()
+
+	if _, status := ardLogin(t, addr, "alice", "wrong"); status != 1 {
+		t.Errorf("wrong password: got SecurityResult %d; want failed", status)
+	}
+
+	nc, status := ardLogin(t, addr, "alice", "secret")
+	if status != 0 {
+		t.Fatalf("got SecurityResult %d; want OK", status)
+	}
+	nc.Write([]byte{1}) // shared
+	init := make([]byte, 24)
+	if _, err := io.ReadFull(nc, init); err != nil {
+		t.Fatal(err)
+	}
+	if bpp := init[4]; bpp != 32 {
+		t.Errorf("ServerInit has %d bits per pixel; want 32", bpp)
+	}
+	// SetEncodings with Apple's private encodings.
+	binary.Write(nc, binary.BigEndian, struct {
+		Type, Pad uint8
+		N         uint16
+		Encodings [3]int32
+	}{2, 0, 3, [3]int32{1000, 1001, 16}})
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); c.Fingerprint().Viewer != "Screen Sharing"; {
+		if time.Now().After(deadline) {
+			t.Fatalf("got fingerprint %+v", c.Fingerprint())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := c.Fingerprint().Security; got != 30 {
+		t.Errorf("got security type %d; want ARD", got)
+	}
+	if got := c.Identity(); got.User != "alice" || got.Method != "ARD" {
+		t.Errorf("got identity %+v; want alice with ARD", got)
+	}
+
+	// Other viewers connect as before.
+	cc, err := rfb.Dial("tcp", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+func TestServerARDWithoutProfile(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(64, 48)
+	s.Password = "secret"
+	s.Authenticate = func(user, password string) bool { return user == "alice" && password == "secret" }
+	go s.Serve(ln)
+	addr := ln.Addr().String()
+
+	// Screen Sharing answering 3.8 still finds ARD, next to VNC
+	// Authentication.
+	if _, status := ardLogin(t, addr, "alice", "wrong"); status != 1 {
+		t.Errorf("wrong password: got SecurityResult %d; want failed", status)
+	}
+	if _, status := ardLogin(t, addr, "alice", "secret"); status != 0 {
+		t.Errorf("got SecurityResult %d; want OK", status)
+	}
+	cc, err := rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+func TestAppleScreenSharingWithoutChecker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(64, 48)
+	s.Password = "secret"
+	s.AppleScreenSharing = &rfb.AppleScreenSharing{}
+	go s.Serve(ln)
+
+	// A client answering Apple's version gets VNC Authentication, not
+	// ARD, which has nothing to check its credentials with.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(nc, buf[:12]); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(nc, "RFB 003.889\n")
+	if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+		t.Fatal(err)
+	}
+	types := make([]byte, buf[0])
+	if _, err := io.ReadFull(nc, types); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(types, []byte{2}) {
+		t.Fatalf("server offered security types %v; want VNC Authentication", types)
+	}
+	nc.Write([]byte{2})
+	if _, err := io.ReadFull(nc, buf); err != nil { // challenge
+		t.Fatal(err)
+	}
+	nc.Write(make([]byte, 16)) // a wrong response
+	var status uint32
+	if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status != 1 {
+		t.Errorf("wrong password: got SecurityResult %d; want failed", status)
+	}
+}
@@ -0,0 +1,228 @@
+package rfb
+
+import (
+	"sync"
+	"time"
+)
+
+// An ArbitrationPolicy decides which clients' input an Arbiter lets
+// through.
+type ArbitrationPolicy int
+
+const (
+	// FirstCome gives control to the first client sending input. It
+	// keeps it until it's idle for the arbiter's IdleTimeout with no
+	// buttons held, disconnects, or control is handed over.
+	FirstCome ArbitrationPolicy = iota
+
+	// ByPriority works like FirstCome, except that a client with a
+	// higher priority than the current owner takes control at once.
+	ByPriority
+
+	// Shared lets all clients control at once. Pointer buttons held by
+	// different clients are merged, so one client moving the pointer
+	// doesn't release another's drag.
+	Shared
+)
+
+// DefaultIdleTimeout is the idle time after which an Arbiter lets another
+// client take control.
+const DefaultIdleTimeout = 2 * time.Second
+
+// A ControlChange reports that control passed from one client to
+// another. Either may be nil for no client.
+type ControlChange struct {
+	From, To *Conn
+}
+
+// An Arbiter decides whose input gets through when several clients
+// share a desktop.
+type Arbiter struct {
+	Policy ArbitrationPolicy
+
+	// IdleTimeout is how long the owner may be idle before another client
+	// can take control. If zero, DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// OnChange, if set, is called when control changes hands. It's
+	// called with the arbiter's lock released, but never concurrently.
+	OnChange func(ControlChange)
+
+	mu        sync.Mutex
+	owner     *Conn
+	lastInput time.Time
+	priority  map[*Conn]int
+	held      map[*Conn]*heldInput    // keys and buttons held per client
+	injectors map[*Conn]InputInjector // of the clients being forwarded
+
+	changeMu sync.Mutex // serializes OnChange calls
+}
+
+// NewArbiter returns an arbiter with the given policy.
+func NewArbiter(policy ArbitrationPolicy) *Arbiter {
+	return &Arbiter{Policy: policy}
+}
+
+// SetPriority sets the priority of c for the ByPriority policy. Clients
+// default to priority 0.
+func (a *Arbiter) SetPriority(c *Conn, priority int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.priority == nil {
+		a.priority = make(map[*Conn]int)
+	}
+	a.priority[c] = priority
+}
+
+// Owner returns the client in control, or nil.
+func (a *Arbiter) Owner() *Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.owner
+}
+
+// Handover gives control to c, or releases it if c is nil, regardless of
+// the policy.
+func (a *Arbiter) Handover(c *Conn) {
+	a.mu.Lock()
+	from := a.owner
+	a.owner = c
+	a.lastInput = time.Now()
+	inj, release := a.releaseLocked(from, c)
+	a.mu.Unlock()
+	injectAll(inj, release)
+	a.changed(from, c)
+}
+
+// Remove forgets c, releasing control if it has it. It should be
+// called when c disconnects; Forward does so itself.
+func (a *Arbiter) Remove(c *Conn) {
+	a.mu.Lock()
+	delete(a.priority, c)
+	delete(a.held, c)
+	delete(a.injectors, c)
+	from := a.owner
+	if from == c {
+		a.owner = nil
+	}
+	a.mu.Unlock()
+	if from == c {
+		a.changed(c, nil)
+	}
+}
+
+// Allow reports whether the input event e from c should be passed on,
+// and returns the event to pass on in its place. Under the Shared
+// policy, pointer events carry the buttons held by all clients.
+func (a *Arbiter) Allow(c *Conn, e interface{}) (interface{}, bool) {
+	a.mu.Lock()
+	a.track(c, e)
+
+	if a.Policy == Shared {
+		switch pe := e.(type) {
+		case PointerEvent:
+			for _, h := range a.held {
+				pe.ButtonMask |= h.buttons
+				pe.ExtButtonMask |= h.extButtons
+			}
+			e = pe
+		case RelativePointerEvent:
+			for _, h := range a.held {
+				pe.ButtonMask |= h.buttons
+			}
+			e = pe
+		}
+		a.mu.Unlock()
+		return e, true
+	}
+
+	from := a.owner
+	switch {
+	case from == c:
+	case from == nil,
+		a.Policy == ByPriority && a.priority[c] > a.priority[from],
+		a.idleLocked():
+		a.owner = c
+	default:
+		a.mu.Unlock()
+		return nil, false
+	}
+	a.lastInput = time.Now()
+	inj, release := a.releaseLocked(from, c)
+	a.mu.Unlock()
+
+	if from != c {
+		injectAll(inj, release)
+		a.changed(from, c)
+	}
+	return e, true
+}
+
+// Forward passes c's input events that the arbiter allows to inj, like
+// Conn.ForwardEvents. It removes c from the arbiter when c disconnects.
+// When another client takes control while c holds keys or buttons, they
+// are released through inj.
+func (a *Arbiter) Forward(c *Conn, inj InputInjector) error {
+	a.mu.Lock()
+	if a.injectors == nil {
+		a.injectors = make(map[*Conn]InputInjector)
+	}
+	a.injectors[c] = inj
+	a.mu.Unlock()
+	defer a.Remove(c)
+	for e := range c.Event {
+		e, ok := a.Allow(c, e)
+		if !ok {
+			continue
+		}
+		if err := inject(inj, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// track records the buttons and keys c holds after e.
+func (a *Arbiter) track(c *Conn, e interface{}) {
+	h := a.held[c]
+	if h == nil {
+		if a.held == nil {
+			a.held = make(map[*Conn]*heldInput)
+		}
+		h = new(heldInput)
+		a.held[c] = h
+	}
+	h.track(e)
+}
+
+// releaseLocked returns the injector of from and the events releasing
+// what from holds, if it loses control to to.
+func (a *Arbiter) releaseLocked(from, to *Conn) (InputInjector, []interface{}) {
+	h, inj := a.held[from], a.injectors[from]
+	if from == to || h == nil || inj == nil {
+		return nil, nil
+	}
+	return inj, h.release()
+}
+
+// idleLocked reports whether the owner has been idle long enough to lose
+// control. An owner holding buttons or keys is never idle.
+func (a *Arbiter) idleLocked() bool {
+	if h := a.held[a.owner]; h != nil && h.held() {
+		return false
+	}
+	timeout := a.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+	return time.Since(a.lastInput) >= timeout
+}
+
+func (a *Arbiter) changed(from, to *Conn) {
+	if a.OnChange == nil || from == to {
+		return
+	}
+	a.changeMu.Lock()
+	defer a.changeMu.Unlock()
+	a.OnChange(ControlChange{From: from, To: to})
+}
@@ -0,0 +1,112 @@
+package rfb_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestArbiterFirstCome(t *testing.T) {
+	a := rfb.NewArbiter(rfb.FirstCome)
+	a.IdleTimeout = 50 * time.Millisecond
+	var changes []rfb.ControlChange
+	a.OnChange = func(c rfb.ControlChange) { changes = append(changes, c) }
+
+	c1, c2 := new(rfb.Conn), new(rfb.Conn)
+	if _, ok := a.Allow(c1, rfb.PointerEvent{ButtonMask: rfb.ButtonLeft}); !ok {
+		t.Fatal("first client was refused")
+	}
+	if _, ok := a.Allow(c2, rfb.PointerEvent{}); ok {
+		t.Fatal("second client got control from an active owner")
+	}
+
+	// Holding a button keeps control past the idle timeout.
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := a.Allow(c2, rfb.PointerEvent{}); ok {
+		t.Fatal("second client got control during a drag")
+	}
+	a.Allow(c1, rfb.PointerEvent{})
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := a.Allow(c2, rfb.PointerEvent{}); !ok {
+		t.Fatal("second client didn't get control from an idle owner")
+	}
+
+	a.Handover(c1)
+	a.Remove(c1)
+	if a.Owner() != nil {
+		t.Errorf("owner after removal = %p; want nil", a.Owner())
+	}
+	want := []rfb.ControlChange{{To: c1}, {From: c1, To: c2}, {From: c2, To: c1}, {From: c1}}
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes; want %d", len(changes), len(want))
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("change %d = %v; want %v", i, changes[i], want[i])
+		}
+	}
+}
+
+func TestArbiterPriority(t *testing.T) {
+	a := rfb.NewArbiter(rfb.ByPriority)
+	low, high := new(rfb.Conn), new(rfb.Conn)
+	a.SetPriority(high, 1)
+	a.Allow(low, rfb.KeyEvent{DownFlag: 1, Key: 'a'})
+	if _, ok := a.Allow(high, rfb.PointerEvent{}); !ok {
+		t.Fatal("higher priority client was refused")
+	}
+	if _, ok := a.Allow(low, rfb.KeyEvent{Key: 'a'}); ok {
+		t.Fatal("lower priority client took control back")
+	}
+}
+
+func TestArbiterShared(t *testing.T) {
+	a := rfb.NewArbiter(rfb.Shared)
+	c1, c2 := new(rfb.Conn), new(rfb.Conn)
+	a.Allow(c1, rfb.PointerEvent{ButtonMask: rfb.ButtonLeft, X: 1, Y: 1})
+	e, ok := a.Allow(c2, rfb.PointerEvent{ButtonMask: rfb.ButtonRight, X: 2, Y: 2})
+	want := rfb.PointerEvent{ButtonMask: rfb.ButtonLeft | rfb.ButtonRight, X: 2, Y: 2}
+	if !ok || e != want {
+		t.Errorf("Allow = %v, %v; want %v, true", e, ok, want)
+	}
+	a.Remove(c1)
+	e, _ = a.Allow(c2, rfb.PointerEvent{X: 3, Y: 3})
+	if want := (rfb.PointerEvent{X: 3, Y: 3}); e != want {
+		t.Errorf("after removal, Allow = %v; want %v", e, want)
+	}
+}
+
+// chanInjector sends the events it injects to a channel.
+type chanInjector chan interface{}
+
+func (inj chanInjector) InjectKey(e rfb.KeyEvent) error         { inj <- e; return nil }
+func (inj chanInjector) InjectPointer(e rfb.PointerEvent) error { inj <- e; return nil }
+
+func TestArbiterReleaseOnTakeover(t *testing.T) {
+	low, lowc, _ := startServer(t, 10, 10)
+	high, highc, _ := startServer(t, 10, 10)
+	a := rfb.NewArbiter(rfb.ByPriority)
+	a.SetPriority(highc, 1)
+	inj := make(chanInjector, 10)
+	go a.Forward(lowc, inj)
+	go a.Forward(highc, inj)
+
+	next := func() interface{} {
+		select {
+		case e := <-inj:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for injected input")
+			return nil
+		}
+	}
+	low.KeyEvent(0xffe3, true) // Control_L
+	next()
+	high.PointerEvent(0, 5, 5)
+	for _, want := range []interface{}{rfb.KeyEvent{Key: 0xffe3}, rfb.PointerEvent{X: 5, Y: 5}} {
+		if e := next(); e != want {
+			t.Errorf("injected %#v; want %#v", e, want)
+		}
+	}
+}
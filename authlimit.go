@@ -0,0 +1,134 @@
+package rfb
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// AuthLimit locks out addresses whose clients fail authentication too
+// often, so password authentication can be exposed without inviting
+// guessing; see Server.AuthLimit. Addresses are IP addresses, without
+// the port.
+type AuthLimit struct {
+	// Failures is how many failed authentications within Window lock
+	// an address out; if zero, DefaultAuthFailures.
+	Failures int
+
+	// Window is how long a failure counts; if zero, a minute.
+	Window time.Duration
+
+	// Lockout is how long clients from a locked out address are
+	// refused at the security negotiation; if zero, Window.
+	Lockout time.Duration
+}
+
+// DefaultAuthFailures is the number of failed authentications locking
+// an address out if AuthLimit.Failures is zero.
+const DefaultAuthFailures = 5
+
+func (l *AuthLimit) failures() int {
+	if l.Failures > 0 {
+		return l.Failures
+	}
+	return DefaultAuthFailures
+}
+
+func (l *AuthLimit) window() time.Duration {
+	if l.Window > 0 {
+		return l.Window
+	}
+	return time.Minute
+}
+
+func (l *AuthLimit) lockout() time.Duration {
+	if l.Lockout > 0 {
+		return l.Lockout
+	}
+	return l.window()
+}
+
+// authRecord is an address's recent failures.
+type authRecord struct {
+	failures []time.Time // within the window, oldest first
+	until    time.Time   // end of the lockout
+}
+
+// authAddr returns the address c's failures are counted under.
+func (c *Conn) authAddr() string {
+	addr := c.c.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// lockedOut reports whether Server.AuthLimit refuses c's address.
+func (c *Conn) lockedOut() bool {
+	s := c.s
+	if s.AuthLimit == nil {
+		return false
+	}
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	r := s.authRecords[c.authAddr()]
+	return r != nil && time.Now().Before(r.until)
+}
+
+// authFailure counts a failed authentication of c, locking its address
+// out if it failed too often. It's called before the client learns of
+// the failure, so a quick retry already finds the address locked out.
+func (c *Conn) authFailure() {
+	s := c.s
+	l := s.AuthLimit
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	s.authMu.Lock()
+	defer s.authMu.Unlock()
+	for addr, r := range s.authRecords {
+		r.expire(now, l.window())
+		if len(r.failures) == 0 && !now.Before(r.until) {
+			delete(s.authRecords, addr)
+		}
+	}
+	if s.authRecords == nil {
+		s.authRecords = make(map[string]*authRecord)
+	}
+	addr := c.authAddr()
+	r := s.authRecords[addr]
+	if r == nil {
+		r = &authRecord{}
+		s.authRecords[addr] = r
+	}
+	r.failures = append(r.failures, now)
+	if len(r.failures) >= l.failures() {
+		r.failures = nil
+		r.until = now.Add(l.lockout())
+		log.Printf("locking out %s for %v after failed authentications", addr, l.lockout())
+	}
+}
+
+// authSuccess forgets the failures of c's address.
+func (c *Conn) authSuccess() {
+	s := c.s
+	if s.AuthLimit == nil {
+		return
+	}
+	s.authMu.Lock()
+	delete(s.authRecords, c.authAddr())
+	s.authMu.Unlock()
+}
+
+// expire drops the failures older than window.
+func (r *authRecord) expire(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(r.failures) && now.Sub(r.failures[i]) >= window {
+		i++
+	}
+	r.failures = r.failures[i:]
+}
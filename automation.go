@@ -0,0 +1,134 @@
+package rfb
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+
+	"github.com/patdhlk/rfb/keysym"
+)
+
+// ErrTimeout is returned by the ClientConn wait methods if the
+// framebuffer didn't reach the expected state in time.
+var ErrTimeout = errors.New("rfb: timeout")
+
+// TypeString types s by pressing and releasing the key for each
+// character. Upper-case letters and symbols are sent as their keysyms;
+// servers take care of the modifiers needed to type them.
+func (cc *ClientConn) TypeString(s string) error {
+	for _, r := range s {
+		ks := keysym.FromRune(r)
+		if err := cc.KeyEvent(ks, true); err != nil {
+			return err
+		}
+		if err := cc.KeyEvent(ks, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Click moves the pointer to (x, y) and presses and releases button, one
+// of the Button constants.
+func (cc *ClientConn) Click(x, y int, button uint8) error {
+	cc.mu.Lock()
+	held := cc.buttons &^ button
+	cc.mu.Unlock()
+	if err := cc.PointerEvent(held, x, y); err != nil {
+		return err
+	}
+	if err := cc.PointerEvent(held|button, x, y); err != nil {
+		return err
+	}
+	return cc.PointerEvent(held, x, y)
+}
+
+// Screenshot returns a copy of the framebuffer.
+func (cc *ClientConn) Screenshot() *image.RGBA {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	img := image.NewRGBA(cc.fb.Rect)
+	copy(img.Pix, cc.fb.Pix)
+	return img
+}
+
+// ReadRegion copies region r of the framebuffer into the same region of
+// dst.
+func (cc *ClientConn) ReadRegion(dst *image.RGBA, r image.Rectangle) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	r = r.Intersect(cc.fb.Rect).Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		copy(dst.Pix[dst.PixOffset(r.Min.X, y):dst.PixOffset(r.Max.X, y)],
+			cc.fb.Pix[cc.fb.PixOffset(r.Min.X, y):cc.fb.PixOffset(r.Max.X, y)])
+	}
+}
+
+// WaitForUpdate waits for the next framebuffer update to arrive.
+func (cc *ClientConn) WaitForUpdate(timeout time.Duration) error {
+	cc.mu.Lock()
+	serial := cc.serial
+	cc.mu.Unlock()
+	return cc.waitFor(timeout, func(*image.RGBA) bool { return cc.serial != serial })
+}
+
+// WaitForPixel waits until the pixel at p has the colour want.
+func (cc *ClientConn) WaitForPixel(p image.Point, want color.Color, timeout time.Duration) error {
+	w := color.RGBAModel.Convert(want).(color.RGBA)
+	w.A = 0xff
+	return cc.waitFor(timeout, func(fb *image.RGBA) bool {
+		return fb.RGBAAt(p.X, p.Y) == w
+	})
+}
+
+// WaitForImage waits until region of the framebuffer looks exactly like
+// want. The top-left corner of want's bounds is aligned with region.Min.
+func (cc *ClientConn) WaitForImage(region image.Rectangle, want image.Image, timeout time.Duration) error {
+	w := image.NewRGBA(region)
+	draw.Draw(w, region, want, want.Bounds().Min, draw.Src)
+	for i := 3; i < len(w.Pix); i += 4 {
+		w.Pix[i] = 0xff
+	}
+	return cc.waitFor(timeout, func(fb *image.RGBA) bool {
+		if !region.In(fb.Rect) {
+			return false
+		}
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			a := fb.Pix[fb.PixOffset(region.Min.X, y):fb.PixOffset(region.Max.X, y)]
+			b := w.Pix[w.PixOffset(region.Min.X, y):w.PixOffset(region.Max.X, y)]
+			if string(a) != string(b) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor waits until cond returns true for the framebuffer. cond is
+// called with cc.mu held.
+func (cc *ClientConn) waitFor(timeout time.Duration, cond func(fb *image.RGBA) bool) error {
+	timedOut := false
+	t := time.AfterFunc(timeout, func() {
+		cc.mu.Lock()
+		timedOut = true
+		cc.cond.Broadcast()
+		cc.mu.Unlock()
+	})
+	defer t.Stop()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for !cond(cc.fb) {
+		switch {
+		case cc.err != nil:
+			return cc.err
+		case timedOut:
+			return fmt.Errorf("%w after %v", ErrTimeout, timeout)
+		}
+		cc.cond.Wait()
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// Package bench measures the server on reproducible synthetic
+// workloads, to compare encoders and catch performance regressions.
+//
+// Run serves the frames of a Workload to a single viewer in the same
+// process, over an in-memory connection, one frame at a time, and
+// reports the bytes, encoding time and allocations per frame. The
+// workloads are deterministic, so runs of the same version on the same
+// machine are comparable, in benchmarks and in CI:
+//
+//	func BenchmarkScrolling(b *testing.B) {
+//		for range b.N {
+//			r, err := bench.Run(bench.ScrollingText(1280, 720, 60), bench.Config{})
+//			if err != nil {
+//				b.Fatal(err)
+//			}
+//			r.ReportMetrics(b)
+//		}
+//	}
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// frameTimeout is how long Run waits for the update of a frame.
+const frameTimeout = 10 * time.Second
+
+// A Workload is a reproducible sequence of frames.
+type Workload struct {
+	Name   string
+	Size   image.Point
+	Frames int
+
+	// Draw renders frame i into img, which holds frame i-1, or is black
+	// for frame 0. Every frame has to differ from the one before. It
+	// returns the area it drew the pointer into, if any, for
+	// LockableImage.Cursor.
+	Draw func(img *image.RGBA, i int) (cursor image.Rectangle)
+}
+
+// Config describes the viewer and server of a run.
+type Config struct {
+	// Encodings is announced by the viewer. The default is that of
+	// rfb.ClientConfig.
+	Encodings []int32
+
+	// PixelFormat, if set, is requested by the viewer instead of the
+	// server's native format.
+	PixelFormat *rfb.PixelFormat
+
+	// Server, if set, configures the server before the viewer connects,
+	// for instance to enable AdaptiveEncoding.
+	Server func(*rfb.Server)
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Workload string
+	Frames   int
+	Updates  int           // framebuffer updates received
+	Bytes    int64         // update bytes received
+	Encode   time.Duration // time the server spent encoding
+	Wall     time.Duration // time the run took, including the viewer
+
+	// Heap allocations during the run, of the server and the viewer
+	// decoding the updates.
+	Allocs, AllocBytes uint64
+
+	// Stats lists what the server sent, per encoding.
+	Stats []rfb.EncodingStats
+}
+
+// BytesPerFrame returns the average update size.
+func (r *Result) BytesPerFrame() float64 {
+	return float64(r.Bytes) / float64(max(r.Frames, 1))
+}
+
+// EncodePerFrame returns the average encoding time.
+func (r *Result) EncodePerFrame() time.Duration {
+	return r.Encode / time.Duration(max(r.Frames, 1))
+}
+
+// AllocsPerFrame returns the average number of heap allocations.
+func (r *Result) AllocsPerFrame() float64 {
+	return float64(r.Allocs) / float64(max(r.Frames, 1))
+}
+
+func (r *Result) String() string {
+	return fmt.Sprintf("%s: %d frames in %v\n"+
+		"%.0f bytes/frame, %v encoding/frame, %.0f allocs/frame (%d bytes)",
+		r.Workload, r.Frames, r.Wall.Round(time.Millisecond),
+		r.BytesPerFrame(), r.EncodePerFrame(), r.AllocsPerFrame(),
+		r.AllocBytes/uint64(max(r.Frames, 1)))
+}
+
+// ReportMetrics reports the per-frame figures as custom benchmark
+// metrics, averaged over the b.N runs.
+func (r *Result) ReportMetrics(b *testing.B) {
+	b.ReportMetric(r.BytesPerFrame(), "bytes/frame")
+	b.ReportMetric(float64(r.EncodePerFrame().Nanoseconds()), "encode-ns/frame")
+	b.ReportMetric(r.AllocsPerFrame(), "allocs/frame")
+}
+
+// Run serves the frames of w to an in-process viewer configured by cfg,
+// waiting for each frame's update before drawing the next.
+func Run(w Workload, cfg Config) (*Result, error) {
+	if w.Draw == nil || w.Frames <= 0 || w.Size.X <= 0 || w.Size.Y <= 0 {
+		return nil, errors.New("bench: empty workload")
+	}
+	s := rfb.NewServer(w.Size.X, w.Size.Y)
+	if cfg.Server != nil {
+		cfg.Server(s)
+	}
+
+	updates := make(chan rfb.UpdateStats, 64)
+	done := make(chan struct{})
+	defer close(done)
+	sc, vc := net.Pipe()
+	conn := s.ServeConn(sc)
+	cc, err := rfb.NewClientConn(vc, &rfb.ClientConfig{
+		Encodings:   cfg.Encodings,
+		PixelFormat: cfg.PixelFormat,
+		OnUpdate: func(u rfb.UpdateStats) {
+			select {
+			case updates <- u:
+			case <-done:
+			}
+		},
+	})
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	defer cc.Close()
+
+	// The server may still compare against the frame before, so frames
+	// alternate between two images, copied from the one drawn into.
+	bounds := image.Rectangle{Max: w.Size}
+	cur := image.NewRGBA(bounds)
+	frames := [2]*rfb.LockableImage{
+		{Img: image.NewRGBA(bounds)},
+		{Img: image.NewRGBA(bounds)},
+	}
+
+	r := &Result{Workload: w.Name, Frames: w.Frames}
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := range w.Frames {
+		cursor := w.Draw(cur, i)
+		li := frames[i%2]
+		li.Lock()
+		draw.Draw(li.Img.(*image.RGBA), bounds, cur, image.Point{}, draw.Src)
+		li.Cursor = cursor
+		li.Unlock()
+		conn.Feed <- li
+		if err := r.await(updates, cc, i); err != nil {
+			return nil, err
+		}
+	}
+	r.Wall = time.Since(start)
+	runtime.ReadMemStats(&after)
+	r.Allocs = after.Mallocs - before.Mallocs
+	r.AllocBytes = after.TotalAlloc - before.TotalAlloc
+	r.Stats = conn.Stats()
+	for _, st := range r.Stats {
+		r.Encode += st.Duration
+	}
+	return r, nil
+}
+
+// await waits for the update of frame i and tallies it.
+func (r *Result) await(updates <-chan rfb.UpdateStats, cc *rfb.ClientConn, i int) error {
+	timeout := time.After(frameTimeout)
+	for {
+		select {
+		case u := <-updates:
+			r.Updates++
+			r.Bytes += u.Bytes
+			if len(u.Damage) > 0 {
+				return nil
+			}
+		case <-timeout:
+			if err := cc.Err(); err != nil {
+				return err
+			}
+			return fmt.Errorf("bench: no update for frame %d of %s", i, r.Workload)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package bench_test
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	"github.com/patdhlk/rfb/bench"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+func TestRun(t *testing.T) {
+	for _, w := range bench.Workloads(96, 64, 8) {
+		r, err := bench.Run(w, bench.Config{})
+		if err != nil {
+			t.Fatalf("%s: %v", w.Name, err)
+		}
+		if r.Frames != 8 || r.Updates < 8 || r.Bytes == 0 || len(r.Stats) == 0 {
+			t.Errorf("%s: got %+v", w.Name, r)
+		}
+		t.Log(r)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	var bytes []int64
+	for range 2 {
+		r, err := bench.Run(bench.ScrollingText(96, 64, 8), bench.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bytes = append(bytes, r.Bytes)
+	}
+	if bytes[0] != bytes[1] {
+		t.Errorf("runs sent %d and %d bytes", bytes[0], bytes[1])
+	}
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	for _, w := range bench.Workloads(640, 480, 20) {
+		b.Run(w.Name, func(b *testing.B) {
+			for range b.N {
+				r, err := bench.Run(w, bench.Config{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				r.ReportMetrics(b)
+			}
+		})
+	}
+}
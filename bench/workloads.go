@@ -0,0 +1,200 @@
+package bench
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+)
+
+// Workload colours.
+var (
+	paper   = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	ink     = color.RGBA{0x20, 0x20, 0x20, 0xff}
+	desktop = color.RGBA{0x3a, 0x6e, 0xa5, 0xff}
+	title   = color.RGBA{0x50, 0x50, 0x60, 0xff}
+)
+
+const (
+	glyphW = 6  // glyph cell width, with spacing
+	lineH  = 12 // line pitch of text
+)
+
+// glyphs are 64 random 5×7 bitmaps standing in for a font: what matters
+// to the encoders is that text is thin, two-coloured and varied.
+var glyphs = func() [64][7]uint8 {
+	var g [64][7]uint8
+	rnd := rand.New(rand.NewSource(1))
+	for i := range g {
+		for row := range g[i] {
+			g[i][row] = uint8(rnd.Intn(32))
+		}
+	}
+	return g
+}()
+
+// drawLine draws a line of random words at y, up to the right edge of r.
+func drawLine(img *image.RGBA, r image.Rectangle, y int, rnd *rand.Rand) {
+	x := r.Min.X + 4
+	for x+glyphW <= r.Max.X-4 {
+		word := 2 + rnd.Intn(8)
+		for range word {
+			if x+glyphW > r.Max.X-4 {
+				break
+			}
+			g := &glyphs[rnd.Intn(len(glyphs))]
+			for row := range g {
+				for col := range 5 {
+					if g[row]&(1<<col) != 0 && y+row < r.Max.Y {
+						img.SetRGBA(x+col, y+row, ink)
+					}
+				}
+			}
+			x += glyphW
+		}
+		x += glyphW // space
+	}
+}
+
+// ScrollingText is a page of text scrolling up by a quarter line per
+// frame, like a terminal or a document being read.
+func ScrollingText(w, h, frames int) Workload {
+	rnd := rand.New(rand.NewSource(1))
+	step := lineH / 4
+	var page *image.RGBA // the lines in view, and the next one
+	return Workload{
+		Name:   "scrolling text",
+		Size:   image.Pt(w, h),
+		Frames: frames,
+		Draw: func(img *image.RGBA, i int) image.Rectangle {
+			b := img.Rect
+			if i == 0 {
+				rnd.Seed(1)
+				page = image.NewRGBA(image.Rect(0, 0, b.Dx(), (b.Dy()/lineH+2)*lineH))
+				draw.Draw(page, page.Rect, image.NewUniform(paper), image.Point{}, draw.Src)
+				for y := 0; y < page.Rect.Dy(); y += lineH {
+					drawLine(page, page.Rect, y, rnd)
+				}
+			}
+			off := i * step % lineH
+			if i > 0 && off == 0 {
+				// Scroll the page by a line and add one at the bottom.
+				copy(page.Pix, page.Pix[lineH*page.Stride:])
+				last := image.Rect(0, page.Rect.Dy()-lineH, b.Dx(), page.Rect.Dy())
+				draw.Draw(page, last, image.NewUniform(paper), image.Point{}, draw.Src)
+				drawLine(page, page.Rect, last.Min.Y, rnd)
+			}
+			draw.Draw(img, b, page, image.Pt(0, off), draw.Src)
+			return image.Rectangle{}
+		},
+	}
+}
+
+// Video is a desktop with a video playing in the middle two thirds:
+// smooth gradients with noise, changing entirely every frame.
+func Video(w, h, frames int) Workload {
+	rnd := rand.New(rand.NewSource(1))
+	return Workload{
+		Name:   "video playback",
+		Size:   image.Pt(w, h),
+		Frames: frames,
+		Draw: func(img *image.RGBA, i int) image.Rectangle {
+			b := img.Rect
+			if i == 0 {
+				rnd.Seed(1)
+				draw.Draw(img, b, image.NewUniform(desktop), image.Point{}, draw.Src)
+			}
+			v := image.Rect(b.Dx()/6, b.Dy()/6, b.Dx()*5/6, b.Dy()*5/6)
+			for y := v.Min.Y; y < v.Max.Y; y++ {
+				p := img.Pix[img.PixOffset(v.Min.X, y):]
+				for x := v.Min.X; x < v.Max.X; x++ {
+					n := rnd.Intn(16)
+					p[0] = uint8(x*2 + i*3 + n)
+					p[1] = uint8(y*2 - i*2 + n)
+					p[2] = uint8((x+y)/2 + i + n)
+					p[3] = 0xff
+					p = p[4:]
+				}
+			}
+			return image.Rectangle{}
+		},
+	}
+}
+
+// arrow is a 12×19 mouse pointer: 1 is black, 2 white.
+var arrow = [19]string{
+	"1",
+	"11",
+	"121",
+	"1221",
+	"12221",
+	"122221",
+	"1222221",
+	"12222221",
+	"122222221",
+	"1222222221",
+	"12222222221",
+	"122222211111",
+	"1222122",
+	"122112 2",
+	"12 1 122",
+	"1  1  122",
+	"     122",
+	"      122",
+	"       1",
+}
+
+// StaticDesktop is a desktop with a few windows of text that don't
+// change, while the pointer moves across it.
+func StaticDesktop(w, h, frames int) Workload {
+	rnd := rand.New(rand.NewSource(1))
+	var bg *image.RGBA // the desktop without the pointer
+	return Workload{
+		Name:   "static desktop",
+		Size:   image.Pt(w, h),
+		Frames: frames,
+		Draw: func(img *image.RGBA, i int) image.Rectangle {
+			b := img.Rect
+			if i == 0 {
+				rnd.Seed(1)
+				bg = image.NewRGBA(b)
+				draw.Draw(bg, b, image.NewUniform(desktop), image.Point{}, draw.Src)
+				for range 3 {
+					win := image.Rect(0, 0, b.Dx()/2, b.Dy()/2).Add(image.Pt(rnd.Intn(b.Dx()/2), rnd.Intn(b.Dy()/2)))
+					draw.Draw(bg, win, image.NewUniform(title), image.Point{}, draw.Src)
+					page := image.Rect(win.Min.X+2, win.Min.Y+lineH+2, win.Max.X-2, win.Max.Y-2).Intersect(b)
+					draw.Draw(bg, page, image.NewUniform(paper), image.Point{}, draw.Src)
+					for y := page.Min.Y; y+lineH <= page.Max.Y; y += lineH {
+						drawLine(bg, page, y, rnd)
+					}
+				}
+			}
+			draw.Draw(img, b, bg, image.Point{}, draw.Src)
+
+			// The pointer sweeps across the screen diagonally.
+			pos := image.Pt((i*7)%b.Dx(), (i*5)%b.Dy())
+			for y, row := range arrow {
+				for x, p := range row {
+					q := pos.Add(image.Pt(x, y))
+					switch {
+					case !q.In(b):
+					case p == '1':
+						img.SetRGBA(q.X, q.Y, color.RGBA{0, 0, 0, 0xff})
+					case p == '2':
+						img.SetRGBA(q.X, q.Y, color.RGBA{0xff, 0xff, 0xff, 0xff})
+					}
+				}
+			}
+			return image.Rect(0, 0, 12, len(arrow)).Add(pos).Intersect(b)
+		},
+	}
+}
+
+// Workloads returns the standard workloads at the given size and length.
+func Workloads(w, h, frames int) []Workload {
+	return []Workload{
+		ScrollingText(w, h, frames),
+		Video(w, h, frames),
+		StaticDesktop(w, h, frames),
+	}
+}
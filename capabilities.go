@@ -0,0 +1,93 @@
+package rfb
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Capabilities describes what a server supports, for applications that
+// publish it in their own APIs or guide users towards suitable viewers.
+type Capabilities struct {
+	Versions        []string     // protocol versions, like "3.8"
+	SecurityTypes   []Capability // as numbered in the handshake
+	Encodings       []Capability // rectangle encodings, including RegisterEncoder's
+	PseudoEncodings []Capability
+	Messages        []Capability // client message types beyond the core protocol
+}
+
+// A Capability is a numbered protocol feature.
+type Capability struct {
+	Number int32
+	Name   string
+}
+
+func (c Capability) String() string {
+	return fmt.Sprintf("%s (%d)", c.Name, c.Number)
+}
+
+// Capabilities returns what the server supports with its current
+// settings.
+func (s *Server) Capabilities() Capabilities {
+	caps := Capabilities{
+		Versions: []string{"3.3", "3.7", "3.8"},
+		PseudoEncodings: []Capability{
+			{encodingDesktopSize, "DesktopSize"},
+			{encodingLastRect, "LastRect"},
+			{encodingExtendedDesktopSize, "ExtendedDesktopSize"},
+			{encodingRichCursor, "RichCursor"},
+			{encodingXCursor, "XCursor"},
+			{encodingCursorWithAlpha, "CursorWithAlpha"},
+			{encodingVMwareCursor, "VMwareCursor"},
+			{encodingPointerPos, "PointerPos"},
+			{encodingDesktopName, "DesktopName"},
+			{encodingQEMUPointerMotion, "QEMUPointerMotionChange"},
+			{encodingExtendedClipboard, "ExtendedClipboard"},
+			{encodingExtendedMouseButtons, "ExtendedMouseButtons"},
+		},
+	}
+	for _, h := range s.securityHandlers() {
+		caps.SecurityTypes = append(caps.SecurityTypes, Capability{int32(h.Type()), securityName(h)})
+	}
+	caps.Messages = append(caps.Messages, Capability{cmdSetDesktopSize, "SetDesktopSize"})
+	caps.Encodings = append(caps.Encodings, Capability{encodingCopyRect, "CopyRect"})
+	for _, enc := range registeredEncodings() {
+		if enc.Number == encodingOpenH264 && s.H264Encoder == nil && s.HardwareEncoder == nil {
+			continue
+		}
+		caps.Encodings = append(caps.Encodings, enc)
+	}
+	for i := range int32(10) {
+		caps.PseudoEncodings = append(caps.PseudoEncodings,
+			Capability{encodingQualityLevel0 + i, fmt.Sprintf("QualityLevel%d", i)},
+			Capability{encodingCompressLevel0 + i, fmt.Sprintf("CompressLevel%d", i)})
+	}
+	if s.QEMUKeyEvents {
+		caps.PseudoEncodings = append(caps.PseudoEncodings, Capability{encodingQEMUExtendedKeyEvent, "QEMUExtendedKeyEvent"})
+		caps.Messages = append(caps.Messages, Capability{cmdQEMU, "QEMU"})
+	}
+	if s.FileSystem != nil {
+		caps.Messages = append(caps.Messages,
+			Capability{cmdFileListRequest, "FileListRequest"},
+			Capability{cmdFileDownloadRequest, "FileDownloadRequest"},
+			Capability{cmdFileUploadRequest, "FileUploadRequest"},
+			Capability{cmdFileUploadData, "FileUploadData"},
+			Capability{cmdFileDownloadCancel, "FileDownloadCancel"},
+			Capability{cmdFileUploadFailed, "FileUploadFailed"},
+			Capability{cmdFileCreateDirRequest, "FileCreateDirRequest"})
+	}
+	if s.TouchEvents {
+		caps.PseudoEncodings = append(caps.PseudoEncodings, Capability{encodingGII, "gii"})
+		caps.Messages = append(caps.Messages, Capability{cmdGII, "gii"})
+	}
+	if s.Xvp {
+		caps.PseudoEncodings = append(caps.PseudoEncodings, Capability{encodingXvp, "xvp"})
+		caps.Messages = append(caps.Messages, Capability{cmdXvp, "xvp"})
+	}
+	if s.AppleScreenSharing != nil {
+		caps.Versions = append(caps.Versions, "3.889")
+	}
+	if s.AppleScreenSharing != nil && s.AppleScreenSharing.Authenticate != nil && !slices.ContainsFunc(caps.SecurityTypes, func(c Capability) bool { return c.Number == authARD }) {
+		caps.SecurityTypes = append(caps.SecurityTypes, Capability{authARD, "ARD"})
+	}
+	return caps
+}
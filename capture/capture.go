@@ -0,0 +1,88 @@
+// Package capture provides rfb.FrameSource implementations that grab the
+// local screen.
+//
+// The portable Display source wraps github.com/kbinani/screenshot.
+// Platform specific backends with native damage reporting live in the
+// subpackages.
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/kbinani/screenshot"
+	"github.com/patdhlk/rfb"
+)
+
+// DefaultInterval is the capture interval used by NewDisplay (30 fps).
+const DefaultInterval = time.Second / 30
+
+// NumDisplays returns the number of active displays.
+func NumDisplays() int {
+	return screenshot.NumActiveDisplays()
+}
+
+// Display is a FrameSource capturing a single display.
+//
+// A Display tracks what it last returned to compute its change hints, so
+// each connection needs its own.
+type Display struct {
+	// Interval is the minimum time between two captures.
+	Interval time.Duration
+
+	index  int
+	bounds image.Rectangle // in desktop coordinates
+
+	mu   sync.Mutex
+	last *image.RGBA
+	next time.Time // earliest time for the next capture
+}
+
+// NewDisplay returns a FrameSource for the display with the given index,
+// 0 being the primary display.
+func NewDisplay(index int) (*Display, error) {
+	if index < 0 || index >= NumDisplays() {
+		return nil, errors.New("capture: no such display")
+	}
+	return &Display{
+		Interval: DefaultInterval,
+		index:    index,
+		bounds:   screenshot.GetDisplayBounds(index),
+	}, nil
+}
+
+// Bounds returns the display's size. The origin is always (0,0), even for
+// secondary displays.
+func (d *Display) Bounds() image.Rectangle {
+	return d.bounds.Sub(d.bounds.Min)
+}
+
+// NextFrame waits for the capture interval to pass and grabs the display.
+// If the screen contents didn't change at all, the frame's Damage is
+// empty (but non-nil), so the server can skip comparing it.
+func (d *Display) NextFrame() (*rfb.LockableImage, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if wait := time.Until(d.next); wait > 0 {
+		time.Sleep(wait)
+	}
+	d.next = time.Now().Add(d.Interval)
+
+	img, err := screenshot.CaptureRect(d.bounds)
+	if err != nil {
+		return nil, err
+	}
+	// the server works in framebuffer coordinates
+	img.Rect = img.Rect.Sub(img.Rect.Min)
+
+	li := &rfb.LockableImage{Img: img}
+	if d.last != nil && bytes.Equal(d.last.Pix, img.Pix) {
+		li.Damage = []image.Rectangle{}
+	}
+	d.last = img
+	return li, nil
+}
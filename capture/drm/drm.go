@@ -0,0 +1,308 @@
+//go:build linux
+
+// Package drm is a capture backend reading the framebuffer a DRM/KMS CRTC
+// scans out, for headless Linux machines and boards that have a modern
+// display driver but no display server (or a display server we can't
+// talk to).
+//
+// Getting at another client's framebuffer needs CAP_SYS_ADMIN. Dumb
+// buffers are mapped through the card; other buffers are exported as a
+// dma-buf and mapped from there, which only yields sensible pixels for
+// linear (untiled) buffers. Like fbdev, the buffer is polled and changes
+// are found by comparing it with the previous snapshot.
+package drm
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/capture/internal/rawfb"
+)
+
+// DefaultInterval is the polling interval used by Open (20 fps).
+const DefaultInterval = time.Second / 20
+
+func iowr(nr, size uintptr) uintptr { return 3<<30 | size<<16 | 'd'<<8 | nr }
+func iow(nr, size uintptr) uintptr  { return 1<<30 | size<<16 | 'd'<<8 | nr }
+
+var (
+	ioctlGemClose      = iow(0x09, unsafe.Sizeof(gemClose{}))
+	ioctlPrimeHandleFD = iowr(0x2d, unsafe.Sizeof(primeHandle{}))
+	ioctlModeGetRes    = iowr(0xa0, unsafe.Sizeof(cardRes{}))
+	ioctlModeGetCrtc   = iowr(0xa1, unsafe.Sizeof(modeCrtc{}))
+	ioctlModeGetFB     = iowr(0xad, unsafe.Sizeof(fbCmd{}))
+	ioctlModeMapDumb   = iowr(0xb3, unsafe.Sizeof(mapDumb{}))
+)
+
+var (
+	errNoActiveCrtc = errors.New("drm: no active CRTC")
+	errNoHandle     = errors.New("drm: no handle for the framebuffer (CAP_SYS_ADMIN needed)")
+)
+
+const (
+	drmCloexec = 0x80000 // O_CLOEXEC
+	drmRdwr    = 0x2     // O_RDWR
+)
+
+// struct drm_mode_card_res
+type cardRes struct {
+	FBIDPtr, CrtcIDPtr, ConnectorIDPtr, EncoderIDPtr uint64
+	CountFBs, CountCrtcs, CountConnectors            uint32
+	CountEncoders                                    uint32
+	MinWidth, MaxWidth, MinHeight, MaxHeight         uint32
+}
+
+// struct drm_mode_modeinfo
+type modeInfo struct {
+	Clock                                         uint32
+	HDisplay, HSyncStart, HSyncEnd, HTotal, HSkew uint16
+	VDisplay, VSyncStart, VSyncEnd, VTotal, VScan uint16
+	VRefresh, Flags, Type                         uint32
+	Name                                          [32]byte
+}
+
+// struct drm_mode_crtc
+type modeCrtc struct {
+	SetConnectorsPtr uint64
+	CountConnectors  uint32
+	CrtcID, FBID     uint32
+	X, Y             uint32
+	GammaSize        uint32
+	ModeValid        uint32
+	Mode             modeInfo
+}
+
+// struct drm_mode_fb_cmd
+type fbCmd struct {
+	FBID                 uint32
+	Width, Height, Pitch uint32
+	BPP, Depth, Handle   uint32
+}
+
+// struct drm_mode_map_dumb
+type mapDumb struct {
+	Handle, Pad uint32
+	Offset      uint64
+}
+
+// struct drm_prime_handle
+type primeHandle struct {
+	Handle, Flags uint32
+	FD            int32
+}
+
+// struct drm_gem_close
+type gemClose struct {
+	Handle, Pad uint32
+}
+
+func ioctl(fd, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR, syscall.EAGAIN:
+			continue
+		}
+		return errno
+	}
+}
+
+// mapping is a mapped framebuffer.
+type mapping struct {
+	fbID   uint32
+	mem    []byte
+	stride int
+	format rawfb.Format
+	w, h   int
+}
+
+// Source is a FrameSource polling the framebuffer of one CRTC. It follows
+// page flips, so it works with double-buffering compositors. It keeps a
+// single frame that is patched in place, so each connection needs its
+// own Source.
+type Source struct {
+	// Interval is the time between two polls.
+	Interval time.Duration
+
+	card   *os.File
+	crtcID uint32
+
+	mu   sync.Mutex
+	maps map[uint32]*mapping // by framebuffer id
+	poll *rawfb.Poller
+	next time.Time
+}
+
+// Open opens a DRM device such as "/dev/dri/card0" and picks the CRTC
+// with the given index among the active ones.
+func Open(device string, crtc int) (*Source, error) {
+	card, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{
+		Interval: DefaultInterval,
+		card:     card,
+		maps:     make(map[uint32]*mapping),
+	}
+	if s.crtcID, err = s.findCrtc(crtc); err != nil {
+		card.Close()
+		return nil, err
+	}
+	m, err := s.current()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.poll = rawfb.NewPoller(m.w, m.h, m.format)
+	return s, nil
+}
+
+func (s *Source) fd() uintptr { return s.card.Fd() }
+
+// findCrtc returns the id of the index-th CRTC that scans out something.
+func (s *Source) findCrtc(index int) (uint32, error) {
+	var res cardRes
+	if err := ioctl(s.fd(), ioctlModeGetRes, unsafe.Pointer(&res)); err != nil {
+		return 0, fmt.Errorf("drm: getting resources: %v", err)
+	}
+	if res.CountCrtcs == 0 {
+		return 0, errNoActiveCrtc
+	}
+	ids := make([]uint32, res.CountCrtcs)
+	res = cardRes{CountCrtcs: uint32(len(ids)), CrtcIDPtr: uint64(uintptr(unsafe.Pointer(&ids[0])))}
+	if err := ioctl(s.fd(), ioctlModeGetRes, unsafe.Pointer(&res)); err != nil {
+		return 0, fmt.Errorf("drm: getting resources: %v", err)
+	}
+	for _, id := range ids[:res.CountCrtcs] {
+		c := modeCrtc{CrtcID: id}
+		if ioctl(s.fd(), ioctlModeGetCrtc, unsafe.Pointer(&c)) != nil || c.FBID == 0 || c.ModeValid == 0 {
+			continue
+		}
+		if index == 0 {
+			return id, nil
+		}
+		index--
+	}
+	return 0, errNoActiveCrtc
+}
+
+// current returns the mapping of the framebuffer the CRTC currently
+// scans out, mapping it first if needed.
+func (s *Source) current() (*mapping, error) {
+	c := modeCrtc{CrtcID: s.crtcID}
+	if err := ioctl(s.fd(), ioctlModeGetCrtc, unsafe.Pointer(&c)); err != nil {
+		return nil, fmt.Errorf("drm: getting CRTC: %v", err)
+	}
+	if c.FBID == 0 {
+		return nil, errNoActiveCrtc
+	}
+	if m, ok := s.maps[c.FBID]; ok {
+		return m, nil
+	}
+
+	fb := fbCmd{FBID: c.FBID}
+	if err := ioctl(s.fd(), ioctlModeGetFB, unsafe.Pointer(&fb)); err != nil {
+		return nil, fmt.Errorf("drm: getting framebuffer: %v", err)
+	}
+	if fb.Handle == 0 {
+		return nil, errNoHandle
+	}
+	defer ioctl(s.fd(), ioctlGemClose, unsafe.Pointer(&gemClose{Handle: fb.Handle}))
+
+	m := &mapping{fbID: c.FBID, stride: int(fb.Pitch), w: int(fb.Width), h: int(fb.Height)}
+	switch fb.BPP {
+	case 32:
+		m.format = rawfb.XRGB8888
+	case 16:
+		m.format = rawfb.RGB565
+	default:
+		return nil, fmt.Errorf("drm: unsupported framebuffer depth of %d bits per pixel", fb.BPP)
+	}
+	size := int(fb.Pitch) * int(fb.Height)
+
+	var err error
+	dumb := mapDumb{Handle: fb.Handle}
+	if ioctl(s.fd(), ioctlModeMapDumb, unsafe.Pointer(&dumb)) == nil {
+		m.mem, err = syscall.Mmap(int(s.fd()), int64(dumb.Offset), size, syscall.PROT_READ, syscall.MAP_SHARED)
+	} else {
+		prime := primeHandle{Handle: fb.Handle, Flags: drmCloexec | drmRdwr}
+		if err = ioctl(s.fd(), ioctlPrimeHandleFD, unsafe.Pointer(&prime)); err == nil {
+			m.mem, err = syscall.Mmap(int(prime.FD), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+			syscall.Close(int(prime.FD))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("drm: mapping framebuffer: %v", err)
+	}
+	s.maps[c.FBID] = m
+	return m, nil
+}
+
+// Bounds returns the size of the scanned out framebuffer.
+func (s *Source) Bounds() image.Rectangle {
+	return s.poll.Bounds()
+}
+
+// NextFrame polls the framebuffer until it changed and returns the frame
+// with the changed tiles as Damage.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if wait := time.Until(s.next); wait > 0 {
+			time.Sleep(wait)
+		}
+		s.next = time.Now().Add(s.Interval)
+
+		m, err := s.current()
+		if err != nil {
+			return nil, err
+		}
+		if m.w != s.poll.Bounds().Dx() || m.h != s.poll.Bounds().Dy() {
+			// mode change
+			s.poll = rawfb.NewPoller(m.w, m.h, m.format)
+		}
+		s.poll.Snapshot(m.mem, m.stride)
+		if frame, damage := s.poll.Update(); len(damage) > 0 {
+			return &rfb.LockableImage{Img: frame, Damage: damage}, nil
+		}
+		s.forgetStale(m.fbID)
+	}
+}
+
+// forgetStale unmaps framebuffers that no longer exist, so a compositor
+// that recreates its buffers doesn't make us leak mappings.
+func (s *Source) forgetStale(keep uint32) {
+	for id, m := range s.maps {
+		if id == keep {
+			continue
+		}
+		fb := fbCmd{FBID: id}
+		if ioctl(s.fd(), ioctlModeGetFB, unsafe.Pointer(&fb)) != nil {
+			syscall.Munmap(m.mem)
+			delete(s.maps, id)
+		} else if fb.Handle != 0 {
+			ioctl(s.fd(), ioctlGemClose, unsafe.Pointer(&gemClose{Handle: fb.Handle}))
+		}
+	}
+}
+
+// Close unmaps all framebuffers and closes the device.
+func (s *Source) Close() error {
+	for id, m := range s.maps {
+		syscall.Munmap(m.mem)
+		delete(s.maps, id)
+	}
+	return s.card.Close()
+}
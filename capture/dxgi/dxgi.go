@@ -0,0 +1,306 @@
+//go:build windows && cgo
+
+// Package dxgi is a capture backend for Windows 8 and later, built on the
+// DXGI Desktop Duplication API.
+//
+// The compositor tells us which regions were redrawn and which were
+// merely moved, so frames come with Damage and Moves hints and no frame
+// comparison is needed.
+package dxgi
+
+/*
+#cgo LDFLAGS: -ld3d11 -ldxgi
+
+#define COBJMACROS
+#define CINTERFACE
+#include <initguid.h>
+#include <windows.h>
+#include <d3d11.h>
+#include <dxgi1_2.h>
+#include <stdlib.h>
+
+typedef struct {
+	ID3D11Device *device;
+	ID3D11DeviceContext *ctx;
+	IDXGIOutputDuplication *dup;
+	ID3D11Texture2D *staging;
+	int width, height;
+
+	// valid between acquire and release
+	int acquired;
+	int mapped;
+	D3D11_MAPPED_SUBRESOURCE map;
+	BYTE *meta;
+	UINT metaSize;
+	DXGI_OUTDUPL_MOVE_RECT *moves;
+	int nmoves;
+	RECT *dirty;
+	int ndirty;
+} rfb_dup;
+
+static void rfb_dup_close(rfb_dup *d) {
+	if (d->staging) ID3D11Texture2D_Release(d->staging);
+	if (d->dup) IDXGIOutputDuplication_Release(d->dup);
+	if (d->ctx) ID3D11DeviceContext_Release(d->ctx);
+	if (d->device) ID3D11Device_Release(d->device);
+	free(d->meta);
+	free(d);
+}
+
+static HRESULT rfb_dup_open(int output, rfb_dup **out) {
+	rfb_dup *d = calloc(1, sizeof(rfb_dup));
+	IDXGIDevice *dxgiDevice = NULL;
+	IDXGIAdapter *adapter = NULL;
+	IDXGIOutput *dxgiOutput = NULL;
+	IDXGIOutput1 *output1 = NULL;
+	DXGI_OUTPUT_DESC desc;
+	D3D11_TEXTURE2D_DESC td;
+
+	HRESULT hr = D3D11CreateDevice(NULL, D3D_DRIVER_TYPE_HARDWARE, NULL, 0, NULL, 0,
+		D3D11_SDK_VERSION, &d->device, NULL, &d->ctx);
+	if (FAILED(hr)) goto done;
+	hr = ID3D11Device_QueryInterface(d->device, &IID_IDXGIDevice, (void **)&dxgiDevice);
+	if (FAILED(hr)) goto done;
+	hr = IDXGIDevice_GetAdapter(dxgiDevice, &adapter);
+	if (FAILED(hr)) goto done;
+	hr = IDXGIAdapter_EnumOutputs(adapter, output, &dxgiOutput);
+	if (FAILED(hr)) goto done;
+	hr = IDXGIOutput_GetDesc(dxgiOutput, &desc);
+	if (FAILED(hr)) goto done;
+	hr = IDXGIOutput_QueryInterface(dxgiOutput, &IID_IDXGIOutput1, (void **)&output1);
+	if (FAILED(hr)) goto done;
+	hr = IDXGIOutput1_DuplicateOutput(output1, (IUnknown *)d->device, &d->dup);
+	if (FAILED(hr)) goto done;
+
+	d->width = desc.DesktopCoordinates.right - desc.DesktopCoordinates.left;
+	d->height = desc.DesktopCoordinates.bottom - desc.DesktopCoordinates.top;
+
+	ZeroMemory(&td, sizeof(td));
+	td.Width = d->width;
+	td.Height = d->height;
+	td.MipLevels = 1;
+	td.ArraySize = 1;
+	td.Format = DXGI_FORMAT_B8G8R8A8_UNORM;
+	td.SampleDesc.Count = 1;
+	td.Usage = D3D11_USAGE_STAGING;
+	td.CPUAccessFlags = D3D11_CPU_ACCESS_READ;
+	hr = ID3D11Device_CreateTexture2D(d->device, &td, NULL, &d->staging);
+
+done:
+	if (output1) IDXGIOutput1_Release(output1);
+	if (dxgiOutput) IDXGIOutput_Release(dxgiOutput);
+	if (adapter) IDXGIAdapter_Release(adapter);
+	if (dxgiDevice) IDXGIDevice_Release(dxgiDevice);
+	if (FAILED(hr)) {
+		rfb_dup_close(d);
+		return hr;
+	}
+	*out = d;
+	return S_OK;
+}
+
+// rfb_dup_acquire waits for a new desktop image, fetches its move and
+// dirty rectangles and maps it for reading. It returns S_FALSE if only
+// the pointer changed.
+static HRESULT rfb_dup_acquire(rfb_dup *d, UINT timeout) {
+	DXGI_OUTDUPL_FRAME_INFO info;
+	IDXGIResource *res = NULL;
+	ID3D11Texture2D *tex = NULL;
+	UINT size = 0;
+
+	HRESULT hr = IDXGIOutputDuplication_AcquireNextFrame(d->dup, timeout, &info, &res);
+	if (FAILED(hr)) return hr;
+	d->acquired = 1;
+	d->nmoves = 0;
+	d->ndirty = 0;
+	if (info.LastPresentTime.QuadPart == 0) {
+		IDXGIResource_Release(res);
+		return S_FALSE;
+	}
+
+	if (info.TotalMetadataBufferSize > d->metaSize) {
+		free(d->meta);
+		d->meta = malloc(info.TotalMetadataBufferSize);
+		d->metaSize = info.TotalMetadataBufferSize;
+	}
+	if (info.TotalMetadataBufferSize > 0) {
+		hr = IDXGIOutputDuplication_GetFrameMoveRects(d->dup, d->metaSize,
+			(DXGI_OUTDUPL_MOVE_RECT *)d->meta, &size);
+		if (FAILED(hr)) goto done;
+		d->moves = (DXGI_OUTDUPL_MOVE_RECT *)d->meta;
+		d->nmoves = size / sizeof(DXGI_OUTDUPL_MOVE_RECT);
+
+		UINT used = size;
+		hr = IDXGIOutputDuplication_GetFrameDirtyRects(d->dup, d->metaSize - used,
+			(RECT *)(d->meta + used), &size);
+		if (FAILED(hr)) goto done;
+		d->dirty = (RECT *)(d->meta + used);
+		d->ndirty = size / sizeof(RECT);
+	}
+
+	hr = IDXGIResource_QueryInterface(res, &IID_ID3D11Texture2D, (void **)&tex);
+	if (FAILED(hr)) goto done;
+	ID3D11DeviceContext_CopyResource(d->ctx, (ID3D11Resource *)d->staging, (ID3D11Resource *)tex);
+	hr = ID3D11DeviceContext_Map(d->ctx, (ID3D11Resource *)d->staging, 0, D3D11_MAP_READ, 0, &d->map);
+	if (SUCCEEDED(hr)) d->mapped = 1;
+
+done:
+	if (tex) ID3D11Texture2D_Release(tex);
+	IDXGIResource_Release(res);
+	return hr;
+}
+
+static void rfb_dup_release(rfb_dup *d) {
+	if (d->mapped) {
+		ID3D11DeviceContext_Unmap(d->ctx, (ID3D11Resource *)d->staging, 0);
+		d->mapped = 0;
+	}
+	if (d->acquired) {
+		IDXGIOutputDuplication_ReleaseFrame(d->dup);
+		d->acquired = 0;
+	}
+}
+
+static BYTE *rfb_dup_pixels(rfb_dup *d) { return (BYTE *)d->map.pData; }
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"unsafe"
+
+	"github.com/patdhlk/rfb"
+)
+
+const (
+	errWaitTimeout = 0x887A0027 // DXGI_ERROR_WAIT_TIMEOUT
+	errAccessLost  = 0x887A0026 // DXGI_ERROR_ACCESS_LOST
+
+	acquireTimeout = 500 // ms
+)
+
+// ErrAccessLost is returned by NextFrame when the duplication became
+// invalid, e.g. because of a mode change or the secure desktop (UAC,
+// lock screen) being shown. Open a new Source to continue.
+var ErrAccessLost = errors.New("dxgi: desktop duplication access lost")
+
+// Source is a FrameSource duplicating one output (monitor). It keeps a
+// single framebuffer that is patched in place, so each connection needs
+// its own Source.
+type Source struct {
+	mu    sync.Mutex
+	d     *C.rfb_dup
+	frame *image.RGBA
+	first bool
+}
+
+// Open starts duplicating the output with the given index on the primary
+// adapter.
+func Open(output int) (*Source, error) {
+	var d *C.rfb_dup
+	if hr := C.rfb_dup_open(C.int(output), &d); hr < 0 {
+		return nil, fmt.Errorf("dxgi: duplicating output %d failed (hresult %#x)", output, uint32(hr))
+	}
+	return &Source{
+		d:     d,
+		frame: image.NewRGBA(image.Rect(0, 0, int(d.width), int(d.height))),
+		first: true,
+	}, nil
+}
+
+// Bounds returns the output's size.
+func (s *Source) Bounds() image.Rectangle {
+	return s.frame.Rect
+}
+
+// NextFrame blocks until the desktop image changes. The regions DXGI
+// reports as redrawn become the frame's Damage and the ones it reports as
+// moved become Moves.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		hr := C.rfb_dup_acquire(s.d, acquireTimeout)
+		switch {
+		case uint32(hr) == errWaitTimeout:
+			continue
+		case uint32(hr) == errAccessLost:
+			return nil, ErrAccessLost
+		case hr < 0:
+			C.rfb_dup_release(s.d)
+			return nil, fmt.Errorf("dxgi: acquiring frame failed (hresult %#x)", uint32(hr))
+		case hr == C.S_FALSE:
+			// pointer-only update
+			C.rfb_dup_release(s.d)
+			continue
+		}
+		li := s.update()
+		C.rfb_dup_release(s.d)
+		return li, nil
+	}
+}
+
+// update copies the changed regions of the mapped desktop image into the
+// framebuffer.
+func (s *Source) update() *rfb.LockableImage {
+	bounds := s.frame.Rect
+	li := &rfb.LockableImage{Img: s.frame, Damage: []image.Rectangle{}}
+
+	if s.first {
+		s.first = false
+		li.Damage = append(li.Damage, bounds)
+	} else {
+		for _, m := range unsafe.Slice(s.d.moves, int(s.d.nmoves)) {
+			dst := rectOf(m.DestinationRect).Intersect(bounds)
+			if dst.Empty() {
+				continue
+			}
+			li.Moves = append(li.Moves, rfb.Move{
+				Src: image.Pt(int(m.SourcePoint.x), int(m.SourcePoint.y)),
+				Dst: dst,
+			})
+		}
+		for _, r := range unsafe.Slice(s.d.dirty, int(s.d.ndirty)) {
+			if r := rectOf(r).Intersect(bounds); !r.Empty() {
+				li.Damage = append(li.Damage, r)
+			}
+		}
+	}
+
+	pitch := int(s.d._map.RowPitch)
+	pix := unsafe.Slice((*byte)(unsafe.Pointer(C.rfb_dup_pixels(s.d))), pitch*bounds.Dy())
+	copyRect := func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			from := pix[y*pitch+r.Min.X*4 : y*pitch+r.Max.X*4]
+			off := s.frame.PixOffset(r.Min.X, y)
+			to := s.frame.Pix[off : off+len(from)]
+			for i := 0; i < len(from); i += 4 {
+				to[i], to[i+1], to[i+2], to[i+3] = from[i+2], from[i+1], from[i], 0xff
+			}
+		}
+	}
+	for _, m := range li.Moves {
+		copyRect(m.Dst)
+	}
+	for _, r := range li.Damage {
+		copyRect(r)
+	}
+	return li
+}
+
+func rectOf(r C.RECT) image.Rectangle {
+	return image.Rect(int(r.left), int(r.top), int(r.right), int(r.bottom))
+}
+
+// Close stops the duplication.
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	C.rfb_dup_close(s.d)
+	s.d = nil
+	return nil
+}
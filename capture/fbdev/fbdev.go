@@ -0,0 +1,173 @@
+//go:build linux
+
+// Package fbdev is a capture backend for the Linux framebuffer device
+// (/dev/fb0 and friends), for embedded devices without a display server.
+//
+// The pixel format is read from the device. The framebuffer is mapped
+// into memory and polled; changes are found by comparing the raw
+// framebuffer contents, so only changed tiles are converted.
+package fbdev
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/capture/internal/rawfb"
+)
+
+// DefaultInterval is the polling interval used by Open (20 fps).
+const DefaultInterval = time.Second / 20
+
+const (
+	ioctlGetVScreenInfo = 0x4600 // FBIOGET_VSCREENINFO
+	ioctlGetFScreenInfo = 0x4602 // FBIOGET_FSCREENINFO
+)
+
+// struct fb_bitfield
+type bitfield struct {
+	Offset, Length, MSBRight uint32
+}
+
+// struct fb_var_screeninfo
+type varScreenInfo struct {
+	XRes, YRes                 uint32
+	XResVirtual, YResVirtual   uint32
+	XOffset, YOffset           uint32
+	BitsPerPixel               uint32
+	Grayscale                  uint32
+	Red, Green, Blue, Transp   bitfield
+	Nonstd, Activate           uint32
+	Height, Width              uint32
+	AccelFlags, Pixclock       uint32
+	LeftMargin, RightMargin    uint32
+	UpperMargin, LowerMargin   uint32
+	HSyncLen, VSyncLen         uint32
+	Sync, VMode, Rotate, Color uint32
+	Reserved                   [4]uint32
+}
+
+// struct fb_fix_screeninfo
+type fixScreenInfo struct {
+	ID           [16]byte
+	SMemStart    uintptr
+	SMemLen      uint32
+	Type         uint32
+	TypeAux      uint32
+	Visual       uint32
+	XPanStep     uint16
+	YPanStep     uint16
+	YWrapStep    uint16
+	LineLength   uint32
+	MMIOStart    uintptr
+	MMIOLen      uint32
+	Accel        uint32
+	Capabilities uint16
+	Reserved     [2]uint16
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Source is a FrameSource polling a framebuffer device. It keeps a single
+// framebuffer that is patched in place, so each connection needs its own
+// Source.
+type Source struct {
+	// Interval is the time between two polls.
+	Interval time.Duration
+
+	f      *os.File
+	mem    []byte // the mapped device memory
+	vinfo  varScreenInfo
+	stride int // bytes per line
+
+	mu   sync.Mutex
+	poll *rawfb.Poller
+	next time.Time
+}
+
+// Open opens a framebuffer device such as "/dev/fb0".
+func Open(device string) (*Source, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{Interval: DefaultInterval, f: f}
+	if err := s.init(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Source) init() error {
+	var finfo fixScreenInfo
+	if err := ioctl(s.f.Fd(), ioctlGetVScreenInfo, unsafe.Pointer(&s.vinfo)); err != nil {
+		return fmt.Errorf("fbdev: FBIOGET_VSCREENINFO: %v", err)
+	}
+	if err := ioctl(s.f.Fd(), ioctlGetFScreenInfo, unsafe.Pointer(&finfo)); err != nil {
+		return fmt.Errorf("fbdev: FBIOGET_FSCREENINFO: %v", err)
+	}
+	switch s.vinfo.BitsPerPixel {
+	case 16, 24, 32:
+	default:
+		return fmt.Errorf("fbdev: unsupported depth of %d bits per pixel", s.vinfo.BitsPerPixel)
+	}
+	s.stride = int(finfo.LineLength)
+
+	mem, err := syscall.Mmap(int(s.f.Fd()), 0, int(finfo.SMemLen), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("fbdev: mmap: %v", err)
+	}
+	s.mem = mem
+
+	v := &s.vinfo
+	s.poll = rawfb.NewPoller(int(v.XRes), int(v.YRes), rawfb.Format{
+		BytesPerPixel: int(v.BitsPerPixel) / 8,
+		Red:           rawfb.Field{Offset: v.Red.Offset, Length: v.Red.Length},
+		Green:         rawfb.Field{Offset: v.Green.Offset, Length: v.Green.Length},
+		Blue:          rawfb.Field{Offset: v.Blue.Offset, Length: v.Blue.Length},
+	})
+	return nil
+}
+
+// Bounds returns the visible resolution.
+func (s *Source) Bounds() image.Rectangle {
+	return s.poll.Bounds()
+}
+
+// NextFrame polls the framebuffer until it changed and returns the frame
+// with the changed tiles as Damage.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the visible area may be panned within the virtual resolution
+	base := int(s.vinfo.YOffset)*s.stride + int(s.vinfo.XOffset)*int(s.vinfo.BitsPerPixel)/8
+	for {
+		if wait := time.Until(s.next); wait > 0 {
+			time.Sleep(wait)
+		}
+		s.next = time.Now().Add(s.Interval)
+
+		s.poll.Snapshot(s.mem[base:], s.stride)
+		if frame, damage := s.poll.Update(); len(damage) > 0 {
+			return &rfb.LockableImage{Img: frame, Damage: damage}, nil
+		}
+	}
+}
+
+// Close unmaps and closes the device.
+func (s *Source) Close() error {
+	syscall.Munmap(s.mem)
+	return s.f.Close()
+}
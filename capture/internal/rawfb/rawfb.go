@@ -0,0 +1,138 @@
+// Package rawfb turns polled snapshots of a raw, memory mapped
+// framebuffer into frames with damage hints. It's shared by the fbdev and
+// drm capture backends.
+package rawfb
+
+import (
+	"bytes"
+	"image"
+)
+
+const tileSize = 64
+
+// A Field describes the position of a colour channel in a pixel.
+type Field struct {
+	Offset, Length uint32
+}
+
+// Format describes little-endian packed pixels.
+type Format struct {
+	BytesPerPixel    int
+	Red, Green, Blue Field
+}
+
+// XRGB8888 is the most common framebuffer format.
+var XRGB8888 = Format{4, Field{16, 8}, Field{8, 8}, Field{0, 8}}
+
+// RGB565 is the common 16 bit framebuffer format.
+var RGB565 = Format{2, Field{11, 5}, Field{5, 6}, Field{0, 5}}
+
+// Poller keeps the last snapshot of a framebuffer and an RGBA frame
+// matching it.
+type Poller struct {
+	format Format
+	bounds image.Rectangle
+	line   int    // bytes per snapshot line
+	raw    []byte // snapshot as of the last frame
+	cur    []byte // snapshot being taken
+	frame  *image.RGBA
+}
+
+// NewPoller returns a poller for a w×h framebuffer.
+func NewPoller(w, h int, format Format) *Poller {
+	line := w * format.BytesPerPixel
+	return &Poller{
+		format: format,
+		bounds: image.Rect(0, 0, w, h),
+		line:   line,
+		raw:    make([]byte, line*h),
+		cur:    make([]byte, line*h),
+	}
+}
+
+// Bounds returns the framebuffer size.
+func (p *Poller) Bounds() image.Rectangle {
+	return p.bounds
+}
+
+// Snapshot copies the framebuffer. mem holds the framebuffer's first
+// visible pixel at offset 0, with stride bytes between lines.
+func (p *Poller) Snapshot(mem []byte, stride int) {
+	for y := 0; y < p.bounds.Dy(); y++ {
+		copy(p.cur[y*p.line:(y+1)*p.line], mem[y*stride:y*stride+p.line])
+	}
+}
+
+// Update compares the latest snapshot with the previous one and converts
+// the changed tiles. It returns the frame and its damage, which is empty
+// if nothing changed. The first call converts everything.
+func (p *Poller) Update() (*image.RGBA, []image.Rectangle) {
+	var damage []image.Rectangle
+	if p.frame == nil {
+		p.frame = image.NewRGBA(p.bounds)
+		damage = []image.Rectangle{p.bounds}
+	} else {
+		damage = p.diff()
+	}
+	if len(damage) > 0 {
+		p.raw, p.cur = p.cur, p.raw
+		for _, r := range damage {
+			p.convert(r)
+		}
+	}
+	return p.frame, damage
+}
+
+// diff compares p.cur to p.raw tile by tile.
+func (p *Poller) diff() []image.Rectangle {
+	var rects []image.Rectangle
+	bpp := p.format.BytesPerPixel
+	for ty := 0; ty < p.bounds.Max.Y; ty += tileSize {
+		for tx := 0; tx < p.bounds.Max.X; tx += tileSize {
+			tile := image.Rect(tx, ty, tx+tileSize, ty+tileSize).Intersect(p.bounds)
+			for y := tile.Min.Y; y < tile.Max.Y; y++ {
+				a, b := y*p.line+tile.Min.X*bpp, y*p.line+tile.Max.X*bpp
+				if !bytes.Equal(p.cur[a:b], p.raw[a:b]) {
+					rects = append(rects, tile)
+					break
+				}
+			}
+		}
+	}
+	return rects
+}
+
+// convert translates r of p.raw into the RGBA frame.
+func (p *Poller) convert(r image.Rectangle) {
+	f := &p.format
+	bpp := f.BytesPerPixel
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := p.raw[y*p.line+r.Min.X*bpp : y*p.line+r.Max.X*bpp]
+		off := p.frame.PixOffset(r.Min.X, y)
+		dst := p.frame.Pix[off : off+r.Dx()*4]
+		for i := 0; i < r.Dx(); i++ {
+			var px uint32
+			for b := 0; b < bpp; b++ {
+				px |= uint32(src[i*bpp+b]) << (8 * uint(b))
+			}
+			dst[i*4+0] = channel(px, f.Red)
+			dst[i*4+1] = channel(px, f.Green)
+			dst[i*4+2] = channel(px, f.Blue)
+			dst[i*4+3] = 0xff
+		}
+	}
+}
+
+// channel extracts a colour channel and scales it to 8 bits.
+func channel(p uint32, f Field) uint8 {
+	if f.Length == 0 {
+		return 0
+	}
+	v := (p >> f.Offset) & (1<<f.Length - 1)
+	if f.Length >= 8 {
+		return uint8(v >> (f.Length - 8))
+	}
+	// replicate the high bits into the low ones, so the maximum maps to 0xff
+	v <<= 8 - f.Length
+	return uint8(v | v>>f.Length)
+}
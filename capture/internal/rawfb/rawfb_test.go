@@ -0,0 +1,54 @@
+package rawfb
+
+import (
+	"image"
+	"testing"
+)
+
+func TestChannel(t *testing.T) {
+	tests := []struct {
+		p       uint32
+		r, g, b uint8
+	}{
+		{0xffff, 0xff, 0xff, 0xff},
+		{0xf800, 0xff, 0, 0},
+		{0x07e0, 0, 0xff, 0},
+		{0x001f, 0, 0, 0xff},
+		{0x8410, 0x84, 0x82, 0x84},
+	}
+	for _, tt := range tests {
+		r, g, b := channel(tt.p, RGB565.Red), channel(tt.p, RGB565.Green), channel(tt.p, RGB565.Blue)
+		if r != tt.r || g != tt.g || b != tt.b {
+			t.Errorf("channels of %#04x = %#x,%#x,%#x; want %#x,%#x,%#x", tt.p, r, g, b, tt.r, tt.g, tt.b)
+		}
+	}
+
+	if got := channel(0x00ab1234, XRGB8888.Red); got != 0xab {
+		t.Errorf("8 bit red = %#x; want 0xab", got)
+	}
+}
+
+func TestPollerDamage(t *testing.T) {
+	const w, h = 100, 70
+	mem := make([]byte, w*h*4)
+	p := NewPoller(w, h, XRGB8888)
+
+	p.Snapshot(mem, w*4)
+	if _, damage := p.Update(); len(damage) != 1 || damage[0] != p.Bounds() {
+		t.Fatalf("first damage = %v; want the whole frame", damage)
+	}
+	p.Snapshot(mem, w*4)
+	if _, damage := p.Update(); len(damage) != 0 {
+		t.Fatalf("damage without change = %v", damage)
+	}
+
+	mem[(66*w+80)*4+2] = 0xff // red pixel at (80,66)
+	p.Snapshot(mem, w*4)
+	frame, damage := p.Update()
+	if want := image.Rect(64, 64, 100, 70); len(damage) != 1 || damage[0] != want {
+		t.Errorf("damage = %v; want [%v]", damage, want)
+	}
+	if r, _, _, _ := frame.At(80, 66).RGBA(); r != 0xffff {
+		t.Errorf("pixel not converted: %v", frame.At(80, 66))
+	}
+}
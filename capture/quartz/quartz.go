@@ -0,0 +1,164 @@
+//go:build darwin && cgo
+
+// Package quartz is a capture backend for macOS.
+//
+// It uses ScreenCaptureKit on macOS 12.3 and later and falls back to
+// CGDisplayStream on older systems. Both report the regions that changed
+// between frames, which are passed on as damage hints. The process needs
+// the Screen Recording permission; Open triggers the system prompt if it
+// wasn't granted yet.
+package quartz
+
+/*
+#cgo CFLAGS: -x objective-c -fobjc-arc
+#cgo LDFLAGS: -framework CoreGraphics -framework Foundation -framework IOSurface -framework CoreMedia -framework CoreVideo -weak_framework ScreenCaptureKit
+
+#include "quartz.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"unsafe"
+
+	"github.com/patdhlk/rfb"
+)
+
+var (
+	// ErrNoDisplay is returned by Open for an invalid display index.
+	ErrNoDisplay = errors.New("quartz: no such display")
+
+	// ErrPermission is returned by Open if the process lacks the Screen
+	// Recording permission. The user has been asked to grant it; the
+	// process usually needs to be restarted afterwards.
+	ErrPermission = errors.New("quartz: screen recording permission not granted")
+
+	errStream = errors.New("quartz: starting display stream failed")
+)
+
+// NumDisplays returns the number of active displays.
+func NumDisplays() int {
+	return int(C.rfb_quartz_num_displays())
+}
+
+// Options configure Open.
+type Options struct {
+	// NoScreenCaptureKit forces the CGDisplayStream backend even where
+	// ScreenCaptureKit is available.
+	NoScreenCaptureKit bool
+}
+
+// Source is a FrameSource capturing one display. It keeps a single
+// framebuffer that is patched in place, so each connection needs its own
+// Source.
+type Source struct {
+	q *C.rfb_quartz
+
+	mu    sync.Mutex
+	frame *image.RGBA
+}
+
+// Open starts capturing the display with the given index, 0 being the
+// main display.
+func Open(display int, opts *Options) (*Source, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	allowSCK := C.int(1)
+	if opts.NoScreenCaptureKit {
+		allowSCK = 0
+	}
+	var cerr C.int
+	q := C.rfb_quartz_open(C.int(display), allowSCK, &cerr)
+	if q == nil {
+		switch cerr {
+		case 1:
+			return nil, ErrNoDisplay
+		case 2:
+			return nil, ErrPermission
+		}
+		return nil, errStream
+	}
+	return &Source{q: q}, nil
+}
+
+// UsesScreenCaptureKit reports whether the ScreenCaptureKit backend is in
+// use, as opposed to CGDisplayStream.
+func (s *Source) UsesScreenCaptureKit() bool {
+	return s.q.sck != 0
+}
+
+// Bounds returns the size of the display in pixels. It's only known once
+// the first frame arrived, so Bounds waits for it.
+func (s *Source) Bounds() image.Rectangle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.frame == nil {
+		if C.rfb_quartz_wait(s.q) != 0 {
+			return image.Rectangle{}
+		}
+		s.update()
+	}
+	return s.frame.Rect
+}
+
+// NextFrame blocks until the display changes.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if C.rfb_quartz_wait(s.q) != 0 {
+		return nil, errors.New("quartz: display stream stopped")
+	}
+	return &rfb.LockableImage{Img: s.frame, Damage: s.update()}, nil
+}
+
+// update copies the damaged parts of the pending frame and releases it.
+// It must be called after a successful rfb_quartz_wait.
+func (s *Source) update() []image.Rectangle {
+	defer C.rfb_quartz_release(s.q)
+
+	w, h := int(s.q.width), int(s.q.height)
+	bounds := image.Rect(0, 0, w, h)
+	var rects []image.Rectangle
+	if s.frame == nil || s.frame.Rect != bounds || s.q.ndamage < 0 {
+		if s.frame == nil || s.frame.Rect != bounds {
+			s.frame = image.NewRGBA(bounds)
+		}
+		rects = []image.Rectangle{bounds}
+	} else {
+		for _, d := range s.q.damage[:s.q.ndamage] {
+			r := image.Rect(int(d.x), int(d.y), int(d.x+d.w), int(d.y+d.h)).Intersect(bounds)
+			if !r.Empty() {
+				rects = append(rects, r)
+			}
+		}
+	}
+
+	src := unsafe.Slice((*byte)(unsafe.Pointer(s.q.frame)), w*h*4)
+	for _, r := range rects {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			from := src[(y*w+r.Min.X)*4 : (y*w+r.Max.X)*4]
+			off := s.frame.PixOffset(r.Min.X, y)
+			to := s.frame.Pix[off : off+len(from)]
+			for i := 0; i < len(from); i += 4 {
+				to[i], to[i+1], to[i+2], to[i+3] = from[i+2], from[i+1], from[i], 0xff
+			}
+		}
+	}
+	if rects == nil {
+		rects = []image.Rectangle{}
+	}
+	return rects
+}
+
+// Close stops capturing.
+func (s *Source) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	C.rfb_quartz_close(s.q)
+	s.q = nil
+	return nil
+}
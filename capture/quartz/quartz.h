@@ -0,0 +1,28 @@
+#include <pthread.h>
+#include <stdint.h>
+
+#define RFB_MAX_DAMAGE 64
+
+typedef struct {
+	int x, y, w, h;
+} rfb_rect;
+
+typedef struct {
+	pthread_mutex_t mu;
+	pthread_cond_t cond;
+	uint8_t *frame; // BGRA, tightly packed
+	int width, height;
+	rfb_rect damage[RFB_MAX_DAMAGE];
+	int ndamage; // -1: everything
+	int fresh;
+	int closed;
+
+	void *impl; // backend specific state
+	int sck;    // whether ScreenCaptureKit is used
+} rfb_quartz;
+
+rfb_quartz *rfb_quartz_open(int display, int allow_sck, int *err);
+int rfb_quartz_wait(rfb_quartz *q);
+void rfb_quartz_release(rfb_quartz *q);
+void rfb_quartz_close(rfb_quartz *q);
+int rfb_quartz_num_displays(void);
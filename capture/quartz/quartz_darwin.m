@@ -0,0 +1,305 @@
+//go:build darwin && cgo
+
+#import <CoreGraphics/CoreGraphics.h>
+#import <Foundation/Foundation.h>
+#import <IOSurface/IOSurface.h>
+#import <ScreenCaptureKit/ScreenCaptureKit.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "quartz.h"
+
+static void rfb_quartz_add_damage(rfb_quartz *q, CGRect r) {
+	if (q->ndamage < 0) {
+		return;
+	}
+	if (q->ndamage == RFB_MAX_DAMAGE) {
+		q->ndamage = -1;
+		return;
+	}
+	r = CGRectIntegral(r);
+	q->damage[q->ndamage++] = (rfb_rect){
+		(int)r.origin.x, (int)r.origin.y, (int)r.size.width, (int)r.size.height};
+}
+
+// rfb_quartz_store copies a BGRA surface into the frame buffer. The
+// damage must have been added by the caller, with the mutex held.
+static void rfb_quartz_store(rfb_quartz *q, IOSurfaceRef surface) {
+	IOSurfaceLock(surface, kIOSurfaceLockReadOnly, NULL);
+	int w = (int)IOSurfaceGetWidth(surface);
+	int h = (int)IOSurfaceGetHeight(surface);
+	size_t stride = IOSurfaceGetBytesPerRow(surface);
+	uint8_t *src = IOSurfaceGetBaseAddress(surface);
+
+	if (q->frame == NULL || q->width != w || q->height != h) {
+		free(q->frame);
+		q->frame = malloc((size_t)w * h * 4);
+		q->width = w;
+		q->height = h;
+		q->ndamage = -1;
+	}
+	for (int y = 0; y < h; y++) {
+		memcpy(q->frame + (size_t)y * w * 4, src + y * stride, (size_t)w * 4);
+	}
+	IOSurfaceUnlock(surface, kIOSurfaceLockReadOnly, NULL);
+
+	q->fresh = 1;
+	pthread_cond_signal(&q->cond);
+}
+
+static void rfb_quartz_fail(rfb_quartz *q) {
+	pthread_mutex_lock(&q->mu);
+	q->closed = 1;
+	pthread_cond_broadcast(&q->cond);
+	pthread_mutex_unlock(&q->mu);
+}
+
+static CGDirectDisplayID rfb_quartz_display(int index) {
+	CGDirectDisplayID ids[32];
+	uint32_t n = 0;
+	if (CGGetActiveDisplayList(32, ids, &n) != kCGErrorSuccess || index < 0 || (uint32_t)index >= n) {
+		return kCGNullDirectDisplay;
+	}
+	return ids[index];
+}
+
+int rfb_quartz_num_displays(void) {
+	uint32_t n = 0;
+	CGGetActiveDisplayList(0, NULL, &n);
+	return (int)n;
+}
+
+// ScreenCaptureKit (macOS 12.3+)
+
+API_AVAILABLE(macos(12.3))
+@interface RFBStreamOutput : NSObject <SCStreamOutput, SCStreamDelegate>
+@property(nonatomic) rfb_quartz *q;
+@property(nonatomic) CGFloat scale;
+@property(nonatomic, strong) SCStream *stream;
+@end
+
+@implementation RFBStreamOutput
+- (void)stream:(SCStream *)stream didOutputSampleBuffer:(CMSampleBufferRef)sb ofType:(SCStreamOutputType)type {
+	if (type != SCStreamOutputTypeScreen) {
+		return;
+	}
+	CFArrayRef attachments = CMSampleBufferGetSampleAttachmentsArray(sb, false);
+	if (attachments == NULL || CFArrayGetCount(attachments) == 0) {
+		return;
+	}
+	NSDictionary *info = (__bridge NSDictionary *)CFArrayGetValueAtIndex(attachments, 0);
+	NSNumber *status = info[SCStreamFrameInfoStatus];
+	if (status == nil || status.integerValue != SCFrameStatusComplete) {
+		return; // idle, blank or suspended frames carry no new pixels
+	}
+	CVPixelBufferRef pb = CMSampleBufferGetImageBuffer(sb);
+	IOSurfaceRef surface = pb ? CVPixelBufferGetIOSurface(pb) : NULL;
+	if (surface == NULL) {
+		return;
+	}
+
+	rfb_quartz *q = self.q;
+	pthread_mutex_lock(&q->mu);
+	NSArray *dirty = info[SCStreamFrameInfoDirtyRects];
+	if (dirty == nil) {
+		q->ndamage = -1;
+	}
+	for (NSDictionary *d in dirty) {
+		CGRect r;
+		if (CGRectMakeWithDictionaryRepresentation((__bridge CFDictionaryRef)d, &r)) {
+			rfb_quartz_add_damage(q, CGRectApplyAffineTransform(r,
+				CGAffineTransformMakeScale(self.scale, self.scale)));
+		}
+	}
+	rfb_quartz_store(q, surface);
+	pthread_mutex_unlock(&q->mu);
+}
+
+- (void)stream:(SCStream *)stream didStopWithError:(NSError *)error {
+	rfb_quartz_fail(self.q);
+}
+@end
+
+API_AVAILABLE(macos(12.3))
+static int rfb_quartz_open_sck(rfb_quartz *q, CGDirectDisplayID id) {
+	__block SCShareableContent *content = nil;
+	dispatch_semaphore_t sem = dispatch_semaphore_create(0);
+	[SCShareableContent getShareableContentWithCompletionHandler:^(SCShareableContent *c, NSError *err) {
+		content = c;
+		dispatch_semaphore_signal(sem);
+	}];
+	dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
+	if (content == nil) {
+		return -1; // most likely no screen recording permission
+	}
+
+	SCDisplay *display = nil;
+	for (SCDisplay *d in content.displays) {
+		if (d.displayID == id) {
+			display = d;
+		}
+	}
+	if (display == nil) {
+		return -1;
+	}
+
+	size_t w = CGDisplayPixelsWide(id), h = CGDisplayPixelsHigh(id);
+	CGDisplayModeRef mode = CGDisplayCopyDisplayMode(id);
+	if (mode != NULL) {
+		w = CGDisplayModeGetPixelWidth(mode);
+		h = CGDisplayModeGetPixelHeight(mode);
+		CGDisplayModeRelease(mode);
+	}
+
+	SCStreamConfiguration *cfg = [[SCStreamConfiguration alloc] init];
+	cfg.width = w;
+	cfg.height = h;
+	cfg.pixelFormat = 'BGRA';
+	cfg.showsCursor = YES;
+	cfg.minimumFrameInterval = CMTimeMake(1, 60);
+
+	SCContentFilter *filter = [[SCContentFilter alloc] initWithDisplay:display excludingWindows:@[]];
+	RFBStreamOutput *out = [[RFBStreamOutput alloc] init];
+	out.q = q;
+	out.scale = (CGFloat)w / display.width;
+	out.stream = [[SCStream alloc] initWithFilter:filter configuration:cfg delegate:out];
+
+	NSError *err = nil;
+	dispatch_queue_t queue = dispatch_queue_create("rfb.capture", DISPATCH_QUEUE_SERIAL);
+	if (![out.stream addStreamOutput:out type:SCStreamOutputTypeScreen sampleHandlerQueue:queue error:&err]) {
+		return -1;
+	}
+	__block int failed = 0;
+	[out.stream startCaptureWithCompletionHandler:^(NSError *e) {
+		failed = e != nil;
+		dispatch_semaphore_signal(sem);
+	}];
+	dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
+	if (failed) {
+		return -1;
+	}
+	q->impl = (__bridge_retained void *)out;
+	q->sck = 1;
+	return 0;
+}
+
+// CGDisplayStream (macOS 10.8+, deprecated in 14)
+
+#pragma clang diagnostic push
+#pragma clang diagnostic ignored "-Wdeprecated-declarations"
+
+static int rfb_quartz_open_cgds(rfb_quartz *q, CGDirectDisplayID id) {
+	size_t w = CGDisplayPixelsWide(id), h = CGDisplayPixelsHigh(id);
+	CGDisplayModeRef mode = CGDisplayCopyDisplayMode(id);
+	if (mode != NULL) {
+		w = CGDisplayModeGetPixelWidth(mode);
+		h = CGDisplayModeGetPixelHeight(mode);
+		CGDisplayModeRelease(mode);
+	}
+
+	dispatch_queue_t queue = dispatch_queue_create("rfb.capture", DISPATCH_QUEUE_SERIAL);
+	CGDisplayStreamRef stream = CGDisplayStreamCreateWithDispatchQueue(id, w, h, 'BGRA', NULL, queue,
+		^(CGDisplayStreamFrameStatus status, uint64_t time, IOSurfaceRef surface, CGDisplayStreamUpdateRef update) {
+			if (status == kCGDisplayStreamFrameStatusStopped) {
+				rfb_quartz_fail(q);
+				return;
+			}
+			if (status != kCGDisplayStreamFrameStatusFrameComplete || surface == NULL) {
+				return;
+			}
+			pthread_mutex_lock(&q->mu);
+			size_t n = 0;
+			const CGRect *rects = CGDisplayStreamUpdateGetRects(update, kCGDisplayStreamUpdateDirtyRects, &n);
+			if (rects == NULL) {
+				q->ndamage = -1;
+			}
+			for (size_t i = 0; i < n; i++) {
+				rfb_quartz_add_damage(q, rects[i]);
+			}
+			rfb_quartz_store(q, surface);
+			pthread_mutex_unlock(&q->mu);
+		});
+	if (stream == NULL) {
+		return -1;
+	}
+	if (CGDisplayStreamStart(stream) != kCGErrorSuccess) {
+		CFRelease(stream);
+		return -1;
+	}
+	q->impl = (void *)stream;
+	return 0;
+}
+
+rfb_quartz *rfb_quartz_open(int display, int allow_sck, int *err) {
+	CGDirectDisplayID id = rfb_quartz_display(display);
+	if (id == kCGNullDirectDisplay) {
+		*err = 1;
+		return NULL;
+	}
+	if (!CGPreflightScreenCaptureAccess()) {
+		CGRequestScreenCaptureAccess();
+		*err = 2;
+		return NULL;
+	}
+
+	rfb_quartz *q = calloc(1, sizeof(rfb_quartz));
+	pthread_mutex_init(&q->mu, NULL);
+	pthread_cond_init(&q->cond, NULL);
+	q->ndamage = -1;
+
+	int rc = -1;
+	if (allow_sck) {
+		if (@available(macOS 12.3, *)) {
+			rc = rfb_quartz_open_sck(q, id);
+		}
+	}
+	if (rc != 0) {
+		rc = rfb_quartz_open_cgds(q, id);
+	}
+	if (rc != 0) {
+		free(q);
+		*err = 3;
+		return NULL;
+	}
+	return q;
+}
+
+int rfb_quartz_wait(rfb_quartz *q) {
+	pthread_mutex_lock(&q->mu);
+	while (!q->fresh && !q->closed) {
+		pthread_cond_wait(&q->cond, &q->mu);
+	}
+	if (q->closed) {
+		pthread_mutex_unlock(&q->mu);
+		return -1;
+	}
+	return 0;
+}
+
+void rfb_quartz_release(rfb_quartz *q) {
+	q->fresh = 0;
+	q->ndamage = 0;
+	pthread_mutex_unlock(&q->mu);
+}
+
+void rfb_quartz_close(rfb_quartz *q) {
+	if (q->sck) {
+		if (@available(macOS 12.3, *)) {
+			RFBStreamOutput *out = (__bridge_transfer RFBStreamOutput *)q->impl;
+			dispatch_semaphore_t sem = dispatch_semaphore_create(0);
+			[out.stream stopCaptureWithCompletionHandler:^(NSError *e) {
+				dispatch_semaphore_signal(sem);
+			}];
+			dispatch_semaphore_wait(sem, DISPATCH_TIME_FOREVER);
+		}
+	} else {
+		CGDisplayStreamRef stream = (CGDisplayStreamRef)q->impl;
+		CGDisplayStreamStop(stream);
+		CFRelease(stream);
+	}
+	rfb_quartz_fail(q);
+	free(q->frame);
+	free(q);
+}
+
+#pragma clang diagnostic pop
@@ -0,0 +1,320 @@
+//go:build linux && cgo
+
+package wayland
+
+/*
+#cgo pkg-config: libpipewire-0.3
+
+#include <errno.h>
+#include <pthread.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include <pipewire/pipewire.h>
+#include <spa/buffer/meta.h>
+#include <spa/param/video/format-utils.h>
+#include <spa/pod/builder.h>
+
+#define RFB_MAX_DAMAGE 64
+
+typedef struct {
+	int x, y, w, h;
+} rfb_rect;
+
+typedef struct {
+	struct pw_thread_loop *loop;
+	struct pw_context *context;
+	struct pw_core *core;
+	struct pw_stream *stream;
+	struct spa_hook listener;
+	struct spa_video_info_raw info;
+
+	pthread_mutex_t mu;
+	pthread_cond_t cond;
+	uint8_t *frame; // tightly packed, 4 bytes per pixel
+	int width, height;
+	uint32_t format;
+	rfb_rect damage[RFB_MAX_DAMAGE];
+	int ndamage; // -1: everything
+	int fresh;
+	int closed;
+} rfb_pw;
+
+static void rfb_pw_add_damage(rfb_pw *p, int x, int y, int w, int h) {
+	if (p->ndamage < 0) {
+		return;
+	}
+	if (p->ndamage == RFB_MAX_DAMAGE) {
+		p->ndamage = -1;
+		return;
+	}
+	p->damage[p->ndamage++] = (rfb_rect){x, y, w, h};
+}
+
+static void rfb_pw_param_changed(void *data, uint32_t id, const struct spa_pod *param) {
+	rfb_pw *p = data;
+	if (param == NULL || id != SPA_PARAM_Format) {
+		return;
+	}
+	if (spa_format_video_raw_parse(param, &p->info) < 0) {
+		return;
+	}
+
+	uint8_t buf[1024];
+	struct spa_pod_builder b = SPA_POD_BUILDER_INIT(buf, sizeof(buf));
+	const struct spa_pod *params[1];
+	params[0] = spa_pod_builder_add_object(&b,
+		SPA_TYPE_OBJECT_ParamMeta, SPA_PARAM_Meta,
+		SPA_PARAM_META_type, SPA_POD_Id(SPA_META_VideoDamage),
+		SPA_PARAM_META_size, SPA_POD_CHOICE_RANGE_Int(
+			sizeof(struct spa_meta_region) * 16,
+			sizeof(struct spa_meta_region) * 1,
+			sizeof(struct spa_meta_region) * RFB_MAX_DAMAGE));
+	pw_stream_update_params(p->stream, params, 1);
+}
+
+static void rfb_pw_process(void *data) {
+	rfb_pw *p = data;
+	struct pw_buffer *b = pw_stream_dequeue_buffer(p->stream);
+	if (b == NULL) {
+		return;
+	}
+	struct spa_buffer *buf = b->buffer;
+	struct spa_data *d = &buf->datas[0];
+	if (d->data == NULL || d->chunk->size == 0) {
+		pw_stream_queue_buffer(p->stream, b);
+		return;
+	}
+
+	int w = p->info.size.width, h = p->info.size.height;
+	int stride = d->chunk->stride ? d->chunk->stride : w * 4;
+	uint8_t *src = (uint8_t *)d->data + d->chunk->offset;
+
+	pthread_mutex_lock(&p->mu);
+	if (p->width != w || p->height != h || p->frame == NULL) {
+		free(p->frame);
+		p->frame = malloc((size_t)w * h * 4);
+		p->width = w;
+		p->height = h;
+		p->ndamage = -1;
+	}
+	p->format = p->info.format;
+
+	struct spa_meta *m = spa_buffer_find_meta(buf, SPA_META_VideoDamage);
+	if (m == NULL) {
+		p->ndamage = -1;
+	} else {
+		struct spa_meta_region *r;
+		spa_meta_for_each(r, m) {
+			if (!spa_meta_region_is_valid(r)) {
+				break;
+			}
+			rfb_pw_add_damage(p, r->region.position.x, r->region.position.y,
+				r->region.size.width, r->region.size.height);
+		}
+	}
+	if (p->frame != NULL) {
+		for (int y = 0; y < h; y++) {
+			memcpy(p->frame + (size_t)y * w * 4, src + (size_t)y * stride, (size_t)w * 4);
+		}
+	}
+	p->fresh = 1;
+	pthread_cond_signal(&p->cond);
+	pthread_mutex_unlock(&p->mu);
+
+	pw_stream_queue_buffer(p->stream, b);
+}
+
+static void rfb_pw_state_changed(void *data, enum pw_stream_state old, enum pw_stream_state state, const char *error) {
+	rfb_pw *p = data;
+	if (state == PW_STREAM_STATE_ERROR || state == PW_STREAM_STATE_UNCONNECTED) {
+		pthread_mutex_lock(&p->mu);
+		p->closed = 1;
+		pthread_cond_signal(&p->cond);
+		pthread_mutex_unlock(&p->mu);
+	}
+}
+
+static const struct pw_stream_events rfb_pw_events = {
+	PW_VERSION_STREAM_EVENTS,
+	.state_changed = rfb_pw_state_changed,
+	.param_changed = rfb_pw_param_changed,
+	.process = rfb_pw_process,
+};
+
+static rfb_pw *rfb_pw_open(int fd, uint32_t node) {
+	pw_init(NULL, NULL);
+
+	rfb_pw *p = calloc(1, sizeof(rfb_pw));
+	pthread_mutex_init(&p->mu, NULL);
+	pthread_cond_init(&p->cond, NULL);
+	p->ndamage = -1;
+
+	p->loop = pw_thread_loop_new("rfb-capture", NULL);
+	p->context = pw_context_new(pw_thread_loop_get_loop(p->loop), NULL, 0);
+	if (pw_thread_loop_start(p->loop) < 0) {
+		goto fail;
+	}
+
+	pw_thread_loop_lock(p->loop);
+	p->core = pw_context_connect_fd(p->context, fd, NULL, 0);
+	if (p->core == NULL) {
+		pw_thread_loop_unlock(p->loop);
+		goto fail;
+	}
+	p->stream = pw_stream_new(p->core, "rfb-capture",
+		pw_properties_new(PW_KEY_MEDIA_TYPE, "Video",
+			PW_KEY_MEDIA_CATEGORY, "Capture",
+			PW_KEY_MEDIA_ROLE, "Screen", NULL));
+	pw_stream_add_listener(p->stream, &p->listener, &rfb_pw_events, p);
+
+	uint8_t buf[1024];
+	struct spa_pod_builder b = SPA_POD_BUILDER_INIT(buf, sizeof(buf));
+	const struct spa_pod *params[1];
+	params[0] = spa_pod_builder_add_object(&b,
+		SPA_TYPE_OBJECT_Format, SPA_PARAM_EnumFormat,
+		SPA_FORMAT_mediaType, SPA_POD_Id(SPA_MEDIA_TYPE_video),
+		SPA_FORMAT_mediaSubtype, SPA_POD_Id(SPA_MEDIA_SUBTYPE_raw),
+		SPA_FORMAT_VIDEO_format, SPA_POD_CHOICE_ENUM_Id(5,
+			SPA_VIDEO_FORMAT_BGRx, SPA_VIDEO_FORMAT_BGRx, SPA_VIDEO_FORMAT_BGRA,
+			SPA_VIDEO_FORMAT_RGBx, SPA_VIDEO_FORMAT_RGBA),
+		SPA_FORMAT_VIDEO_size, SPA_POD_CHOICE_RANGE_Rectangle(
+			&SPA_RECTANGLE(1920, 1080), &SPA_RECTANGLE(1, 1), &SPA_RECTANGLE(16384, 16384)),
+		SPA_FORMAT_VIDEO_framerate, SPA_POD_CHOICE_RANGE_Fraction(
+			&SPA_FRACTION(30, 1), &SPA_FRACTION(0, 1), &SPA_FRACTION(240, 1)));
+
+	int err = pw_stream_connect(p->stream, PW_DIRECTION_INPUT, node,
+		PW_STREAM_FLAG_AUTOCONNECT | PW_STREAM_FLAG_MAP_BUFFERS, params, 1);
+	pw_thread_loop_unlock(p->loop);
+	if (err < 0) {
+		goto fail;
+	}
+	return p;
+
+fail:
+	pw_thread_loop_stop(p->loop);
+	if (p->context) {
+		pw_context_destroy(p->context);
+	}
+	pw_thread_loop_destroy(p->loop);
+	free(p);
+	return NULL;
+}
+
+// rfb_pw_wait blocks until a new frame arrived and leaves the mutex held.
+static int rfb_pw_wait(rfb_pw *p) {
+	pthread_mutex_lock(&p->mu);
+	while (!p->fresh && !p->closed) {
+		pthread_cond_wait(&p->cond, &p->mu);
+	}
+	if (p->closed) {
+		pthread_mutex_unlock(&p->mu);
+		return -1;
+	}
+	return 0;
+}
+
+static void rfb_pw_release(rfb_pw *p) {
+	p->fresh = 0;
+	p->ndamage = 0;
+	pthread_mutex_unlock(&p->mu);
+}
+
+static void rfb_pw_close(rfb_pw *p) {
+	pw_thread_loop_lock(p->loop);
+	pw_stream_destroy(p->stream);
+	pw_core_disconnect(p->core);
+	pw_thread_loop_unlock(p->loop);
+	pw_thread_loop_stop(p->loop);
+	pw_context_destroy(p->context);
+	pw_thread_loop_destroy(p->loop);
+
+	pthread_mutex_lock(&p->mu);
+	p->closed = 1;
+	pthread_cond_broadcast(&p->cond);
+	pthread_mutex_unlock(&p->mu);
+	free(p->frame);
+	free(p);
+}
+
+static int rfb_pw_is_rgb(uint32_t format) {
+	return format == SPA_VIDEO_FORMAT_RGBx || format == SPA_VIDEO_FORMAT_RGBA;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// pwStream receives frames from a PipeWire node.
+type pwStream struct {
+	p *C.rfb_pw
+}
+
+func openStream(fd int, node uint32) (*pwStream, error) {
+	p := C.rfb_pw_open(C.int(fd), C.uint32_t(node))
+	if p == nil {
+		return nil, errors.New("wayland: connecting to PipeWire stream failed")
+	}
+	return &pwStream{p: p}, nil
+}
+
+// next waits for a frame and copies its damaged parts into dst, which is
+// reallocated if the stream size changed. It returns the damaged regions,
+// which cover the whole frame if the compositor didn't say.
+func (s *pwStream) next(dst *image.RGBA) (*image.RGBA, []image.Rectangle, error) {
+	if C.rfb_pw_wait(s.p) != 0 {
+		return dst, nil, errors.New("wayland: stream closed")
+	}
+	defer C.rfb_pw_release(s.p)
+
+	w, h := int(s.p.width), int(s.p.height)
+	bounds := image.Rect(0, 0, w, h)
+	var rects []image.Rectangle
+	if dst == nil || dst.Rect != bounds || s.p.ndamage < 0 {
+		if dst == nil || dst.Rect != bounds {
+			dst = image.NewRGBA(bounds)
+		}
+	} else {
+		for _, d := range s.p.damage[:s.p.ndamage] {
+			r := image.Rect(int(d.x), int(d.y), int(d.x+d.w), int(d.y+d.h)).Intersect(bounds)
+			if !r.Empty() {
+				rects = append(rects, r)
+			}
+		}
+	}
+
+	src := unsafe.Slice((*byte)(unsafe.Pointer(s.p.frame)), w*h*4)
+	swap := C.rfb_pw_is_rgb(s.p.format) == 0
+	copyRect := func(r image.Rectangle) {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			from := src[(y*w+r.Min.X)*4 : (y*w+r.Max.X)*4]
+			off := dst.PixOffset(r.Min.X, y)
+			to := dst.Pix[off : off+len(from)]
+			for i := 0; i < len(from); i += 4 {
+				if swap {
+					to[i], to[i+1], to[i+2] = from[i+2], from[i+1], from[i]
+				} else {
+					to[i], to[i+1], to[i+2] = from[i], from[i+1], from[i+2]
+				}
+				to[i+3] = 0xff
+			}
+		}
+	}
+	if rects == nil {
+		copyRect(bounds)
+		rects = []image.Rectangle{bounds}
+	} else {
+		for _, r := range rects {
+			copyRect(r)
+		}
+	}
+	return dst, rects, nil
+}
+
+func (s *pwStream) close() {
+	C.rfb_pw_close(s.p)
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package wayland
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	portalName   = "org.freedesktop.portal.Desktop"
+	portalPath   = "/org/freedesktop/portal/desktop"
+	screenCast   = "org.freedesktop.portal.ScreenCast"
+	portalReqIfc = "org.freedesktop.portal.Request"
+
+	sourceMonitor = 1
+
+	cursorEmbedded      = 2
+	persistUntilRevoked = 2
+)
+
+// ErrCancelled is returned when the user declines the screen cast in the
+// compositor's permission dialog.
+var ErrCancelled = errors.New("wayland: screen cast request cancelled")
+
+// portal drives the xdg-desktop-portal ScreenCast interface.
+type portal struct {
+	bus    *dbus.Conn
+	obj    dbus.BusObject
+	sender string // unique bus name, as used in request object paths
+	n      int    // token counter
+}
+
+func newPortal() (*portal, error) {
+	bus, err := dbus.SessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("wayland: connecting to session bus: %v", err)
+	}
+	names := bus.Names()
+	if len(names) == 0 {
+		return nil, errors.New("wayland: no unique name on session bus")
+	}
+	sender := strings.Replace(strings.TrimPrefix(names[0], ":"), ".", "_", -1)
+	return &portal{
+		bus:    bus,
+		obj:    bus.Object(portalName, portalPath),
+		sender: sender,
+	}, nil
+}
+
+// call invokes a portal method that answers through a Request object and
+// waits for that object's Response signal. The handle_token option is
+// filled in by call.
+func (p *portal) call(method string, opts map[string]dbus.Variant, args ...interface{}) (map[string]dbus.Variant, error) {
+	p.n++
+	token := fmt.Sprintf("rfb%d", p.n)
+	path := dbus.ObjectPath(portalPath + "/request/" + p.sender + "/" + token)
+	opts["handle_token"] = dbus.MakeVariant(token)
+
+	// Subscribe before calling, the response may come back immediately.
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(path),
+		dbus.WithMatchInterface(portalReqIfc),
+		dbus.WithMatchMember("Response"),
+	}
+	if err := p.bus.AddMatchSignal(match...); err != nil {
+		return nil, err
+	}
+	defer p.bus.RemoveMatchSignal(match...)
+	sigc := make(chan *dbus.Signal, 4)
+	p.bus.Signal(sigc)
+	defer p.bus.RemoveSignal(sigc)
+
+	args = append(args, opts)
+	if call := p.obj.Call(screenCast+"."+method, 0, args...); call.Err != nil {
+		return nil, fmt.Errorf("wayland: %s: %v", method, call.Err)
+	}
+	for sig := range sigc {
+		if sig.Path != path || len(sig.Body) != 2 {
+			continue
+		}
+		code, _ := sig.Body[0].(uint32)
+		results, _ := sig.Body[1].(map[string]dbus.Variant)
+		switch code {
+		case 0:
+			return results, nil
+		case 1:
+			return nil, ErrCancelled
+		default:
+			return nil, fmt.Errorf("wayland: %s failed", method)
+		}
+	}
+	return nil, errors.New("wayland: session bus closed")
+}
+
+// stream is a PipeWire stream handed out by the portal.
+type stream struct {
+	node          uint32
+	width, height int
+}
+
+// start runs the permission dance: create a session, select a monitor
+// and ask the user to start sharing it. It returns the PipeWire remote
+// fd, the stream to connect to and the restore token for next time.
+func (p *portal) start(restoreToken string) (fd int, st stream, token string, err error) {
+	res, err := p.call("CreateSession", map[string]dbus.Variant{
+		"session_handle_token": dbus.MakeVariant("rfb"),
+	})
+	if err != nil {
+		return -1, st, "", err
+	}
+	var session string
+	if err := res["session_handle"].Store(&session); err != nil {
+		return -1, st, "", fmt.Errorf("wayland: bad session handle: %v", err)
+	}
+	handle := dbus.ObjectPath(session)
+
+	opts := map[string]dbus.Variant{
+		"types":        dbus.MakeVariant(uint32(sourceMonitor)),
+		"multiple":     dbus.MakeVariant(false),
+		"persist_mode": dbus.MakeVariant(uint32(persistUntilRevoked)),
+	}
+	if modes, err := p.obj.GetProperty(screenCast + ".AvailableCursorModes"); err == nil {
+		if m, ok := modes.Value().(uint32); ok && m&cursorEmbedded != 0 {
+			opts["cursor_mode"] = dbus.MakeVariant(uint32(cursorEmbedded))
+		}
+	}
+	if restoreToken != "" {
+		opts["restore_token"] = dbus.MakeVariant(restoreToken)
+	}
+	if _, err := p.call("SelectSources", opts, handle); err != nil {
+		return -1, st, "", err
+	}
+
+	res, err = p.call("Start", map[string]dbus.Variant{}, handle, "")
+	if err != nil {
+		return -1, st, "", err
+	}
+	var streams []struct {
+		Node  uint32
+		Props map[string]dbus.Variant
+	}
+	if err := res["streams"].Store(&streams); err != nil || len(streams) == 0 {
+		return -1, st, "", errors.New("wayland: portal returned no streams")
+	}
+	st.node = streams[0].Node
+	var size struct{ W, H int32 }
+	if v, ok := streams[0].Props["size"]; ok && v.Store(&size) == nil {
+		st.width, st.height = int(size.W), int(size.H)
+	}
+	if v, ok := res["restore_token"]; ok {
+		v.Store(&token)
+	}
+
+	var ufd dbus.UnixFD
+	err = p.obj.Call(screenCast+".OpenPipeWireRemote", 0, handle, map[string]dbus.Variant{}).Store(&ufd)
+	if err != nil {
+		return -1, st, "", fmt.Errorf("wayland: OpenPipeWireRemote: %v", err)
+	}
+	return int(ufd), st, token, nil
+}
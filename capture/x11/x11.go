@@ -0,0 +1,242 @@
+//go:build linux
+
+// Package x11 is a capture backend for X11 displays.
+//
+// It grabs the screen through the MIT-SHM extension, so pixels are copied
+// straight from the X server into shared memory, and it uses the DAMAGE
+// extension to learn which regions changed, so neither full-screen copies
+// nor full-frame comparisons are needed.
+package x11
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/xgb"
+	"github.com/BurntSushi/xgb/damage"
+	"github.com/BurntSushi/xgb/shm"
+	"github.com/BurntSushi/xgb/xproto"
+	"github.com/patdhlk/rfb"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultInterval is the minimum time between two frames (60 fps).
+const DefaultInterval = time.Second / 60
+
+// Source is a FrameSource capturing the root window of an X display.
+// It keeps a single framebuffer that is patched in place, so each
+// connection needs its own Source.
+type Source struct {
+	// Interval is the minimum time between two frames. Damage reported
+	// in between is merged into the next frame.
+	Interval time.Duration
+
+	x      *xgb.Conn
+	root   xproto.Window
+	width  int
+	height int
+	seg    shm.Seg
+	shmid  int
+	mem    []byte // the shared memory segment
+	dmg    damage.Damage
+
+	mu    sync.Mutex
+	frame *image.RGBA
+	first bool
+	next  time.Time
+}
+
+// Open connects to the X server named by display (or $DISPLAY if empty)
+// and prepares capturing its default screen.
+func Open(display string) (*Source, error) {
+	x, err := xgb.NewConnDisplay(display)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSource(x)
+	if err != nil {
+		x.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSource(x *xgb.Conn) (*Source, error) {
+	if err := shm.Init(x); err != nil {
+		return nil, fmt.Errorf("x11: MIT-SHM unavailable: %v", err)
+	}
+	if err := damage.Init(x); err != nil {
+		return nil, fmt.Errorf("x11: DAMAGE unavailable: %v", err)
+	}
+	if _, err := damage.QueryVersion(x, 1, 1).Reply(); err != nil {
+		return nil, err
+	}
+
+	screen := xproto.Setup(x).DefaultScreen(x)
+	if screen.RootDepth != 24 && screen.RootDepth != 32 {
+		return nil, fmt.Errorf("x11: unsupported root depth %d", screen.RootDepth)
+	}
+	s := &Source{
+		Interval: DefaultInterval,
+		x:        x,
+		root:     screen.Root,
+		width:    int(screen.WidthInPixels),
+		height:   int(screen.HeightInPixels),
+		first:    true,
+	}
+
+	size := s.width * s.height * 4
+	id, err := unix.SysvShmGet(unix.IPC_PRIVATE, size, unix.IPC_CREAT|0600)
+	if err != nil {
+		return nil, fmt.Errorf("x11: shmget: %v", err)
+	}
+	s.shmid = id
+	if s.mem, err = unix.SysvShmAttach(id, 0, 0); err != nil {
+		unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+		return nil, fmt.Errorf("x11: shmat: %v", err)
+	}
+	if s.seg, err = shm.NewSegId(x); err == nil {
+		err = shm.AttachChecked(x, s.seg, uint32(id), false).Check()
+	}
+	// Mark the segment for removal right away; it's destroyed once both
+	// we and the X server have detached.
+	unix.SysvShmCtl(id, unix.IPC_RMID, nil)
+	if err != nil {
+		unix.SysvShmDetach(s.mem)
+		return nil, fmt.Errorf("x11: attaching shared memory: %v", err)
+	}
+
+	if s.dmg, err = damage.NewDamageId(x); err == nil {
+		err = damage.CreateChecked(x, s.dmg, xproto.Drawable(s.root), damage.ReportLevelRawRectangles).Check()
+	}
+	if err != nil {
+		// Open closes the connection.
+		shm.Detach(x, s.seg)
+		unix.SysvShmDetach(s.mem)
+		return nil, fmt.Errorf("x11: creating damage object: %v", err)
+	}
+
+	s.frame = image.NewRGBA(image.Rect(0, 0, s.width, s.height))
+	return s, nil
+}
+
+// Bounds returns the size of the X screen.
+func (s *Source) Bounds() image.Rectangle {
+	return image.Rect(0, 0, s.width, s.height)
+}
+
+// NextFrame blocks until the X server reports damage and returns the
+// framebuffer with the damaged regions refreshed. The first call returns
+// the complete screen.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wait := time.Until(s.next); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.next = time.Now().Add(s.Interval)
+
+	var rects []image.Rectangle
+	if s.first {
+		s.first = false
+		rects = []image.Rectangle{s.Bounds()}
+		s.drainDamage() // everything's fresh anyway
+	} else {
+		var err error
+		if rects, err = s.waitDamage(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range rects {
+		if err := s.grab(r); err != nil {
+			return nil, err
+		}
+	}
+	return &rfb.LockableImage{Img: s.frame, Damage: rects}, nil
+}
+
+// waitDamage blocks for the first damage event and collects the ones
+// queued behind it.
+func (s *Source) waitDamage() ([]image.Rectangle, error) {
+	ev, err := s.x.WaitForEvent()
+	for {
+		if ev == nil && err == nil {
+			return nil, errors.New("x11: connection closed")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rects := s.addDamage(nil, ev); rects != nil {
+			return append(rects, s.drainDamage()...), nil
+		}
+		ev, err = s.x.WaitForEvent()
+	}
+}
+
+// drainDamage returns the damage of all events already queued.
+func (s *Source) drainDamage() []image.Rectangle {
+	var rects []image.Rectangle
+	for {
+		ev, err := s.x.PollForEvent()
+		if ev == nil && err == nil {
+			return rects
+		}
+		if ev != nil {
+			rects = s.addDamage(rects, ev)
+		}
+	}
+}
+
+func (s *Source) addDamage(rects []image.Rectangle, ev xgb.Event) []image.Rectangle {
+	n, ok := ev.(damage.NotifyEvent)
+	if !ok || n.Damage != s.dmg {
+		return rects
+	}
+	a := n.Area
+	r := image.Rect(int(a.X), int(a.Y), int(a.X)+int(a.Width), int(a.Y)+int(a.Height))
+	r = r.Intersect(s.Bounds())
+	if r.Empty() {
+		return rects
+	}
+	return append(rects, r)
+}
+
+// grab copies r from the screen into the framebuffer.
+func (s *Source) grab(r image.Rectangle) error {
+	_, err := shm.GetImage(s.x, xproto.Drawable(s.root),
+		int16(r.Min.X), int16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy()),
+		0xffffffff, xproto.ImageFormatZPixmap, s.seg, 0).Reply()
+	if err != nil {
+		return err
+	}
+
+	// The segment now holds r as tightly packed BGRX rows.
+	w := r.Dx()
+	for y := 0; y < r.Dy(); y++ {
+		src := s.mem[y*w*4 : (y+1)*w*4]
+		off := s.frame.PixOffset(r.Min.X, r.Min.Y+y)
+		dst := s.frame.Pix[off : off+w*4]
+		for i := 0; i < len(src); i += 4 {
+			dst[i+0] = src[i+2]
+			dst[i+1] = src[i+1]
+			dst[i+2] = src[i+0]
+			dst[i+3] = 0xff
+		}
+	}
+	return nil
+}
+
+// Close releases the X resources and closes the connection.
+func (s *Source) Close() error {
+	if s.dmg != 0 {
+		damage.Destroy(s.x, s.dmg)
+	}
+	shm.Detach(s.x, s.seg)
+	s.x.Close()
+	return unix.SysvShmDetach(s.mem)
+}
@@ -0,0 +1,1486 @@
+package rfb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// Server -> Client
+	cmdSetColourMapEntries = 1
+	cmdBell                = 2
+	cmdServerCutText       = 3
+)
+
+// ClientConfig configures a client connection.
+type ClientConfig struct {
+	// Exclusive asks the server to disconnect other clients.
+	Exclusive bool
+
+	// Password is used for RSA-AES or VNC Authentication if the server
+	// doesn't offer None.
+	Password string
+
+	// User is the user name sent with Password to servers asking for one
+	// in RSA-AES.
+	User string
+
+	// PixelFormat, if set, is requested from the server instead of using
+	// the server's native format. It must be a true-colour format.
+	PixelFormat *PixelFormat
+
+	// Encodings lists the encodings to announce, in order of preference.
+	// The default is CopyRect, ZRLE, Tight, Hextile, Raw and the
+	// pseudo-encodings the client supports. The client fails on
+	// receiving an encoding it can't decode.
+	Encodings []int32
+
+	// H264Decoder, if set, decodes Open H.264 rectangles. The encoding
+	// has to be announced in Encodings.
+	H264Decoder H264Decoder
+
+	// RequestInterval is the minimum time between two framebuffer
+	// update requests. By default, the next update is requested as soon
+	// as one arrives.
+	RequestInterval time.Duration
+
+	// OnUpdate, if set, is called from the receiving goroutine after
+	// each framebuffer update.
+	OnUpdate func(UpdateStats)
+
+	// OnCutText, if set, is called from the receiving goroutine with
+	// the server's clipboard text.
+	OnCutText func(string)
+
+	// OnBell, if set, is called from the receiving goroutine when the
+	// server rings the bell.
+	OnBell func()
+
+	// OnCursor, if set, is called from the receiving goroutine with the
+	// pointer shape the server sends with the CursorWithAlpha, VMware
+	// cursor, RichCursor or XCursor pseudo-encoding, which has to be
+	// announced in Encodings. img is nil for a hidden pointer.
+	OnCursor func(img *image.RGBA, hotspot image.Point)
+
+	// OnPointerPos, if set, is called from the receiving goroutine with
+	// the pointer position the server sets with the PointerPos
+	// pseudo-encoding, which has to be announced in Encodings.
+	OnPointerPos func(p image.Point)
+}
+
+// An H264Decoder decodes a client's H.264 stream.
+type H264Decoder interface {
+	// Decode decodes the next piece of the stream, which starts a new
+	// stream if reset is set, and returns the resulting frame.
+	Decode(data []byte, reset bool) (image.Image, error)
+}
+
+// UpdateStats describes a received framebuffer update.
+type UpdateStats struct {
+	Rects   int           // number of rectangles, including pseudo-encodings
+	Bytes   int64         // size of the message on the wire
+	Latency time.Duration // time since the update was requested
+
+	// Damage lists the framebuffer regions the update changed.
+	Damage []image.Rectangle
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// ClientConn is the client side of an RFB connection. It keeps a copy of
+// the remote framebuffer that is updated continuously.
+type ClientConn struct {
+	c      net.Conn
+	config ClientConfig
+	cr     *countingReader
+	br     *bufio.Reader
+
+	wmu sync.Mutex // guards bw
+	bw  *bufio.Writer
+
+	name   string // guarded by mu once connected
+	format PixelFormat
+
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled on framebuffer updates and errors
+	fb       *image.RGBA
+	err      error // why the connection ended
+	serial   int   // incremented with every update
+	buttons  uint8
+	pointer  image.Point
+	screens  []Screen // the layout sent with ExtendedDesktopSize
+	relative bool     // the server asked for relative pointer movements
+	extended bool     // the server confirmed extended mouse buttons
+
+	authenticated bool // the handshake sent credentials
+
+	requested time.Time // when the last update request was sent; guarded by wmu
+	lastRect  bool      // whether LastRect was announced; guarded by mu
+
+	zin  bytes.Buffer  // compressed ZRLE data not yet inflated
+	zrle io.ReadCloser // the ZRLE zlib stream, once it started
+
+	tin   [4]bytes.Buffer  // compressed Tight data not yet inflated
+	tight [4]io.ReadCloser // the Tight zlib streams, once they started
+}
+
+// Dial connects to the RFB server at address and performs the handshake.
+func Dial(network, address string, config *ClientConfig) (*ClientConn, error) {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := NewClientConn(c, config)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// NewClientConn performs the client handshake on c and starts receiving
+// framebuffer updates. The None, VNC Authentication and RSA-AES
+// security types are supported.
+func NewClientConn(c net.Conn, config *ClientConfig) (*ClientConn, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+	cc := &ClientConn{
+		c:      c,
+		config: *config,
+		cr:     &countingReader{r: c},
+		bw:     bufio.NewWriter(c),
+	}
+	cc.br = bufio.NewReader(cc.cr)
+	cc.cond = sync.NewCond(&cc.mu)
+	if err := cc.handshake(config); err != nil {
+		return nil, err
+	}
+	go cc.readLoop()
+	return cc, nil
+}
+
+func (cc *ClientConn) w(v interface{}) {
+	binary.Write(cc.bw, binary.BigEndian, v)
+}
+
+func (cc *ClientConn) read(v interface{}) error {
+	return binary.Read(cc.br, binary.BigEndian, v)
+}
+
+// readString reads a u32 length followed by that many bytes.
+func (cc *ClientConn) readString() (string, error) {
+	var n uint32
+	if err := cc.read(&n); err != nil {
+		return "", err
+	}
+	return cc.readText(n)
+}
+
+// readText reads a string of n bytes.
+func (cc *ClientConn) readText(n uint32) (string, error) {
+	if n > 1<<20 {
+		return "", fmt.Errorf("rfb: string of %d bytes from server", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(cc.br, b)
+	return string(b), err
+}
+
+// authVNC answers the server's VNC Authentication challenge.
+func (cc *ClientConn) authVNC(password string) error {
+	challenge := make([]byte, 16)
+	if _, err := io.ReadFull(cc.br, challenge); err != nil {
+		return err
+	}
+	cc.bw.Write(vncAuthResponse(password, challenge))
+	cc.authenticated = true
+	return cc.bw.Flush()
+}
+
+func (cc *ClientConn) handshake(config *ClientConfig) error {
+	sl, err := cc.br.ReadSlice('\n')
+	if err != nil {
+		return fmt.Errorf("rfb: reading server protocol version: %v", err)
+	}
+	ver := string(sl)
+	switch {
+	case ver == v3 || ver == v7 || ver == v8:
+	case len(ver) == len(v8) && ver > v8:
+		ver = v8
+	default:
+		return fmt.Errorf("rfb: unsupported server protocol version %q", ver)
+	}
+	cc.bw.WriteString(ver)
+	if err := cc.bw.Flush(); err != nil {
+		return err
+	}
+
+	if ver >= v7 {
+		var n uint8
+		if err := cc.read(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			reason, _ := cc.readString()
+			return fmt.Errorf("rfb: server refused connection: %s", reason)
+		}
+		types := make([]byte, n)
+		if _, err := io.ReadFull(cc.br, types); err != nil {
+			return err
+		}
+		t := uint8(authNone)
+		if bytes.IndexByte(types, authNone) < 0 {
+			t = 0
+			if config.Password != "" {
+				for _, pref := range append(slices.Clone(ra2Types), authVNC) {
+					if bytes.IndexByte(types, pref) >= 0 {
+						t = pref
+						break
+					}
+				}
+			}
+			if t == 0 {
+				return fmt.Errorf("rfb: server doesn't offer security type None (offers %v)", types)
+			}
+		}
+		cc.w(t)
+		if err := cc.bw.Flush(); err != nil {
+			return err
+		}
+		switch {
+		case t == authVNC:
+			if err := cc.authVNC(config.Password); err != nil {
+				return err
+			}
+		case slices.Contains(ra2Types, t):
+			if err := cc.authRSAAES(t, config.User, config.Password); err != nil {
+				return err
+			}
+		}
+	} else {
+		var t uint32
+		if err := cc.read(&t); err != nil {
+			return err
+		}
+		if t == 0 {
+			reason, _ := cc.readString()
+			return fmt.Errorf("rfb: server refused connection: %s", reason)
+		}
+		switch {
+		case t == authVNC && config.Password != "":
+			if err := cc.authVNC(config.Password); err != nil {
+				return err
+			}
+		case t != authNone:
+			return fmt.Errorf("rfb: server wants security type %d, not None", t)
+		}
+	}
+
+	if ver >= v8 || cc.authenticated {
+		var status uint32
+		if err := cc.read(&status); err != nil {
+			return err
+		}
+		if status != statusOK {
+			reason := "wrong password"
+			if ver >= v8 {
+				reason, _ = cc.readString()
+			}
+			return fmt.Errorf("rfb: authentication failed: %s", reason)
+		}
+	}
+
+	// ClientInit
+	shared := uint8(1)
+	if config.Exclusive {
+		shared = 0
+	}
+	cc.w(shared)
+	if err := cc.bw.Flush(); err != nil {
+		return err
+	}
+
+	// ServerInit
+	var init struct {
+		Width, Height uint16
+		Format        PixelFormat
+		Pad           [3]uint8
+	}
+	if err := cc.read(&init); err != nil {
+		return err
+	}
+	if cc.name, err = cc.readString(); err != nil {
+		return err
+	}
+	cc.fb = image.NewRGBA(image.Rect(0, 0, int(init.Width), int(init.Height)))
+	cc.format = init.Format
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if f := config.PixelFormat; f != nil {
+		cc.format = *f
+		cc.w(uint8(cmdSetPixelFormat))
+		cc.w([3]uint8{}) // padding
+		cc.w(f)
+		cc.w([3]uint8{}) // padding
+	}
+	if cc.format.TrueColour == 0 {
+		return errors.New("rfb: colour map pixel formats aren't supported")
+	}
+	switch cc.format.BPP {
+	case 8, 16, 32:
+	default:
+		return fmt.Errorf("rfb: unsupported pixel format with %d bits per pixel", cc.format.BPP)
+	}
+
+	encodings := config.Encodings
+	if len(encodings) == 0 {
+		encodings = []int32{encodingCopyRect, encodingZRLE, encodingTight, encodingHextile, encodingRaw, encodingExtendedDesktopSize, encodingDesktopSize, encodingLastRect, encodingDesktopName}
+	}
+	cc.writeSetEncodings(encodings)
+	cc.writeUpdateRequest(false)
+	return cc.bw.Flush()
+}
+
+// SetEncodings announces a new list of encodings, for instance to ask
+// for another compression level. The server uses it for the updates it
+// sends after receiving it.
+func (cc *ClientConn) SetEncodings(encodings []int32) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.writeSetEncodings(encodings)
+	return cc.bw.Flush()
+}
+
+// writeSetEncodings announces encodings. The caller must hold cc.wmu.
+func (cc *ClientConn) writeSetEncodings(encodings []int32) {
+	cc.w(uint8(cmdSetEncodings))
+	cc.w(uint8(0)) // padding
+	cc.w(uint16(len(encodings)))
+	cc.w(encodings)
+	cc.mu.Lock()
+	cc.lastRect = slices.Contains(encodings, encodingLastRect)
+	cc.mu.Unlock()
+}
+
+// writeUpdateRequest asks for the whole framebuffer. The caller must hold
+// cc.wmu.
+func (cc *ClientConn) writeUpdateRequest(incremental bool) {
+	cc.mu.Lock()
+	b := cc.fb.Bounds()
+	cc.mu.Unlock()
+	inc := uint8(0)
+	if incremental {
+		inc = 1
+	}
+	cc.w(uint8(cmdFramebufferUpdateRequest))
+	cc.w(inc)
+	cc.w(uint16(0))
+	cc.w(uint16(0))
+	cc.w(uint16(b.Dx()))
+	cc.w(uint16(b.Dy()))
+	cc.requested = time.Now()
+}
+
+// Name returns the desktop name announced by the server, or the last
+// one it sent with the DesktopName pseudo-encoding.
+func (cc *ClientConn) Name() string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.name
+}
+
+// Bounds returns the size of the remote framebuffer.
+func (cc *ClientConn) Bounds() image.Rectangle {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.fb.Bounds()
+}
+
+// Screens returns the monitor layout of the remote desktop, if the
+// server sent one with the ExtendedDesktopSize pseudo-encoding.
+func (cc *ClientConn) Screens() []Screen {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return slices.Clone(cc.screens)
+}
+
+// RelativePointer reports whether the server asked for relative pointer
+// movements, to be sent with MovePointer, with QEMU's Pointer Motion
+// Change pseudo-encoding.
+func (cc *ClientConn) RelativePointer() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.relative
+}
+
+// ExtendedMouseButtons reports whether the server confirmed the
+// ExtendedMouseButtons pseudo-encoding (-316), which has to be in
+// ClientConfig.Encodings, so ExtendedPointerEvent sends all buttons.
+func (cc *ClientConn) ExtendedMouseButtons() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.extended
+}
+
+// SetDesktopSize asks the server to resize the framebuffer to w×h with
+// the given monitor layout, or a single screen if nil. If the server
+// agrees, Bounds and Screens change with a later update.
+func (cc *ClientConn) SetDesktopSize(w, h int, screens []Screen) error {
+	if screens == nil {
+		screens = []Screen{{Rect: image.Rect(0, 0, w, h)}}
+	}
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.w(uint8(cmdSetDesktopSize))
+	cc.w(uint8(0)) // padding
+	cc.w(uint16(w))
+	cc.w(uint16(h))
+	cc.w(uint8(len(screens)))
+	cc.w(uint8(0)) // padding
+	for _, sc := range screens {
+		cc.w(sc.ID)
+		cc.w(uint16(sc.Rect.Min.X))
+		cc.w(uint16(sc.Rect.Min.Y))
+		cc.w(uint16(sc.Rect.Dx()))
+		cc.w(uint16(sc.Rect.Dy()))
+		cc.w(sc.Flags)
+	}
+	return cc.bw.Flush()
+}
+
+// Close closes the connection.
+func (cc *ClientConn) Close() error {
+	return cc.c.Close()
+}
+
+// Err returns why the connection ended, or nil while it's alive.
+func (cc *ClientConn) Err() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err
+}
+
+func (cc *ClientConn) readLoop() {
+	var err error
+	for err == nil {
+		var cmd uint8
+		if err = cc.read(&cmd); err != nil {
+			break
+		}
+		switch cmd {
+		case cmdFramebufferUpdate:
+			if err = cc.readUpdate(); err == nil {
+				err = cc.requestUpdate()
+			}
+		case cmdSetColourMapEntries:
+			var hdr struct {
+				Pad          uint8
+				First, Count uint16
+			}
+			if err = cc.read(&hdr); err == nil {
+				_, err = cc.br.Discard(int(hdr.Count) * 6)
+			}
+		case cmdBell:
+			if cc.config.OnBell != nil {
+				cc.config.OnBell()
+			}
+		case cmdServerCutText:
+			var text string
+			var n int32
+			if _, err = cc.br.Discard(3); err == nil {
+				err = cc.read(&n)
+			}
+			if err == nil && n < 0 {
+				// Extended Clipboard, which isn't announced.
+				_, err = cc.br.Discard(int(-n))
+				break
+			}
+			if err == nil {
+				text, err = cc.readText(uint32(n))
+			}
+			if err == nil && cc.config.OnCutText != nil {
+				cc.config.OnCutText(latin1ToUTF8(text))
+			}
+		default:
+			err = fmt.Errorf("rfb: unsupported message type %d from server", cmd)
+		}
+	}
+	if err == io.EOF {
+		err = errors.New("rfb: connection closed by server")
+	}
+	cc.mu.Lock()
+	cc.err = err
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+	cc.c.Close()
+}
+
+// requestUpdate asks for the next incremental update, waiting for the
+// request interval to pass first.
+func (cc *ClientConn) requestUpdate() error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if wait := time.Until(cc.requested.Add(cc.config.RequestInterval)); wait > 0 {
+		time.Sleep(wait)
+	}
+	cc.writeUpdateRequest(true)
+	return cc.bw.Flush()
+}
+
+func (cc *ClientConn) readUpdate() error {
+	start := cc.cr.n - int64(cc.br.Buffered()) - 1 // the message type was read already
+	var hdr struct {
+		Pad   uint8
+		Count uint16
+	}
+	if err := cc.read(&hdr); err != nil {
+		return err
+	}
+	var damage []image.Rectangle
+	count := int(hdr.Count)
+	cc.mu.Lock()
+	lastRect := cc.lastRect
+	cc.mu.Unlock()
+	if count == 0xffff && lastRect {
+		count = math.MaxInt // until LastRect
+	}
+	n := 0 // rectangles read
+rects:
+	for ; n < count; n++ {
+		var r struct {
+			X, Y, W, H uint16
+			Encoding   int32
+		}
+		if err := cc.read(&r); err != nil {
+			return err
+		}
+		rect := image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.W), int(r.Y)+int(r.H))
+		switch r.Encoding {
+		case encodingRaw:
+			if err := cc.readRaw(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingZRLE:
+			if err := cc.readZRLE(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingOpenH264:
+			if err := cc.readH264(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingTight, encodingTightPNG:
+			if err := cc.readTight(rect, r.Encoding == encodingTightPNG); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingCoRRE:
+			if err := cc.readCoRRE(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingHextile:
+			if err := cc.readHextile(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingCopyRect:
+			if err := cc.readCopyRect(rect); err != nil {
+				return err
+			}
+			damage = append(damage, rect)
+		case encodingRichCursor:
+			if err := cc.readCursor(rect); err != nil {
+				return err
+			}
+		case encodingXCursor:
+			if err := cc.readXCursor(rect); err != nil {
+				return err
+			}
+		case encodingCursorWithAlpha:
+			if err := cc.readAlphaCursor(rect); err != nil {
+				return err
+			}
+		case encodingVMwareCursor:
+			if err := cc.readVMwareCursor(rect); err != nil {
+				return err
+			}
+		case encodingPointerPos:
+			if cc.config.OnPointerPos != nil {
+				cc.config.OnPointerPos(rect.Min)
+			}
+		case encodingQEMUExtendedKeyEvent:
+			// acknowledgement without payload
+		case encodingLastRect:
+			n++
+			break rects
+		case encodingDesktopSize:
+			cc.resize(rect.Size())
+		case encodingExtendedMouseButtons:
+			cc.mu.Lock()
+			cc.extended = true
+			cc.mu.Unlock()
+		case encodingQEMUPointerMotion:
+			cc.mu.Lock()
+			cc.relative = r.X == 0
+			cc.mu.Unlock()
+		case encodingDesktopName:
+			name, err := cc.readString()
+			if err != nil {
+				return err
+			}
+			cc.mu.Lock()
+			cc.name = name
+			cc.mu.Unlock()
+		case encodingExtendedDesktopSize:
+			var n struct {
+				Screens uint8
+				Pad     [3]uint8
+			}
+			if err := cc.read(&n); err != nil {
+				return err
+			}
+			screens := make([]Screen, n.Screens)
+			for i := range screens {
+				var sc struct {
+					ID         uint32
+					X, Y, W, H uint16
+					Flags      uint32
+				}
+				if err := cc.read(&sc); err != nil {
+					return err
+				}
+				screens[i] = Screen{
+					ID:    sc.ID,
+					Rect:  image.Rect(int(sc.X), int(sc.Y), int(sc.X)+int(sc.W), int(sc.Y)+int(sc.H)),
+					Flags: sc.Flags,
+				}
+			}
+			if r.Y == 0 { // status: no error
+				cc.resize(rect.Size())
+				cc.mu.Lock()
+				cc.screens = screens
+				cc.mu.Unlock()
+			}
+		default:
+			return fmt.Errorf("rfb: unsupported encoding %d from server", r.Encoding)
+		}
+	}
+	cc.mu.Lock()
+	cc.serial++
+	cc.cond.Broadcast()
+	cc.mu.Unlock()
+
+	if cc.config.OnUpdate != nil {
+		cc.wmu.Lock()
+		latency := time.Since(cc.requested)
+		cc.wmu.Unlock()
+		cc.config.OnUpdate(UpdateStats{
+			Rects:   n,
+			Bytes:   cc.cr.n - int64(cc.br.Buffered()) - start,
+			Latency: latency,
+			Damage:  damage,
+		})
+	}
+	return nil
+}
+
+// latin1ToUTF8 decodes s, which is in ISO 8859-1.
+func latin1ToUTF8(s string) string {
+	r := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
+
+// resize replaces the framebuffer with an empty one of the given size.
+func (cc *ClientConn) resize(size image.Point) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.fb.Rect.Size() == size {
+		return
+	}
+	cc.fb = image.NewRGBA(image.Rectangle{Max: size})
+}
+
+func (cc *ClientConn) readRaw(r image.Rectangle) error {
+	bpp := int(cc.format.BPP) / 8
+	buf := make([]byte, r.Dx()*bpp)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !r.In(cc.fb.Rect) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if _, err := io.ReadFull(cc.br, buf); err != nil {
+			return err
+		}
+		off := cc.fb.PixOffset(r.Min.X, y)
+		row := cc.fb.Pix[off : off+r.Dx()*4]
+		for x := 0; x < r.Dx(); x++ {
+			cc.format.decode(row[x*4:x*4+4], buf[x*bpp:x*bpp+bpp])
+		}
+	}
+	return nil
+}
+
+// readCursor reads a RichCursor pseudo-rectangle: the pointer shape r,
+// positioned at its hotspot, as pixels and a bitmask of those shown.
+func (cc *ClientConn) readCursor(r image.Rectangle) error {
+	w, h := r.Dx(), r.Dy()
+	bpp := int(cc.format.BPP) / 8
+	stride := (w + 7) / 8
+	buf := make([]byte, w*h*bpp+stride*h)
+	if _, err := io.ReadFull(cc.br, buf); err != nil {
+		return err
+	}
+	if cc.config.OnCursor == nil {
+		return nil
+	}
+	if w == 0 || h == 0 {
+		cc.config.OnCursor(nil, r.Min)
+		return nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	mask := buf[w*h*bpp:]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if mask[y*stride+x/8]&(0x80>>(x%8)) == 0 {
+				continue
+			}
+			i := y*w + x
+			cc.format.decode(img.Pix[4*i:4*i+4], buf[i*bpp:i*bpp+bpp])
+		}
+	}
+	cc.config.OnCursor(img, r.Min)
+	return nil
+}
+
+// readXCursor reads an XCursor pseudo-rectangle: the pointer shape r,
+// positioned at its hotspot, as two colours, a bitmap choosing between
+// them and a bitmask of the pixels shown.
+func (cc *ClientConn) readXCursor(r image.Rectangle) error {
+	w, h := r.Dx(), r.Dy()
+	if w == 0 || h == 0 {
+		if cc.config.OnCursor != nil {
+			cc.config.OnCursor(nil, r.Min)
+		}
+		return nil
+	}
+	stride := (w + 7) / 8
+	buf := make([]byte, 6+2*stride*h)
+	if _, err := io.ReadFull(cc.br, buf); err != nil {
+		return err
+	}
+	if cc.config.OnCursor == nil {
+		return nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	bitmap, mask := buf[6:6+stride*h], buf[6+stride*h:]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			bit := byte(0x80 >> (x % 8))
+			if mask[y*stride+x/8]&bit == 0 {
+				continue
+			}
+			col := buf[3:6] // background
+			if bitmap[y*stride+x/8]&bit != 0 {
+				col = buf[0:3]
+			}
+			copy(img.Pix[img.PixOffset(x, y):], []byte{col[0], col[1], col[2], 0xff})
+		}
+	}
+	cc.config.OnCursor(img, r.Min)
+	return nil
+}
+
+// readAlphaCursor reads a CursorWithAlpha pseudo-rectangle: the pointer
+// shape r, positioned at its hotspot, as 8 bit RGBA pixels with
+// premultiplied alpha, in Raw encoding.
+func (cc *ClientConn) readAlphaCursor(r image.Rectangle) error {
+	var enc int32
+	if err := cc.read(&enc); err != nil {
+		return err
+	}
+	if enc != encodingRaw {
+		return fmt.Errorf("rfb: unsupported encoding %d for the pointer shape", enc)
+	}
+	img := image.NewRGBA(image.Rectangle{Max: r.Size()})
+	if _, err := io.ReadFull(cc.br, img.Pix); err != nil {
+		return err
+	}
+	if cc.config.OnCursor != nil {
+		if img.Rect.Empty() {
+			img = nil
+		}
+		cc.config.OnCursor(img, r.Min)
+	}
+	return nil
+}
+
+// readVMwareCursor reads a VMware cursor pseudo-rectangle: the pointer
+// shape r, positioned at its hotspot, as 8 bit RGBA pixels for an alpha
+// cursor, or as AND and XOR masks in the pixel format for a classic one.
+// Pixels a classic cursor inverts are left transparent.
+func (cc *ClientConn) readVMwareCursor(r image.Rectangle) error {
+	var hdr struct{ Type, Pad uint8 }
+	if err := cc.read(&hdr); err != nil {
+		return err
+	}
+	w, h := r.Dx(), r.Dy()
+	var n int
+	switch hdr.Type {
+	case vmwareClassic:
+		n = 2 * w * h * int(cc.format.BPP) / 8
+	case vmwareAlpha:
+		n = 4 * w * h
+	default:
+		return fmt.Errorf("rfb: unsupported VMware cursor type %d", hdr.Type)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cc.br, buf); err != nil {
+		return err
+	}
+	if cc.config.OnCursor == nil {
+		return nil
+	}
+	if w == 0 || h == 0 {
+		cc.config.OnCursor(nil, r.Min)
+		return nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if hdr.Type == vmwareAlpha {
+		for i := 0; i < len(buf); i += 4 {
+			c := color.RGBAModel.Convert(color.NRGBA{buf[i], buf[i+1], buf[i+2], buf[i+3]}).(color.RGBA)
+			copy(img.Pix[i:], []byte{c.R, c.G, c.B, c.A})
+		}
+	} else {
+		bpp := int(cc.format.BPP) / 8
+		and, xor := buf[:w*h*bpp], buf[w*h*bpp:]
+		for i := 0; i < w*h; i++ {
+			if slices.ContainsFunc(and[i*bpp:i*bpp+bpp], func(b byte) bool { return b != 0 }) {
+				continue // transparent or inverted
+			}
+			cc.format.decode(img.Pix[4*i:4*i+4], xor[i*bpp:i*bpp+bpp])
+		}
+	}
+	cc.config.OnCursor(img, r.Min)
+	return nil
+}
+
+func (cc *ClientConn) readCopyRect(r image.Rectangle) error {
+	var src struct{ X, Y uint16 }
+	if err := cc.read(&src); err != nil {
+		return err
+	}
+	sr := r.Add(image.Pt(int(src.X), int(src.Y)).Sub(r.Min))
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !r.In(cc.fb.Rect) || !sr.In(cc.fb.Rect) {
+		return fmt.Errorf("rfb: copy from %v to %v outside of framebuffer", sr, r)
+	}
+	// Rows are copied away from the direction of the move, so that
+	// overlapping regions work out; copy handles overlap within a row.
+	n := r.Dx() * 4
+	for i := 0; i < r.Dy(); i++ {
+		y := i
+		if sr.Min.Y < r.Min.Y {
+			y = r.Dy() - 1 - i
+		}
+		dst := cc.fb.PixOffset(r.Min.X, r.Min.Y+y)
+		from := cc.fb.PixOffset(sr.Min.X, sr.Min.Y+y)
+		copy(cc.fb.Pix[dst:dst+n], cc.fb.Pix[from:from+n])
+	}
+	return nil
+}
+
+func (cc *ClientConn) readCoRRE(r image.Rectangle) error {
+	if !r.In(cc.fb.Bounds()) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	var n uint32
+	if err := cc.read(&n); err != nil {
+		return err
+	}
+	buf := make([]byte, int(cc.format.BPP/8)+4)
+	var col [4]byte
+	if _, err := io.ReadFull(cc.br, buf[:cc.format.BPP/8]); err != nil {
+		return err
+	}
+	cc.format.decode(col[:], buf[:cc.format.BPP/8])
+	cc.fill(r, col)
+	for range n {
+		if _, err := io.ReadFull(cc.br, buf); err != nil {
+			return err
+		}
+		cc.format.decode(col[:], buf[:cc.format.BPP/8])
+		xywh := buf[cc.format.BPP/8:]
+		sr := image.Rect(int(xywh[0]), int(xywh[1]), int(xywh[0])+int(xywh[2]), int(xywh[1])+int(xywh[3])).Add(r.Min)
+		if !sr.In(r) {
+			return fmt.Errorf("rfb: CoRRE subrectangle %v outside of rectangle %v", sr, r)
+		}
+		cc.fill(sr, col)
+	}
+	return nil
+}
+
+func (cc *ClientConn) readHextile(r image.Rectangle) error {
+	if !r.In(cc.fb.Bounds()) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	buf := make([]byte, cc.format.BPP/8)
+	readPixel := func(dst *[4]byte) error {
+		if _, err := io.ReadFull(cc.br, buf); err != nil {
+			return err
+		}
+		cc.format.decode(dst[:], buf)
+		return nil
+	}
+	var bg, fg [4]byte
+	for ty := r.Min.Y; ty < r.Max.Y; ty += 16 {
+		for tx := r.Min.X; tx < r.Max.X; tx += 16 {
+			t := image.Rect(tx, ty, min(tx+16, r.Max.X), min(ty+16, r.Max.Y))
+			mask, err := cc.br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if mask&hextileRaw != 0 {
+				if err := cc.readRaw(t); err != nil {
+					return err
+				}
+				continue
+			}
+			if mask&hextileBackgroundSpecified != 0 {
+				if err := readPixel(&bg); err != nil {
+					return err
+				}
+			}
+			if mask&hextileForegroundSpecified != 0 {
+				if err := readPixel(&fg); err != nil {
+					return err
+				}
+			}
+			cc.fill(t, bg)
+			if mask&hextileAnySubrects == 0 {
+				continue
+			}
+			n, err := cc.br.ReadByte()
+			if err != nil {
+				return err
+			}
+			for range n {
+				col := fg
+				if mask&hextileSubrectsColoured != 0 {
+					if err := readPixel(&col); err != nil {
+						return err
+					}
+				}
+				var xywh [2]byte
+				if _, err := io.ReadFull(cc.br, xywh[:]); err != nil {
+					return err
+				}
+				x, y := int(xywh[0]>>4), int(xywh[0]&15)
+				w, h := int(xywh[1]>>4)+1, int(xywh[1]&15)+1
+				sr := image.Rect(x, y, x+w, y+h).Add(t.Min)
+				if !sr.In(t) {
+					return fmt.Errorf("rfb: hextile subrectangle %v outside of tile %v", sr, t)
+				}
+				cc.fill(sr, col)
+			}
+		}
+	}
+	return nil
+}
+
+func (cc *ClientConn) readZRLE(r image.Rectangle) error {
+	if !r.In(cc.fb.Bounds()) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	var n uint32
+	if err := cc.read(&n); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(&cc.zin, cc.br, int64(n)); err != nil {
+		return err
+	}
+	if cc.zrle == nil {
+		zr, err := zlib.NewReader(&cc.zin)
+		if err != nil {
+			return err
+		}
+		cc.zrle = zr
+	}
+	zr := cc.zrle
+
+	size, off := cc.format.cpixel()
+	pix := make([]byte, cc.format.BPP/8)
+	readPixel := func() (col [4]byte, err error) {
+		if _, err := io.ReadFull(zr, pix[off:off+size]); err != nil {
+			return col, err
+		}
+		cc.format.decode(col[:], pix)
+		return col, nil
+	}
+	readByte := func() (byte, error) {
+		var b [1]byte
+		_, err := io.ReadFull(zr, b[:])
+		return b[0], err
+	}
+	readRunLength := func() (int, error) {
+		n := 1
+		for {
+			b, err := readByte()
+			if err != nil {
+				return 0, err
+			}
+			n += int(b)
+			if b != 255 {
+				return n, nil
+			}
+		}
+	}
+
+	tile := make([][4]byte, 0, zrleTileSize*zrleTileSize)
+	var pal [][4]byte
+	for ty := r.Min.Y; ty < r.Max.Y; ty += zrleTileSize {
+		for tx := r.Min.X; tx < r.Max.X; tx += zrleTileSize {
+			t := image.Rect(tx, ty, min(tx+zrleTileSize, r.Max.X), min(ty+zrleTileSize, r.Max.Y))
+			w, h := t.Dx(), t.Dy()
+			sub, err := readByte()
+			if err != nil {
+				return err
+			}
+			pal = pal[:0]
+			if n := int(sub &^ zrleRLE); sub != zrleRaw && sub != zrleRLE {
+				if n > maxPaletteSize || sub < zrleRLE && n > 16 {
+					return fmt.Errorf("rfb: bad ZRLE subencoding %d", sub)
+				}
+				for range n {
+					col, err := readPixel()
+					if err != nil {
+						return err
+					}
+					pal = append(pal, col)
+				}
+			}
+			tile = tile[:0]
+			switch {
+			case sub == zrleSolid:
+				for range w * h {
+					tile = append(tile, pal[0])
+				}
+			case sub == zrleRaw:
+				for range w * h {
+					col, err := readPixel()
+					if err != nil {
+						return err
+					}
+					tile = append(tile, col)
+				}
+			case sub == zrleRLE:
+				for len(tile) < w*h {
+					col, err := readPixel()
+					if err != nil {
+						return err
+					}
+					n, err := readRunLength()
+					if err != nil {
+						return err
+					}
+					for range n {
+						tile = append(tile, col)
+					}
+				}
+			case sub > zrleRLE:
+				for len(tile) < w*h {
+					i, err := readByte()
+					if err != nil {
+						return err
+					}
+					n := 1
+					if i&128 != 0 {
+						if n, err = readRunLength(); err != nil {
+							return err
+						}
+						i &^= 128
+					}
+					if int(i) >= len(pal) {
+						return fmt.Errorf("rfb: ZRLE palette index %d out of range", i)
+					}
+					for range n {
+						tile = append(tile, pal[i])
+					}
+				}
+			default: // packed palette
+				bits := 4
+				if len(pal) <= 2 {
+					bits = 1
+				} else if len(pal) <= 4 {
+					bits = 2
+				}
+				row := make([]byte, (w*bits+7)/8)
+				for range h {
+					if _, err := io.ReadFull(zr, row); err != nil {
+						return err
+					}
+					for x := range w {
+						bit := x * bits
+						i := row[bit/8] >> (8 - bits - bit%8) & (1<<bits - 1)
+						if int(i) >= len(pal) {
+							return fmt.Errorf("rfb: ZRLE palette index %d out of range", i)
+						}
+						tile = append(tile, pal[i])
+					}
+				}
+			}
+			if len(tile) != w*h {
+				return errors.New("rfb: ZRLE run beyond the end of a tile")
+			}
+			cc.mu.Lock()
+			for y := range h {
+				p := cc.fb.PixOffset(t.Min.X, t.Min.Y+y)
+				for x, col := range tile[y*w : y*w+w] {
+					copy(cc.fb.Pix[p+4*x:], col[:])
+				}
+			}
+			cc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (cc *ClientConn) readTight(r image.Rectangle, isPNG bool) error {
+	if !r.In(cc.fb.Bounds()) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	ctrl, err := cc.br.ReadByte()
+	if err != nil {
+		return err
+	}
+	for i := range cc.tight {
+		if ctrl&(1<<i) != 0 {
+			cc.tin[i].Reset()
+			cc.tight[i] = nil
+		}
+	}
+
+	psize := int(cc.format.BPP / 8)
+	if cc.format.tpixel() {
+		psize = 3
+	}
+	decode := func(col []byte, pix []byte) {
+		if psize == 3 {
+			col[0], col[1], col[2], col[3] = pix[0], pix[1], pix[2], 0xff
+			return
+		}
+		cc.format.decode(col, pix)
+	}
+
+	w, h := r.Dx(), r.Dy()
+	switch ctrl >> 4 {
+	case tightFill >> 4:
+		pix := make([]byte, psize)
+		if _, err := io.ReadFull(cc.br, pix); err != nil {
+			return err
+		}
+		var col [4]byte
+		decode(col[:], pix)
+		cc.fill(r, col)
+		return nil
+	case tightJPEG >> 4, tightPNG >> 4:
+		if ctrl>>4 == tightPNG>>4 && !isPNG {
+			break
+		}
+		n, err := cc.readCompactLength()
+		if err != nil {
+			return err
+		}
+		decode := jpeg.Decode
+		if ctrl>>4 == tightPNG>>4 {
+			decode = png.Decode
+		}
+		img, err := decode(io.LimitReader(cc.br, int64(n)))
+		if err != nil {
+			return err
+		}
+		if img.Bounds().Size() != r.Size() {
+			return fmt.Errorf("rfb: Tight image of size %v for rectangle %v", img.Bounds().Size(), r)
+		}
+		cc.mu.Lock()
+		draw.Draw(cc.fb, r, img, img.Bounds().Min, draw.Src)
+		cc.mu.Unlock()
+		return nil
+	}
+	if ctrl>>4 > tightJPEG>>4 || isPNG {
+		// TightPNG has no basic compression.
+		return fmt.Errorf("rfb: bad Tight compression control %#x", ctrl)
+	}
+
+	stream := int(ctrl>>4) & 3
+	filter := byte(tightFilterCopy)
+	if ctrl&tightExplicitFilter != 0 {
+		if filter, err = cc.br.ReadByte(); err != nil {
+			return err
+		}
+	}
+	var pal [][4]byte
+	var size int // of the data after filtering
+	switch filter {
+	case tightFilterCopy:
+		size = w * h * psize
+	case tightFilterPalette:
+		n, err := cc.br.ReadByte()
+		if err != nil {
+			return err
+		}
+		pix := make([]byte, psize)
+		for range int(n) + 1 {
+			if _, err := io.ReadFull(cc.br, pix); err != nil {
+				return err
+			}
+			var col [4]byte
+			decode(col[:], pix)
+			pal = append(pal, col)
+		}
+		if len(pal) == 2 {
+			size = (w + 7) / 8 * h
+		} else {
+			size = w * h
+		}
+	default:
+		return fmt.Errorf("rfb: unsupported Tight filter %d", filter)
+	}
+
+	data := make([]byte, size)
+	if size < tightMinToCompress {
+		if _, err := io.ReadFull(cc.br, data); err != nil {
+			return err
+		}
+	} else {
+		n, err := cc.readCompactLength()
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(&cc.tin[stream], cc.br, int64(n)); err != nil {
+			return err
+		}
+		if cc.tight[stream] == nil {
+			zr, err := zlib.NewReader(&cc.tin[stream])
+			if err != nil {
+				return err
+			}
+			cc.tight[stream] = zr
+		}
+		if _, err := io.ReadFull(cc.tight[stream], data); err != nil {
+			return err
+		}
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for y := range h {
+		p := cc.fb.PixOffset(r.Min.X, r.Min.Y+y)
+		for x := range w {
+			dst := cc.fb.Pix[p+4*x : p+4*x+4]
+			switch {
+			case pal == nil:
+				i := (y*w + x) * psize
+				decode(dst, data[i:i+psize])
+				continue
+			case len(pal) == 2:
+				i := data[y*((w+7)/8)+x/8] >> (7 - x%8) & 1
+				copy(dst, pal[i][:])
+			default:
+				i := data[y*w+x]
+				if int(i) >= len(pal) {
+					return fmt.Errorf("rfb: Tight palette index %d out of range", i)
+				}
+				copy(dst, pal[i][:])
+			}
+		}
+	}
+	return nil
+}
+
+func (cc *ClientConn) readH264(r image.Rectangle) error {
+	if !r.In(cc.fb.Bounds()) {
+		return fmt.Errorf("rfb: rectangle %v outside of framebuffer", r)
+	}
+	var hdr struct{ Length, Flags uint32 }
+	if err := cc.read(&hdr); err != nil {
+		return err
+	}
+	data := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(cc.br, data); err != nil {
+		return err
+	}
+	if cc.config.H264Decoder == nil {
+		return errors.New("rfb: Open H.264 rectangle without an H264Decoder")
+	}
+	img, err := cc.config.H264Decoder.Decode(data, hdr.Flags&(h264ResetContext|h264ResetAllContext) != 0)
+	if err != nil {
+		return err
+	}
+	if img.Bounds().Size() != r.Size() {
+		return fmt.Errorf("rfb: H.264 frame of size %v for rectangle %v", img.Bounds().Size(), r)
+	}
+	cc.mu.Lock()
+	draw.Draw(cc.fb, r, img, img.Bounds().Min, draw.Src)
+	cc.mu.Unlock()
+	return nil
+}
+
+// readCompactLength reads a length in Tight's compact representation.
+func (cc *ClientConn) readCompactLength() (int, error) {
+	n := 0
+	for i := 0; i < 3; i++ {
+		b, err := cc.br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			n |= int(b) << 14
+			break
+		}
+		n |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return n, nil
+}
+
+// fill sets r of the framebuffer to col.
+func (cc *ClientConn) fill(r image.Rectangle, col [4]byte) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := cc.fb.Pix[cc.fb.PixOffset(r.Min.X, y):cc.fb.PixOffset(r.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			copy(row[i:i+4], col[:])
+		}
+	}
+}
+
+// decode converts the pixel in src to RGBA in dst.
+func (f *PixelFormat) decode(dst, src []byte) {
+	var p uint32
+	for i, b := range src {
+		if f.BigEndian != 0 {
+			p = p<<8 | uint32(b)
+		} else {
+			p |= uint32(b) << (8 * uint(i))
+		}
+	}
+	dst[0] = scale8(p>>f.RedShift, f.RedMax)
+	dst[1] = scale8(p>>f.GreenShift, f.GreenMax)
+	dst[2] = scale8(p>>f.BlueShift, f.BlueMax)
+	dst[3] = 0xff
+}
+
+// scale8 scales the channel value v&max to 0..255.
+func scale8(v uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	return uint8((v & uint32(max)) * 0xff / uint32(max))
+}
+
+// KeyEvent presses (down) or releases a key.
+func (cc *ClientConn) KeyEvent(key uint32, down bool) error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	flag := uint8(0)
+	if down {
+		flag = 1
+	}
+	cc.w(uint8(cmdKeyEvent))
+	cc.w(flag)
+	cc.w(uint16(0)) // padding
+	cc.w(key)
+	return cc.bw.Flush()
+}
+
+// MovePointer moves the pointer by dx, dy with the given buttons
+// pressed, for servers that asked for relative movements; see
+// RelativePointer.
+func (cc *ClientConn) MovePointer(buttons uint8, dx, dy int) error {
+	cc.mu.Lock()
+	cc.buttons = buttons
+	cc.mu.Unlock()
+
+	return cc.writePointer(buttons, 0, relativeOffset+dx, relativeOffset+dy)
+}
+
+// PointerEvent moves the pointer to (x, y) with the given buttons
+// pressed.
+func (cc *ClientConn) PointerEvent(buttons uint8, x, y int) error {
+	return cc.ExtendedPointerEvent(buttons, 0, x, y)
+}
+
+// ExtendedPointerEvent is PointerEvent with the buttons from 9 up in ext,
+// as in PointerEvent.ExtButtonMask. Servers that didn't confirm the
+// ExtendedMouseButtons pseudo-encoding don't get them.
+func (cc *ClientConn) ExtendedPointerEvent(buttons, ext uint8, x, y int) error {
+	cc.mu.Lock()
+	cc.buttons = buttons
+	cc.pointer = image.Pt(x, y)
+	cc.mu.Unlock()
+	return cc.writePointer(buttons, ext, x, y)
+}
+
+// writePointer sends a pointer event, in the extended form if the server
+// confirmed it and a button from 8 up is pressed.
+func (cc *ClientConn) writePointer(buttons, ext uint8, x, y int) error {
+	cc.mu.Lock()
+	extended := cc.extended
+	cc.mu.Unlock()
+
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	cc.w(uint8(cmdPointerEvent))
+	all := uint16(buttons) | uint16(ext)<<8
+	if extended && all>>7 != 0 {
+		cc.w(uint8(all&0x7f | 0x80))
+	} else {
+		cc.w(buttons)
+	}
+	cc.w(uint16(x))
+	cc.w(uint16(y))
+	if extended && all>>7 != 0 {
+		cc.w(uint8(all >> 7))
+	}
+	return cc.bw.Flush()
+}
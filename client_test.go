@@ -0,0 +1,403 @@
+package rfb_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+// chanSource is a FrameSource returning the frames sent on it.
+type chanSource struct {
+	bounds image.Rectangle
+	frames chan *rfb.LockableImage
+}
+
+func (s *chanSource) Bounds() image.Rectangle { return s.bounds }
+
+func (s *chanSource) NextFrame() (*rfb.LockableImage, error) {
+	return <-s.frames, nil
+}
+
+// startServer serves w×h frames from the returned source and connects a
+// client to it.
+func startServer(t *testing.T, w, h int) (*rfb.ClientConn, *rfb.Conn, *chanSource) {
+	return startServerConfig(t, w, h, nil)
+}
+
+// startServerConfig is startServer with a client configuration.
+func startServerConfig(t *testing.T, w, h int, config *rfb.ClientConfig) (*rfb.ClientConn, *rfb.Conn, *chanSource) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := rfb.NewServer(w, h)
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, w, h), frames: make(chan *rfb.LockableImage, 1)}
+	connc := make(chan *rfb.Conn)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return cc, <-connc, src
+}
+
+func solid(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestClientFramebuffer(t *testing.T) {
+	cc, _, src := startServer(t, 100, 80)
+	if got := cc.Bounds(); got != image.Rect(0, 0, 100, 80) {
+		t.Fatalf("Bounds() = %v", got)
+	}
+
+	// The server sends 16 bit colour, so stick to values that survive
+	// the conversion.
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(100, 80, blue)}
+	if err := cc.WaitForPixel(image.Pt(50, 40), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	next := solid(100, 80, blue)
+	next.Set(70, 10, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	src.frames <- &rfb.LockableImage{Img: next}
+	if err := cc.WaitForImage(next.Rect, next, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cc.WaitForPixel(image.Pt(0, 0), color.Black, 100*time.Millisecond); err == nil {
+		t.Error("WaitForPixel succeeded for a colour that isn't there")
+	}
+}
+
+func TestClientInput(t *testing.T) {
+	cc, c, _ := startServer(t, 32, 32)
+
+	if err := cc.TypeString("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.Click(5, 6, rfb.ButtonRight); err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{
+		rfb.KeyEvent{DownFlag: 1, Key: 'a'},
+		rfb.KeyEvent{DownFlag: 0, Key: 'a'},
+		rfb.PointerEvent{ButtonMask: 0, X: 5, Y: 6},
+		rfb.PointerEvent{ButtonMask: rfb.ButtonRight, X: 5, Y: 6},
+		rfb.PointerEvent{ButtonMask: 0, X: 5, Y: 6},
+	}
+	for i, w := range want {
+		select {
+		case e := <-c.Event:
+			if e != w {
+				t.Errorf("event %d = %#v; want %#v", i, e, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for event %d", i)
+		}
+	}
+}
+
+func TestClientResize(t *testing.T) {
+	cc, _, src := startServer(t, 32, 32)
+
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, blue)}
+	if err := cc.WaitForPixel(image.Pt(5, 5), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(48, 40, red)}
+	if err := cc.WaitForPixel(image.Pt(47, 39), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cc.Bounds(), image.Rect(0, 0, 48, 40); got != want {
+		t.Errorf("Bounds() = %v; want %v", got, want)
+	}
+}
+
+func TestClientConnResize(t *testing.T) {
+	cc, c, src := startServer(t, 32, 32)
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, blue)}
+	if err := cc.WaitForPixel(image.Pt(5, 5), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The frames keep their size; the client is resized regardless, and
+	// gets them cropped.
+	c.Resize(64, 48)
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, blue)}
+	for deadline := time.Now().Add(5 * time.Second); cc.Bounds() != image.Rect(0, 0, 64, 48); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Bounds() = %v; want 64×48", cc.Bounds())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := cc.WaitForPixel(image.Pt(5, 5), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.Screenshot().RGBAAt(50, 40); got != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("pixel outside the frame = %v; want black", got)
+	}
+
+	// Back to following the frames.
+	c.Resize(0, 0)
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, red)}
+	if err := cc.WaitForPixel(image.Pt(5, 5), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cc.Bounds(), image.Rect(0, 0, 32, 32); got != want {
+		t.Errorf("Bounds() = %v; want %v", got, want)
+	}
+}
+
+func TestClientScreens(t *testing.T) {
+	cc, c, src := startServer(t, 64, 32)
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(64, 32, blue)}
+	if err := cc.WaitForPixel(image.Pt(5, 5), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cc.Screens(), []rfb.Screen{{Rect: image.Rect(0, 0, 64, 32)}}; !slices.Equal(got, want) {
+		t.Errorf("initial layout %v; want %v", got, want)
+	}
+
+	// Two monitors side by side, the second reaching past the
+	// framebuffer. The layout goes out without a frame, and the
+	// framebuffer stays.
+	c.SetScreens([]rfb.Screen{
+		{ID: 1, Rect: image.Rect(0, 0, 32, 32)},
+		{ID: 2, Rect: image.Rect(32, 0, 80, 32), Flags: 7},
+	})
+	want := []rfb.Screen{
+		{ID: 1, Rect: image.Rect(0, 0, 32, 32)},
+		{ID: 2, Rect: image.Rect(32, 0, 64, 32), Flags: 7},
+	}
+	for deadline := time.Now().Add(5 * time.Second); !slices.Equal(cc.Screens(), want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("layout %v; want %v", cc.Screens(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := cc.Screenshot().RGBAAt(5, 5); got != blue {
+		t.Errorf("pixel = %v after the layout change; want %v", got, blue)
+	}
+}
+
+func TestClientSetDesktopSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(32, 32)
+	s.DesktopSizeRequests = true
+	go s.Serve(ln)
+	src := &chanSource{bounds: image.Rect(0, 0, 32, 32), frames: make(chan *rfb.LockableImage, 1)}
+	connc := make(chan *rfb.Conn)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, blue)}
+	if err := cc.WaitForPixel(image.Pt(5, 5), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(w, h int, screens []rfb.Screen) rfb.DesktopSizeRequest {
+		t.Helper()
+		if err := cc.SetDesktopSize(w, h, screens); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			select {
+			case e := <-c.Event:
+				if req, ok := e.(rfb.DesktopSizeRequest); ok {
+					return req
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for the request")
+			}
+		}
+	}
+
+	// Refused: the framebuffer stays.
+	request(64, 64, nil).Reject(rfb.DesktopSizeProhibited)
+	src.frames <- &rfb.LockableImage{Img: solid(32, 32, blue)}
+	if err := cc.WaitForUpdate(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.Bounds(); got != image.Rect(0, 0, 32, 32) {
+		t.Fatalf("Bounds() = %v after a rejection", got)
+	}
+
+	// Accepted: the client is resized, and the frames follow.
+	screens := []rfb.Screen{
+		{ID: 1, Rect: image.Rect(0, 0, 24, 40)},
+		{ID: 2, Rect: image.Rect(24, 0, 48, 40)},
+	}
+	req := request(48, 40, screens)
+	if req.Width != 48 || req.Height != 40 || !slices.Equal(req.Screens, screens) {
+		t.Errorf("got request %+v", req)
+	}
+	req.Accept()
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(48, 40, red)}
+	if err := cc.WaitForPixel(image.Pt(47, 39), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.Bounds(); got != image.Rect(0, 0, 48, 40) {
+		t.Errorf("Bounds() = %v; want 48×40", got)
+	}
+	if got := cc.Screens(); !slices.Equal(got, screens) {
+		t.Errorf("layout %v; want %v", got, screens)
+	}
+}
+
+func TestClientDesktopName(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.SetName("build farm")
+	go s.Serve(ln)
+	connc := make(chan *rfb.Conn)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		connc <- c
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+	if got := cc.Name(); got != "build farm" {
+		t.Errorf("Name() = %q after the handshake", got)
+	}
+
+	// Renames go out without a frame.
+	for _, tt := range []struct {
+		rename func()
+		want   string
+	}{
+		{func() { s.SetName("build farm 2") }, "build farm 2"},
+		{func() { c.SetName("alice on build farm") }, "alice on build farm"},
+		{func() { s.SetName("") }, "alice on build farm"},
+		{func() { c.SetName("") }, rfb.DefaultName},
+	} {
+		tt.rename()
+		for deadline := time.Now().Add(5 * time.Second); cc.Name() != tt.want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Name() = %q; want %q", cc.Name(), tt.want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestClientSizePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy rfb.SizePolicy
+		want   color.RGBA // at (20, 20) of the client's 32×32 framebuffer
+	}{
+		{rfb.Crop, color.RGBA{0, 0, 0, 0xff}},
+		{rfb.Scale, color.RGBA{0, 0, 0xff, 0xff}},
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := rfb.NewServer(32, 32)
+		s.SizePolicy = tt.policy
+		go s.Serve(ln)
+
+		// A 16×16 frame, half the client's size.
+		src := &chanSource{bounds: image.Rect(0, 0, 32, 32), frames: make(chan *rfb.LockableImage, 1)}
+		src.frames <- &rfb.LockableImage{Img: solid(16, 16, color.RGBA{0, 0, 0xff, 0xff})}
+		go func() {
+			c, _ := s.Accept(context.Background())
+			c.SetFrameSource(src)
+		}()
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		if err := cc.WaitForUpdate(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if got := cc.Bounds(); got != image.Rect(0, 0, 32, 32) {
+			t.Errorf("policy %d: client was resized to %v", tt.policy, got)
+		}
+		if got := cc.Screenshot().RGBAAt(20, 20); got != tt.want {
+			t.Errorf("policy %d: pixel = %v; want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestClientSwapFrameSource(t *testing.T) {
+	cc, c, login := startServer(t, 16, 16)
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	login.frames <- &rfb.LockableImage{Img: solid(16, 16, red)}
+	if err := cc.WaitForPixel(image.Pt(1, 1), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The login source has no more frames; the desktop takes over with
+	// another size. Its damage doesn't matter, the frame is sent in full.
+	desktop := &chanSource{bounds: image.Rect(0, 0, 32, 24), frames: make(chan *rfb.LockableImage, 1)}
+	c.SetFrameSource(desktop)
+	green := color.RGBA{0, 0xff, 0, 0xff}
+	desktop.frames <- &rfb.LockableImage{Img: solid(32, 24, green), Damage: []image.Rectangle{}}
+	if err := cc.WaitForPixel(image.Pt(20, 20), green, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.Bounds(); got != image.Rect(0, 0, 32, 24) {
+		t.Errorf("framebuffer is %v after the swap", got)
+	}
+	if err := cc.WaitForPixel(image.Pt(1, 1), green, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,66 @@
+package rfb
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// DefaultClipboardWindow is how long a ClipboardGuard remembers clipboard
+// contents.
+const DefaultClipboardWindow = 2 * time.Second
+
+// A ClipboardGuard keeps bidirectional clipboard sync with one peer from
+// looping. Text received from the peer is typically set on the local
+// clipboard, which reports it as changed, which would send it back to
+// the peer, and so on; rapid duplicate cut-text messages are also
+// common.
+//
+// The guard remembers a hash of every text that crossed it in either
+// direction for Window and refuses to let the same text cross again
+// within that time.
+type ClipboardGuard struct {
+	// Window is how long texts are remembered. If zero,
+	// DefaultClipboardWindow is used.
+	Window time.Duration
+
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]time.Time
+}
+
+// Send reports whether text, a new local clipboard content, should be
+// sent to the peer.
+func (g *ClipboardGuard) Send(text string) bool {
+	return g.pass(text)
+}
+
+// Receive reports whether text, received from the peer, should be set
+// on the local clipboard.
+func (g *ClipboardGuard) Receive(text string) bool {
+	return g.pass(text)
+}
+
+func (g *ClipboardGuard) pass(text string) bool {
+	sum := sha256.Sum256([]byte(text))
+	now := time.Now()
+	window := g.Window
+	if window == 0 {
+		window = DefaultClipboardWindow
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for h, t := range g.seen {
+		if now.Sub(t) >= window {
+			delete(g.seen, h)
+		}
+	}
+	if _, ok := g.seen[sum]; ok {
+		return false
+	}
+	if g.seen == nil {
+		g.seen = make(map[[sha256.Size]byte]time.Time)
+	}
+	g.seen[sum] = now
+	return true
+}
@@ -0,0 +1,197 @@
+package rfb_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestClipboardGuard(t *testing.T) {
+	g := &rfb.ClipboardGuard{Window: 50 * time.Millisecond}
+	if !g.Receive("hello") {
+		t.Fatal("new text from peer was refused")
+	}
+	if g.Send("hello") {
+		t.Error("text from peer was echoed back")
+	}
+	if g.Receive("hello") {
+		t.Error("duplicate text from peer was passed")
+	}
+	if !g.Send("world") {
+		t.Error("new local text was refused")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !g.Send("hello") {
+		t.Error("text was still refused after the window")
+	}
+}
+
+func TestServerExtendedClipboard(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	rawHandshake(t, nc)
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		text    = 1 << 0
+		caps    = 1 << 24
+		request = 1 << 25
+		notify  = 1 << 27
+		provide = 1 << 28
+	)
+	send := func(flags uint32, payload []byte) {
+		b := []byte{6, 0, 0, 0}
+		b = binary.BigEndian.AppendUint32(b, uint32(-4-len(payload)))
+		b = binary.BigEndian.AppendUint32(b, flags)
+		nc.Write(append(b, payload...))
+	}
+	recv := func() (flags uint32, payload []byte) {
+		t.Helper()
+		hdr := make([]byte, 12)
+		if _, err := io.ReadFull(nc, hdr); err != nil {
+			t.Fatal(err)
+		}
+		n := int32(binary.BigEndian.Uint32(hdr[4:]))
+		if hdr[0] != 3 || n > -4 {
+			t.Fatalf("got message %d of length %d; want an extended ServerCutText", hdr[0], n)
+		}
+		payload = make([]byte, -n-4)
+		if _, err := io.ReadFull(nc, payload); err != nil {
+			t.Fatal(err)
+		}
+		return binary.BigEndian.Uint32(hdr[8:]), payload
+	}
+	event := func(want string) {
+		t.Helper()
+		select {
+		case e := <-c.Event:
+			if e != (rfb.ClipboardEvent{Text: want}) {
+				t.Fatalf("got event %#v; want text %q", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no clipboard event")
+		}
+	}
+
+	nc.Write([]byte{2, 0, 0, 1, 0xc0, 0xa1, 0xe5, 0xce})
+	if flags, _ := recv(); flags&(caps|text) != caps|text {
+		t.Fatalf("got flags %#x; want the server's text caps", flags)
+	}
+	send(caps|text|request|notify|provide, binary.BigEndian.AppendUint32(nil, 1<<20))
+
+	// Plain ClientCutText is still Latin-1.
+	nc.Write([]byte{6, 0, 0, 0, 0, 0, 0, 4, 'c', 'a', 'f', 0xe9})
+	event("café")
+
+	if err := c.SetClipboard("héllo\n✓"); err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := recv(); flags != notify|text {
+		t.Fatalf("got flags %#x; want a text notify", flags)
+	}
+	send(request|text, nil)
+	flags, payload := recv()
+	if flags != provide|text {
+		t.Fatalf("got flags %#x; want a text provide", flags)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(zr)
+	if want := "\x00\x00\x00\x0chéllo\r\n✓\x00"; string(data) != want {
+		t.Errorf("got provided %q; want %q", data, want)
+	}
+
+	// SendCutText provides the text without a notify.
+	if err := c.SendCutText("now"); err != nil {
+		t.Fatal(err)
+	}
+	if flags, _ := recv(); flags != provide|text {
+		t.Fatalf("got flags %#x; want a text provide", flags)
+	}
+
+	send(notify|text, nil)
+	if flags, _ := recv(); flags != request|text {
+		t.Fatalf("got flags %#x; want a text request", flags)
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte("\x00\x00\x00\x09wörld\r\n\x00"))
+	zw.Close()
+	send(provide|text, buf.Bytes())
+	event("wörld\n")
+}
+
+func TestServerSetClipboard(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	go s.Serve(ln)
+
+	var texts [2]chan string
+	for i := range texts {
+		texts[i] = make(chan string, 16)
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+			OnCutText: func(text string) { texts[i] <- text },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+	}
+	s.SetClipboard("first")
+	s.SetClipboard("second")
+	for i, ch := range texts {
+		// The first text may be skipped, but never arrive last.
+		for text := ""; text != "second"; {
+			select {
+			case text = <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("client %d didn't get the clipboard", i)
+			}
+		}
+		select {
+		case text := <-ch:
+			t.Errorf("client %d got %q after the latest text", i, text)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	s.SendCutText("third")
+	for i, ch := range texts {
+		select {
+		case text := <-ch:
+			if text != "third" {
+				t.Errorf("client %d got %q; want %q", i, text, "third")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client %d didn't get the cut text", i)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Command rfbbench load-tests an RFB server with many concurrent
+// headless viewers.
+//
+// Usage:
+//
+//	rfbbench -addr localhost:5900 -sessions 50 -duration 30s -inputRate 20
+//
+// The -latency, -jitter, -bandwidth and -loss flags simulate a slow
+// network between the viewers and the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/patdhlk/rfb/loadtest"
+	"github.com/patdhlk/rfb/netsim"
+)
+
+var (
+	addr            = flag.String("addr", "localhost:5900", "server address")
+	sessions        = flag.Int("sessions", 10, "number of concurrent sessions")
+	duration        = flag.Duration("duration", 10e9, "how long to run")
+	encodings       = flag.String("encodings", "raw", "comma-separated encodings to announce, by name or number")
+	requestInterval = flag.Duration("requestInterval", 0, "minimum time between update requests per session")
+	inputRate       = flag.Float64("inputRate", 0, "pointer events per second per session")
+	latency         = flag.Duration("latency", 0, "simulated one-way network latency")
+	jitter          = flag.Duration("jitter", 0, "simulated random extra latency, up to this much")
+	bandwidth       = flag.Int("bandwidth", 0, "simulated bandwidth per session and direction, in bytes per second")
+	loss            = flag.Float64("loss", 0, "simulated probability of a lost packet, from 0 to 1")
+)
+
+var encodingNames = map[string]int32{
+	"raw": 0,
+}
+
+func parseEncodings(s string) ([]int32, error) {
+	var encs []int32
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if e, ok := encodingNames[strings.ToLower(f)]; ok {
+			encs = append(encs, e)
+			continue
+		}
+		e, err := strconv.ParseInt(f, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unknown encoding %q", f)
+		}
+		encs = append(encs, int32(e))
+	}
+	return encs, nil
+}
+
+func main() {
+	flag.Parse()
+
+	encs, err := parseEncodings(*encodings)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var network *netsim.Conditions
+	if *latency > 0 || *jitter > 0 || *bandwidth > 0 || *loss > 0 {
+		network = &netsim.Conditions{
+			Latency:   *latency,
+			Jitter:    *jitter,
+			Bandwidth: *bandwidth,
+			Loss:      *loss,
+		}
+	}
+
+	r, err := loadtest.Run(ctx, loadtest.Config{
+		Addr:            *addr,
+		Sessions:        *sessions,
+		Duration:        *duration,
+		Encodings:       encs,
+		RequestInterval: *requestInterval,
+		InputRate:       *inputRate,
+		Network:         network,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(r)
+	for _, err := range r.Errors {
+		log.Printf("session failed: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package rfb
+
+// Clients asking for a colour-map pixel format get a fixed palette of
+// the 216 web-safe colours: six levels of red, green and blue, with the
+// pixel value (red*6 + green)*6 + blue. As the palette is fixed, pixels
+// are computed like true-colour ones, without a search for the nearest
+// colour.
+const colourMapLevels = 6
+
+// colourMapSize is the number of colours in the palette.
+const colourMapSize = colourMapLevels * colourMapLevels * colourMapLevels
+
+// colourMapFormat returns the format to use for a client asking for the
+// colour-map format pf, whose channel maximums and shifts are
+// meaningless; they're set to the palette's levels, so that the
+// channels fit pf's bits per pixel.
+func colourMapFormat(pf PixelFormat) PixelFormat {
+	pf.Depth = 8
+	pf.RedMax, pf.GreenMax, pf.BlueMax = colourMapLevels-1, colourMapLevels-1, colourMapLevels-1
+	pf.RedShift, pf.GreenShift, pf.BlueShift = 0, 0, 0
+	return pf
+}
+
+// pushColourMapLocked sends the palette with a SetColourMapEntries
+// message if the client uses a colour-map format and hasn't got it since
+// it asked for the format. It goes before any pixels in that format.
+// c.mu must be held.
+func (c *Conn) pushColourMapLocked() {
+	if c.format.TrueColour != 0 || c.colourMapSent {
+		return
+	}
+	c.w(uint8(cmdSetColourMapEntries))
+	c.w(uint8(0))  // padding
+	c.w(uint16(0)) // first colour
+	c.w(uint16(colourMapSize))
+	for i := range colourMapSize {
+		c.w(colourMapEntry(uint32(i)))
+	}
+	c.colourMapSent = true
+}
+
+// colourMapEntry returns the red, green and blue of palette entry v,
+// with 16 bits per channel.
+func colourMapEntry(v uint32) [3]uint16 {
+	var rgb [3]uint16
+	for i, level := range [3]uint32{v / (colourMapLevels * colourMapLevels), v / colourMapLevels % colourMapLevels, v % colourMapLevels} {
+		rgb[i] = uint16(level * 0xffff / (colourMapLevels - 1))
+	}
+	return rgb
+}
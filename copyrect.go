@@ -0,0 +1,58 @@
+package rfb
+
+import "image"
+
+// clipMoves clips the moves' destinations to bounds, shrinking their
+// sources to match, and drops moves whose source lies outside bounds.
+func clipMoves(moves []Move, bounds image.Rectangle) []Move {
+	var mc []Move
+	for _, m := range moves {
+		dst := m.Dst.Intersect(bounds)
+		if dst.Empty() {
+			continue
+		}
+		src := m.Src.Add(dst.Min.Sub(m.Dst.Min))
+		if !(image.Rectangle{src, src.Add(dst.Size())}).In(bounds) {
+			continue
+		}
+		mc = append(mc, Move{Src: src, Dst: dst})
+	}
+	return mc
+}
+
+// pushCopyRectLocked sends m as a CopyRect rectangle. The client copies
+// the pixels from its own framebuffer, so moves have to go before any
+// rectangle that overwrites their source.
+func (c *Conn) pushCopyRectLocked(m Move) {
+	c.w(uint16(m.Dst.Min.X)) // x
+	c.w(uint16(m.Dst.Min.Y)) // y
+	c.w(uint16(m.Dst.Dx()))  // width
+	c.w(uint16(m.Dst.Dy()))  // height
+	c.w(int32(encodingCopyRect))
+	c.w(uint16(m.Src.X)) // src-x-position
+	c.w(uint16(m.Src.Y)) // src-y-position
+
+	pixels := int64(m.Dst.Dx() * m.Dst.Dy())
+	c.recordLocked(EncodingStats{
+		Encoding: encodingCopyRect,
+		Rects:    1,
+		Pixels:   pixels,
+		RawBytes: pixels * int64(c.format.BPP/8),
+		Bytes:    4,
+	})
+}
+
+// forgetTilesLocked drops the remembered hashes of the tiles the moves
+// write to, since the client's copy of them changes without the server
+// hashing it. c.mu must be held.
+func (c *Conn) forgetTilesLocked(moves []Move) {
+	size := c.s.tileSize()
+	for _, m := range moves {
+		r := m.Dst
+		for ty := r.Min.Y - r.Min.Y%size.Y; ty < r.Max.Y; ty += size.Y {
+			for tx := r.Min.X - r.Min.X%size.X; tx < r.Max.X; tx += size.X {
+				delete(c.tiles, image.Pt(tx, ty))
+			}
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// cursorOnly checks whether the changed tiles differ between old and new
+// only within areas, where the pointer was drawn in either frame. If so,
+// it returns the parts of areas within the changed tiles, which are all
+// the client needs.
+func cursorOnly(old, new image.Image, changed []image.Rectangle, areas ...image.Rectangle) ([]image.Rectangle, bool) {
+	areas = clipRects(areas, new.Bounds())
+	if len(areas) == 0 || len(changed) == 0 {
+		return nil, false
+	}
+	inArea := func(p image.Point) bool {
+		for _, a := range areas {
+			if p.In(a) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, t := range changed {
+		for y := t.Min.Y; y < t.Max.Y; y++ {
+			for x := t.Min.X; x < t.Max.X; x++ {
+				if !inArea(image.Pt(x, y)) && old.At(x, y) != new.At(x, y) {
+					return nil, false
+				}
+			}
+		}
+	}
+	var rc []image.Rectangle
+	for _, t := range changed {
+		rc = append(rc, clipRects(areas, t)...)
+	}
+	return rc, true
+}
+
+// cursorShape is the pointer shape set with Conn.SetCursor.
+type cursorShape struct {
+	img     *image.RGBA // nil for no shape, or a hidden pointer if set
+	hotspot image.Point
+	set     bool  // SetCursor was called
+	sent    int32 // the pseudo-encoding the client has it in, or 0
+}
+
+// SetCursor sets the pointer shape clients supporting the
+// CursorWithAlpha, VMware cursor, RichCursor or XCursor pseudo-encoding
+// draw themselves, so the pointer moves without framebuffer updates and
+// needn't be drawn into the frames. hotspot is the point of img,
+// relative to its top left corner, that's at the pointer position. A nil
+// img hides the pointer. The shape goes out with the next update, which
+// is sent at once if the client is waiting for one; clients supporting
+// none of the pseudo-encodings ignore it. The one keeping most of the
+// shape is used: RichCursor pixels are either transparent or opaque,
+// and XCursor has just the average colours of the dark and of the light
+// pixels.
+func (c *Conn) SetCursor(img image.Image, hotspot image.Point) {
+	var rgba *image.RGBA
+	if img != nil {
+		b := img.Bounds()
+		rgba = image.NewRGBA(image.Rectangle{Max: b.Size()})
+		draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	}
+	c.mu.Lock()
+	c.shape = cursorShape{img: rgba, hotspot: hotspot, set: true}
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// Types of VMware cursors.
+const (
+	vmwareClassic = 0 // AND and XOR masks in the client's pixel format
+	vmwareAlpha   = 1 // RGBA pixels
+)
+
+// pointerPos is the pointer position set with Conn.SetPointerPos.
+type pointerPos struct {
+	p       image.Point
+	pending bool // not sent yet
+}
+
+// SetPointerPos moves the pointer of clients supporting the PointerPos
+// pseudo-encoding, which draw it themselves, to p, for input that
+// originates on the server, as when mirroring a real desktop. Like the
+// shape set with SetCursor, the position goes out with the next update,
+// which is sent at once if the client is waiting for one; clients
+// without PointerPos support ignore it.
+func (c *Conn) SetPointerPos(p image.Point) {
+	c.mu.Lock()
+	c.pos = pointerPos{p: p, pending: true}
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// wakeShape wakes the update loop waiting for a frame, for an update
+// with just pseudo-rectangles, like those for the pointer shape.
+func (c *Conn) wakeShape() {
+	select {
+	case c.shapec <- struct{}{}:
+	default:
+	}
+}
+
+// pointerRectsLocked returns the number of pseudo-rectangles the next
+// update needs for the pointer shape, position, mode and extended
+// buttons. c.mu must be held.
+func (c *Conn) pointerRectsLocked() int {
+	n := 0
+	if c.cursorPendingLocked() {
+		n++
+	}
+	if c.pos.pending && c.supportsLocked(encodingPointerPos) {
+		n++
+	}
+	if c.motionPendingLocked() {
+		n++
+	}
+	if c.extButtonsPendingLocked() {
+		n++
+	}
+	return n
+}
+
+// pushPointerLocked writes the pseudo-rectangles counted by
+// pointerRectsLocked. c.mu must be held.
+func (c *Conn) pushPointerLocked() {
+	if c.cursorPendingLocked() {
+		c.pushCursorLocked()
+	}
+	if c.pos.pending && c.supportsLocked(encodingPointerPos) {
+		c.pos.pending = false
+		c.w(uint16(c.pos.p.X))
+		c.w(uint16(c.pos.p.Y))
+		c.w(uint16(0)) // width
+		c.w(uint16(0)) // height
+		c.w(int32(encodingPointerPos))
+	}
+	if c.motionPendingLocked() {
+		c.pushMotionLocked()
+	}
+	if c.extButtonsPendingLocked() {
+		c.pushExtButtonsLocked()
+	}
+}
+
+// cursorEncodingLocked returns the pseudo-encoding to send the pointer
+// shape with, the one keeping most of it, or 0 if the client supports
+// none. c.mu must be held.
+func (c *Conn) cursorEncodingLocked() int32 {
+	switch {
+	case c.supportsLocked(encodingCursorWithAlpha):
+		return encodingCursorWithAlpha
+	case c.supportsLocked(encodingVMwareCursor):
+		return encodingVMwareCursor
+	case c.supportsLocked(encodingRichCursor):
+		return encodingRichCursor
+	case c.supportsLocked(encodingXCursor):
+		return encodingXCursor
+	}
+	return 0
+}
+
+// cursorPendingLocked reports whether the next update should carry the
+// pointer shape, because the client doesn't have it or has it in
+// another pseudo-encoding than the one to use now. c.mu must be held.
+func (c *Conn) cursorPendingLocked() bool {
+	enc := c.cursorEncodingLocked()
+	return c.shape.set && enc != 0 && enc != c.shape.sent
+}
+
+// pushCursorLocked writes the pointer shape as a CursorWithAlpha, VMware
+// cursor, RichCursor or XCursor pseudo-rectangle. c.mu must be held.
+func (c *Conn) pushCursorLocked() {
+	enc := c.cursorEncodingLocked()
+	c.shape.sent = enc
+	img, hot := c.shape.img, c.shape.hotspot
+	var size image.Point
+	if img != nil {
+		size = img.Rect.Size()
+	}
+	c.w(uint16(hot.X))
+	c.w(uint16(hot.Y))
+	c.w(uint16(size.X))
+	c.w(uint16(size.Y))
+	c.w(enc)
+	switch {
+	case enc == encodingCursorWithAlpha:
+		// The encoding of the pixels, which are 8 bit RGBA with
+		// premultiplied alpha whatever the client's pixel format, as
+		// in img. It's there even for a hidden pointer.
+		c.w(int32(encodingRaw))
+		if img != nil {
+			c.bw.Write(img.Pix)
+		}
+		return
+	case enc == encodingVMwareCursor:
+		// An alpha cursor: 8 bit RGBA without premultiplied alpha.
+		c.w([2]uint8{vmwareAlpha, 0}) // type, padding
+		if img == nil {
+			return
+		}
+		c.buf8 = c.buf8[:0]
+		for i := 0; i < len(img.Pix); i += 4 {
+			nc := color.NRGBAModel.Convert(color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}).(color.NRGBA)
+			c.buf8 = append(c.buf8, nc.R, nc.G, nc.B, nc.A)
+		}
+		c.bw.Write(c.buf8)
+		return
+	case img == nil:
+		return
+	case enc == encodingXCursor:
+		c.pushXCursorLocked(img)
+		return
+	}
+	// RichCursor: the pixels in the client's format followed by the
+	// mask.
+	c.pixbuf = c.translateLocked(c.pixbuf[:0], img, img.Rect)
+	c.buf8 = c.buf8[:0]
+	for _, v := range c.pixbuf {
+		c.buf8 = c.format.appendPixel(c.buf8, v)
+	}
+	c.bw.Write(c.buf8)
+	c.bw.Write(cursorMask(img, func(r, g, b, a uint8) bool { return a >= 0x80 }))
+}
+
+// pushXCursorLocked writes the XCursor payload: the foreground and
+// background colour as 8 bit RGB, a bitmap of the pixels in the
+// foreground colour and the mask. The dark pixels are the foreground.
+// c.mu must be held.
+func (c *Conn) pushXCursorLocked(img *image.RGBA) {
+	shown := func(r, g, b, a uint8) bool { return a >= 0x80 }
+	dark := func(r, g, b, a uint8) bool { return shown(r, g, b, a) && luma(r, g, b) < 0x80 }
+	light := func(r, g, b, a uint8) bool { return shown(r, g, b, a) && !dark(r, g, b, a) }
+	fg, bg := averageColour(img, dark), averageColour(img, light)
+	c.bw.Write(fg[:])
+	c.bw.Write(bg[:])
+	c.bw.Write(cursorMask(img, dark))
+	c.bw.Write(cursorMask(img, shown))
+}
+
+// cursorMask returns a bitmap of the pixels of img matching f, a bit per
+// pixel with the most significant first and rows padded to a byte.
+func cursorMask(img *image.RGBA, f func(r, g, b, a uint8) bool) []byte {
+	size := img.Rect.Size()
+	stride := (size.X + 7) / 8
+	mask := make([]byte, stride*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			if f(p[0], p[1], p[2], p[3]) {
+				mask[y*stride+x/8] |= 0x80 >> (x % 8)
+			}
+		}
+	}
+	return mask
+}
+
+// averageColour returns the average colour of the pixels of img
+// matching f, or black if there are none.
+func averageColour(img *image.RGBA, f func(r, g, b, a uint8) bool) [3]uint8 {
+	var sum [3]int
+	n := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4]
+		if f(p[0], p[1], p[2], p[3]) {
+			sum[0] += int(p[0])
+			sum[1] += int(p[1])
+			sum[2] += int(p[2])
+			n++
+		}
+	}
+	if n == 0 {
+		return [3]uint8{}
+	}
+	return [3]uint8{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n)}
+}
+
+// luma returns the brightness of a colour.
+func luma(r, g, b uint8) int {
+	return (299*int(r) + 587*int(g) + 114*int(b)) / 1000
+}
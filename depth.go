@@ -0,0 +1,98 @@
+package rfb
+
+import "image"
+
+// A colourLimit reduces the pixels sent to a connection to fewer levels
+// per channel, so they compress better: palettes get smaller and runs
+// longer. The pixel format stays the client's.
+type colourLimit struct {
+	depth   int         // bits per pixel; 0 for no limit
+	format  PixelFormat // the format the tables are for
+	levels  [3][]uint32 // reduced red, green and blue values, by value; nil to keep a channel
+	current bool        // the tables match depth and format
+}
+
+// SetColourDepth limits the colours sent to the client to those of a
+// depth-bit format, like 8 for 256 colours, regardless of the pixel
+// format the client asked for. It trades fidelity for bandwidth on slow
+// links; the client's format only limits colours further. A depth of 0,
+// or 24 and more, removes the limit. The next update is sent in full,
+// in the new colours.
+func (c *Conn) SetColourDepth(depth int) {
+	if depth <= 0 || depth >= 24 {
+		depth = 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if depth == c.colour.depth {
+		return
+	}
+	c.colour.depth = depth
+	c.colour.current = false
+	c.tiles = nil    // hashed with the old colours
+	c.refresh = true // in the new colours
+}
+
+// channelBits returns the bits of red, green and blue in a format of the
+// given depth; green gets spare bits first, as in RGB565.
+func channelBits(depth int) [3]int {
+	b := depth / 3
+	bits := [3]int{b, b, b}
+	if depth%3 >= 1 {
+		bits[1]++
+	}
+	if depth%3 == 2 {
+		bits[0]++
+	}
+	return bits
+}
+
+// reduceLevels returns the table mapping the values 0 to max of a
+// channel to the nearest of 2^bits evenly spaced levels, or nil if the
+// channel has no more levels than that.
+func reduceLevels(max uint16, bits int) []uint32 {
+	n := uint32(1)<<bits - 1
+	m := uint32(max)
+	if m <= n {
+		return nil
+	}
+	t := make([]uint32, m+1)
+	for v := range t {
+		level := (uint32(v)*n + m/2) / m
+		t[v] = (level*m + n/2) / n
+	}
+	return t
+}
+
+// translateLocked appends the pixels of rect in img, in the client's
+// format and with its colour limit, which colour-map formats are
+// already within, to dst. c.mu must be held.
+func (c *Conn) translateLocked(dst []uint32, img image.Image, rect image.Rectangle) []uint32 {
+	start := len(dst)
+	dst = c.format.translate(dst, img, rect)
+	l := &c.colour
+	if l.depth == 0 || c.format.TrueColour == 0 {
+		return dst
+	}
+	f := &c.format
+	if !l.current || l.format != *f {
+		bits := channelBits(l.depth)
+		for i, max := range [3]uint16{f.RedMax, f.GreenMax, f.BlueMax} {
+			l.levels[i] = reduceLevels(max, bits[i])
+		}
+		l.format, l.current = *f, true
+	}
+	shifts := [3]uint8{f.RedShift, f.GreenShift, f.BlueShift}
+	maxes := [3]uint32{uint32(f.RedMax), uint32(f.GreenMax), uint32(f.BlueMax)}
+	for i, v := range dst[start:] {
+		for ch, t := range l.levels {
+			if t == nil {
+				continue
+			}
+			x := v >> shifts[ch] & maxes[ch]
+			v = v&^(maxes[ch]<<shifts[ch]) | t[x]<<shifts[ch]
+		}
+		dst[start+i] = v
+	}
+	return dst
+}
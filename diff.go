@@ -0,0 +1,58 @@
+package rfb
+
+import "image"
+
+// A Differ finds the regions that changed between two frames, for
+// incremental updates. Applications can supply their own through
+// Server.Differ, for instance to use damage from the capture API or a
+// diff computed on the GPU.
+type Differ interface {
+	// Diff returns the regions of new that differ from old, which the
+	// client has. hint is the frame's LockableImage.Damage, nil if the
+	// source reported none; moved regions aren't in it, as the server
+	// sends them itself. Diff is called concurrently for different
+	// connections, and the result is clipped to new's bounds.
+	Diff(old, new image.Image, hint []image.Rectangle) []image.Rectangle
+}
+
+// defaultTileSize is the tile size used if Server.TileSize is zero.
+var defaultTileSize = image.Pt(64, 64)
+
+// TileDiffer is the default Differ. It trusts the hint if there is one,
+// and otherwise compares the frames in tiles of Size, reporting the
+// tiles that changed.
+type TileDiffer struct {
+	Size image.Point // if zero, 64×64
+}
+
+func (d TileDiffer) Diff(old, new image.Image, hint []image.Rectangle) []image.Rectangle {
+	if hint != nil {
+		return hint
+	}
+	return compareImages(old, new, validTileSize(d.Size))
+}
+
+// differ returns the Differ to use.
+func (s *Server) differ() Differ {
+	if s.Differ != nil {
+		return s.Differ
+	}
+	return TileDiffer{Size: s.TileSize}
+}
+
+// tileSize returns the server's tile size.
+func (s *Server) tileSize() image.Point {
+	return validTileSize(s.TileSize)
+}
+
+// validTileSize returns size, or defaultTileSize's width or height
+// where size has none.
+func validTileSize(size image.Point) image.Point {
+	if size.X <= 0 {
+		size.X = defaultTileSize.X
+	}
+	if size.Y <= 0 {
+		size.Y = defaultTileSize.Y
+	}
+	return size
+}
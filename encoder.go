@@ -0,0 +1,234 @@
+package rfb
+
+import (
+	"cmp"
+	"errors"
+	"image"
+	"io"
+	"slices"
+	"sync"
+)
+
+// An Encoder sends rectangles in one encoding. Each connection gets its
+// own Encoders, created when first needed, so they may keep state from
+// one rectangle to the next, like a compression stream. Encode is only
+// called from the connection's sending goroutine, which holds the
+// connection's lock: it mustn't call the Conn's methods.
+type Encoder interface {
+	// Encode writes the payload of a rectangle holding rect of img, in
+	// pixel format pf, to w; the rectangle's header goes out before the
+	// first write. If Encode returns ErrFallback without writing, the
+	// rectangle is sent as Raw instead. Other errors end the connection.
+	Encode(w io.Writer, pf PixelFormat, img image.Image, rect image.Rectangle) error
+}
+
+// ErrFallback is returned by an Encoder that leaves a rectangle to Raw,
+// for instance because it wouldn't be any smaller.
+var ErrFallback = errors.New("rfb: encoder falls back to Raw")
+
+// A RectSplitter is an Encoder with limits on the rectangles it can
+// encode. SplitRects returns the rectangles to send to cover rects of a
+// frame with the given bounds.
+type RectSplitter interface {
+	Encoder
+	SplitRects(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle
+}
+
+// registeredEncoder is an encoding in the registry.
+type registeredEncoder struct {
+	name       string
+	newEncoder func(c *Conn) Encoder
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = builtinEncoders()
+)
+
+// RegisterEncoder makes encoding number enc available to clients that
+// announce it, under the given name. newEncoder is called for each
+// connection that uses the encoding. Registering a number again replaces
+// the earlier encoder, including the built-in ones.
+func RegisterEncoder(enc int32, name string, newEncoder func() Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[enc] = registeredEncoder{name, func(*Conn) Encoder { return newEncoder() }}
+}
+
+// registeredEncodings returns the registry's encodings, ordered by
+// number.
+func registeredEncodings() []Capability {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	var l []Capability
+	for enc, r := range encoders {
+		l = append(l, Capability{enc, r.name})
+	}
+	slices.SortFunc(l, func(a, b Capability) int { return cmp.Compare(a.Number, b.Number) })
+	return l
+}
+
+// builtinEncoder is an Encoder using a connection's own encoding state.
+type builtinEncoder struct {
+	encode    func(w io.Writer, img image.Image, rect image.Rectangle) error
+	split     func(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle
+	available func(bounds image.Rectangle) bool // nil means always
+}
+
+func (e *builtinEncoder) Encode(w io.Writer, pf PixelFormat, img image.Image, rect image.Rectangle) error {
+	return e.encode(w, img, rect)
+}
+
+func (e *builtinEncoder) SplitRects(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+	if e.split == nil {
+		return rects
+	}
+	return e.split(rects, bounds)
+}
+
+// builtinEncoders returns the registry of the encodings implemented in
+// this package.
+func builtinEncoders() map[int32]registeredEncoder {
+	payload := func(b []byte, w io.Writer) error {
+		if b == nil {
+			return ErrFallback
+		}
+		_, err := w.Write(b)
+		return err
+	}
+	tight := func(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+		return tileRects(splitRects(rects, tightMaxPixels), tightMaxWidth)
+	}
+	return map[int32]registeredEncoder{
+		encodingRaw: {"Raw", func(c *Conn) Encoder {
+			return &builtinEncoder{encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+				c.pushRawLocked(w, img, rect)
+				return nil
+			}}
+		}},
+		encodingCoRRE: {"CoRRE", func(c *Conn) Encoder {
+			return &builtinEncoder{
+				encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+					return payload(c.encodeCoRRELocked(img, rect), w)
+				},
+				split: func(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+					return tileRects(rects, maxCoRRESize)
+				},
+			}
+		}},
+		encodingHextile: {"Hextile", func(c *Conn) Encoder {
+			return &builtinEncoder{encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+				c.pushHextileLocked(w, img, rect)
+				return nil
+			}}
+		}},
+		encodingTight: {"Tight", func(c *Conn) Encoder {
+			return &builtinEncoder{
+				encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+					c.pushTightLocked(w, img, rect, false)
+					return nil
+				},
+				split: tight,
+			}
+		}},
+		encodingTightPNG: {"TightPNG", func(c *Conn) Encoder {
+			return &builtinEncoder{
+				encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+					c.pushTightLocked(w, img, rect, true)
+					return nil
+				},
+				split: tight,
+			}
+		}},
+		encodingZRLE: {"ZRLE", func(c *Conn) Encoder {
+			return &builtinEncoder{encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+				c.pushZRLELocked(w, img, rect)
+				return nil
+			}}
+		}},
+		encodingOpenH264: {"OpenH264", func(c *Conn) Encoder {
+			return &builtinEncoder{
+				encode: func(w io.Writer, img image.Image, rect image.Rectangle) error {
+					return payload(c.encodeH264Locked(img), w)
+				},
+				split: func(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+					// Video frames are always complete.
+					if len(rects) == 0 {
+						return nil
+					}
+					return []image.Rectangle{bounds}
+				},
+				available: c.h264AvailableLocked,
+			}
+		}},
+	}
+}
+
+// rectEncoderLocked returns the encoding for rectangles of frames with
+// the given bounds, the first in the client's SetEncodings list that's
+// registered and available, or Raw, and the connection's Encoder for
+// it. c.mu must be held.
+func (c *Conn) rectEncoderLocked(bounds image.Rectangle) (int32, Encoder) {
+	for _, enc := range c.encodings {
+		if e := c.usableEncoderLocked(enc, bounds); e != nil {
+			return enc, e
+		}
+	}
+	return encodingRaw, c.encoderLocked(encodingRaw)
+}
+
+// usableEncoderLocked returns the connection's Encoder for enc if it can
+// encode frames with the given bounds, or nil. c.mu must be held.
+func (c *Conn) usableEncoderLocked(enc int32, bounds image.Rectangle) Encoder {
+	e := c.encoderLocked(enc)
+	if b, ok := e.(*builtinEncoder); ok && b.available != nil && !b.available(bounds) {
+		return nil
+	}
+	return e
+}
+
+// encoderLocked returns the connection's Encoder for enc, or nil if the
+// encoding isn't registered. c.mu must be held.
+func (c *Conn) encoderLocked(enc int32) Encoder {
+	if e, ok := c.encoders[enc]; ok {
+		return e
+	}
+	encodersMu.RLock()
+	r, ok := encoders[enc]
+	encodersMu.RUnlock()
+	if !ok {
+		return nil
+	}
+	if c.encoders == nil {
+		c.encoders = make(map[int32]Encoder)
+	}
+	e := r.newEncoder(c)
+	c.encoders[enc] = e
+	return e
+}
+
+// rectWriter writes a rectangle's header before its payload.
+type rectWriter struct {
+	c       *Conn
+	rect    image.Rectangle
+	enc     int32
+	started bool // the header was written
+}
+
+func (w *rectWriter) header() {
+	if w.started {
+		return
+	}
+	w.started = true
+	c := w.c
+	c.w(uint16(w.rect.Min.X)) // x
+	c.w(uint16(w.rect.Min.Y)) // y
+	c.w(uint16(w.rect.Dx()))  // width
+	c.w(uint16(w.rect.Dy()))  // height
+	c.w(w.enc)
+}
+
+func (w *rectWriter) Write(p []byte) (int, error) {
+	w.header()
+	return w.c.bw.Write(p)
+}
@@ -0,0 +1,617 @@
+package rfb_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"math/rand"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// testFrames returns frames mixing the kinds of content encodings treat
+// differently: flat areas, two-colour text, gradients, patterns of a few
+// colours and noise. Their size isn't a multiple of common tile sizes.
+// The third frame changes 64×64 tiles to a single colour and to two.
+func testFrames() []*image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	const w, h = 150, 90
+	first := solid(w, h, color.RGBA{0x40, 0x40, 0x40, 0xff})
+	for y := 10; y < 40; y++ { // "text"
+		for x := 5; x < 70; x++ {
+			if (x*7+y*3)%5 < 2 {
+				first.Set(x, y, color.Black)
+			} else {
+				first.Set(x, y, color.White)
+			}
+		}
+	}
+	for y := 0; y < h; y++ { // gradient
+		for x := 80; x < 120; x++ {
+			first.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 2), 0x80, 0xff})
+		}
+	}
+	for y := 0; y < 64; y++ { // 20 colours in short runs
+		for x := 128; x < w; x++ {
+			k := uint8(((x-128)/4 + y) % 20)
+			first.Set(x, y, color.RGBA{k * 12, 0xff - k*12, k * 5, 0xff})
+		}
+	}
+	for y := 66; y < 86; y++ { // noise
+		for x := 0; x < 60; x++ {
+			first.Set(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff})
+		}
+	}
+	second := image.NewRGBA(first.Rect)
+	copy(second.Pix, first.Pix)
+	draw.Draw(second, image.Rect(20, 20, 45, 70), image.NewUniform(color.RGBA{0xff, 0, 0, 0xff}), image.Point{}, draw.Src)
+	third := image.NewRGBA(first.Rect)
+	copy(third.Pix, second.Pix)
+	draw.Draw(third, image.Rect(64, 64, 128, 90), image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}), image.Point{}, draw.Src)
+	for i := 0; i < 15; i++ { // a white cross on grey
+		third.Set(130+i, 70+i, color.White)
+		third.Set(144-i, 70+i, color.White)
+	}
+	return []*image.RGBA{first, second, third}
+}
+
+// checkEncoding sends the test frames to a client asking for encodings
+// and to one asking for Raw, in pixel format pf, and checks that both
+// end up with the same framebuffer. It returns the bytes of the updates
+// received by both.
+func checkEncoding(t *testing.T, encodings []int32, pf rfb.PixelFormat) (got, raw int64) {
+	t.Helper()
+	frames := testFrames()
+	type client struct {
+		cc      *rfb.ClientConn
+		src     *chanSource
+		updates chan rfb.UpdateStats
+		bytes   int64
+	}
+	var clients [2]*client
+	for i, encs := range [][]int32{encodings, {0}} {
+		cl := &client{updates: make(chan rfb.UpdateStats, 10)}
+		cl.cc, _, cl.src = startServerConfig(t, frames[0].Rect.Dx(), frames[0].Rect.Dy(), &rfb.ClientConfig{
+			PixelFormat: &pf,
+			Encodings:   encs,
+			OnUpdate:    func(u rfb.UpdateStats) { cl.updates <- u },
+		})
+		clients[i] = cl
+	}
+	for n, img := range frames {
+		for _, cl := range clients {
+			cl.src.frames <- &rfb.LockableImage{Img: img}
+			select {
+			case u := <-cl.updates:
+				cl.bytes += u.Bytes
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for update")
+			}
+		}
+		a, b := clients[0].cc.Screenshot(), clients[1].cc.Screenshot()
+		if !bytes.Equal(a.Pix, b.Pix) {
+			t.Errorf("encodings %v, %+v: frame %d differs from Raw", encodings, pf, n)
+		}
+	}
+	return clients[0].bytes, clients[1].bytes
+}
+
+func TestHextile(t *testing.T) {
+	for _, pf := range []rfb.PixelFormat{rgb565, bigEndian(rgb565), rgb888, bigEndian(rgb888)} {
+		got, raw := checkEncoding(t, []int32{5}, pf)
+		if got >= raw {
+			t.Errorf("%+v: Hextile took %d bytes, Raw %d", pf, got, raw)
+		}
+	}
+}
+
+func TestZRLE(t *testing.T) {
+	rgb888hi := rgb888 // colours in the most significant three bytes
+	rgb888hi.RedShift, rgb888hi.GreenShift, rgb888hi.BlueShift = 24, 16, 8
+	for _, pf := range []rfb.PixelFormat{rgb565, bigEndian(rgb565), rgb888, bigEndian(rgb888), rgb888hi, bigEndian(rgb888hi), rgb101010} { // the last without compressed pixels
+		got, raw := checkEncoding(t, []int32{16}, pf)
+		if got >= raw/2 {
+			t.Errorf("%+v: ZRLE took %d bytes, Raw %d", pf, got, raw)
+		}
+	}
+}
+
+// TestZRLELowColourPalette checks that 16-bit clients get palette tiles
+// for low-colour content even after photo-like content, for which
+// truecolour clients' palette search is skipped.
+func TestZRLELowColourPalette(t *testing.T) {
+	const w, h = 1024, 1024 // 256 tiles
+	rnd := rand.New(rand.NewSource(1))
+	noise := image.NewRGBA(image.Rect(0, 0, w, h))
+	rnd.Read(noise.Pix)
+	for i := 3; i < len(noise.Pix); i += 4 {
+		noise.Pix[i] = 0xff
+	}
+	// Two colours at random in the top left 256×256, which palette
+	// tiles pack into a bit per pixel.
+	text := image.NewRGBA(noise.Rect)
+	copy(text.Pix, noise.Pix)
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			if rnd.Intn(2) == 0 {
+				text.Set(x, y, color.Black)
+			} else {
+				text.Set(x, y, color.White)
+			}
+		}
+	}
+
+	updates := make(chan rfb.UpdateStats, 10)
+	_, _, src := startServerConfig(t, w, h, &rfb.ClientConfig{
+		PixelFormat: &rgb565,
+		Encodings:   []int32{16},
+		OnUpdate:    func(u rfb.UpdateStats) { updates <- u },
+	})
+	var got rfb.UpdateStats
+	for _, img := range []*image.RGBA{noise, text} {
+		src.frames <- &rfb.LockableImage{Img: img}
+		select {
+		case got = <-updates:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+	}
+	if max := int64(256 * 256 / 8 * 3 / 2); got.Bytes > max {
+		t.Errorf("two-colour region took %d bytes; want at most %d, as palette tiles", got.Bytes, max)
+	}
+}
+
+// TestDeepColour checks the lossless encodings with 10 bits per channel.
+func TestDeepColour(t *testing.T) {
+	for _, enc := range []int32{2, 4, 5, 7, 16} { // RRE, CoRRE, Hextile, Tight, ZRLE
+		for _, pf := range []rfb.PixelFormat{rgb101010, bigEndian(rgb101010)} {
+			checkEncoding(t, []int32{enc}, pf)
+		}
+	}
+}
+
+func TestCompressLevel(t *testing.T) {
+	for _, enc := range []int32{16, 7} { // ZRLE, Tight
+		fast, _ := checkEncoding(t, []int32{enc, -256}, rgb888)
+		best, _ := checkEncoding(t, []int32{enc, -247}, rgb888)
+		if best >= fast {
+			t.Errorf("encoding %d: level 9 took %d bytes, level 0 %d", enc, best, fast)
+		}
+
+		// The level can change within a session.
+		cc, _, src := startServerConfig(t, 150, 90, &rfb.ClientConfig{PixelFormat: &rgb888, Encodings: []int32{enc, -255}})
+		for i, img := range testFrames() {
+			src.frames <- &rfb.LockableImage{Img: img}
+			if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+				t.Fatalf("encoding %d, frame %d: %v", enc, i, err)
+			}
+			if err := cc.SetEncodings([]int32{enc, int32(-247 - 3*i)}); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(20 * time.Millisecond) // for the server to read it
+		}
+	}
+}
+
+func TestCoRRE(t *testing.T) {
+	for _, pf := range []rfb.PixelFormat{rgb565, bigEndian(rgb888)} {
+		got, raw := checkEncoding(t, []int32{4}, pf)
+		if got >= raw {
+			t.Errorf("%+v: CoRRE took %d bytes, Raw %d", pf, got, raw)
+		}
+	}
+}
+
+func TestCoRRESplit(t *testing.T) {
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, _, src := startServerConfig(t, 300, 270, &rfb.ClientConfig{
+		Encodings: []int32{4},
+		OnUpdate:  func(u rfb.UpdateStats) { updates <- u },
+	})
+	img := solid(300, 270, color.RGBA{0xff, 0, 0, 0xff})
+	img.Set(299, 269, color.White)
+	src.frames <- &rfb.LockableImage{Img: img}
+	select {
+	case u := <-updates:
+		want := []image.Rectangle{
+			image.Rect(0, 0, 255, 255), image.Rect(255, 0, 300, 255),
+			image.Rect(0, 255, 255, 270), image.Rect(255, 255, 300, 270),
+		}
+		if len(u.Damage) != len(want) {
+			t.Fatalf("got rectangles %v; want %v", u.Damage, want)
+		}
+		for i, r := range u.Damage {
+			if r != want[i] {
+				t.Errorf("got rectangles %v; want %v", u.Damage, want)
+				break
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTight(t *testing.T) {
+	rgb888hi := rgb888
+	rgb888hi.RedShift, rgb888hi.GreenShift, rgb888hi.BlueShift = 24, 16, 8
+	for _, pf := range []rfb.PixelFormat{rgb565, bigEndian(rgb565), rgb888, bigEndian(rgb888), rgb888hi} {
+		got, raw := checkEncoding(t, []int32{7}, pf)
+		if got >= raw/2 {
+			t.Errorf("%+v: Tight took %d bytes, Raw %d", pf, got, raw)
+		}
+	}
+}
+
+func TestTightJPEG(t *testing.T) {
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, c, src := startServerConfig(t, 128, 96, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{7, -32 + 9}, // Tight, quality level 9
+		OnUpdate:    func(u rfb.UpdateStats) { updates <- u },
+	})
+	img := image.NewRGBA(image.Rect(0, 0, 128, 96))
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 2), uint8(y * 2), uint8(x + y), 0xff})
+		}
+	}
+	src.frames <- &rfb.LockableImage{Img: img}
+	select {
+	case u := <-updates:
+		if raw := int64(128 * 96 * 4); u.Bytes >= raw/4 {
+			t.Errorf("update took %d bytes; Raw takes %d", u.Bytes, raw)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+
+	// JPEG is lossy, but not by much at this quality.
+	shot := cc.Screenshot()
+	diff := func(a, b uint8) int { return max(int(a)-int(b), int(b)-int(a)) }
+	for y := 0; y < 96; y++ {
+		for x := 0; x < 128; x++ {
+			got, want := shot.RGBAAt(x, y), img.RGBAAt(x, y)
+			if diff(got.R, want.R) > 16 || diff(got.G, want.G) > 16 || diff(got.B, want.B) > 16 {
+				t.Fatalf("pixel (%d, %d) = %v; want about %v", x, y, got, want)
+			}
+		}
+	}
+	if st := c.Stats(); len(st) != 1 || st[0].Encoding != 7 {
+		t.Errorf("got stats %+v; want Tight only", st)
+	}
+}
+
+func TestTightPNG(t *testing.T) {
+	for _, pf := range []rfb.PixelFormat{rgb565, rgb888} {
+		got, raw := checkEncoding(t, []int32{-260}, pf)
+		if got >= raw/2 {
+			t.Errorf("%+v: TightPNG took %d bytes, Raw %d", pf, got, raw)
+		}
+	}
+}
+
+// pngVideo is an H264Encoder and H264Decoder sending frames as PNG.
+type pngVideo struct {
+	resets  chan bool
+	failAt  int // fail encoding the failAt'th frame, if non-zero
+	encoded int
+}
+
+func (v *pngVideo) NewH264Stream(bounds image.Rectangle) (rfb.HardwareStream, error) {
+	return v, nil
+}
+
+func (v *pngVideo) Encode(img image.Image) ([]byte, error) {
+	if v.encoded++; v.encoded == v.failAt {
+		return nil, errors.New("encoder broke")
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+func (v *pngVideo) Close() error { return nil }
+
+func (v *pngVideo) Decode(data []byte, reset bool) (image.Image, error) {
+	v.resets <- reset
+	return png.Decode(bytes.NewReader(data))
+}
+
+func TestOpenH264(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	video := &pngVideo{resets: make(chan bool, 10), failAt: 3}
+	s := rfb.NewServer(64, 48)
+	s.H264Encoder = video
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 64, 48), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{50, 0},
+		H264Decoder: video,
+		OnUpdate:    func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	for i, want := range []bool{true, false, false} {
+		img := solid(64, 48, color.RGBA{0xff, 0, 0, 0xff})
+		img.Set(i, i, color.White)
+		src.frames <- &rfb.LockableImage{Img: img}
+		select {
+		case u := <-updates:
+			// The whole frame, even if a pixel changed.
+			if len(u.Damage) != 1 || u.Damage[0] != img.Rect {
+				t.Errorf("frame %d: sent %v", i, u.Damage)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		if err := cc.WaitForImage(img.Rect, img, time.Second); err != nil {
+			t.Errorf("frame %d: %v", i, err)
+		}
+		if i == 2 {
+			// The encoder failed; the frame was sent as Raw.
+			if len(video.resets) != 0 {
+				t.Error("broken encoder's frame decoded")
+			}
+			break
+		}
+		if got := <-video.resets; got != want {
+			t.Errorf("frame %d: reset %v; want %v", i, got, want)
+		}
+	}
+}
+
+// fakeHardware is a HardwareEncoder compressing JPEG in software for
+// frames up to maxWidth pixels wide. It doesn't support H.264.
+type fakeHardware struct {
+	mu       sync.Mutex
+	maxWidth int
+	failAt   int               // fail the failAt'th EncodeJPEG call, if non-zero
+	asked    []image.Rectangle // the bounds Supports was asked about
+	encoded  int
+}
+
+func (h *fakeHardware) Supports(codec rfb.HardwareCodec, bounds image.Rectangle) bool {
+	if codec != rfb.HardwareJPEG {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.asked = append(h.asked, bounds)
+	return bounds.Dx() <= h.maxWidth
+}
+
+func (h *fakeHardware) EncodeJPEG(img image.Image, r image.Rectangle, quality int) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.encoded++; h.encoded == h.failAt {
+		return nil, errors.New("encoder broke")
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img.(*image.RGBA).SubImage(r), &jpeg.Options{Quality: quality})
+	return buf.Bytes(), err
+}
+
+func (h *fakeHardware) NewH264Stream(bounds image.Rectangle) (rfb.HardwareStream, error) {
+	return nil, errors.New("unsupported")
+}
+
+// state returns the bounds Supports was asked about and the number of
+// EncodeJPEG calls.
+func (h *fakeHardware) state() ([]image.Rectangle, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return slices.Clone(h.asked), h.encoded
+}
+
+func TestHardwareEncoder(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	hw := &fakeHardware{maxWidth: 64}
+	s := rfb.NewServer(128, 96)
+	s.HardwareEncoder = hw
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 128, 96), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{7, -32 + 9, -223}, // Tight, quality level 9, DesktopSize
+		OnUpdate:    func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// send sends a gradient differing from the previous frames in every
+	// pixel, so all of it is encoded again.
+	frame := 0
+	send := func(w, h int) {
+		t.Helper()
+		frame++
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Set(x, y, color.RGBA{uint8(x*2 + frame), uint8(y * 2), uint8(x + y), 0xff})
+			}
+		}
+		src.frames <- &rfb.LockableImage{Img: img}
+		select {
+		case <-updates:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("frame %d: timeout waiting for update", frame)
+		}
+	}
+
+	// Too wide for the encoder: software only.
+	send(128, 96)
+	if asked, encoded := hw.state(); len(asked) != 1 || asked[0] != image.Rect(0, 0, 128, 96) || encoded != 0 {
+		t.Fatalf("Supports asked about %v, %d JPEG images encoded; want 128×96 once, none", asked, encoded)
+	}
+
+	// The resize asks again, and the encoder is used.
+	send(64, 48)
+	asked, encoded := hw.state()
+	if len(asked) != 2 || asked[1] != image.Rect(0, 0, 64, 48) || encoded == 0 {
+		t.Fatalf("Supports asked about %v, %d JPEG images encoded; want 64×48 again, some", asked, encoded)
+	}
+
+	// The encoder fails: the frame still goes out, compressed in
+	// software, and the encoder isn't used again.
+	hw.mu.Lock()
+	hw.failAt = hw.encoded + 1
+	hw.mu.Unlock()
+	send(64, 48)
+	send(64, 48)
+	if _, n := hw.state(); n != encoded+1 {
+		t.Errorf("%d JPEG images encoded after the failure; want %d", n, encoded+1)
+	}
+
+	// Until the next resize.
+	send(48, 48)
+	if asked, n := hw.state(); len(asked) != 3 || n <= encoded+1 {
+		t.Errorf("Supports asked about %v, %d JPEG images encoded after the resize; want 48×48 again, more than %d", asked, n, encoded+1)
+	}
+}
+
+// declining is an Encoder that leaves every rectangle to Raw, after
+// splitting them in columns of 16 pixels.
+type declining struct{ calls chan image.Rectangle }
+
+func (e declining) Encode(w io.Writer, pf rfb.PixelFormat, img image.Image, rect image.Rectangle) error {
+	e.calls <- rect
+	return rfb.ErrFallback
+}
+
+func (e declining) SplitRects(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+	var out []image.Rectangle
+	for _, r := range rects {
+		for x := r.Min.X; x < r.Max.X; x += 16 {
+			out = append(out, image.Rect(x, r.Min.Y, min(x+16, r.Max.X), r.Max.Y))
+		}
+	}
+	return out
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	const enc = 0x52464201 // unassigned
+	calls := make(chan image.Rectangle, 10)
+	rfb.RegisterEncoder(enc, "Declining", func() rfb.Encoder { return declining{calls} })
+	if caps := rfb.NewServer(1, 1).Capabilities(); caps.Encodings[len(caps.Encodings)-1] != (rfb.Capability{Number: enc, Name: "Declining"}) {
+		t.Errorf("registered encoding missing from %v", caps.Encodings)
+	}
+
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, c, src := startServerConfig(t, 40, 10, &rfb.ClientConfig{
+		Encodings: []int32{enc, 5},
+		OnUpdate:  func(u rfb.UpdateStats) { updates <- u },
+	})
+	img := solid(40, 10, color.RGBA{0xff, 0, 0, 0xff})
+	src.frames <- &rfb.LockableImage{Img: img}
+	select {
+	case u := <-updates:
+		if len(u.Damage) != 3 {
+			t.Errorf("sent %v; want three columns", u.Damage)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+	if len(calls) != 3 {
+		t.Errorf("encoder called %d times; want 3", len(calls))
+	}
+	if err := cc.WaitForImage(img.Rect, img, time.Second); err != nil {
+		t.Error(err)
+	}
+	if st := c.Stats(); len(st) != 1 || st[0].Encoding != 0 || st[0].Bytes != 40*10*2 {
+		t.Errorf("got stats %+v; want Raw", st)
+	}
+}
+
+func TestAdaptiveEncoding(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(60, 30)
+	s.AdaptiveEncoding = true
+	s.MaxRectPixels = 600 // bands of 10 rows
+	go s.Serve(ln)
+
+	// A solid band, a band of two colours and a band of noise.
+	rnd := rand.New(rand.NewSource(1))
+	img := solid(60, 30, color.RGBA{0x40, 0x40, 0x40, 0xff})
+	for y := 10; y < 30; y++ {
+		for x := 0; x < 60; x++ {
+			if y >= 20 {
+				img.Set(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 0xff})
+			} else if (x+y)%3 == 0 {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	src := &chanSource{bounds: img.Rect, frames: make(chan *rfb.LockableImage, 1)}
+	src.frames <- &rfb.LockableImage{Img: img}
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{16, 7, 0}, // ZRLE, Tight, Raw
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+	if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	rects := make(map[int32]int)
+	for _, st := range c.Stats() {
+		rects[st.Encoding] += st.Rects
+	}
+	if want := map[int32]int{7: 2, 16: 1}; !maps.Equal(rects, want) {
+		t.Errorf("sent rectangles by encoding %v; want %v", rects, want)
+	}
+}
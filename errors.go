@@ -0,0 +1,133 @@
+package rfb
+
+import (
+	"fmt"
+	"log"
+)
+
+// An ErrorClass groups the problems a connection can run into.
+type ErrorClass int
+
+const (
+	// ClassIO is a failure to read from or write to the client. The
+	// connection is always closed.
+	ClassIO ErrorClass = iota
+
+	// ClassMalformed is a message the server can't parse, after which
+	// the stream can't be followed. The connection is always closed.
+	ClassMalformed
+
+	// ClassUnsupported is a well-formed request the server can't honour,
+	// such as an unsupported pixel format. By default, the connection is
+	// closed; if ignored, the request has no effect.
+	ClassUnsupported
+
+	// ClassBadRequest is a request that contradicts the protocol state,
+	// such as an update request for a region outside the framebuffer.
+	// By default, it's answered with an empty update where possible and
+	// ignored otherwise.
+	ClassBadRequest
+
+	// ClassAuth is a client failing authentication. The connection is
+	// always closed.
+	ClassAuth
+
+	// ClassInternal is a failure on the server's side, such as an
+	// encoder or frame source panicking. It ends only the connection it
+	// happened on, which is always closed.
+	ClassInternal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ClassIO:
+		return "I/O error"
+	case ClassMalformed:
+		return "malformed message"
+	case ClassUnsupported:
+		return "unsupported request"
+	case ClassBadRequest:
+		return "bad request"
+	case ClassAuth:
+		return "authentication failure"
+	case ClassInternal:
+		return "internal error"
+	}
+	return fmt.Sprintf("ErrorClass(%d)", int(c))
+}
+
+// fatal reports whether errors of class c always end the connection.
+func (c ErrorClass) fatal() bool {
+	return c == ClassIO || c == ClassMalformed || c == ClassAuth || c == ClassInternal
+}
+
+// An ErrorAction is the response to a protocol error.
+type ErrorAction int
+
+const (
+	ActionClose       ErrorAction = iota // close the connection
+	ActionIgnore                         // carry on as if the request wasn't made
+	ActionEmptyUpdate                    // answer an update request with an empty update
+)
+
+// A ProtocolError describes a problem with a client.
+type ProtocolError struct {
+	Class ErrorClass
+	Msg   string
+}
+
+func (e *ProtocolError) Error() string {
+	return "rfb: " + e.Class.String() + ": " + e.Msg
+}
+
+// Err returns the error that ended the connection, or nil if it's still
+// running or the client disconnected cleanly.
+func (c *Conn) Err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+// failf ends the connection with an error of the given class. The
+// application's OnProtocolError hook is told, but can't prevent it.
+func (c *Conn) failf(class ErrorClass, format string, args ...interface{}) {
+	err := &ProtocolError{Class: class, Msg: fmt.Sprintf(format, args...)}
+	if h := c.s.OnProtocolError; h != nil {
+		h(c, err)
+	}
+	panic(err)
+}
+
+// reject reports a recoverable error and returns the action to take,
+// as decided by the application's OnProtocolError hook or the class's
+// default. If that's ActionClose, it doesn't return.
+func (c *Conn) reject(class ErrorClass, format string, args ...interface{}) ErrorAction {
+	err := &ProtocolError{Class: class, Msg: fmt.Sprintf(format, args...)}
+	action := ActionClose
+	if class == ClassBadRequest {
+		action = ActionEmptyUpdate
+	}
+	if h := c.s.OnProtocolError; h != nil {
+		action = h(c, err)
+	}
+	if action == ActionClose || class.fatal() {
+		panic(err)
+	}
+	log.Printf("ignoring %v", err)
+	return action
+}
+
+// recoverErr turns a panic of the connection's goroutines into the
+// connection's error. Panics other than those of failf and reject are
+// of the given class.
+func (c *Conn) recoverErr(e interface{}, class ErrorClass) {
+	err, ok := e.(*ProtocolError)
+	if !ok {
+		err = &ProtocolError{Class: class, Msg: fmt.Sprint(e)}
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+}
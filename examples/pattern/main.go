@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"image"
 	"log"
@@ -36,7 +37,7 @@ func main() {
 		err = s.Serve(ln)
 		log.Fatalf("rfb server failed with: %v", err)
 	}()
-	for c := range s.Conns {
+	for c := range s.Incoming(context.Background()) {
 		handleConn(c)
 	}
 }
@@ -0,0 +1,22 @@
+package rfb
+
+// encodingExtendedMouseButtons is the pseudo-encoding of clients able to
+// send buttons beyond the eight of PointerEvent's mask, once the server
+// confirmed it with a pseudo-rectangle of its own. Their pointer events
+// then use bit 7 of the mask to flag an extra byte, which carries the
+// buttons from 8 up.
+const encodingExtendedMouseButtons = -316
+
+// extButtonsPendingLocked reports whether the client is to be told it
+// may send extended buttons. c.mu must be held.
+func (c *Conn) extButtonsPendingLocked() bool {
+	return !c.extButtons && c.supportsLocked(encodingExtendedMouseButtons)
+}
+
+// pushExtButtonsLocked writes the ExtendedMouseButtons pseudo-rectangle.
+// c.mu must be held.
+func (c *Conn) pushExtButtonsLocked() {
+	c.extButtons = true
+	c.w([4]uint16{}) // x, y, width, height
+	c.w(int32(encodingExtendedMouseButtons))
+}
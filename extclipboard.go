@@ -0,0 +1,292 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// encodingExtendedClipboard is the pseudo-encoding of clients speaking
+// the Extended Clipboard extension, which carries UTF-8 text in cut
+// text messages with a negative length.
+const encodingExtendedClipboard = -1063131698 // 0xc0a1e5ce
+
+// Extended Clipboard flags: formats in the low bits, actions in the
+// high ones.
+const (
+	clipText    = 1 << 0
+	clipCaps    = 1 << 24
+	clipRequest = 1 << 25
+	clipPeek    = 1 << 26
+	clipNotify  = 1 << 27
+	clipProvide = 1 << 28
+
+	clipFormats = 0xffff
+)
+
+// maxClipboard is the most clipboard text taken from a client, and the
+// limit announced to Extended Clipboard clients.
+const maxClipboard = 10 << 20
+
+// ClipboardEvent is new clipboard text from the client, as UTF-8.
+type ClipboardEvent struct {
+	Text string
+}
+
+// extClipboard is a client's Extended Clipboard state.
+type extClipboard struct {
+	caps    uint32 // from the client's caps message; 0 until it came
+	maxText uint32 // the most text the client takes
+	text    string // the server's clipboard, for the client's requests
+	has     bool   // text was set
+	seq     uint64 // numbers the texts to send, so only the latest is sent
+}
+
+// SetClipboard sends text to the client's clipboard. Clients speaking
+// the Extended Clipboard extension are notified and fetch the text, in
+// UTF-8, when they want it; others get it at once in Latin-1, with
+// other characters replaced by '?'.
+func (c *Conn) SetClipboard(text string) error {
+	return c.sendClipboard(c.clipTurn(), text, true)
+}
+
+// SendCutText sends text to the client's clipboard at once: Extended
+// Clipboard clients get it in a provide message, rather than a notify
+// they have to answer, and others in Latin-1, as with SetClipboard.
+func (c *Conn) SendCutText(text string) error {
+	return c.sendClipboard(c.clipTurn(), text, false)
+}
+
+// SetClipboard sends text to the clipboards of all connected clients, as
+// Conn.SetClipboard does, without waiting for them. Clients still in
+// the handshake get it once it's done.
+func (s *Server) SetClipboard(text string) {
+	s.broadcastClipboard(text, true)
+}
+
+// SendCutText sends text to the clipboards of all connected clients, as
+// Conn.SendCutText does, without waiting for them.
+func (s *Server) SendCutText(text string) {
+	s.broadcastClipboard(text, false)
+}
+
+// broadcastClipboard sends text to all connected clients' clipboards,
+// notifying Extended Clipboard clients if notify is set.
+func (s *Server) broadcastClipboard(text string, notify bool) {
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	for c := range s.live {
+		seq := c.clipTurn()
+		c.spawn(func() { c.sendClipboard(seq, text, notify) })
+	}
+}
+
+// clipTurn numbers a text about to be sent to the client's clipboard.
+func (c *Conn) clipTurn() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clip.seq++
+	return c.clip.seq
+}
+
+// sendClipboard sends text, numbered seq by clipTurn, to the client's
+// clipboard, unless a later text was numbered meanwhile. Texts sent from
+// different goroutines thus can't overtake each other. notify is passed
+// on to writeClipboard.
+func (c *Conn) sendClipboard(seq uint64, text string, notify bool) error {
+	return c.writeMessage(func() {
+		c.mu.RLock()
+		latest := c.clip.seq == seq
+		c.mu.RUnlock()
+		if latest {
+			c.writeClipboard(text, notify)
+		}
+	})
+}
+
+// writeClipboard writes text for the client's clipboard as a notify, if
+// notify is set and the client takes it, as a provide, if the client
+// takes that, or as Latin-1 ServerCutText. c.wmu must be held.
+func (c *Conn) writeClipboard(text string, notify bool) {
+	c.mu.Lock()
+	c.clip.text, c.clip.has = text, true
+	caps, max := c.clip.caps, c.clip.maxText
+	c.mu.Unlock()
+	switch {
+	case notify && caps&clipNotify != 0:
+		c.writeExtClipboard(clipNotify|clipText, nil)
+	case caps&clipProvide != 0:
+		c.writeProvide(text, max)
+	default:
+		c.writeCutText(text)
+	}
+}
+
+// writeProvide writes a provide message with text, or with no text if
+// it's longer than max. c.wmu must be held.
+func (c *Conn) writeProvide(text string, max uint32) {
+	b := []byte(strings.ReplaceAll(text, "\n", "\r\n") + "\x00")
+	if max != 0 && uint32(len(b)) > max {
+		log.Printf("clipboard text of %d bytes over the client's %d byte limit", len(b), max)
+		c.writeExtClipboard(clipProvide, compressClip(nil))
+		return
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(len(b)))
+	data.Write(b)
+	c.writeExtClipboard(clipProvide|clipText, compressClip(data.Bytes()))
+}
+
+// compressClip returns b as the zlib stream of a provide message.
+func compressClip(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// writeExtClipboard writes an Extended Clipboard message with flags and
+// payload. c.wmu must be held.
+func (c *Conn) writeExtClipboard(flags uint32, payload []byte) {
+	c.w(uint8(cmdServerCutText))
+	c.w([3]uint8{}) // padding
+	c.w(int32(-4 - len(payload)))
+	c.w(flags)
+	c.bw.Write(payload)
+}
+
+// writeCutText writes a ServerCutText message. ServerCutText is Latin-1,
+// so other characters are replaced by '?'. c.wmu must be held.
+func (c *Conn) writeCutText(text string) {
+	b := make([]byte, 0, len(text))
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	c.w(uint8(cmdServerCutText))
+	c.w([3]uint8{}) // padding
+	c.w(uint32(len(b)))
+	c.bw.Write(b)
+}
+
+// sendClipboardCaps tells an Extended Clipboard client what the server
+// supports, which has it answer with its own caps.
+func (c *Conn) sendClipboardCaps() {
+	c.writeMessage(func() {
+		c.writeExtClipboard(clipCaps|clipRequest|clipPeek|clipNotify|clipProvide|clipText,
+			binary.BigEndian.AppendUint32(nil, maxClipboard))
+	})
+}
+
+// 6.4.6
+func (c *Conn) handleClientCutText() {
+	c.readPadding("client-cut-text.padding", 3)
+	var n int32
+	c.read("client-cut-text.length", &n)
+	size := int64(n)
+	if size < 0 {
+		size = -size
+	}
+	if size > maxClipboard+1024 {
+		c.failf(ClassMalformed, "client cut text of %d bytes", size)
+	}
+	b := make([]byte, size)
+	c.read("client-cut-text.text", b)
+	if n >= 0 {
+		c.deliverInput(ClipboardEvent{Text: latin1ToUTF8(string(b))})
+		return
+	}
+	if size < 4 {
+		c.reject(ClassMalformed, "extended clipboard message of %d bytes", size)
+		return
+	}
+	c.handleExtClipboard(binary.BigEndian.Uint32(b), b[4:])
+}
+
+// handleExtClipboard handles an Extended Clipboard message from the
+// client.
+func (c *Conn) handleExtClipboard(flags uint32, payload []byte) {
+	switch {
+	case flags&clipCaps != 0:
+		c.mu.Lock()
+		c.clip.caps = flags
+		c.clip.maxText = 0
+		if flags&clipText != 0 && len(payload) >= 4 {
+			c.clip.maxText = binary.BigEndian.Uint32(payload)
+		}
+		c.mu.Unlock()
+	case flags&clipRequest != 0:
+		c.mu.RLock()
+		text, has, max := c.clip.text, c.clip.has, c.clip.maxText
+		c.mu.RUnlock()
+		if flags&clipText != 0 && has {
+			c.writeMessage(func() { c.writeProvide(text, max) })
+		}
+	case flags&clipPeek != 0:
+		c.mu.RLock()
+		has := c.clip.has
+		c.mu.RUnlock()
+		formats := uint32(0)
+		if has {
+			formats = clipText
+		}
+		c.writeMessage(func() { c.writeExtClipboard(clipNotify|formats, nil) })
+	case flags&clipNotify != 0:
+		c.mu.RLock()
+		caps := c.clip.caps
+		c.mu.RUnlock()
+		if flags&clipText != 0 && caps&clipRequest != 0 {
+			c.writeMessage(func() { c.writeExtClipboard(clipRequest|clipText, nil) })
+		}
+	case flags&clipProvide != 0:
+		text, err := readProvide(flags, payload)
+		if err != nil {
+			c.reject(ClassMalformed, "extended clipboard provide: %v", err)
+			return
+		}
+		if flags&clipText != 0 {
+			c.deliverInput(ClipboardEvent{Text: text})
+		}
+	}
+}
+
+// readProvide returns the text of a provide message's zlib payload.
+// The formats' data follow in the order of their flags, each with its
+// size; only text is kept.
+func readProvide(flags uint32, payload []byte) (string, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+	r := io.LimitReader(zr, maxClipboard+1024)
+	var text string
+	for f := uint32(1); f&clipFormats != 0; f <<= 1 {
+		if flags&f == 0 {
+			continue
+		}
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			return "", err
+		}
+		if n > maxClipboard {
+			return "", fmt.Errorf("format data of %d bytes", n)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if f == clipText {
+			text = strings.ReplaceAll(strings.TrimRight(string(b), "\x00"), "\r\n", "\n")
+			break
+		}
+	}
+	return text, nil
+}
@@ -0,0 +1,347 @@
+// Package fbs replays FBS session recordings.
+//
+// An FBS file, as written by rfbproxy and compatible recorders, holds
+// what a server sent to one viewer: the header "FBS 001.000\n", then
+// blocks of server data, each with the number of milliseconds since the
+// recording started. A Player feeds the blocks to an rfb.ClientConn and
+// reconstructs the framebuffer at any point of the recording, which
+// serves for thumbnails or for looking into a session without a viewer.
+package fbs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"iter"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// maxBlock is the largest block accepted, to fail on corrupt files
+// instead of allocating whatever their length fields say.
+const maxBlock = 64 << 20
+
+// A Block is a piece of the server's data.
+type Block struct {
+	Data []byte
+	Time time.Duration // since the recording started
+}
+
+// Reader reads the blocks of a recording.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader reads the header of a recording.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	var hdr [12]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("fbs: reading header: %v", err)
+	}
+	var minor int
+	if _, err := fmt.Sscanf(string(hdr[:]), "FBS 001.%03d\n", &minor); err != nil {
+		return nil, fmt.Errorf("fbs: not an FBS recording (header %q)", hdr[:])
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next block. It returns io.EOF at the end of the
+// recording.
+func (r *Reader) Next() (Block, error) {
+	var n uint32
+	if err := binary.Read(r.r, binary.BigEndian, &n); err != nil {
+		return Block{}, err
+	}
+	if n > maxBlock {
+		return Block{}, fmt.Errorf("fbs: block of %d bytes", n)
+	}
+	// The data is padded to a multiple of four bytes and followed by
+	// the timestamp.
+	buf := make([]byte, (n+3)&^3+4)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Block{}, err
+	}
+	ms := binary.BigEndian.Uint32(buf[len(buf)-4:])
+	return Block{Data: buf[:n], Time: time.Duration(ms) * time.Millisecond}, nil
+}
+
+// Player reconstructs the framebuffer of a recording. It only moves
+// forward; going back in time takes a new Player.
+type Player struct {
+	r    *Reader
+	conn *replayConn
+	cc   *rfb.ClientConn
+
+	next *Block        // the next block to feed, nil at the end
+	now  time.Duration // the time the framebuffer shows
+	err  error         // why the replay stopped
+}
+
+// NewPlayer reads the recording's handshake and returns a Player at its
+// start. config configures the client decoding the recording; its
+// PixelFormat has to be the one the recorded viewer asked for, if any,
+// as the recording doesn't include it. Only recordings of sessions
+// without authentication can be replayed.
+func NewPlayer(r io.Reader, config *rfb.ClientConfig) (*Player, error) {
+	fr, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &Player{r: fr, conn: newReplayConn()}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		cc  *rfb.ClientConn
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		cc, err := rfb.NewClientConn(p.conn, config)
+		res <- result{cc, err}
+	}()
+	for {
+		select {
+		case r := <-res:
+			if r.err != nil {
+				p.conn.Close()
+				return nil, r.err
+			}
+			p.cc = r.cc
+			return p, nil
+		case <-p.conn.idle:
+			// The client wants more of the handshake.
+			if err := p.feed(); err != nil {
+				p.conn.Close()
+				return nil, err
+			}
+		}
+	}
+}
+
+// advance reads the block after the current one.
+func (p *Player) advance() error {
+	b, err := p.r.Next()
+	switch {
+	case err == io.EOF:
+		p.next = nil
+		return nil
+	case err != nil:
+		p.next = nil
+		return err
+	}
+	p.next = &b
+	return nil
+}
+
+// feed hands the next block to the client, or the end of the recording
+// if there's none.
+func (p *Player) feed() error {
+	if p.next == nil {
+		p.conn.end()
+		return nil
+	}
+	b := p.next
+	if err := p.advance(); err != nil {
+		return err
+	}
+	if b.Time > p.now {
+		p.now = b.Time
+	}
+	select {
+	case p.conn.in <- b.Data:
+	case <-p.conn.done:
+	}
+	return nil
+}
+
+// Seek moves to t, applying all blocks recorded up to then. Times after
+// the end of the recording show its last frame.
+func (p *Player) Seek(t time.Duration) error {
+	if p.err != nil {
+		return p.err
+	}
+	if t < p.now {
+		return fmt.Errorf("fbs: can't seek back from %v to %v", p.now, t)
+	}
+	for p.next != nil && p.next.Time <= t {
+		if err := p.feed(); err != nil {
+			p.err = err
+			return err
+		}
+	}
+	// Wait for the client to decode everything it got.
+	select {
+	case <-p.conn.idle:
+	case <-p.conn.done:
+		if !p.conn.ended() {
+			p.err = p.cc.Err()
+			return p.err
+		}
+	}
+	p.now = t
+	return nil
+}
+
+// Time returns the time the framebuffer shows.
+func (p *Player) Time() time.Duration {
+	return p.now
+}
+
+// Done reports whether the whole recording has been applied.
+func (p *Player) Done() bool {
+	return p.next == nil
+}
+
+// Image returns a copy of the framebuffer.
+func (p *Player) Image() *image.RGBA {
+	return p.cc.Screenshot()
+}
+
+// Frames returns the framebuffer every interval from the current time
+// until the end of the recording. Err tells whether the iteration
+// stopped early.
+func (p *Player) Frames(interval time.Duration) iter.Seq2[time.Duration, *image.RGBA] {
+	return func(yield func(time.Duration, *image.RGBA) bool) {
+		for t := p.now; ; t += interval {
+			if err := p.Seek(t); err != nil {
+				return
+			}
+			if !yield(t, p.Image()) || p.Done() {
+				return
+			}
+		}
+	}
+}
+
+// Err returns why the replay stopped early, or nil.
+func (p *Player) Err() error {
+	return p.err
+}
+
+// ExportPNG writes the framebuffer every interval until the end of the
+// recording to dir, as PNG files named after the time in milliseconds.
+// It returns the number of files written.
+func (p *Player) ExportPNG(dir string, interval time.Duration) (int, error) {
+	n := 0
+	for t, img := range p.Frames(interval) {
+		name := filepath.Join(dir, fmt.Sprintf("%010d.png", t.Milliseconds()))
+		if err := writePNG(name, img); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, p.err
+}
+
+func writePNG(name string, img image.Image) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Close stops the replay.
+func (p *Player) Close() error {
+	return p.cc.Close()
+}
+
+// replayConn is the net.Conn the client reads the recording from. Its
+// Read offers idle while it waits for data, which tells the player that
+// the client decoded everything it got so far. Writes are dropped.
+type replayConn struct {
+	in   chan []byte
+	idle chan struct{}
+	buf  []byte // data handed out by the player but not read yet
+
+	once  sync.Once
+	done  chan struct{} // closed by Close
+	endMu sync.Mutex
+	eof   bool // whether the player reached the end of the recording
+}
+
+func newReplayConn() *replayConn {
+	return &replayConn{
+		in:   make(chan []byte),
+		idle: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// end makes Read return io.EOF once the data is used up.
+func (c *replayConn) end() {
+	c.endMu.Lock()
+	defer c.endMu.Unlock()
+	if !c.eof {
+		c.eof = true
+		close(c.in)
+	}
+}
+
+func (c *replayConn) ended() bool {
+	c.endMu.Lock()
+	defer c.endMu.Unlock()
+	return c.eof
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		select {
+		case c.idle <- struct{}{}:
+		case b, ok := <-c.in:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.buf = b
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+		return len(p), nil
+	}
+}
+
+func (c *replayConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (c *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (c *replayConn) SetDeadline(t time.Time) error      { return errors.ErrUnsupported }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return errors.ErrUnsupported }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "fbs" }
+func (replayAddr) String() string  { return "recording" }
@@ -0,0 +1,150 @@
+package fbs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/fbs"
+	"github.com/patdhlk/rfb/rfbtest"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+// recordingConn records what is read from it in the FBS format, with
+// the timestamp set by the test.
+type recordingConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	now time.Duration
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		binary.Write(&c.buf, binary.BigEndian, uint32(n))
+		c.buf.Write(p[:n])
+		c.buf.Write(make([]byte, (4-n%4)%4))
+		binary.Write(&c.buf, binary.BigEndian, uint32(c.now.Milliseconds()))
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *recordingConn) setTime(t time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+func (c *recordingConn) recording() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte("FBS 001.000\n"), c.buf.Bytes()...)
+}
+
+// record records a session showing red, then blue a second later.
+func record(t *testing.T) []byte {
+	s := rfb.NewServer(32, 24)
+	src := rfbtest.NewSource(image.Rect(0, 0, 32, 24))
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	addr := rfbtest.Serve(t, s)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &recordingConn{Conn: nc}
+	cc, err := rfb.NewClientConn(rc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	for i, c := range []color.RGBA{{0xff, 0, 0, 0xff}, {0, 0, 0xff, 0xff}} {
+		rc.setTime(time.Duration(i+1) * time.Second)
+		img := rfbtest.Solid(32, 24, c)
+		src.Frames <- &rfb.LockableImage{Img: img}
+		if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rc.recording()
+}
+
+func TestPlayer(t *testing.T) {
+	rec := record(t)
+	red := rfbtest.Solid(32, 24, color.RGBA{0xff, 0, 0, 0xff})
+	blue := rfbtest.Solid(32, 24, color.RGBA{0, 0, 0xff, 0xff})
+
+	p, err := fbs.NewPlayer(bytes.NewReader(rec), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for _, step := range []struct {
+		t    time.Duration
+		want *image.RGBA
+	}{
+		{1500 * time.Millisecond, red},
+		{2 * time.Second, blue},
+		{time.Hour, blue},
+	} {
+		if err := p.Seek(step.t); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Image(); !bytes.Equal(got.Pix, step.want.Pix) {
+			t.Errorf("at %v: got pixel %v", step.t, got.At(0, 0))
+		}
+	}
+	if !p.Done() {
+		t.Error("not done at the end of the recording")
+	}
+	if err := p.Seek(time.Second); err == nil {
+		t.Error("seeking back succeeded")
+	}
+}
+
+func TestExportPNG(t *testing.T) {
+	p, err := fbs.NewPlayer(bytes.NewReader(record(t)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	dir := t.TempDir()
+	n, err := p.ExportPNG(dir, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wrote %d frames; want 3", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0000002000.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotFBS(t *testing.T) {
+	if _, err := fbs.NewPlayer(bytes.NewReader([]byte("RFB 003.008\n")), nil); err == nil {
+		t.Error("NewPlayer accepted an RFB stream")
+	}
+}
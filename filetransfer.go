@@ -0,0 +1,403 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TightVNC file transfer messages, in both directions.
+const (
+	cmdFileListRequest      = 130
+	cmdFileDownloadRequest  = 131
+	cmdFileUploadRequest    = 132
+	cmdFileUploadData       = 133
+	cmdFileDownloadCancel   = 134
+	cmdFileUploadFailed     = 135
+	cmdFileCreateDirRequest = 136
+
+	cmdFileListData       = 130
+	cmdFileDownloadData   = 131
+	cmdFileUploadCancel   = 132
+	cmdFileDownloadFailed = 133
+)
+
+const (
+	fileListDirsOnly = 0x10       // FileListRequest flag: no files
+	fileListFailed   = 0x80       // FileListData flag: the directory couldn't be read
+	fileListDirSize  = 0xffffffff // FileListData size of a directory
+
+	// fileBlockSize is the most data in one FileDownloadData or
+	// FileUploadData message.
+	fileBlockSize = 8192
+)
+
+// FileSystem is the tree of files clients can list, download and upload
+// with TightVNC's file transfer extension; see Server.FileSystem. Names
+// are slash-separated and unrooted, as in io/fs, whatever the client's
+// conventions; the root of the tree is the root clients see.
+type FileSystem interface {
+	// Open opens a file for downloads, and directories for listings,
+	// which must implement fs.ReadDirFile. Downloads resumed at an
+	// offset seek if the file implements io.Seeker.
+	fs.FS
+
+	// Create creates or truncates the file for an upload.
+	Create(name string) (io.WriteCloser, error)
+
+	// Mkdir creates a directory.
+	Mkdir(name string) error
+}
+
+// DirFileSystem returns a FileSystem for the directory tree at dir.
+// Like os.DirFS, it doesn't keep symbolic links from leading out of
+// dir.
+func DirFileSystem(dir string) FileSystem {
+	return dirFileSystem{os.DirFS(dir).(fs.StatFS), dir}
+}
+
+type dirFileSystem struct {
+	fs.StatFS
+	dir string
+}
+
+func (d dirFileSystem) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(name)), nil
+}
+
+func (d dirFileSystem) Create(name string) (io.WriteCloser, error) {
+	p, err := d.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+func (d dirFileSystem) Mkdir(name string) error {
+	p, err := d.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, 0o777)
+}
+
+// fileTransfer is a connection's file transfer state. It's only used by
+// the goroutine reading from the client.
+type fileTransfer struct {
+	cancel chan struct{} // closed to stop the running download
+	upload io.WriteCloser
+	name   string // of the upload
+}
+
+// fsPath returns the FileSystem name of a client's path.
+func fsPath(p string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+// readFileName reads a name of n bytes in a file transfer message.
+func (c *Conn) readFileName(what string, n uint16) string {
+	b := make([]byte, n)
+	c.read(what, b)
+	return string(b)
+}
+
+// handleFileTransfer handles the file transfer message cmd, or fails
+// the connection if the server has no FileSystem.
+func (c *Conn) handleFileTransfer(cmd uint8) {
+	fsys := c.s.FileSystem
+	if fsys == nil {
+		c.failf(ClassMalformed, "unsupported command type %d from client", int(cmd))
+	}
+	switch cmd {
+	case cmdFileListRequest:
+		var msg struct {
+			Flags uint8
+			Size  uint16
+		}
+		c.read("file-list-request", &msg)
+		c.sendFileList(fsys, msg.Flags, c.readFileName("file-list-request.name", msg.Size))
+	case cmdFileDownloadRequest:
+		var msg struct {
+			Level    uint8
+			Size     uint16
+			Position uint32
+		}
+		c.read("file-download-request", &msg)
+		name := c.readFileName("file-download-request.name", msg.Size)
+		c.stopDownload()
+		cancel := make(chan struct{})
+		c.ft.cancel = cancel
+		c.spawn(func() { c.download(fsys, name, int64(msg.Position), cancel) })
+	case cmdFileDownloadCancel, cmdFileUploadFailed:
+		c.readPadding("file-transfer.padding", 1)
+		var n uint16
+		c.read("file-transfer.reason-length", &n)
+		reason := c.readFileName("file-transfer.reason", n)
+		log.Printf("client stopped file transfer: %q", reason)
+		if cmd == cmdFileDownloadCancel {
+			c.stopDownload()
+		} else {
+			c.abortUpload()
+		}
+	case cmdFileUploadRequest:
+		var msg struct {
+			Level    uint8
+			Size     uint16
+			Position uint32
+		}
+		c.read("file-upload-request", &msg)
+		c.startUpload(fsys, c.readFileName("file-upload-request.name", msg.Size), msg.Position)
+	case cmdFileUploadData:
+		var msg struct {
+			Level          uint8
+			Size, Compress uint16
+		}
+		c.read("file-upload-data", &msg)
+		if msg.Size == 0 && msg.Compress == 0 {
+			var mtime uint32
+			c.read("file-upload-data.mtime", &mtime)
+			c.finishUpload()
+			return
+		}
+		data := make([]byte, msg.Compress)
+		c.read("file-upload-data.data", data)
+		c.uploadData(data, msg.Level, int(msg.Size))
+	case cmdFileCreateDirRequest:
+		c.readPadding("file-create-dir.padding", 1)
+		var n uint16
+		c.read("file-create-dir.length", &n)
+		p := c.readFileName("file-create-dir.name", n)
+		name, ok := fsPath(p)
+		if !ok {
+			log.Printf("client wants to create directory %q outside the file system", p)
+			return
+		}
+		if c.isViewOnly() {
+			log.Printf("view-only client wants to create directory %q", p)
+			return
+		}
+		if err := fsys.Mkdir(name); err != nil {
+			log.Printf("creating directory for client: %v", err)
+		}
+	}
+}
+
+// sendFileList answers a FileListRequest for the directory p.
+func (c *Conn) sendFileList(fsys FileSystem, flags uint8, p string) {
+	type entry struct{ Size, Mtime uint32 }
+	var entries []entry
+	var names bytes.Buffer
+	name, ok := fsPath(p)
+	var list []fs.DirEntry
+	var err error
+	if ok {
+		list, err = fs.ReadDir(fsys, name)
+	}
+	if !ok || err != nil {
+		log.Printf("listing %q for client: %v", p, err)
+		flags |= fileListFailed
+		list = nil
+	}
+	for _, de := range list {
+		info, err := de.Info()
+		if err != nil || (flags&fileListDirsOnly != 0 && !de.IsDir()) {
+			continue
+		}
+		e := entry{uint32(info.Size()), uint32(info.ModTime().Unix())}
+		if de.IsDir() {
+			e.Size = fileListDirSize
+		} else if info.Size() >= fileListDirSize {
+			continue // too big for the protocol
+		}
+		if names.Len()+len(de.Name())+1 > 0xffff {
+			break
+		}
+		entries = append(entries, e)
+		names.WriteString(de.Name())
+		names.WriteByte(0)
+	}
+	c.writeMessage(func() {
+		c.w(uint8(cmdFileListData))
+		c.w(flags)
+		c.w(uint16(len(entries)))
+		c.w(uint16(names.Len())) // data size
+		c.w(uint16(names.Len())) // compressed size: uncompressed
+		c.w(entries)
+		c.bw.Write(names.Bytes())
+	})
+}
+
+// download sends the file p from offset in FileDownloadData messages
+// until it's done or cancel is closed.
+func (c *Conn) download(fsys FileSystem, p string, offset int64, cancel chan struct{}) {
+	fail := func(err error) {
+		log.Printf("download of %q for client: %v", p, err)
+		reason := err.Error()
+		c.writeMessage(func() {
+			c.w(uint8(cmdFileDownloadFailed))
+			c.w(uint8(0)) // padding
+			c.w(uint16(len(reason)))
+			c.bw.WriteString(reason)
+		})
+	}
+	name, ok := fsPath(p)
+	if !ok {
+		fail(fs.ErrInvalid)
+		return
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = errors.New("is a directory")
+	}
+	if err == nil && offset > 0 {
+		if s, ok := f.(io.Seeker); ok {
+			_, err = s.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, f, offset)
+		}
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	buf := make([]byte, fileBlockSize)
+	for {
+		select {
+		case <-cancel:
+			return
+		default:
+		}
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if c.writeMessage(func() {
+				c.w(uint8(cmdFileDownloadData))
+				c.w(uint8(0))  // not compressed
+				c.w(uint16(n)) // size
+				c.w(uint16(n)) // compressed size
+				c.bw.Write(buf[:n])
+			}) != nil {
+				return
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+	c.writeMessage(func() {
+		c.w(uint8(cmdFileDownloadData))
+		c.w(uint8(0))
+		c.w(uint16(0))
+		c.w(uint16(0))
+		c.w(uint32(info.ModTime().Unix()))
+	})
+}
+
+// stopDownload cancels the running download, if any.
+func (c *Conn) stopDownload() {
+	if c.ft.cancel != nil {
+		close(c.ft.cancel)
+		c.ft.cancel = nil
+	}
+}
+
+// cancelUpload aborts the upload and tells the client why.
+func (c *Conn) cancelUpload(err error) {
+	log.Printf("upload of %q from client: %v", c.ft.name, err)
+	c.abortUpload()
+	reason := err.Error()
+	c.writeMessage(func() {
+		c.w(uint8(cmdFileUploadCancel))
+		c.w(uint8(0)) // padding
+		c.w(uint16(len(reason)))
+		c.bw.WriteString(reason)
+	})
+}
+
+// abortUpload closes the file being uploaded, if any. The part already
+// written is left.
+func (c *Conn) abortUpload() {
+	if c.ft.upload != nil {
+		c.ft.upload.Close()
+		c.ft.upload = nil
+	}
+}
+
+func (c *Conn) startUpload(fsys FileSystem, p string, position uint32) {
+	c.abortUpload()
+	c.ft.name = p
+	name, ok := fsPath(p)
+	switch {
+	case !ok:
+		c.cancelUpload(fs.ErrInvalid)
+		return
+	case position != 0:
+		c.cancelUpload(errors.New("resuming uploads isn't supported"))
+		return
+	}
+	if c.isViewOnly() {
+		c.cancelUpload(fs.ErrPermission)
+		return
+	}
+	w, err := fsys.Create(name)
+	if err != nil {
+		c.cancelUpload(err)
+		return
+	}
+	c.ft.upload = w
+}
+
+func (c *Conn) uploadData(data []byte, level uint8, size int) {
+	if c.ft.upload == nil {
+		return // canceled
+	}
+	if level != 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			c.cancelUpload(err)
+			return
+		}
+		data = make([]byte, size)
+		if _, err := io.ReadFull(zr, data); err != nil {
+			c.cancelUpload(err)
+			return
+		}
+	}
+	if _, err := c.ft.upload.Write(data); err != nil {
+		c.cancelUpload(err)
+	}
+}
+
+func (c *Conn) finishUpload() {
+	if c.ft.upload == nil {
+		return
+	}
+	err := c.ft.upload.Close()
+	c.ft.upload = nil
+	if err != nil {
+		c.cancelUpload(err)
+	}
+}
@@ -0,0 +1,272 @@
+package rfb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestServerFileTransfer(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), bytes.Repeat([]byte("abc"), 5000), 0o666)
+	os.Mkdir(filepath.Join(dir, "sub"), 0o777)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.FileSystem = rfb.DirFileSystem(dir)
+	go s.Serve(ln)
+
+	_, nc, read := fileTransferConn(t, s, ln.Addr().String())
+
+	list := func(dir string) map[string]uint32 {
+		t.Helper()
+		msg := []byte{130, 0}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(dir)))
+		nc.Write(append(msg, dir...))
+		hdr := read(8)
+		if hdr[0] != 130 || hdr[1]&0x80 != 0 {
+			t.Fatalf("got list reply %v", hdr)
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:]))
+		sizes := read(8 * n)
+		names := bytes.Split(read(int(binary.BigEndian.Uint16(hdr[4:]))), []byte{0})
+		m := make(map[string]uint32)
+		for i := range n {
+			m[string(names[i])] = binary.BigEndian.Uint32(sizes[8*i:])
+		}
+		return m
+	}
+	if got := list("/"); len(got) != 2 || got["a.txt"] != 15000 || got["sub"] != 0xffffffff {
+		t.Errorf("got listing %v; want a.txt of 15000 bytes and directory sub", got)
+	}
+
+	// Download from an offset.
+	msg := []byte{131, 0}
+	msg = binary.BigEndian.AppendUint16(msg, 6)
+	msg = binary.BigEndian.AppendUint32(msg, 3000)
+	nc.Write(append(msg, "/a.txt"...))
+	var got []byte
+	for {
+		hdr := read(6)
+		if hdr[0] != 131 {
+			t.Fatalf("got download reply %v", hdr)
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:]))
+		if n == 0 {
+			read(4) // mtime
+			break
+		}
+		got = append(got, read(n)...)
+	}
+	if want := bytes.Repeat([]byte("abc"), 4000); !bytes.Equal(got, want) {
+		t.Errorf("downloaded %d bytes; want the %d after the offset", len(got), len(want))
+	}
+
+	// Upload in two blocks.
+	msg = []byte{132, 0}
+	msg = binary.BigEndian.AppendUint16(msg, 10)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = append(msg, "/sub/b.txt"...)
+	for _, block := range []string{"hello, ", "world"} {
+		msg = append(msg, 133, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(block)))
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(block)))
+		msg = append(msg, block...)
+	}
+	msg = append(msg, 133, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	nc.Write(msg)
+	if got := list("/sub"); got["b.txt"] != 12 {
+		t.Errorf("got listing %v; want b.txt of 12 bytes", got)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "sub", "b.txt")); string(b) != "hello, world" {
+		t.Errorf("uploaded %q", b)
+	}
+}
+
+// fileTransferConn connects to s at addr through the Tight security
+// type, which announces file transfer. It returns the server's and the
+// client's ends of the connection, and a function reading n bytes from
+// the client's.
+func fileTransferConn(t *testing.T, s *rfb.Server, addr string) (*rfb.Conn, net.Conn, func(n int) []byte) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	read := func(n int) []byte {
+		t.Helper()
+		b := make([]byte, n)
+		if _, err := io.ReadFull(nc, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// The Tight security type, then its lists after ServerInit.
+	read(12)
+	io.WriteString(nc, "RFB 003.008\n")
+	if types := read(3); !bytes.Equal(types, []byte{2, 1, 16}) {
+		t.Fatalf("got security types %v; want None and Tight", types)
+	}
+	nc.Write([]byte{16})
+	if tunnels := read(20); !bytes.Contains(tunnels, []byte("NOTUNNEL")) {
+		t.Fatalf("got tunnel types %q; want NOTUNNEL", tunnels)
+	}
+	nc.Write([]byte{0, 0, 0, 0})
+	if auths := read(4); !bytes.Equal(auths, []byte{0, 0, 0, 0}) {
+		t.Fatalf("got auth count %v; want none", auths)
+	}
+	read(4) // SecurityResult
+	nc.Write([]byte{1})
+	init := read(24)
+	read(int(binary.BigEndian.Uint32(init[20:])))
+	hdr := read(8)
+	nServer, nClient := int(binary.BigEndian.Uint16(hdr)), int(binary.BigEndian.Uint16(hdr[2:]))
+	read(16 * nServer)
+	if caps := read(16 * nClient); !bytes.Contains(caps, []byte("FTC_LSRQ")) {
+		t.Errorf("client message capabilities %q lack FileListRequest", caps)
+	}
+	read(16 * int(binary.BigEndian.Uint16(hdr[4:])))
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, nc, read
+}
+
+// tightOffer connects to addr as a 3.8 client, returning the security
+// types offered and the SecurityResult after picking Tight regardless.
+func tightOffer(t *testing.T, addr string) (types []byte, status uint32) {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(nc, "RFB 003.008\n")
+	if _, err := io.ReadFull(nc, buf[:1]); err != nil {
+		t.Fatal(err)
+	}
+	types = make([]byte, buf[0])
+	if _, err := io.ReadFull(nc, types); err != nil {
+		t.Fatal(err)
+	}
+	nc.Write([]byte{16})
+	if bytes.IndexByte(types, 16) >= 0 {
+		// Tight with no authentication types to offer, as it is then.
+		if _, err := io.ReadFull(nc, make([]byte, 4+16)); err != nil {
+			t.Fatal(err)
+		}
+		nc.Write([]byte{0, 0, 0, 0})
+		if _, err := io.ReadFull(nc, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+		t.Fatal(err)
+	}
+	return types, status
+}
+
+func TestServerTightWithAuthenticate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Authenticate = func(user, password string) bool { return false }
+	s.FileSystem = rfb.DirFileSystem(t.TempDir())
+	go s.Serve(ln)
+
+	// Tight can't check the credentials, so it mustn't let anyone in.
+	types, status := tightOffer(t, ln.Addr().String())
+	if bytes.IndexByte(types, 16) >= 0 {
+		t.Errorf("got security types %v; want no Tight without a password", types)
+	}
+	if status != 1 {
+		t.Errorf("picking Tight got SecurityResult %d; want failed", status)
+	}
+}
+
+func TestServerTightWithSecurityHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.SecurityHandlers = []rfb.SecurityHandler{tokenSecurity{}}
+	s.TightSecurity = true
+	go s.Serve(ln)
+
+	// Picking Tight mustn't skip the application's security type.
+	types, status := tightOffer(t, ln.Addr().String())
+	if !bytes.Equal(types, []byte{200}) {
+		t.Errorf("got security types %v; want only the handler's", types)
+	}
+	if status != 1 {
+		t.Errorf("picking Tight got SecurityResult %d; want failed", status)
+	}
+}
+
+func TestServerFileTransferViewOnly(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("keep"), 0o666)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.FileSystem = rfb.DirFileSystem(dir)
+	go s.Serve(ln)
+
+	c, nc, read := fileTransferConn(t, s, ln.Addr().String())
+	c.SetViewOnly(true)
+
+	// A new directory, then an upload overwriting a.txt.
+	msg := []byte{136, 0}
+	msg = binary.BigEndian.AppendUint16(msg, 4)
+	msg = append(msg, "/new"...)
+	msg = append(msg, 132, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 6)
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	msg = append(msg, "/a.txt"...)
+	msg = append(msg, 133, 0, 0, 1, 0, 1, 'x')
+	msg = append(msg, 133, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	nc.Write(msg)
+	if hdr := read(4); hdr[0] != 132 {
+		t.Fatalf("got reply %v; want FileUploadCancel", hdr)
+	} else {
+		read(int(binary.BigEndian.Uint16(hdr[2:])))
+	}
+	// A listing, answered after the messages before it.
+	nc.Write([]byte{130, 0, 0, 1, '/'})
+	read(8)
+	if b, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(b) != "keep" {
+		t.Errorf("view-only client changed a.txt to %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); err == nil {
+		t.Error("view-only client created a directory")
+	}
+}
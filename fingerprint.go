@@ -0,0 +1,116 @@
+package rfb
+
+import "slices"
+
+// A Fingerprint describes a client as far as the handshake reveals it,
+// to tell viewers apart.
+type Fingerprint struct {
+	Version   string  // protocol version the client chose: "3.3", "3.7" or "3.8"
+	Security  uint8   // security type the client chose
+	Shared    bool    // the client's ClientInit asked to share the desktop
+	Encodings []int32 // the client's first SetEncodings list, in its order
+	Viewer    string  // the first matching ViewerRule's Viewer, or ""
+}
+
+// Announces reports whether the client announced enc in its first
+// SetEncodings.
+func (f Fingerprint) Announces(enc int32) bool {
+	return slices.Contains(f.Encodings, enc)
+}
+
+// Quirks are workarounds for viewer bugs.
+type Quirks struct {
+	// NoLastRect makes the server ignore the LastRect pseudo-encoding,
+	// for viewers that announce it but misread updates using it.
+	NoLastRect bool
+
+	// RGB555 sends pixels as RGB555 to viewers asking for 16-bit RGB565,
+	// for viewers that decode all 16-bit pixels as RGB555, like some
+	// versions of Screens.
+	RGB555 bool
+}
+
+// A ViewerRule recognizes a viewer from its Fingerprint and names the
+// quirks it needs.
+type ViewerRule struct {
+	Viewer string
+	Match  func(Fingerprint) bool
+	Quirks Quirks
+}
+
+// DefaultViewers is the viewer table used if Server.Viewers is nil. It
+// recognizes viewers by encodings only they announce.
+var DefaultViewers = []ViewerRule{
+	{
+		Viewer: "noVNC",
+		Match:  func(f Fingerprint) bool { return f.Announces(encodingTightPNG) },
+	},
+	{
+		Viewer: "Screen Sharing",
+		Match:  func(f Fingerprint) bool { return f.Announces(encodingApple) },
+	},
+	{
+		Viewer: "TigerVNC",
+		Match: func(f Fingerprint) bool {
+			return f.Announces(encodingFence) && f.Announces(encodingContinuousUpdates)
+		},
+	},
+}
+
+// Pseudo-encodings only used to recognize viewers.
+const (
+	encodingFence             = -312
+	encodingContinuousUpdates = -313
+)
+
+// Fingerprint returns what the connection's handshake revealed about
+// the client. Version, Security and Shared are set as the handshake
+// gets to them, and complete once the client can be sent updates;
+// Viewer and Encodings are only set once the client sent SetEncodings.
+func (c *Conn) Fingerprint() Fingerprint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fp := c.fp
+	fp.Encodings = slices.Clone(fp.Encodings)
+	return fp
+}
+
+// identifyLocked fills in the fingerprint's encodings and viewer from the
+// client's first SetEncodings, and applies the viewer's quirks. c.mu
+// must be held.
+func (c *Conn) identifyLocked(encodings []int32) {
+	c.fp.Encodings = encodings
+	rules := c.s.Viewers
+	if rules == nil {
+		rules = DefaultViewers
+	}
+	for _, r := range rules {
+		if r.Match != nil && r.Match(c.fp) {
+			c.fp.Viewer = r.Viewer
+			c.quirks = r.Quirks
+			break
+		}
+	}
+	c.identified = true
+	c.format = c.quirkFormat(c.format)
+}
+
+// quirkFormat returns the pixel format to use for a client asking for
+// pf.
+func (c *Conn) quirkFormat(pf PixelFormat) PixelFormat {
+	if c.quirks.RGB555 && pf.BPP == 16 && pf.RedMax == 31 && pf.GreenMax == 63 && pf.BlueMax == 31 {
+		pf.Depth = 15
+		pf.GreenMax = 31
+		pf.RedShift, pf.GreenShift, pf.BlueShift = 10, 5, 0
+	}
+	return pf
+}
+
+// quirkEncodings returns the encodings the client announced, minus those
+// its quirks rule out.
+func (c *Conn) quirkEncodings(encodings []int32) []int32 {
+	if c.quirks.NoLastRect {
+		encodings = slices.DeleteFunc(slices.Clone(encodings), func(e int32) bool { return e == encodingLastRect })
+	}
+	return encodings
+}
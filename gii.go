@@ -0,0 +1,230 @@
+package rfb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"strings"
+)
+
+// encodingGII is the pseudo-encoding of clients supporting the General
+// Input Interface extension, which describes input devices and their
+// valuators (axes) and carries their events.
+const encodingGII = -305
+
+const (
+	cmdGII = 253 // in both directions
+
+	giiBigEndian = 0x80 // flag in the sub-type byte
+
+	// Sub-types.
+	giiSubEvent   = 0
+	giiSubVersion = 1
+	giiSubDevice  = 2
+
+	// Valuator event types.
+	giiValuatorRelative = 12
+	giiValuatorAbsolute = 13
+
+	// maxGIIDevices is the most devices a client may create.
+	maxGIIDevices = 32
+)
+
+// TouchEvent is a contact on a touch device of a client speaking the
+// gii extension; see Server.TouchEvents. A contact is reported again
+// whenever it moves, and for the last time with a zero Pressure once it
+// was lifted.
+type TouchEvent struct {
+	Device   uint32 // the client's device, numbered from 1
+	ID       uint32 // the contact, unique among the device's current ones
+	X, Y     int
+	Pressure float64 // from 0 to 1; 1 if the device doesn't measure it
+}
+
+// giiValuator is the part of a gii valuator the server cares about.
+type giiValuator struct {
+	min, max int32
+}
+
+// giiDevice is a device created by the client. Its valuators hold their
+// last values, as gii events only carry changes.
+type giiDevice struct {
+	valuators []giiValuator
+	values    []int32
+	x, y      int // indices of the position valuators; -1 if missing
+	id, p     int // indices of the contact and pressure valuators, or -1
+}
+
+// touch reports whether the device is a touch device.
+func (d *giiDevice) touch() bool {
+	return d.x >= 0 && d.y >= 0
+}
+
+// event returns the TouchEvent for the device's current values.
+func (d *giiDevice) event(origin uint32) TouchEvent {
+	e := TouchEvent{Device: origin, X: int(d.values[d.x]), Y: int(d.values[d.y]), Pressure: 1}
+	if d.id >= 0 {
+		e.ID = uint32(d.values[d.id])
+	}
+	if d.p >= 0 {
+		v := d.valuators[d.p]
+		e.Pressure = 0
+		if v.max > v.min {
+			e.Pressure = min(max(float64(d.values[d.p]-v.min)/float64(v.max-v.min), 0), 1)
+		}
+	}
+	return e
+}
+
+// valuatorRole returns what the valuator with the given names measures.
+// gii doesn't standardize names, so the common ones are matched.
+func valuatorRole(short, long string) string {
+	short, long = strings.ToLower(short), strings.ToLower(long)
+	switch {
+	case short == "x" || strings.HasSuffix(long, " x"):
+		return "x"
+	case short == "y" || strings.HasSuffix(long, " y"):
+		return "y"
+	case short == "id" || short == "tid" || strings.Contains(long, "touch id"):
+		return "id"
+	case short == "p" || short == "pres" || strings.Contains(long, "pressure"):
+		return "pressure"
+	}
+	return ""
+}
+
+// sendGIIVersion tells a client supporting gii the versions the server
+// speaks, which has it go on with creating devices.
+func (c *Conn) sendGIIVersion() {
+	c.writeMessage(func() {
+		c.w(uint8(cmdGII))
+		c.w(uint8(giiBigEndian | giiSubVersion))
+		c.w(uint16(4)) // length
+		c.w(uint16(1)) // maximum version
+		c.w(uint16(1)) // minimum version
+	})
+}
+
+func (c *Conn) handleGII() {
+	subtype := c.readByte("gii.sub-type")
+	var order binary.ByteOrder = binary.LittleEndian
+	if subtype&giiBigEndian != 0 {
+		order = binary.BigEndian
+	}
+	b := make([]byte, 2)
+	c.read("gii.length", b)
+	data := make([]byte, order.Uint16(b))
+	c.read("gii.data", data)
+	if !c.s.TouchEvents {
+		c.failf(ClassMalformed, "unsupported command type %d from client", cmdGII)
+	}
+	switch subtype &^ giiBigEndian {
+	case giiSubVersion:
+		// Only version 1 exists.
+	case giiSubDevice:
+		origin := c.createGIIDevice(order, data)
+		c.writeMessage(func() {
+			c.w(uint8(cmdGII))
+			c.w(uint8(giiBigEndian | giiSubDevice))
+			c.w(uint16(4)) // length
+			c.w(origin)
+		})
+	case giiSubEvent:
+		c.handleGIIEvents(order, data)
+	default:
+		c.reject(ClassMalformed, "unsupported gii sub-type %d", subtype&^giiBigEndian)
+	}
+}
+
+// createGIIDevice records the device described by a device creation
+// message and returns its origin, or 0 if it can't be created.
+func (c *Conn) createGIIDevice(order binary.ByteOrder, data []byte) uint32 {
+	var hdr struct {
+		Name                          [32]byte
+		Vendor, Product, EventMask    uint32
+		Registers, Valuators, Buttons uint32
+	}
+	r := bytes.NewReader(data)
+	if binary.Read(r, order, &hdr) != nil || hdr.Valuators > 64 {
+		c.reject(ClassMalformed, "bad gii device creation of %d bytes", len(data))
+		return 0
+	}
+	name := string(bytes.TrimRight(hdr.Name[:], "\x00"))
+	d := &giiDevice{x: -1, y: -1, id: -1, p: -1}
+	for i := range int(hdr.Valuators) {
+		var v struct {
+			Index                uint32
+			Long                 [75]byte
+			Short                [5]byte
+			Min, Center, Max     int32
+			Unit                 uint32
+			Add, Mul, Div, Shift int32
+		}
+		if binary.Read(r, order, &v) != nil {
+			c.reject(ClassMalformed, "bad gii valuator for device %q", name)
+			return 0
+		}
+		switch valuatorRole(string(bytes.TrimRight(v.Short[:], "\x00")), string(bytes.TrimRight(v.Long[:], "\x00"))) {
+		case "x":
+			d.x = i
+		case "y":
+			d.y = i
+		case "id":
+			d.id = i
+		case "pressure":
+			d.p = i
+		}
+		d.valuators = append(d.valuators, giiValuator{v.Min, v.Max})
+	}
+	d.values = make([]int32, len(d.valuators))
+	if c.gii == nil {
+		c.gii = make(map[uint32]*giiDevice)
+	}
+	if len(c.gii) >= maxGIIDevices {
+		log.Printf("client has too many gii devices to create %q", name)
+		return 0
+	}
+	origin := uint32(len(c.gii) + 1)
+	c.gii[origin] = d
+	log.Printf("client created gii device %d %q with %d valuators (touch: %v)", origin, name, len(d.valuators), d.touch())
+	return origin
+}
+
+// handleGIIEvents delivers the touches in an event injection message.
+// Key, pointer and button events are left out; clients send them as core
+// RFB events too.
+func (c *Conn) handleGIIEvents(order binary.ByteOrder, data []byte) {
+	for len(data) > 0 {
+		size := int(data[0])
+		if size < 2 || size > len(data) {
+			c.reject(ClassMalformed, "gii event of %d bytes in %d", size, len(data))
+			return
+		}
+		e := data[:size]
+		data = data[size:]
+		if e[1] != giiValuatorRelative && e[1] != giiValuatorAbsolute {
+			continue
+		}
+		if size < 16 {
+			c.reject(ClassMalformed, "gii valuator event of %d bytes", size)
+			return
+		}
+		origin, first, count := order.Uint32(e[4:]), order.Uint32(e[8:]), order.Uint32(e[12:])
+		d := c.gii[origin]
+		if d == nil || !d.touch() {
+			continue
+		}
+		if uint64(first)+uint64(count) > uint64(len(d.values)) || 16+4*int(count) > size {
+			c.reject(ClassMalformed, "gii valuator event for %d values from %d", count, first)
+			return
+		}
+		for i := range count {
+			v := int32(order.Uint32(e[16+4*i:]))
+			if e[1] == giiValuatorRelative {
+				v += d.values[first+i]
+			}
+			d.values[first+i] = v
+		}
+		c.deliverInput(d.event(origin))
+	}
+}
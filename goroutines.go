@@ -0,0 +1,68 @@
+package rfb
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"runtime/debug"
+)
+
+// maxPulls is how many NextFrame calls a connection may have waiting at
+// once, counting those on sources swapped out with SetFrameSource. A
+// connection whose sources don't return fails rather than piling up
+// goroutines.
+const maxPulls = 4
+
+// ActiveGoroutines returns the number of goroutines the server runs for
+// its connections, for tests checking that none are leaked: once all
+// connections are gone, it drops to zero. A connection runs at most one
+// goroutine reading the client's messages, one sending updates, and
+// one per NextFrame call not returned yet, besides short-lived ones
+// such as for Session and Shutdown. A panic in any of them, including
+// in an Encoder or a FrameSource, ends only the connection it belongs
+// to, with an error of ClassInternal.
+func (s *Server) ActiveGoroutines() int {
+	return int(s.goroutines.Load())
+}
+
+// spawn runs f in a goroutine counted by ActiveGoroutines.
+func (c *Conn) spawn(f func()) {
+	c.s.goroutines.Add(1)
+	go func() {
+		defer c.s.goroutines.Add(-1)
+		f()
+	}()
+}
+
+// pullFrame calls src.NextFrame, turning a panic into an error, which
+// ends the connection.
+func pullFrame(src FrameSource) (li *LockableImage, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("NextFrame panicked: %v\n%s", e, debug.Stack())
+		}
+	}()
+	return src.NextFrame()
+}
+
+// An encoderPanic is the error encode returns for a panicking Encoder.
+type encoderPanic struct {
+	v     any
+	stack []byte
+}
+
+func (p encoderPanic) Error() string { return fmt.Sprintf("encoder panicked: %v", p.v) }
+
+// encode calls e.Encode, turning a panic into an encoderPanic. Those of
+// failf, for failed writes, go on.
+func encode(e Encoder, w io.Writer, pf PixelFormat, im image.Image, rect image.Rectangle) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if _, ok := v.(*ProtocolError); ok {
+				panic(v)
+			}
+			err = encoderPanic{v, debug.Stack()}
+		}
+	}()
+	return e.Encode(w, pf, im, rect)
+}
@@ -0,0 +1,102 @@
+package rfb_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// panicking is an Encoder that panics.
+type panicking struct{}
+
+func (panicking) Encode(w io.Writer, pf rfb.PixelFormat, img image.Image, rect image.Rectangle) error {
+	panic("broken encoder")
+}
+
+// stoppableSource serves one frame, then blocks until stop is closed.
+type stoppableSource struct {
+	img  *image.RGBA
+	sent bool
+	stop chan struct{}
+}
+
+func (s *stoppableSource) Bounds() image.Rectangle { return s.img.Rect }
+
+func (s *stoppableSource) NextFrame() (*rfb.LockableImage, error) {
+	if !s.sent {
+		s.sent = true
+		return &rfb.LockableImage{Img: s.img}, nil
+	}
+	<-s.stop
+	return nil, errors.New("stopped")
+}
+
+func TestEncoderPanic(t *testing.T) {
+	const enc = 0x52464202 // unassigned
+	rfb.RegisterEncoder(enc, "Panicking", func() rfb.Encoder { return panicking{} })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rfb.NewServer(16, 16)
+	go s.Serve(ln)
+	stop := make(chan struct{})
+	green := color.RGBA{0, 0xff, 0, 0xff}
+	connc := make(chan *rfb.Conn)
+	go func() {
+		for {
+			c, err := s.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			c.SetFrameSource(&stoppableSource{img: solid(16, 16, green), stop: stop})
+			connc <- c
+		}
+	}()
+
+	broken, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{Encodings: []int32{enc}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+	bc := <-connc
+	for deadline := time.Now().Add(5 * time.Second); bc.Err() == nil; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection with the panicking encoder is still up")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	var perr *rfb.ProtocolError
+	if !errors.As(bc.Err(), &perr) || perr.Class != rfb.ClassInternal {
+		t.Errorf("got error %v; want an internal error", bc.Err())
+	}
+
+	// The server and other connections carry on.
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-connc
+	if err := cc.WaitForPixel(image.Pt(1, 1), green, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is left behind once the connections are gone.
+	cc.Close()
+	ln.Close()
+	close(stop)
+	for deadline := time.Now().Add(5 * time.Second); s.ActiveGoroutines() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left", s.ActiveGoroutines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,100 @@
+package rfb
+
+import (
+	"image"
+	"log"
+)
+
+// Open H.264 rectangle flags.
+const (
+	h264ResetContext    = 1 << 0 // the rectangle starts a new stream
+	h264ResetAllContext = 1 << 1
+)
+
+// An H264Encoder starts software H.264 streams, for instance through
+// bindings to x264 or openh264. Set Server.H264Encoder to offer the Open
+// H.264 encoding; the server's HardwareEncoder, if any, is tried first.
+// A HardwareEncoder is also an H264Encoder.
+type H264Encoder interface {
+	// NewH264Stream starts a stream for frames with the given bounds.
+	NewH264Stream(bounds image.Rectangle) (HardwareStream, error)
+}
+
+// h264State is a connection's software H.264 stream. It's only used by
+// the sending goroutine.
+type h264State struct {
+	stream   HardwareStream
+	bounds   image.Rectangle // of the frames in the stream
+	disabled bool            // the encoder failed
+}
+
+// h264AvailableLocked reports whether the server can send img to the
+// client in Open H.264.
+func (c *Conn) h264AvailableLocked(bounds image.Rectangle) bool {
+	return c.s.H264Encoder != nil && !c.h264.disabled || c.hardware(HardwareH264, bounds) != nil
+}
+
+// encodeH264Locked compresses img as the next frame of the connection's
+// H.264 stream and returns the payload of an Open H.264 rectangle, or
+// nil if neither the hardware nor the software encoder can.
+func (c *Conn) encodeH264Locked(img image.Image) []byte {
+	b := img.Bounds()
+	if c.h264.bounds != b {
+		// Streams have a fixed frame size.
+		c.closeH264Streams()
+		c.h264.bounds = b
+	}
+
+	fresh := c.hw.stream == nil
+	data, ok := c.encodeHardwareH264(img)
+	if !ok {
+		fresh = c.h264.stream == nil
+		data, ok = c.encodeSoftwareH264(img)
+	}
+	if !ok {
+		return nil
+	}
+	var flags uint32
+	if fresh {
+		flags = h264ResetContext
+	}
+	payload := make([]byte, 0, 8+len(data))
+	payload = append(payload, byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	payload = append(payload, byte(flags>>24), byte(flags>>16), byte(flags>>8), byte(flags))
+	return append(payload, data...)
+}
+
+// encodeSoftwareH264 is encodeHardwareH264 for Server.H264Encoder.
+func (c *Conn) encodeSoftwareH264(img image.Image) (data []byte, ok bool) {
+	st := &c.h264
+	if c.s.H264Encoder == nil || st.disabled {
+		return nil, false
+	}
+	if st.stream == nil {
+		s, err := c.s.H264Encoder.NewH264Stream(img.Bounds())
+		if err != nil {
+			log.Printf("H.264 encoding failed: %v", err)
+			st.disabled = true
+			return nil, false
+		}
+		st.stream = s
+	}
+	data, err := st.stream.Encode(img)
+	if err != nil {
+		log.Printf("H.264 encoding failed: %v", err)
+		st.disabled = true
+		c.closeH264Streams()
+		return nil, false
+	}
+	return data, true
+}
+
+// closeH264Streams ends the connection's H.264 streams, hardware and
+// software.
+func (c *Conn) closeH264Streams() {
+	c.closeHardwareStream()
+	if c.h264.stream != nil {
+		c.h264.stream.Close()
+		c.h264.stream = nil
+	}
+}
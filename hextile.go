@@ -0,0 +1,112 @@
+package rfb
+
+import (
+	"image"
+	"io"
+)
+
+// Hextile tile subencoding flags.
+const (
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+)
+
+// hextileEncoder holds the state carried from tile to tile within a
+// Hextile rectangle, and buffers reused across rectangles.
+type hextileEncoder struct {
+	bg, fg           uint32
+	bgValid, fgValid bool
+
+	counts  map[uint32]int
+	covered [16 * 16]bool
+	out     []byte
+}
+
+// pushHextileLocked sends rect of im as the payload of a Hextile
+// rectangle: 16×16 tiles, each a background colour with subrectangles
+// on top, or raw if that's smaller.
+func (c *Conn) pushHextileLocked(w io.Writer, im image.Image, rect image.Rectangle) {
+	e := c.hextile
+	if e == nil {
+		e = &hextileEncoder{counts: make(map[uint32]int)}
+		c.hextile = e
+	}
+	// Nothing carries over from the previous rectangle.
+	e.bgValid, e.fgValid = false, false
+	for ty := rect.Min.Y; ty < rect.Max.Y; ty += 16 {
+		for tx := rect.Min.X; tx < rect.Max.X; tx += 16 {
+			t := image.Rect(tx, ty, min(tx+16, rect.Max.X), min(ty+16, rect.Max.Y))
+			c.pixbuf = c.translateLocked(c.pixbuf[:0], im, t)
+			w.Write(e.encodeTile(&c.format, c.pixbuf, t.Dx(), t.Dy()))
+		}
+	}
+}
+
+// encodeTile returns the encoding of a w×h tile with the given pixels.
+func (e *hextileEncoder) encodeTile(f *PixelFormat, px []uint32, w, h int) []byte {
+	bg, colours := background(px, e.counts)
+
+	rawSize := 1 + w*h*int(f.BPP)/8
+	out := append(e.out[:0], 0) // subencoding, filled in below
+	mask := byte(0)
+	if !e.bgValid || bg != e.bg {
+		mask |= hextileBackgroundSpecified
+		out = f.appendPixel(out, bg)
+	}
+	coloured := colours > 2
+	var fg uint32
+	if colours == 2 {
+		for v := range e.counts {
+			if v != bg {
+				fg = v
+			}
+		}
+		if !e.fgValid || fg != e.fg {
+			mask |= hextileForegroundSpecified
+			out = f.appendPixel(out, fg)
+		}
+	}
+	if colours > 1 {
+		mask |= hextileAnySubrects
+		if coloured {
+			mask |= hextileSubrectsColoured
+		}
+		countAt := len(out)
+		out = append(out, 0)
+		nsub := 0
+		for v, r := range subrects(px, w, h, bg, e.covered[:]) {
+			if len(out) >= rawSize {
+				break
+			}
+			if coloured {
+				out = f.appendPixel(out, v)
+			}
+			out = append(out, byte(r.Min.X<<4|r.Min.Y), byte((r.Dx()-1)<<4|(r.Dy()-1)))
+			nsub++
+		}
+		out[countAt] = byte(nsub)
+	}
+
+	if len(out) >= rawSize {
+		// Raw tiles leave the colours undefined for the next tile.
+		out = append(out[:0], hextileRaw)
+		for _, v := range px {
+			out = f.appendPixel(out, v)
+		}
+		e.bgValid, e.fgValid = false, false
+	} else {
+		out[0] = mask
+		e.bg, e.bgValid = bg, true
+		if mask&hextileForegroundSpecified != 0 {
+			e.fg, e.fgValid = fg, true
+		}
+		if coloured {
+			e.fgValid = false
+		}
+	}
+	e.out = out
+	return out
+}
@@ -0,0 +1,150 @@
+package rfb
+
+import (
+	"image"
+	"log"
+)
+
+// A HardwareCodec identifies a kind of compression that can be
+// offloaded to a HardwareEncoder.
+type HardwareCodec int
+
+const (
+	HardwareJPEG HardwareCodec = iota // single JPEG images, as used by Tight
+	HardwareH264                      // an H.264 stream per connection
+)
+
+func (c HardwareCodec) String() string {
+	switch c {
+	case HardwareJPEG:
+		return "JPEG"
+	case HardwareH264:
+		return "H.264"
+	}
+	return "HardwareCodec(?)"
+}
+
+// A HardwareEncoder offloads JPEG and H.264 compression to a hardware
+// encoder such as VA-API, NVENC or VideoToolbox. Bindings live outside
+// this package; set Server.HardwareEncoder to use one.
+//
+// The JPEG and H.264 encoding paths ask the encoder first and fall back
+// to software if it doesn't support the connection's parameters or
+// fails. After a failure, a connection stays on software until its
+// framebuffer is resized.
+type HardwareEncoder interface {
+	// Supports reports whether codec can be used for frames with the
+	// given bounds. It's asked once per connection and codec, and again
+	// when the connection's framebuffer is resized.
+	Supports(codec HardwareCodec, bounds image.Rectangle) bool
+
+	// EncodeJPEG compresses region r of img with the given quality
+	// (0 to 100).
+	EncodeJPEG(img image.Image, r image.Rectangle, quality int) ([]byte, error)
+
+	// NewH264Stream starts an H.264 stream for frames with the given
+	// bounds.
+	NewH264Stream(bounds image.Rectangle) (HardwareStream, error)
+}
+
+// A HardwareStream is a stateful hardware encoder for one connection.
+type HardwareStream interface {
+	// Encode compresses the next frame and returns the resulting
+	// bitstream.
+	Encode(img image.Image) ([]byte, error)
+
+	// Close releases the encoder.
+	Close() error
+}
+
+// hardwareState tracks a connection's use of the server's hardware
+// encoder. It's only used by the sending goroutine.
+type hardwareState struct {
+	checked  [2]bool // whether Supports was asked, per codec
+	disabled [2]bool // true if the codec is unsupported or failed
+	stream   HardwareStream
+}
+
+// hardware returns the server's hardware encoder if it may be used for
+// codec on this connection.
+func (c *Conn) hardware(codec HardwareCodec, bounds image.Rectangle) HardwareEncoder {
+	enc := c.s.HardwareEncoder
+	if enc == nil {
+		return nil
+	}
+	hw := &c.hw
+	if !hw.checked[codec] {
+		hw.checked[codec] = true
+		hw.disabled[codec] = !enc.Supports(codec, bounds)
+	}
+	if hw.disabled[codec] {
+		return nil
+	}
+	return enc
+}
+
+// hardwareFailed switches the connection to software encoding for codec.
+func (c *Conn) hardwareFailed(codec HardwareCodec, err error) {
+	log.Printf("hardware %v encoding failed, using software: %v", codec, err)
+	c.hw.disabled[codec] = true
+	if codec == HardwareH264 {
+		c.closeHardwareStream()
+	}
+}
+
+// encodeHardwareJPEG compresses r of img in hardware. ok is false if the
+// caller has to fall back to software.
+func (c *Conn) encodeHardwareJPEG(img image.Image, r image.Rectangle, quality int) (data []byte, ok bool) {
+	enc := c.hardware(HardwareJPEG, img.Bounds())
+	if enc == nil {
+		return nil, false
+	}
+	data, err := enc.EncodeJPEG(img, r, quality)
+	if err != nil {
+		c.hardwareFailed(HardwareJPEG, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// encodeHardwareH264 compresses img as the next frame of the
+// connection's H.264 stream. ok is false if the caller has to fall back
+// to software; the software encoder must then start a new stream.
+func (c *Conn) encodeHardwareH264(img image.Image) (data []byte, ok bool) {
+	enc := c.hardware(HardwareH264, img.Bounds())
+	if enc == nil {
+		return nil, false
+	}
+	if c.hw.stream == nil {
+		s, err := enc.NewH264Stream(img.Bounds())
+		if err != nil {
+			c.hardwareFailed(HardwareH264, err)
+			return nil, false
+		}
+		c.hw.stream = s
+	}
+	data, err := c.hw.stream.Encode(img)
+	if err != nil {
+		c.hardwareFailed(HardwareH264, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// closeHardwareStream ends the connection's H.264 stream, if any. The
+// next frame starts a new one.
+func (c *Conn) closeHardwareStream() {
+	if c.hw.stream != nil {
+		c.hw.stream.Close()
+		c.hw.stream = nil
+	}
+}
+
+// resetHardware ends the connection's H.264 stream and forgets which
+// codecs are unsupported or failed, so the hardware encoder is asked
+// again for frames of a new size.
+func (c *Conn) resetHardware() {
+	c.closeHardwareStream()
+	c.hw.checked = [2]bool{}
+	c.hw.disabled = [2]bool{}
+}
@@ -0,0 +1,93 @@
+package rfb
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// Identity is who a client authenticated as, for the application's
+// authorization and logging, such as making some users view-only.
+type Identity struct {
+	// User is the user name the client sent, if its security type
+	// carries one, as Apple Remote Desktop, RSA-AES and MSLogonII do.
+	User string
+
+	// Method names the security type, like "VNC Authentication", or
+	// "None" for clients that didn't authenticate.
+	Method string
+
+	// TLS is the state of the connection's TLS layer, if it was served
+	// over a *tls.Conn.
+	TLS *tls.ConnectionState
+
+	// Certificate is the client's certificate, as verified against
+	// Server.ClientCAs. Its Subject names the client.
+	Certificate *x509.Certificate
+}
+
+// Identity returns who the client authenticated as. Accept may return
+// connections still in the handshake; Method is set once the client
+// has passed the security negotiation.
+func (c *Conn) Identity() Identity {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.identity
+}
+
+// SetUser records the user name a SecurityHandler authenticated the
+// client as, for Identity.
+func (c *Conn) SetUser(user string) {
+	c.mu.Lock()
+	c.identity.User = user
+	c.mu.Unlock()
+}
+
+// setIdentity completes the client's Identity once security type h has
+// run.
+func (c *Conn) setIdentity(h SecurityHandler) {
+	var state *tls.ConnectionState
+	if tc, ok := c.c.(*tls.Conn); ok {
+		s := tc.ConnectionState()
+		state = &s
+	}
+	c.mu.Lock()
+	c.identity.Method = securityName(h)
+	c.identity.TLS = state
+	c.mu.Unlock()
+}
+
+// verifyClientCert checks the client's TLS certificate against
+// Server.ClientCAs, refusing clients without a valid one, and records
+// it for Identity.
+func (c *Conn) verifyClientCert() {
+	tc, ok := c.c.(*tls.Conn)
+	if !ok {
+		c.refuseSecurity("TLS client certificate required")
+		c.failf(ClassAuth, "client certificate required on a connection without TLS")
+	}
+	if err := tc.Handshake(); err != nil {
+		c.failf(ClassIO, "TLS handshake: %v", err)
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		c.authFailure()
+		c.refuseSecurity("TLS client certificate required")
+		c.failf(ClassAuth, "client sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         c.s.ClientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		c.authFailure()
+		c.refuseSecurity("TLS client certificate not accepted")
+		c.failf(ClassAuth, "client certificate %q: %v", certs[0].Subject, err)
+	}
+	c.mu.Lock()
+	c.identity.Certificate = certs[0]
+	c.mu.Unlock()
+}
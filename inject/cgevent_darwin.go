@@ -0,0 +1,403 @@
+//go:build darwin && cgo
+
+package inject
+
+/*
+#cgo LDFLAGS: -framework ApplicationServices -framework Carbon -framework CoreFoundation
+
+#include <ApplicationServices/ApplicationServices.h>
+#include <Carbon/Carbon.h>
+
+typedef struct {
+	UniChar ch;
+	uint16_t code;
+	uint8_t shift, option;
+} rfb_keymap_entry;
+
+// rfb_keymap fills out with the characters typed by each key of the active
+// layout, without modifiers, with Shift, with Option and with both. It
+// returns the number of entries written.
+static int rfb_keymap(rfb_keymap_entry *out, int max) {
+	TISInputSourceRef src = TISCopyCurrentKeyboardLayoutInputSource();
+	if (src == NULL) {
+		return 0;
+	}
+	CFDataRef data = TISGetInputSourceProperty(src, kTISPropertyUnicodeKeyLayoutData);
+	if (data == NULL) {
+		CFRelease(src);
+		return 0;
+	}
+	const UCKeyboardLayout *layout = (const UCKeyboardLayout *)CFDataGetBytePtr(data);
+
+	static const UInt32 mods[] = {0, shiftKey, optionKey, shiftKey | optionKey};
+	int n = 0;
+	for (int m = 0; m < 4; m++) {
+		for (uint16_t code = 0; code < 128 && n < max; code++) {
+			UInt32 dead = 0;
+			UniChar chars[4];
+			UniCharCount len = 0;
+			OSStatus err = UCKeyTranslate(layout, code, kUCKeyActionDown, (mods[m] >> 8) & 0xff,
+				LMGetKbdType(), kUCKeyTranslateNoDeadKeysBit, &dead, 4, &len, chars);
+			if (err != noErr || len != 1) {
+				continue;
+			}
+			out[n++] = (rfb_keymap_entry){chars[0], code, (mods[m] & shiftKey) != 0, (mods[m] & optionKey) != 0};
+		}
+	}
+	CFRelease(src);
+	return n;
+}
+
+static int rfb_post_key(uint16_t code, int down, CGEventFlags flags, UniChar ch) {
+	CGEventRef ev = CGEventCreateKeyboardEvent(NULL, code, down);
+	if (ev == NULL) {
+		return -1;
+	}
+	if (ch != 0) {
+		CGEventKeyboardSetUnicodeString(ev, 1, &ch);
+	}
+	CGEventSetFlags(ev, flags);
+	CGEventPost(kCGHIDEventTap, ev);
+	CFRelease(ev);
+	return 0;
+}
+
+static int rfb_post_mouse(CGEventType type, double x, double y, CGMouseButton button) {
+	CGEventRef ev = CGEventCreateMouseEvent(NULL, type, CGPointMake(x, y), button);
+	if (ev == NULL) {
+		return -1;
+	}
+	CGEventPost(kCGHIDEventTap, ev);
+	CFRelease(ev);
+	return 0;
+}
+
+static int rfb_post_scroll(int32_t dy, int32_t dx) {
+	CGEventRef ev = CGEventCreateScrollWheelEvent(NULL, kCGScrollEventUnitLine, 2, dy, dx);
+	if (ev == NULL) {
+		return -1;
+	}
+	CGEventPost(kCGHIDEventTap, ev);
+	CFRelease(ev);
+	return 0;
+}
+
+static int rfb_trusted(int prompt) {
+	if (!prompt) {
+		return AXIsProcessTrusted();
+	}
+	const void *keys[] = {kAXTrustedCheckOptionPrompt};
+	const void *values[] = {kCFBooleanTrue};
+	CFDictionaryRef opts = CFDictionaryCreate(NULL, keys, values, 1,
+		&kCFCopyStringDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	int ok = AXIsProcessTrustedWithOptions(opts);
+	CFRelease(opts);
+	return ok;
+}
+
+static int rfb_display_bounds(int index, CGRect *bounds, size_t *pw, size_t *ph) {
+	CGDirectDisplayID ids[32];
+	uint32_t n = 0;
+	if (CGGetActiveDisplayList(32, ids, &n) != kCGErrorSuccess || index < 0 || (uint32_t)index >= n) {
+		return -1;
+	}
+	*bounds = CGDisplayBounds(ids[index]);
+	*pw = CGDisplayPixelsWide(ids[index]);
+	*ph = CGDisplayPixelsHigh(ids[index]);
+	CGDisplayModeRef mode = CGDisplayCopyDisplayMode(ids[index]);
+	if (mode != NULL) {
+		*pw = CGDisplayModeGetPixelWidth(mode);
+		*ph = CGDisplayModeGetPixelHeight(mode);
+		CGDisplayModeRelease(mode);
+	}
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/keysym"
+)
+
+// ErrNotTrusted is returned by NewCGEvent if the process isn't allowed to
+// control the computer (System Settings, Privacy & Security,
+// Accessibility). Events posted without the permission are silently
+// dropped by the system.
+var ErrNotTrusted = errors.New("inject: accessibility permission not granted")
+
+// Virtual key codes of keys that are the same on every layout
+// (HIToolbox/Events.h).
+var macKeys = map[uint32]uint16{
+	keysym.Return:     0x24,
+	keysym.Tab:        0x30,
+	' ':               0x31,
+	keysym.BackSpace:  0x33,
+	keysym.Escape:     0x35,
+	keysym.SuperR:     0x36,
+	keysym.SuperL:     0x37,
+	keysym.MetaR:      0x36,
+	keysym.MetaL:      0x37,
+	keysym.ShiftL:     0x38,
+	keysym.CapsLock:   0x39,
+	keysym.AltL:       0x3a,
+	keysym.ControlL:   0x3b,
+	keysym.ShiftR:     0x3c,
+	keysym.AltR:       0x3d,
+	keysym.ControlR:   0x3e,
+	keysym.Help:       0x72,
+	keysym.Insert:     0x72,
+	keysym.Home:       0x73,
+	keysym.PageUp:     0x74,
+	keysym.Delete:     0x75,
+	keysym.End:        0x77,
+	keysym.PageDown:   0x79,
+	keysym.Left:       0x7b,
+	keysym.Right:      0x7c,
+	keysym.Down:       0x7d,
+	keysym.Up:         0x7e,
+	keysym.KPDecimal:  0x41,
+	keysym.KPMultiply: 0x43,
+	keysym.KPAdd:      0x45,
+	keysym.NumLock:    0x47, // keypad Clear
+	keysym.KPDivide:   0x4b,
+	keysym.KPEnter:    0x4c,
+	keysym.KPSubtract: 0x4e,
+	keysym.KPEqual:    0x51,
+	keysym.KP0:        0x52,
+	keysym.KP0 + 1:    0x53,
+	keysym.KP0 + 2:    0x54,
+	keysym.KP0 + 3:    0x55,
+	keysym.KP0 + 4:    0x56,
+	keysym.KP0 + 5:    0x57,
+	keysym.KP0 + 6:    0x58,
+	keysym.KP0 + 7:    0x59,
+	keysym.KP0 + 8:    0x5b,
+	keysym.KP0 + 9:    0x5c,
+	keysym.F1:         0x7a,
+	keysym.F1 + 1:     0x78,
+	keysym.F1 + 2:     0x63,
+	keysym.F1 + 3:     0x76,
+	keysym.F1 + 4:     0x60,
+	keysym.F1 + 5:     0x61,
+	keysym.F1 + 6:     0x62,
+	keysym.F1 + 7:     0x64,
+	keysym.F1 + 8:     0x65,
+	keysym.F1 + 9:     0x6d,
+	keysym.F1 + 10:    0x67,
+	keysym.F1 + 11:    0x6f,
+	keysym.F1 + 12:    0x69,
+	keysym.F1 + 13:    0x6b,
+	keysym.F1 + 14:    0x71,
+
+	keysym.ISOLevel3Shift: 0x3d,
+	keysym.ModeSwitch:     0x3d,
+}
+
+// Modifier flags for the modifier keysyms.
+var macFlags = map[uint32]C.CGEventFlags{
+	keysym.ShiftL:         C.kCGEventFlagMaskShift,
+	keysym.ShiftR:         C.kCGEventFlagMaskShift,
+	keysym.ControlL:       C.kCGEventFlagMaskControl,
+	keysym.ControlR:       C.kCGEventFlagMaskControl,
+	keysym.AltL:           C.kCGEventFlagMaskAlternate,
+	keysym.AltR:           C.kCGEventFlagMaskAlternate,
+	keysym.ISOLevel3Shift: C.kCGEventFlagMaskAlternate,
+	keysym.ModeSwitch:     C.kCGEventFlagMaskAlternate,
+	keysym.MetaL:          C.kCGEventFlagMaskCommand,
+	keysym.MetaR:          C.kCGEventFlagMaskCommand,
+	keysym.SuperL:         C.kCGEventFlagMaskCommand,
+	keysym.SuperR:         C.kCGEventFlagMaskCommand,
+}
+
+type macChar struct {
+	code          uint16
+	shift, option bool
+}
+
+// CGEvent is an injector for macOS built on CGEventPost.
+//
+// Characters are mapped to key codes through the keyboard layout that
+// was active when the injector was created. If typing a character would
+// need modifiers other than the ones the client holds down, or the layout
+// can't type it at all, it's sent as Unicode text instead.
+type CGEvent struct {
+	originX, originY float64 // display origin in global coordinates (points)
+	scale            float64 // points per framebuffer pixel
+
+	mu      sync.Mutex
+	chars   map[rune]macChar
+	flags   C.CGEventFlags
+	held    map[uint32]bool // modifier keysyms pressed
+	buttons uint8
+	x, y    float64
+}
+
+// NewCGEvent returns an injector for the display with the given index,
+// 0 being the main display. Pointer coordinates are taken to be pixels of
+// that display, as captured by the quartz capture backend.
+//
+// If the process lacks the Accessibility permission, the system prompt is
+// shown (if prompt is true) and ErrNotTrusted returned.
+func NewCGEvent(display int, prompt bool) (*CGEvent, error) {
+	p := C.int(0)
+	if prompt {
+		p = 1
+	}
+	if C.rfb_trusted(p) == 0 {
+		return nil, ErrNotTrusted
+	}
+
+	var bounds C.CGRect
+	var pw, ph C.size_t
+	if C.rfb_display_bounds(C.int(display), &bounds, &pw, &ph) != 0 {
+		return nil, errors.New("inject: no such display")
+	}
+	inj := &CGEvent{
+		originX: float64(bounds.origin.x),
+		originY: float64(bounds.origin.y),
+		scale:   1,
+		chars:   make(map[rune]macChar),
+		held:    make(map[uint32]bool),
+	}
+	if pw > 0 {
+		inj.scale = float64(bounds.size.width) / float64(pw)
+	}
+
+	var entries [4 * 128]C.rfb_keymap_entry
+	n := int(C.rfb_keymap(&entries[0], C.int(len(entries))))
+	for _, e := range entries[:n] {
+		r := rune(e.ch)
+		if _, dup := inj.chars[r]; dup {
+			continue // the first (simplest) combination wins
+		}
+		inj.chars[r] = macChar{uint16(e.code), e.shift != 0, e.option != 0}
+	}
+	return inj, nil
+}
+
+// Trusted reports whether the process has the Accessibility permission.
+func Trusted() bool {
+	return C.rfb_trusted(0) != 0
+}
+
+// InjectKey presses or releases the key for e.Key.
+func (c *CGEvent) InjectKey(e rfb.KeyEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	down := e.DownFlag != 0
+	if _, ok := macFlags[e.Key]; ok {
+		c.held[e.Key] = down
+		c.flags = 0
+		for ks, pressed := range c.held {
+			if pressed {
+				c.flags |= macFlags[ks]
+			}
+		}
+	}
+
+	if code, ok := macKeys[e.Key]; ok {
+		return c.post(code, down, 0)
+	}
+	r := keysym.ToRune(e.Key)
+	if r <= 0 || r >= 0x10000 {
+		return nil // nothing we could type
+	}
+	shift := c.flags&C.kCGEventFlagMaskShift != 0
+	option := c.flags&C.kCGEventFlagMaskAlternate != 0
+	if mc, ok := c.chars[r]; ok && mc.shift == shift && mc.option == option {
+		return c.post(mc.code, down, 0)
+	}
+	if mc, ok := c.chars[r]; ok && c.flags&(C.kCGEventFlagMaskCommand|C.kCGEventFlagMaskControl) != 0 {
+		// Shortcuts must be real key presses to trigger anything.
+		return c.post(mc.code, down, 0)
+	}
+	return c.post(0, down, C.UniChar(r))
+}
+
+func (c *CGEvent) post(code uint16, down bool, ch C.UniChar) error {
+	d := C.int(0)
+	if down {
+		d = 1
+	}
+	if C.rfb_post_key(C.uint16_t(code), d, c.flags, ch) != 0 {
+		return errors.New("inject: creating key event failed")
+	}
+	return nil
+}
+
+// InjectPointer moves the pointer and presses or releases buttons as
+// necessary. Wheel "buttons" are turned into scrolling when pressed.
+func (c *CGEvent) InjectPointer(e rfb.PointerEvent) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	x := c.originX + float64(e.X)*c.scale
+	y := c.originY + float64(e.Y)*c.scale
+	pressed := e.ButtonMask &^ c.buttons
+	released := c.buttons &^ e.ButtonMask
+	c.buttons = e.ButtonMask
+
+	if x != c.x || y != c.y {
+		c.x, c.y = x, y
+		typ, button := C.CGEventType(C.kCGEventMouseMoved), C.CGMouseButton(C.kCGMouseButtonLeft)
+		switch held := e.ButtonMask &^ pressed; {
+		case held&buttonLeft != 0:
+			typ = C.kCGEventLeftMouseDragged
+		case held&buttonRight != 0:
+			typ, button = C.kCGEventRightMouseDragged, C.kCGMouseButtonRight
+		case held&buttonMiddle != 0:
+			typ, button = C.kCGEventOtherMouseDragged, C.kCGMouseButtonCenter
+		}
+		if C.rfb_post_mouse(typ, C.double(x), C.double(y), button) != 0 {
+			return errors.New("inject: creating mouse event failed")
+		}
+	}
+
+	for _, b := range []struct {
+		mask     uint8
+		down, up C.CGEventType
+		button   C.CGMouseButton
+	}{
+		{buttonLeft, C.kCGEventLeftMouseDown, C.kCGEventLeftMouseUp, C.kCGMouseButtonLeft},
+		{buttonMiddle, C.kCGEventOtherMouseDown, C.kCGEventOtherMouseUp, C.kCGMouseButtonCenter},
+		{buttonRight, C.kCGEventRightMouseDown, C.kCGEventRightMouseUp, C.kCGMouseButtonRight},
+	} {
+		typ := C.CGEventType(0)
+		switch {
+		case pressed&b.mask != 0:
+			typ = b.down
+		case released&b.mask != 0:
+			typ = b.up
+		default:
+			continue
+		}
+		if C.rfb_post_mouse(typ, C.double(x), C.double(y), b.button) != 0 {
+			return errors.New("inject: creating mouse event failed")
+		}
+	}
+
+	var dx, dy int32
+	if pressed&wheelUp != 0 {
+		dy++
+	}
+	if pressed&wheelDown != 0 {
+		dy--
+	}
+	if pressed&wheelLeft != 0 {
+		dx++
+	}
+	if pressed&wheelRight != 0 {
+		dx--
+	}
+	if dx != 0 || dy != 0 {
+		if C.rfb_post_scroll(C.int32_t(dy), C.int32_t(dx)) != 0 {
+			return errors.New("inject: creating scroll event failed")
+		}
+	}
+	return nil
+}
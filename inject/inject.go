@@ -0,0 +1,15 @@
+// Package inject replays RFB client input on the local machine. It
+// provides rfb.InputInjector implementations for the platforms the
+// capture backends cover.
+package inject
+
+// Bits of rfb.PointerEvent.ButtonMask.
+const (
+	buttonLeft = 1 << iota
+	buttonMiddle
+	buttonRight
+	wheelUp
+	wheelDown
+	wheelLeft
+	wheelRight
+)
@@ -0,0 +1,314 @@
+package inject
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/keysym"
+)
+
+var (
+	user32               = syscall.NewLazyDLL("user32.dll")
+	procSendInput        = user32.NewProc("SendInput")
+	procVkKeyScanW       = user32.NewProc("VkKeyScanW")
+	procMapVirtualKeyW   = user32.NewProc("MapVirtualKeyW")
+	procGetSystemMetrics = user32.NewProc("GetSystemMetrics")
+)
+
+const (
+	inputMouse    = 0
+	inputKeyboard = 1
+
+	keyeventfExtendedKey = 0x0001
+	keyeventfKeyUp       = 0x0002
+	keyeventfUnicode     = 0x0004
+	keyeventfScanCode    = 0x0008
+
+	mouseeventfMove        = 0x0001
+	mouseeventfLeftDown    = 0x0002
+	mouseeventfLeftUp      = 0x0004
+	mouseeventfRightDown   = 0x0008
+	mouseeventfRightUp     = 0x0010
+	mouseeventfMiddleDown  = 0x0020
+	mouseeventfMiddleUp    = 0x0040
+	mouseeventfWheel       = 0x0800
+	mouseeventfHWheel      = 0x1000
+	mouseeventfVirtualDesk = 0x4000
+	mouseeventfAbsolute    = 0x8000
+
+	wheelDelta = 120
+
+	smXVirtualScreen  = 76
+	smYVirtualScreen  = 77
+	smCXVirtualScreen = 78
+	smCYVirtualScreen = 79
+
+	mapvkVkToVsc = 0
+)
+
+// The INPUT structure; the union is sized for its largest member.
+type mouseInput struct {
+	dx, dy    int32
+	mouseData uint32
+	flags     uint32
+	time      uint32
+	extraInfo uintptr
+}
+
+type keybdInput struct {
+	vk, scan  uint16
+	flags     uint32
+	time      uint32
+	extraInfo uintptr
+}
+
+type input struct {
+	typ uint32
+	mi  mouseInput // or keybdInput
+}
+
+func keyboard(ki keybdInput) input {
+	in := input{typ: inputKeyboard}
+	*(*keybdInput)(unsafe.Pointer(&in.mi)) = ki
+	return in
+}
+
+type vkey struct {
+	vk       uint16
+	extended bool
+}
+
+// Keysyms that have a fixed virtual-key code, independent of the layout.
+var vkeys = map[uint32]vkey{
+	keysym.BackSpace:   {0x08, false},
+	keysym.Tab:         {0x09, false},
+	keysym.Clear:       {0x0c, false},
+	keysym.Return:      {0x0d, false},
+	keysym.Pause:       {0x13, false},
+	keysym.ScrollLock:  {0x91, false},
+	keysym.Escape:      {0x1b, false},
+	keysym.Delete:      {0x2e, true},
+	keysym.Home:        {0x24, true},
+	keysym.Left:        {0x25, true},
+	keysym.Up:          {0x26, true},
+	keysym.Right:       {0x27, true},
+	keysym.Down:        {0x28, true},
+	keysym.PageUp:      {0x21, true},
+	keysym.PageDown:    {0x22, true},
+	keysym.End:         {0x23, true},
+	keysym.Select:      {0x29, false},
+	keysym.Print:       {0x2c, true},
+	keysym.Execute:     {0x2b, false},
+	keysym.Insert:      {0x2d, true},
+	keysym.Menu:        {0x5d, true},
+	keysym.Help:        {0x2f, false},
+	keysym.Cancel:      {0x03, false},
+	keysym.NumLock:     {0x90, true},
+	keysym.KPEnter:     {0x0d, true},
+	keysym.KPHome:      {0x24, false},
+	keysym.KPLeft:      {0x25, false},
+	keysym.KPUp:        {0x26, false},
+	keysym.KPRight:     {0x27, false},
+	keysym.KPDown:      {0x28, false},
+	keysym.KPPageUp:    {0x21, false},
+	keysym.KPPageDown:  {0x22, false},
+	keysym.KPEnd:       {0x23, false},
+	keysym.KPBegin:     {0x0c, false},
+	keysym.KPInsert:    {0x2d, false},
+	keysym.KPDelete:    {0x2e, false},
+	keysym.KPMultiply:  {0x6a, false},
+	keysym.KPAdd:       {0x6b, false},
+	keysym.KPSeparator: {0x6c, false},
+	keysym.KPSubtract:  {0x6d, false},
+	keysym.KPDecimal:   {0x6e, false},
+	keysym.KPDivide:    {0x6f, true},
+	keysym.ShiftL:      {0xa0, false},
+	keysym.ShiftR:      {0xa1, false},
+	keysym.ControlL:    {0xa2, false},
+	keysym.ControlR:    {0xa3, true},
+	keysym.CapsLock:    {0x14, false},
+	keysym.MetaL:       {0xa4, false},
+	keysym.MetaR:       {0xa5, true},
+	keysym.AltL:        {0xa4, false},
+	keysym.AltR:        {0xa5, true},
+	keysym.SuperL:      {0x5b, true},
+	keysym.SuperR:      {0x5c, true},
+
+	keysym.ISOLevel3Shift: {0xa5, true},
+	' ':                   {0x20, false},
+}
+
+func init() {
+	for i := uint32(0); i < 10; i++ {
+		vkeys[keysym.KP0+i] = vkey{uint16(0x60 + i), false}
+	}
+	for i := uint32(0); i < 24; i++ {
+		vkeys[keysym.F1+i] = vkey{uint16(0x70 + i), false}
+	}
+}
+
+// SendInput is an injector for Windows built on the SendInput API.
+//
+// Keys with a layout independent virtual-key code are sent as such.
+// Characters are looked up in the active keyboard layout and sent as
+// their virtual key; characters the layout can't type are sent as
+// Unicode input.
+type SendInput struct {
+	screen image.Rectangle
+
+	mu      sync.Mutex
+	buttons uint8
+	unicode map[uint32]uint16 // keysyms pressed as Unicode input
+}
+
+// NewSendInput returns an injector mapping the framebuffer onto screen,
+// given in virtual desktop coordinates (the bounds of the captured
+// monitor). An empty screen means the primary monitor.
+func NewSendInput(screen image.Rectangle) *SendInput {
+	if screen.Empty() {
+		screen = image.Rect(0, 0, systemMetric(0), systemMetric(1)) // SM_CXSCREEN, SM_CYSCREEN
+	}
+	return &SendInput{
+		screen:  screen,
+		unicode: make(map[uint32]uint16),
+	}
+}
+
+func systemMetric(index int) int {
+	r, _, _ := procGetSystemMetrics.Call(uintptr(index))
+	return int(int32(r))
+}
+
+func sendInput(inputs ...input) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	n, _, err := procSendInput.Call(uintptr(len(inputs)), uintptr(unsafe.Pointer(&inputs[0])), unsafe.Sizeof(inputs[0]))
+	if int(n) != len(inputs) {
+		if err == nil || err == syscall.Errno(0) {
+			err = errors.New("inject: SendInput was blocked")
+		}
+		return err
+	}
+	return nil
+}
+
+func scanCode(vk uint16) uint16 {
+	r, _, _ := procMapVirtualKeyW.Call(uintptr(vk), mapvkVkToVsc)
+	return uint16(r)
+}
+
+// InjectKey presses or releases the key for e.Key.
+func (s *SendInput) InjectKey(e rfb.KeyEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	down := e.DownFlag != 0
+	var flags uint32
+	if !down {
+		flags |= keyeventfKeyUp
+	}
+
+	vk, ok := vkeys[e.Key]
+	if !ok {
+		if r := keysym.ToRune(e.Key); r >= 'a' && r <= 'z' {
+			// letters are their upper-case ASCII value on every layout
+			vk, ok = vkey{uint16(r - 'a' + 'A'), false}, true
+		} else if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			vk, ok = vkey{uint16(r), false}, true
+		} else if r > 0 && r < 0x10000 {
+			if res, _, _ := procVkKeyScanW.Call(uintptr(r)); int16(res) != -1 {
+				// The low byte is the key, the high byte the shift state
+				// the layout needs for it. The client sends the modifiers
+				// it wants itself.
+				vk, ok = vkey{uint16(res & 0xff), false}, true
+			}
+		}
+	}
+	if ok {
+		if vk.extended {
+			flags |= keyeventfExtendedKey
+		}
+		return sendInput(keyboard(keybdInput{vk: vk.vk, scan: scanCode(vk.vk), flags: flags}))
+	}
+
+	// Unicode fallback. Characters outside the BMP would need a
+	// surrogate pair, which KEYEVENTF_UNICODE supports, but the viewer
+	// sends separate press and release events, so only the BMP is
+	// handled.
+	r := keysym.ToRune(e.Key)
+	if r <= 0 || r >= 0x10000 {
+		return nil // nothing we could type
+	}
+	if down {
+		s.unicode[e.Key] = uint16(r)
+	} else if _, pressed := s.unicode[e.Key]; !pressed {
+		return nil
+	} else {
+		delete(s.unicode, e.Key)
+	}
+	return sendInput(keyboard(keybdInput{scan: uint16(r), flags: flags | keyeventfUnicode}))
+}
+
+// InjectPointer moves the pointer and presses or releases buttons as
+// necessary. Wheel "buttons" are turned into wheel rotation when pressed.
+func (s *SendInput) InjectPointer(e rfb.PointerEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Absolute coordinates are normalized to 0..65535 across the whole
+	// virtual desktop.
+	vx, vy := systemMetric(smXVirtualScreen), systemMetric(smYVirtualScreen)
+	vw, vh := systemMetric(smCXVirtualScreen), systemMetric(smCYVirtualScreen)
+	if vw < 2 || vh < 2 {
+		return errors.New("inject: can't determine virtual desktop size")
+	}
+	x := s.screen.Min.X + int(e.X) - vx
+	y := s.screen.Min.Y + int(e.Y) - vy
+	inputs := []input{{typ: inputMouse, mi: mouseInput{
+		dx:    int32(x * 65535 / (vw - 1)),
+		dy:    int32(y * 65535 / (vh - 1)),
+		flags: mouseeventfMove | mouseeventfAbsolute | mouseeventfVirtualDesk,
+	}}}
+
+	pressed := e.ButtonMask &^ s.buttons
+	released := s.buttons &^ e.ButtonMask
+	s.buttons = e.ButtonMask
+	for _, b := range []struct {
+		mask     uint8
+		down, up uint32
+	}{
+		{buttonLeft, mouseeventfLeftDown, mouseeventfLeftUp},
+		{buttonMiddle, mouseeventfMiddleDown, mouseeventfMiddleUp},
+		{buttonRight, mouseeventfRightDown, mouseeventfRightUp},
+	} {
+		if pressed&b.mask != 0 {
+			inputs = append(inputs, input{typ: inputMouse, mi: mouseInput{flags: b.down}})
+		}
+		if released&b.mask != 0 {
+			inputs = append(inputs, input{typ: inputMouse, mi: mouseInput{flags: b.up}})
+		}
+	}
+	for _, w := range []struct {
+		mask  uint8
+		flags uint32
+		delta int32
+	}{
+		{wheelUp, mouseeventfWheel, wheelDelta},
+		{wheelDown, mouseeventfWheel, -wheelDelta},
+		{wheelLeft, mouseeventfHWheel, -wheelDelta},
+		{wheelRight, mouseeventfHWheel, wheelDelta},
+	} {
+		if pressed&w.mask != 0 {
+			inputs = append(inputs, input{typ: inputMouse, mi: mouseInput{
+				mouseData: uint32(w.delta),
+				flags:     w.flags,
+			}})
+		}
+	}
+	return sendInput(inputs...)
+}
@@ -0,0 +1,115 @@
+package rfb
+
+import (
+	"maps"
+	"slices"
+)
+
+// An InputInjector replays client input on the local machine. The inject
+// subpackage has implementations for the common platforms.
+type InputInjector interface {
+	InjectKey(KeyEvent) error
+	InjectPointer(PointerEvent) error
+}
+
+// ForwardEvents passes the client's key and pointer events to inj until
+// the client disconnects or inj fails. Other events are dropped, so it
+// should only be used if the application has no interest in them.
+func (c *Conn) ForwardEvents(inj InputInjector) error {
+	for e := range c.Event {
+		if err := inject(inj, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inject passes the input event e to inj.
+func inject(inj InputInjector, e interface{}) error {
+	switch e := e.(type) {
+	case KeyEvent:
+		return inj.InjectKey(e)
+	case PointerEvent:
+		return inj.InjectPointer(e)
+	case QEMUKeyEvent:
+		return inj.InjectKey(KeyEvent{DownFlag: uint8(e.DownFlag), Key: e.Key})
+	}
+	return nil
+}
+
+// injectAll passes events to inj, ignoring errors: they are releases,
+// and the next event reports a broken injector.
+func injectAll(inj InputInjector, events []interface{}) {
+	for _, e := range events {
+		inject(inj, e)
+	}
+}
+
+// heldInput tracks the keys, pointer buttons and touch contacts an input
+// stream holds down, so they can be released when the stream ends. Otherwise, a
+// client disconnecting with Ctrl down leaves it stuck on the machine.
+type heldInput struct {
+	keys       map[uint32]interface{} // the event releasing each held keysym
+	buttons    uint8
+	extButtons uint8                  // PointerEvent.ExtButtonMask
+	pointer    interface{}            // the event releasing the buttons
+	touches    map[uint64]interface{} // the event lifting each contact, by device and ID
+}
+
+// track records the keys and buttons held after e.
+func (h *heldInput) track(e interface{}) {
+	switch e := e.(type) {
+	case PointerEvent:
+		h.buttons, h.extButtons = e.ButtonMask, e.ExtButtonMask
+		h.pointer = PointerEvent{X: e.X, Y: e.Y}
+	case RelativePointerEvent:
+		h.buttons, h.extButtons = e.ButtonMask, 0
+		h.pointer = RelativePointerEvent{}
+	case KeyEvent:
+		h.key(e.Key, e.DownFlag != 0, KeyEvent{Key: e.Key})
+	case QEMUKeyEvent:
+		h.key(e.Key, e.DownFlag != 0, QEMUKeyEvent{Key: e.Key, Keycode: e.Keycode})
+	case TouchEvent:
+		k := uint64(e.Device)<<32 | uint64(e.ID)
+		if e.Pressure == 0 {
+			delete(h.touches, k)
+			return
+		}
+		if h.touches == nil {
+			h.touches = make(map[uint64]interface{})
+		}
+		h.touches[k] = TouchEvent{Device: e.Device, ID: e.ID, X: e.X, Y: e.Y}
+	}
+}
+
+func (h *heldInput) key(ks uint32, down bool, release interface{}) {
+	if !down {
+		delete(h.keys, ks)
+		return
+	}
+	if h.keys == nil {
+		h.keys = make(map[uint32]interface{})
+	}
+	h.keys[ks] = release
+}
+
+// held reports whether any key or button is down.
+func (h *heldInput) held() bool {
+	return h.buttons != 0 || h.extButtons != 0 || len(h.keys) != 0
+}
+
+// release returns the events releasing everything held, and forgets it.
+func (h *heldInput) release() []interface{} {
+	var events []interface{}
+	for _, ks := range slices.Sorted(maps.Keys(h.keys)) {
+		events = append(events, h.keys[ks])
+	}
+	if h.buttons != 0 || h.extButtons != 0 {
+		events = append(events, h.pointer)
+	}
+	for _, k := range slices.Sorted(maps.Keys(h.touches)) {
+		events = append(events, h.touches[k])
+	}
+	h.keys, h.buttons, h.extButtons, h.touches = nil, 0, 0, nil
+	return events
+}
@@ -0,0 +1,269 @@
+// Package keymap translates the keysyms of RFB key events into the key
+// presses that type them on a given keyboard layout. Injection backends
+// that send scancodes, like the keyboards of virtual machines, need it
+// when the viewer's layout differs from the one the controlled machine
+// uses: a viewer on a US keyboard types '@' as Shift+2, which a German
+// layout turns into '"'.
+package keymap
+
+import (
+	"slices"
+
+	"github.com/patdhlk/rfb/keysym"
+)
+
+// Scancodes are XT scancodes in QEMU's encoding, as in rfb.QEMUKeyEvent:
+// extended keys have the 0xe0 prefix replaced by the high bit.
+const (
+	scanShiftL = 0x2a
+	scanShiftR = 0x36
+	scanAltGr  = 0xb8 // right Alt
+)
+
+// positions lists the scancodes of the keys whose characters depend on
+// the layout, in the order of the level strings given to newLayout: the
+// key left of 1, the number row, the three letter rows with the key
+// right of the second one (the ISO key left of Return) and the ISO key
+// right of left Shift between the second and third.
+var positions = func() []uint32 {
+	p := []uint32{0x29}
+	for _, r := range [][2]uint32{{0x02, 0x0d}, {0x10, 0x1b}, {0x2b, 0x2b}, {0x1e, 0x28}, {0x56, 0x56}, {0x2c, 0x35}} {
+		for sc := r[0]; sc <= r[1]; sc++ {
+			p = append(p, sc)
+		}
+	}
+	return p
+}()
+
+// Modifiers says which modifiers a character needs.
+type Modifiers uint8
+
+const (
+	Shift Modifiers = 1 << iota
+	AltGr
+)
+
+// A Stroke is a key and the modifiers to hold while pressing it.
+type Stroke struct {
+	Scancode uint32
+	Mods     Modifiers
+}
+
+// A Layout maps characters to the strokes that type them.
+type Layout struct {
+	Name  string
+	chars map[rune]Stroke
+}
+
+// newLayout returns the layout typing the characters in levels, which
+// list what each key in positions types unmodified, with Shift and with
+// AltGr; an empty level has no characters. A space means the key types
+// nothing at that level; dead keys are left out, as typing their
+// character takes a second key press.
+func newLayout(name string, levels [3]string) *Layout {
+	l := &Layout{Name: name, chars: map[rune]Stroke{' ': {Scancode: 0x39}}}
+	for i, mods := range []Modifiers{0, Shift, AltGr} {
+		level := []rune(levels[i])
+		if len(level) != 0 && len(level) != len(positions) {
+			panic("keymap: layout " + name + " has a level of the wrong length")
+		}
+		for pos, r := range level {
+			if _, ok := l.chars[r]; ok || r == ' ' {
+				continue // the first, simplest stroke wins
+			}
+			l.chars[r] = Stroke{positions[pos], mods}
+		}
+	}
+	return l
+}
+
+// The supported layouts, as their Windows and X11 defaults have them.
+var (
+	US = newLayout("us", [3]string{
+		"`" + "1234567890-=" + "qwertyuiop[]" + `\` + "asdfghjkl;'" + " " + "zxcvbnm,./",
+		"~" + "!@#$%^&*()_+" + "QWERTYUIOP{}" + "|" + `ASDFGHJKL:"` + " " + "ZXCVBNM<>?",
+		"",
+	})
+	UK = newLayout("uk", [3]string{
+		"`" + "1234567890-=" + "qwertyuiop[]" + "#" + "asdfghjkl;'" + `\` + "zxcvbnm,./",
+		"¬" + `!"£$%^&*()_+` + "QWERTYUIOP{}" + "~" + "ASDFGHJKL:@" + "|" + "ZXCVBNM<>?",
+		"¦" + "   €        " + "  é   úíó   " + " " + "á          " + " " + "          ",
+	})
+	DE = newLayout("de", [3]string{
+		" " + "1234567890ß " + "qwertzuiopü+" + "#" + "asdfghjklöä" + "<" + "yxcvbnm,.-",
+		"°" + `!"§$%&/()=? ` + "QWERTZUIOPÜ*" + "'" + "ASDFGHJKLÖÄ" + ">" + "YXCVBNM;:_",
+		" " + " ²³   {[]}\\ " + "@ €        ~" + " " + "           " + "|" + "      µ   ",
+	})
+	FR = newLayout("fr", [3]string{
+		"²" + `&é"'(-è_çà)=` + "azertyuiop $" + "*" + "qsdfghjklmù" + "<" + "wxcvbn,;:!",
+		" " + "1234567890°+" + "AZERTYUIOP £" + "µ" + "QSDFGHJKLM%" + ">" + "WXCVBN?./§",
+		" " + "  #{[| \\^@]}" + "  €        ¤" + " " + "           " + " " + "          ",
+	})
+)
+
+// ByName returns the layout called name ("us", "uk", "de" or "fr"), or
+// nil.
+func ByName(name string) *Layout {
+	for _, l := range []*Layout{US, UK, DE, FR} {
+		if l.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Lookup returns the stroke typing r.
+func (l *Layout) Lookup(r rune) (Stroke, bool) {
+	s, ok := l.chars[r]
+	return s, ok
+}
+
+// keys maps the keysyms of keys that are the same on all layouts to
+// their scancodes.
+var keys = map[uint32]uint32{
+	keysym.Escape:     0x01,
+	keysym.BackSpace:  0x0e,
+	keysym.Tab:        0x0f,
+	keysym.Return:     0x1c,
+	keysym.ControlL:   0x1d,
+	keysym.ShiftL:     scanShiftL,
+	keysym.ShiftR:     scanShiftR,
+	keysym.AltL:       0x38,
+	keysym.MetaL:      0x38,
+	keysym.CapsLock:   0x3a,
+	keysym.NumLock:    0x45,
+	keysym.ScrollLock: 0x46,
+	keysym.F1 + 10:    0x57, // F11
+	keysym.F12:        0x58,
+
+	keysym.KPMultiply: 0x37,
+	keysym.KPSubtract: 0x4a,
+	keysym.KPAdd:      0x4e,
+	keysym.KPDecimal:  0x53,
+	keysym.KPDelete:   0x53,
+	keysym.KPEnter:    0x9c,
+	keysym.KPDivide:   0xb5,
+	keysym.KPHome:     0x47,
+	keysym.KPUp:       0x48,
+	keysym.KPPageUp:   0x49,
+	keysym.KPLeft:     0x4b,
+	keysym.KPBegin:    0x4c,
+	keysym.KPRight:    0x4d,
+	keysym.KPEnd:      0x4f,
+	keysym.KPDown:     0x50,
+	keysym.KPPageDown: 0x51,
+	keysym.KPInsert:   0x52,
+
+	keysym.ControlR:       0x9d,
+	keysym.Print:          0xb7,
+	keysym.AltR:           scanAltGr,
+	keysym.MetaR:          scanAltGr,
+	keysym.ISOLevel3Shift: scanAltGr,
+	keysym.ModeSwitch:     scanAltGr,
+	keysym.Home:           0xc7,
+	keysym.Up:             0xc8,
+	keysym.PageUp:         0xc9,
+	keysym.Left:           0xcb,
+	keysym.Right:          0xcd,
+	keysym.End:            0xcf,
+	keysym.Down:           0xd0,
+	keysym.PageDown:       0xd1,
+	keysym.Insert:         0xd2,
+	keysym.Delete:         0xd3,
+	keysym.SuperL:         0xdb,
+	keysym.SuperR:         0xdc,
+	keysym.Menu:           0xdd,
+}
+
+func init() {
+	for i := uint32(0); i < 10; i++ {
+		keys[keysym.F1+i] = 0x3b + i
+	}
+	for i, sc := range []uint32{0x52, 0x4f, 0x50, 0x51, 0x4b, 0x4c, 0x4d, 0x47, 0x48, 0x49} {
+		keys[keysym.KP0+uint32(i)] = sc
+	}
+}
+
+// A Key is a key press or release to inject.
+type Key struct {
+	Keysym   uint32 // the key's keysym, for backends that want it too
+	Scancode uint32
+	Down     bool
+}
+
+// A Translator turns a viewer's key events into key presses on a
+// layout. It tracks which modifiers the viewer holds, to release or add
+// Shift and AltGr around characters that need them. Right Alt counts as
+// AltGr only if the viewer sends it as ISO Level 3 Shift or Mode
+// Switch, as viewers on layouts with AltGr do. A Translator isn't
+// safe for concurrent use.
+type Translator struct {
+	layout *Layout
+	mods   map[uint32]bool   // modifier keysyms held by the viewer
+	held   map[uint32]uint32 // scancodes of the keysyms held
+}
+
+// NewTranslator returns a translator for the given layout.
+func NewTranslator(l *Layout) *Translator {
+	return &Translator{
+		layout: l,
+		mods:   make(map[uint32]bool),
+		held:   make(map[uint32]uint32),
+	}
+}
+
+// Translate returns the key presses and releases that perform the
+// viewer's press or release of ks. It returns nothing for keysyms the
+// layout can't type.
+func (t *Translator) Translate(down bool, ks uint32) []Key {
+	if !down {
+		sc, ok := t.held[ks]
+		if !ok {
+			return nil
+		}
+		delete(t.held, ks)
+		delete(t.mods, ks)
+		return []Key{{ks, sc, false}}
+	}
+
+	if sc, ok := keys[ks]; ok {
+		switch ks {
+		case keysym.ShiftL, keysym.ShiftR, keysym.ISOLevel3Shift, keysym.ModeSwitch:
+			t.mods[ks] = true
+		}
+		t.held[ks] = sc
+		return []Key{{ks, sc, true}}
+	}
+	r := keysym.ToRune(ks)
+	s, ok := t.layout.Lookup(r)
+	if !ok {
+		return nil
+	}
+	t.held[ks] = s.Scancode
+
+	// Make the held modifiers match the stroke's, and restore them after
+	// the key went down, which is when it types.
+	var before, after []Key
+	adjust := func(m Modifiers, add Key, held ...uint32) {
+		var pressed []uint32
+		for _, mks := range held {
+			if t.mods[mks] {
+				pressed = append(pressed, mks)
+			}
+		}
+		switch {
+		case s.Mods&m != 0 && len(pressed) == 0:
+			before = append(before, add)
+			after = append(after, Key{add.Keysym, add.Scancode, false})
+		case s.Mods&m == 0:
+			for _, mks := range pressed {
+				before = append(before, Key{mks, t.held[mks], false})
+				after = append(after, Key{mks, t.held[mks], true})
+			}
+		}
+	}
+	adjust(Shift, Key{keysym.ShiftL, scanShiftL, true}, keysym.ShiftL, keysym.ShiftR)
+	adjust(AltGr, Key{keysym.ISOLevel3Shift, scanAltGr, true}, keysym.ISOLevel3Shift, keysym.ModeSwitch)
+	slices.Reverse(after)
+	return append(append(before, Key{ks, s.Scancode, true}), after...)
+}
@@ -0,0 +1,81 @@
+package keymap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/patdhlk/rfb/keysym"
+)
+
+func TestLayouts(t *testing.T) {
+	for _, l := range []*Layout{US, UK, DE, FR} {
+		if ByName(l.Name) != l {
+			t.Errorf("ByName(%q) isn't the layout", l.Name)
+		}
+		for r := 'a'; r <= 'z'; r++ {
+			if s, ok := l.Lookup(r); !ok || s.Mods != 0 {
+				t.Errorf("%s: %q is %+v, %v", l.Name, r, s, ok)
+			}
+		}
+	}
+	tests := []struct {
+		l    *Layout
+		r    rune
+		want Stroke
+	}{
+		{US, '@', Stroke{0x03, Shift}},
+		{UK, '@', Stroke{0x28, Shift}},
+		{UK, '€', Stroke{0x05, AltGr}},
+		{DE, '@', Stroke{0x10, AltGr}},
+		{DE, 'z', Stroke{0x15, 0}},
+		{DE, 'ä', Stroke{0x28, 0}},
+		{DE, '|', Stroke{0x56, AltGr}},
+		{FR, '1', Stroke{0x02, Shift}},
+		{FR, 'a', Stroke{0x10, 0}},
+		{FR, '@', Stroke{0x0b, AltGr}},
+		{FR, '§', Stroke{0x35, Shift}},
+	}
+	for _, tt := range tests {
+		if got, ok := tt.l.Lookup(tt.r); !ok || got != tt.want {
+			t.Errorf("%s: %q is %+v, %v; want %+v", tt.l.Name, tt.r, got, ok, tt.want)
+		}
+	}
+	if _, ok := DE.Lookup('^'); ok {
+		t.Error("de: dead key ^ is typeable")
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	tr := NewTranslator(DE)
+	// A US viewer types '@' with Shift+2.
+	tr.Translate(true, keysym.ShiftL)
+	got := tr.Translate(true, '@')
+	want := []Key{
+		{keysym.ShiftL, 0x2a, false},
+		{keysym.ISOLevel3Shift, 0xb8, true},
+		{'@', 0x10, true},
+		{keysym.ISOLevel3Shift, 0xb8, false},
+		{keysym.ShiftL, 0x2a, true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("@ on de: got %v; want %v", got, want)
+	}
+	if got, want := tr.Translate(false, '@'), []Key{{'@', 0x10, false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("releasing @: got %v; want %v", got, want)
+	}
+	tr.Translate(false, keysym.ShiftL)
+
+	// 'ä' needs nothing on de, and Shift on nothing else.
+	if got, want := tr.Translate(true, 0xe4), []Key{{0xe4, 0x28, true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ä on de: got %v; want %v", got, want)
+	}
+	if got := NewTranslator(US).Translate(true, 0xe4); got != nil {
+		t.Errorf("ä on us: got %v; want nothing", got)
+	}
+	if got := tr.Translate(false, 'x'); got != nil {
+		t.Errorf("releasing a key that isn't down: got %v", got)
+	}
+	if got, want := tr.Translate(true, keysym.Left), []Key{{keysym.Left, 0xcb, true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Left: got %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+// Package keysym defines the X11 keysyms used in RFB key events.
+package keysym
+
+// Function keys, cursor control and modifiers. The full list is in
+// X11/keysymdef.h.
+const (
+	BackSpace  = 0xff08
+	Tab        = 0xff09
+	Linefeed   = 0xff0a
+	Clear      = 0xff0b
+	Return     = 0xff0d
+	Pause      = 0xff13
+	ScrollLock = 0xff14
+	SysReq     = 0xff15
+	Escape     = 0xff1b
+	Delete     = 0xffff
+
+	Home     = 0xff50
+	Left     = 0xff51
+	Up       = 0xff52
+	Right    = 0xff53
+	Down     = 0xff54
+	PageUp   = 0xff55
+	PageDown = 0xff56
+	End      = 0xff57
+	Begin    = 0xff58
+
+	Select  = 0xff60
+	Print   = 0xff61
+	Execute = 0xff62
+	Insert  = 0xff63
+	Undo    = 0xff65
+	Redo    = 0xff66
+	Menu    = 0xff67
+	Find    = 0xff68
+	Cancel  = 0xff69
+	Help    = 0xff6a
+	Break   = 0xff6b
+	NumLock = 0xff7f
+
+	KPSpace     = 0xff80
+	KPTab       = 0xff89
+	KPEnter     = 0xff8d
+	KPHome      = 0xff95
+	KPLeft      = 0xff96
+	KPUp        = 0xff97
+	KPRight     = 0xff98
+	KPDown      = 0xff99
+	KPPageUp    = 0xff9a
+	KPPageDown  = 0xff9b
+	KPEnd       = 0xff9c
+	KPBegin     = 0xff9d
+	KPInsert    = 0xff9e
+	KPDelete    = 0xff9f
+	KPEqual     = 0xffbd
+	KPMultiply  = 0xffaa
+	KPAdd       = 0xffab
+	KPSeparator = 0xffac
+	KPSubtract  = 0xffad
+	KPDecimal   = 0xffae
+	KPDivide    = 0xffaf
+	KP0         = 0xffb0 // KP1..KP9 follow
+	KP9         = 0xffb9
+
+	F1  = 0xffbe // F2..F35 follow
+	F12 = 0xffc9
+	F24 = 0xffd5
+
+	ShiftL    = 0xffe1
+	ShiftR    = 0xffe2
+	ControlL  = 0xffe3
+	ControlR  = 0xffe4
+	CapsLock  = 0xffe5
+	ShiftLock = 0xffe6
+	MetaL     = 0xffe7
+	MetaR     = 0xffe8
+	AltL      = 0xffe9
+	AltR      = 0xffea
+	SuperL    = 0xffeb
+	SuperR    = 0xffec
+	HyperL    = 0xffed
+	HyperR    = 0xffee
+
+	ISOLevel3Shift = 0xfe03 // AltGr on most layouts
+	ModeSwitch     = 0xff7e
+)
+
+// unicodeOffset marks keysyms that directly encode a Unicode code point.
+const unicodeOffset = 0x01000000
+
+// ToRune returns the character a keysym types, or -1 if it doesn't type
+// one (function keys, modifiers) or isn't known.
+//
+// Latin-1 keysyms equal their code point and keysyms with the 0x01000000
+// bit encode arbitrary code points. Keypad keys map to what they type with
+// Num Lock on. The legacy non Latin-1 keysym ranges aren't covered.
+func ToRune(ks uint32) rune {
+	switch {
+	case ks >= 0x20 && ks <= 0x7e, ks >= 0xa0 && ks <= 0xff:
+		return rune(ks)
+	case ks >= unicodeOffset+0x20 && ks <= unicodeOffset+0x10ffff:
+		return rune(ks - unicodeOffset)
+	case ks >= KP0 && ks <= KP9:
+		return rune('0' + ks - KP0)
+	}
+	switch ks {
+	case BackSpace:
+		return '\b'
+	case Tab, KPTab:
+		return '\t'
+	case Return, KPEnter:
+		return '\r'
+	case Escape:
+		return 0x1b
+	case Delete:
+		return 0x7f
+	case KPSpace:
+		return ' '
+	case KPEqual:
+		return '='
+	case KPMultiply:
+		return '*'
+	case KPAdd:
+		return '+'
+	case KPSeparator:
+		return ','
+	case KPSubtract:
+		return '-'
+	case KPDecimal:
+		return '.'
+	case KPDivide:
+		return '/'
+	}
+	return -1
+}
+
+// FromRune returns the keysym that types r.
+func FromRune(r rune) uint32 {
+	switch {
+	case r >= 0x20 && r <= 0x7e, r >= 0xa0 && r <= 0xff:
+		return uint32(r)
+	case r == '\b':
+		return BackSpace
+	case r == '\t':
+		return Tab
+	case r == '\r', r == '\n':
+		return Return
+	case r == 0x1b:
+		return Escape
+	case r == 0x7f:
+		return Delete
+	}
+	return unicodeOffset + uint32(r)
+}
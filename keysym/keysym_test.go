@@ -0,0 +1,32 @@
+package keysym
+
+import "testing"
+
+func TestToRune(t *testing.T) {
+	tests := []struct {
+		ks   uint32
+		want rune
+	}{
+		{'a', 'a'},
+		{0xe4, 'ä'},
+		{0x010020ac, '€'},
+		{KP0 + 7, '7'},
+		{KPDecimal, '.'},
+		{Return, '\r'},
+		{ShiftL, -1},
+		{F1, -1},
+	}
+	for _, tt := range tests {
+		if got := ToRune(tt.ks); got != tt.want {
+			t.Errorf("ToRune(%#x) = %q; want %q", tt.ks, got, tt.want)
+		}
+	}
+}
+
+func TestFromRuneRoundTrip(t *testing.T) {
+	for _, r := range "aZ9@ äß€\t" {
+		if got := ToRune(FromRune(r)); got != r {
+			t.Errorf("ToRune(FromRune(%q)) = %q", r, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package rfb
+
+import (
+	"image"
+	"sync"
+)
+
+// An updateLatch holds the client's outstanding framebuffer update
+// request. Requests arriving while one is pending are merged into it, so
+// the reading goroutine never waits for the sending one.
+type updateLatch struct {
+	mu      sync.Mutex
+	req     FrameBufferUpdateRequest
+	pending bool
+	closed  bool
+	ready   chan struct{} // has a value when pending or closed may have changed
+}
+
+func newUpdateLatch() *updateLatch {
+	return &updateLatch{ready: make(chan struct{}, 1)}
+}
+
+// put records req, merging it with a pending request: the regions are
+// unioned, and the result is only incremental if both are.
+func (l *updateLatch) put(req FrameBufferUpdateRequest) {
+	l.mu.Lock()
+	if l.pending {
+		r := l.req.rect().Union(req.rect())
+		l.req = FrameBufferUpdateRequest{
+			IncrementalFlag: l.req.IncrementalFlag & req.IncrementalFlag,
+			X:               uint16(r.Min.X),
+			Y:               uint16(r.Min.Y),
+			Width:           uint16(r.Dx()),
+			Height:          uint16(r.Dy()),
+		}
+	} else {
+		l.req = req
+		l.pending = true
+	}
+	l.mu.Unlock()
+	l.signal()
+}
+
+// take waits for a request. ok is false once the latch is closed.
+func (l *updateLatch) take() (req FrameBufferUpdateRequest, ok bool) {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return req, false
+		}
+		if l.pending {
+			req = l.req
+			l.pending = false
+			l.mu.Unlock()
+			return req, true
+		}
+		l.mu.Unlock()
+		<-l.ready
+	}
+}
+
+// close makes take return false.
+func (l *updateLatch) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.signal()
+}
+
+func (l *updateLatch) signal() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (r *FrameBufferUpdateRequest) rect() image.Rectangle {
+	return image.Rect(int(r.X), int(r.Y), int(r.X)+int(r.Width), int(r.Y)+int(r.Height))
+}
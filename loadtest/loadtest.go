@@ -0,0 +1,224 @@
+// Package loadtest drives an RFB server with many concurrent headless
+// viewers and reports throughput and update latency.
+package loadtest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/netsim"
+)
+
+// Config describes a load test.
+type Config struct {
+	Addr     string        // server address, host:port
+	Sessions int           // number of concurrent viewers; default 1
+	Duration time.Duration // how long each viewer stays connected; default 10s
+
+	// Encodings is announced by every viewer. The default is that of
+	// rfb.ClientConfig.
+	Encodings []int32
+
+	// RequestInterval is the minimum time between update requests of a
+	// viewer. Zero requests the next update as soon as one arrives.
+	RequestInterval time.Duration
+
+	// InputRate is the number of pointer events per second each viewer
+	// sends, moving to random positions. Zero disables input.
+	InputRate float64
+
+	// Network, if not nil, simulates the link between each viewer and
+	// the server, in both directions. Each viewer's link is seeded
+	// differently.
+	Network *netsim.Conditions
+}
+
+// Report summarizes a load test.
+type Report struct {
+	Sessions int           // viewers that connected
+	Failed   int           // viewers that failed to connect or were dropped
+	Duration time.Duration // wall time of the test
+	Updates  int64         // framebuffer updates received
+	Rects    int64         // rectangles received
+	Bytes    int64         // update bytes received
+	Inputs   int64         // input events sent
+
+	// Latency percentiles between an update request and the
+	// corresponding update.
+	P50, P90, P99, Max time.Duration
+
+	Errors []error // the first error of each failed viewer
+}
+
+// Throughput returns the received bytes per second.
+func (r *Report) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+func (r *Report) String() string {
+	secs := r.Duration.Seconds()
+	if secs <= 0 {
+		secs = 1
+	}
+	return fmt.Sprintf("%d sessions (%d failed) in %v\n"+
+		"updates: %d (%.1f/s), rects: %d, inputs: %d\n"+
+		"throughput: %.2f MB/s\n"+
+		"latency: p50 %v, p90 %v, p99 %v, max %v",
+		r.Sessions, r.Failed, r.Duration.Round(time.Millisecond),
+		r.Updates, float64(r.Updates)/secs, r.Rects, r.Inputs,
+		r.Throughput()/1e6,
+		r.P50, r.P90, r.P99, r.Max)
+}
+
+// session is the tally of one viewer.
+type session struct {
+	updates, rects, bytes, inputs int64
+	latencies                     []time.Duration
+	err                           error
+}
+
+// Run runs the load test described by cfg until its duration has passed
+// or ctx is done. It only returns an error if no session could connect.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Sessions <= 0 {
+		cfg.Sessions = 1
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	start := time.Now()
+	sessions := make([]*session, cfg.Sessions)
+	var wg sync.WaitGroup
+	for i := range sessions {
+		s := new(session)
+		sessions[i] = s
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			s.run(ctx, cfg, seed)
+		}(int64(i))
+	}
+	wg.Wait()
+
+	r := &Report{Duration: time.Since(start)}
+	var latencies []time.Duration
+	for _, s := range sessions {
+		if s.err != nil {
+			r.Failed++
+			r.Errors = append(r.Errors, s.err)
+		}
+		if s.updates > 0 || s.err == nil {
+			r.Sessions++
+		}
+		r.Updates += s.updates
+		r.Rects += s.rects
+		r.Bytes += s.bytes
+		r.Inputs += s.inputs
+		latencies = append(latencies, s.latencies...)
+	}
+	if r.Sessions == 0 && len(r.Errors) > 0 {
+		return r, r.Errors[0]
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.P50 = percentile(latencies, 50)
+	r.P90 = percentile(latencies, 90)
+	r.P99 = percentile(latencies, 99)
+	r.Max = percentile(latencies, 100)
+	return r, nil
+}
+
+// percentile returns the p-th percentile of the sorted durations d.
+func percentile(d []time.Duration, p int) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	i := (len(d)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return d[i]
+}
+
+func (s *session) run(ctx context.Context, cfg Config, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+	c, err := net.Dial("tcp", cfg.Addr)
+	if err != nil {
+		s.err = err
+		return
+	}
+	if cfg.Network != nil {
+		cond := *cfg.Network
+		cond.Seed += seed
+		c = netsim.Wrap(c, cond, cond)
+	}
+	var mu sync.Mutex // guards the tally against the client's read goroutine
+	cc, err := rfb.NewClientConn(c, &rfb.ClientConfig{
+		Encodings:       cfg.Encodings,
+		RequestInterval: cfg.RequestInterval,
+		OnUpdate: func(u rfb.UpdateStats) {
+			mu.Lock()
+			s.updates++
+			s.rects += int64(u.Rects)
+			s.bytes += u.Bytes
+			s.latencies = append(s.latencies, u.Latency)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		c.Close()
+		s.err = err
+		return
+	}
+	defer func() {
+		cc.Close()
+		mu.Lock() // wait for a running OnUpdate
+		mu.Unlock()
+	}()
+
+	var input <-chan time.Time
+	if cfg.InputRate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / cfg.InputRate))
+		defer t.Stop()
+		input = t.C
+	}
+	b := cc.Bounds()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-input:
+			x := b.Min.X + rnd.Intn(b.Dx())
+			y := b.Min.Y + rnd.Intn(b.Dy())
+			if err := cc.PointerEvent(0, x, y); err != nil {
+				s.fail(&mu, err)
+				return
+			}
+			mu.Lock()
+			s.inputs++
+			mu.Unlock()
+		case <-time.After(100 * time.Millisecond):
+			if err := cc.Err(); err != nil {
+				s.fail(&mu, err)
+				return
+			}
+		}
+	}
+}
+
+func (s *session) fail(mu *sync.Mutex, err error) {
+	mu.Lock()
+	s.err = err
+	mu.Unlock()
+}
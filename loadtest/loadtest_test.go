@@ -0,0 +1,86 @@
+package loadtest
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/rfbtest"
+)
+
+// tickSource produces a frame of alternating colour every few
+// milliseconds.
+type tickSource struct {
+	n    int
+	imgs [2]*rfb.LockableImage
+}
+
+func newTickSource(w, h int) *tickSource {
+	s := new(tickSource)
+	for i, c := range []color.RGBA{{R: 0xff, A: 0xff}, {B: 0xff, A: 0xff}} {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for p := 0; p < len(img.Pix); p += 4 {
+			img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = c.R, c.G, c.B, c.A
+		}
+		s.imgs[i] = &rfb.LockableImage{Img: img}
+	}
+	return s
+}
+
+func (s *tickSource) Bounds() image.Rectangle { return s.imgs[0].Img.Bounds() }
+
+func (s *tickSource) NextFrame() (*rfb.LockableImage, error) {
+	time.Sleep(5 * time.Millisecond)
+	s.n++
+	return s.imgs[s.n%2], nil
+}
+
+func TestRun(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	s := rfb.NewServer(64, 48)
+	addr := rfbtest.Serve(t, s)
+	go func() {
+		for c := range s.Incoming(context.Background()) {
+			c.SetFrameSource(newTickSource(64, 48))
+		}
+	}()
+
+	r, err := Run(context.Background(), Config{
+		Addr:      addr,
+		Sessions:  4,
+		Duration:  300 * time.Millisecond,
+		InputRate: 50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Sessions != 4 || r.Failed != 0 {
+		t.Fatalf("sessions = %d, failed = %d (%v); want 4, 0", r.Sessions, r.Failed, r.Errors)
+	}
+	if r.Updates < 4 || r.Bytes == 0 || r.Inputs == 0 {
+		t.Errorf("report = %+v; want updates, bytes and inputs", r)
+	}
+	if r.P50 > r.P99 || r.P99 > r.Max {
+		t.Errorf("percentiles out of order: %v, %v, %v", r.P50, r.P99, r.Max)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	d := make([]time.Duration, 100)
+	for i := range d {
+		d[i] = time.Duration(i + 1)
+	}
+	for _, tt := range []struct{ p, want int }{{50, 50}, {90, 90}, {99, 99}, {100, 100}, {0, 1}} {
+		if got := percentile(d, tt.p); got != time.Duration(tt.want) {
+			t.Errorf("percentile(%d) = %d; want %d", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package rfb
+
+// writeMessage writes one complete server-to-client message with f and
+// sends it. It waits for the handshake to finish and for the update
+// being sent, if any, so messages never interleave.
+func (c *Conn) writeMessage(f func()) error {
+	select {
+	case <-c.initc:
+	case <-c.closec:
+		return ErrConnClosed
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	f()
+	return c.bw.Flush()
+}
+
+// Bell makes the client beep.
+func (c *Conn) Bell() error {
+	return c.writeMessage(func() {
+		c.w(uint8(cmdBell))
+	})
+}
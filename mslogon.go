@@ -0,0 +1,71 @@
+package rfb
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/big"
+)
+
+// authMSLogonII is UltraVNC's MSLogonII: a Diffie-Hellman key agreement
+// on 64-bit numbers, after which the client sends its user name and
+// password encrypted with DES under the shared secret.
+const authMSLogonII = 113
+
+// UltraVNC's viewers compute with 64-bit integers, so the modulus has
+// to stay below 2^32 for their products not to overflow. That makes the
+// key agreement easy to break: MSLogonII only keeps the credentials from
+// being sent in the clear to a passive eavesdropper.
+const msLogonBits = 31
+
+// Sizes of the encrypted credentials.
+const (
+	msLogonUserLen     = 256
+	msLogonPasswordLen = 64
+)
+
+// authMSLogon runs MSLogonII and returns the user name, which may be in
+// domain form, and whether Server.Authenticate accepts the credentials.
+func (c *Conn) authMSLogon() (user string, ok bool) {
+	mod, err := rand.Prime(rand.Reader, msLogonBits)
+	if err != nil {
+		c.failf(ClassInternal, "generating MSLogonII modulus: %v", err)
+	}
+	two := big.NewInt(2)
+	gen, err := rand.Int(rand.Reader, new(big.Int).Sub(mod, two))
+	if err != nil {
+		c.failf(ClassInternal, "generating MSLogonII generator: %v", err)
+	}
+	gen.Add(gen, two)
+	priv, err := rand.Int(rand.Reader, new(big.Int).Sub(mod, two))
+	if err != nil {
+		c.failf(ClassInternal, "generating MSLogonII key: %v", err)
+	}
+	priv.Add(priv, big.NewInt(1))
+	c.w(gen.Uint64())
+	c.w(mod.Uint64())
+	c.w(new(big.Int).Exp(gen, priv, mod).Uint64())
+	c.flush()
+
+	msg := make([]byte, 8+msLogonUserLen+msLogonPasswordLen) // the client's key, then the credentials
+	if _, err := io.ReadFull(c.br, msg); err != nil {
+		c.failf(ClassIO, "reading MSLogonII credentials: %v", err)
+	}
+	peer := new(big.Int).SetUint64(binary.BigEndian.Uint64(msg))
+	key := new(big.Int).Exp(peer, priv, mod).FillBytes(make([]byte, 8))
+	userb := msLogonDecrypt(key, msg[8:8+msLogonUserLen])
+	password := msLogonDecrypt(key, msg[8+msLogonUserLen:])
+	user = cString(userb)
+	return user, c.s.Authenticate(user, cString(password))
+}
+
+// msLogonDecrypt decrypts b in place as UltraVNC encrypts credentials:
+// DES in CBC mode with the shared secret both as the key, with the bits
+// of each byte reversed as in VNC Authentication, and as the IV.
+func msLogonDecrypt(key, b []byte) []byte {
+	block, _ := des.NewCipher(vncDESKey(key))
+	cipher.NewCBCDecrypter(block, key).CryptBlocks(b, b)
+	return b
+}
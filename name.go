@@ -0,0 +1,68 @@
+package rfb
+
+import "log"
+
+// encodingDesktopName is the pseudo-encoding telling the client a new
+// desktop name.
+const encodingDesktopName = -307
+
+// SetName changes the desktop name that clients show, typically in
+// their window title, for instance to the active session or user. It's
+// announced to new connections and sent to connected clients supporting
+// the DesktopName pseudo-encoding with their next update, except to
+// those with a name of their own from StartOptions.Name or Conn.SetName.
+// An empty name means DefaultName.
+func (s *Server) SetName(name string) {
+	s.sizeMu.Lock()
+	s.name = name
+	s.sizeMu.Unlock()
+
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	for c := range s.live {
+		c.wakeShape()
+	}
+}
+
+// SetName changes the desktop name of this client, overriding the
+// server's. Clients supporting the DesktopName pseudo-encoding get it
+// with the next update, which is sent at once if the client is waiting
+// for one; others keep the name from the handshake. An empty name
+// returns to the server's.
+func (c *Conn) SetName(name string) {
+	c.mu.Lock()
+	c.name = name
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// nameLocked returns the desktop name for the client. c.mu must be held.
+func (c *Conn) nameLocked() string {
+	if c.name != "" {
+		return c.name
+	}
+	c.s.sizeMu.RLock()
+	defer c.s.sizeMu.RUnlock()
+	if c.s.name != "" {
+		return c.s.name
+	}
+	return DefaultName
+}
+
+// namePendingLocked reports whether the client is to be told a new
+// name. c.mu must be held.
+func (c *Conn) namePendingLocked() bool {
+	return c.sentName != "" && c.supportsLocked(encodingDesktopName) && c.nameLocked() != c.sentName
+}
+
+// pushNameLocked writes the DesktopName pseudo-rectangle, which must be
+// counted in the current update. c.mu must be held.
+func (c *Conn) pushNameLocked() {
+	name := c.nameLocked()
+	log.Printf("renaming desktop from %q to %q", c.sentName, name)
+	c.w([4]uint16{}) // x, y, width, height
+	c.w(int32(encodingDesktopName))
+	c.w(uint32(len(name)))
+	c.bw.WriteString(name)
+	c.sentName = name
+}
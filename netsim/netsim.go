@@ -0,0 +1,216 @@
+// Package netsim simulates network conditions on connections: latency,
+// jitter, bandwidth limits and loss. Wrap either end of a connection to
+// test how an RFB server or viewer copes with a slow link.
+package netsim
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conditions describes a simulated link in one direction.
+type Conditions struct {
+	Latency time.Duration // delay added to all data
+	Jitter  time.Duration // random extra delay of up to Jitter; data stays in order
+
+	// Bandwidth limits the link to this many bytes per second. Writers
+	// block while the link is busy, as with a full socket buffer. Zero
+	// means unlimited.
+	Bandwidth int
+
+	// Loss is the probability, from 0 to 1, that a write is lost and
+	// has to be retransmitted, which delays it and everything after it
+	// by Retransmit. The stream itself stays intact, as with TCP.
+	Loss       float64
+	Retransmit time.Duration // if zero, 200ms
+
+	// Seed seeds the random jitter and losses, so that runs can be
+	// repeated.
+	Seed int64
+}
+
+// link schedules the data sent in one direction.
+type link struct {
+	cond Conditions
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	busy time.Time // when the link is done sending what was written
+	last time.Time // arrival of the last chunk
+}
+
+func newLink(cond Conditions) *link {
+	if cond.Retransmit == 0 {
+		cond.Retransmit = 200 * time.Millisecond
+	}
+	return &link{cond: cond, rnd: rand.New(rand.NewSource(cond.Seed))}
+}
+
+// schedule returns when n bytes written at now are sent, and when they
+// arrive.
+func (l *link) schedule(now time.Time, n int) (sent, arrive time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sent = now
+	if l.cond.Bandwidth > 0 {
+		sent = maxTime(now, l.busy).Add(time.Duration(n) * time.Second / time.Duration(l.cond.Bandwidth))
+		l.busy = sent
+	}
+	arrive = sent.Add(l.cond.Latency)
+	if l.cond.Jitter > 0 {
+		arrive = arrive.Add(time.Duration(l.rnd.Int63n(int64(l.cond.Jitter) + 1)))
+	}
+	if l.cond.Loss > 0 && l.rnd.Float64() < l.cond.Loss {
+		arrive = arrive.Add(l.cond.Retransmit)
+	}
+	arrive = maxTime(arrive, l.last)
+	l.last = arrive
+	return sent, arrive
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// A chunk is data on its way.
+type chunk struct {
+	data   []byte
+	arrive time.Time
+}
+
+// Conn is a net.Conn whose traffic goes through simulated links.
+// Deadlines apply to the underlying connection only.
+type Conn struct {
+	net.Conn
+	out, in *link
+
+	outq chan chunk // to the writing goroutine
+	inq  chan chunk // from the reading goroutine
+	rest []byte     // of the chunk being read
+
+	mu       sync.Mutex
+	writeErr error // of the underlying connection
+	readErr  error // of the underlying connection, after inq is drained
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Wrap returns c with out applied to the data written to it and in to
+// the data read from it.
+func Wrap(c net.Conn, out, in Conditions) *Conn {
+	sc := &Conn{
+		Conn:   c,
+		out:    newLink(out),
+		in:     newLink(in),
+		outq:   make(chan chunk, 64),
+		inq:    make(chan chunk, 64),
+		closed: make(chan struct{}),
+	}
+	go sc.writeLoop()
+	go sc.readLoop()
+	return sc
+}
+
+var errClosed = errors.New("netsim: use of closed connection")
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	err := c.writeErr
+	c.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	sent, arrive := c.out.schedule(time.Now(), len(p))
+	time.Sleep(time.Until(sent))
+	select {
+	case c.outq <- chunk{append([]byte(nil), p...), arrive}:
+		return len(p), nil
+	case <-c.closed:
+		return 0, errClosed
+	}
+}
+
+func (c *Conn) writeLoop() {
+	for {
+		select {
+		case ch := <-c.outq:
+			time.Sleep(time.Until(ch.arrive))
+			if _, err := c.Conn.Write(ch.data); err != nil {
+				c.mu.Lock()
+				c.writeErr = err
+				c.mu.Unlock()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Conn) readLoop() {
+	defer close(c.inq)
+	for {
+		buf := make([]byte, 32<<10)
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			_, arrive := c.in.schedule(time.Now(), n)
+			select {
+			case c.inq <- chunk{buf[:n], arrive}:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.mu.Lock()
+			c.readErr = err
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.rest) == 0 {
+		ch, ok := <-c.inq
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return 0, c.readErr
+		}
+		time.Sleep(time.Until(ch.arrive))
+		c.rest = ch.data
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Close closes the connection, dropping data still on its way.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Listener wraps the connections accepted by ln; see Wrap.
+func Listener(ln net.Listener, out, in Conditions) net.Listener {
+	return &listener{ln, out, in}
+}
+
+type listener struct {
+	net.Listener
+	out, in Conditions
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(c, l.out, l.in), nil
+}
@@ -0,0 +1,85 @@
+package netsim_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb/netsim"
+)
+
+// transfer writes data through a link with cond and returns it as read
+// at the other end, with the time it took.
+func transfer(t *testing.T, cond netsim.Conditions, data []byte, chunk int) ([]byte, time.Duration) {
+	a, b := net.Pipe()
+	sa := netsim.Wrap(a, cond, netsim.Conditions{})
+	defer sa.Close()
+	defer b.Close()
+	start := time.Now()
+	go func() {
+		for p := data; len(p) > 0; {
+			n := min(chunk, len(p))
+			if _, err := sa.Write(p[:n]); err != nil {
+				t.Error(err)
+				return
+			}
+			p = p[n:]
+		}
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil {
+		t.Fatal(err)
+	}
+	return got, time.Since(start)
+}
+
+func TestConditions(t *testing.T) {
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, tt := range []struct {
+		name string
+		cond netsim.Conditions
+		min  time.Duration
+	}{
+		{"none", netsim.Conditions{}, 0},
+		{"latency", netsim.Conditions{Latency: 50 * time.Millisecond}, 50 * time.Millisecond},
+		{"jitter", netsim.Conditions{Latency: 10 * time.Millisecond, Jitter: 20 * time.Millisecond, Seed: 1}, 10 * time.Millisecond},
+		{"bandwidth", netsim.Conditions{Bandwidth: 100000}, 100 * time.Millisecond},
+		{"loss", netsim.Conditions{Loss: 1, Retransmit: 30 * time.Millisecond}, 30 * time.Millisecond},
+	} {
+		got, d := transfer(t, tt.cond, data, 1000)
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: data corrupted", tt.name)
+		}
+		if d < tt.min {
+			t.Errorf("%s: transfer took %v, want at least %v", tt.name, d, tt.min)
+		}
+	}
+}
+
+func TestReadDelay(t *testing.T) {
+	a, b := net.Pipe()
+	sa := netsim.Wrap(a, netsim.Conditions{}, netsim.Conditions{Latency: 40 * time.Millisecond})
+	defer sa.Close()
+	defer b.Close()
+	start := time.Now()
+	go b.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(sa, buf); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("read after %v, want at least 40ms", d)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q", buf)
+	}
+	b.Close()
+	if _, err := sa.Read(buf); err != io.EOF {
+		t.Errorf("read after close: %v, want EOF", err)
+	}
+}
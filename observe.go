@@ -0,0 +1,118 @@
+package rfb
+
+import (
+	"image"
+	"image/draw"
+	"slices"
+	"sync"
+)
+
+// An Observer watches a connection's traffic without being a client,
+// for thumbnails, supervision or recording. Its methods are called
+// synchronously, from the goroutines serving the connection, so they
+// should return quickly.
+type Observer interface {
+	// Update is called after each framebuffer update sent to the client.
+	// fb is the framebuffer the client now shows, in full colour, and
+	// rects the regions of it the update changed; the first call after
+	// Observe reports all of fb. fb is reused for later updates, so
+	// observers must copy what they want to keep.
+	Update(fb *image.RGBA, rects []image.Rectangle)
+
+	// Event is called with each input event from the client, before it's
+	// passed to the application: a KeyEvent, PointerEvent,
+	// RelativePointerEvent, QEMUKeyEvent, TouchEvent or ClipboardEvent.
+	// Events of view-only connections are observed too.
+	Event(e interface{})
+}
+
+// observers is the set of a connection's observers.
+type observers struct {
+	mu   sync.Mutex
+	list []*observer
+
+	// Only used by the sending goroutine:
+	fb      *image.RGBA       // the client's framebuffer
+	pending []image.Rectangle // changed by the last update
+	updated bool              // an update was sent
+}
+
+type observer struct {
+	o      Observer
+	primed bool // has seen the whole framebuffer; guarded by observers.mu
+}
+
+// Observe adds o to the connection's observers. Calling stop removes it
+// again.
+func (c *Conn) Observe(o Observer) (stop func()) {
+	ob := &observer{o: o}
+	c.obs.mu.Lock()
+	c.obs.list = append(c.obs.list, ob)
+	c.obs.mu.Unlock()
+	return func() {
+		c.obs.mu.Lock()
+		defer c.obs.mu.Unlock()
+		c.obs.list = slices.DeleteFunc(c.obs.list, func(x *observer) bool { return x == ob })
+	}
+}
+
+// observed returns a copy of the observer list.
+func (c *Conn) observed() []*observer {
+	c.obs.mu.Lock()
+	defer c.obs.mu.Unlock()
+	return slices.Clone(c.obs.list)
+}
+
+// mirrorLocked copies the regions of img an update changed into the
+// observers' framebuffer, while the frame is still locked.
+func (c *Conn) mirrorLocked(img image.Image, copies []Move, rects []image.Rectangle) {
+	if len(c.observed()) == 0 {
+		c.obs.fb = nil
+		return
+	}
+	c.obs.updated = true
+	c.obs.pending = c.obs.pending[:0]
+	b := img.Bounds()
+	if c.obs.fb == nil || c.obs.fb.Rect != b {
+		c.obs.fb = image.NewRGBA(b)
+		rects, copies = []image.Rectangle{b}, nil
+	}
+	for _, m := range copies {
+		c.obs.pending = append(c.obs.pending, m.Dst)
+	}
+	c.obs.pending = append(c.obs.pending, rects...)
+	for _, r := range c.obs.pending {
+		draw.Draw(c.obs.fb, r, img, r.Min, draw.Src)
+	}
+}
+
+// notifyObservers reports the last update to the observers. It's called
+// by the sending goroutine with no locks held.
+func (c *Conn) notifyObservers() {
+	if !c.obs.updated {
+		return
+	}
+	c.obs.updated = false
+	fb := c.obs.fb
+	if fb == nil {
+		return
+	}
+	for _, ob := range c.observed() {
+		c.obs.mu.Lock()
+		primed := ob.primed
+		ob.primed = true
+		c.obs.mu.Unlock()
+		if primed {
+			ob.o.Update(fb, c.obs.pending)
+		} else {
+			ob.o.Update(fb, []image.Rectangle{fb.Rect})
+		}
+	}
+}
+
+// observeEvent passes an input event to the observers.
+func (c *Conn) observeEvent(e interface{}) {
+	for _, ob := range c.observed() {
+		ob.o.Event(e)
+	}
+}
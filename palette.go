@@ -0,0 +1,57 @@
+package rfb
+
+// maxPaletteSize is the largest palette the palette-capable encodings
+// (ZRLE and Tight) can send.
+const maxPaletteSize = 127
+
+// prefersPalette reports whether palette-indexed encodings should be
+// tried for clients using format f even where they rarely win, as ZRLE
+// does. Low-colour content shrinks the most
+// relative to 8 and 16 bit truecolour, whose pixels are as cheap as
+// palette indexes to compute.
+func (f *PixelFormat) prefersPalette() bool {
+	return f.BPP <= 16
+}
+
+// A palette lists the distinct pixel values of a region, in order of
+// appearance.
+type palette struct {
+	colours []uint32
+	index   map[uint32]int
+}
+
+// newPalette returns the palette of pixels, or nil if they have more than
+// max distinct values.
+func newPalette(pixels []uint32, max int) *palette {
+	p := &palette{index: make(map[uint32]int)}
+	last, lastOK := uint32(0), false
+	for _, v := range pixels {
+		if lastOK && v == last {
+			continue // runs are common; skip the map
+		}
+		last, lastOK = v, true
+		if _, ok := p.index[v]; ok {
+			continue
+		}
+		if len(p.colours) == max {
+			return nil
+		}
+		p.index[v] = len(p.colours)
+		p.colours = append(p.colours, v)
+	}
+	return p
+}
+
+// bitsPerIndex returns the size of a packed palette index, as used by
+// ZRLE and Tight: 1, 2, 4 or 8 bits.
+func (p *palette) bitsPerIndex() int {
+	switch n := len(p.colours); {
+	case n <= 2:
+		return 1
+	case n <= 4:
+		return 2
+	case n <= 16:
+		return 4
+	}
+	return 8
+}
@@ -0,0 +1,110 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+)
+
+// pixel converts col to a pixel value in format f.
+func (f *PixelFormat) pixel(col color.Color) uint32 {
+	r16, g16, b16, _ := col.RGBA()
+	return f.pixel16(r16, g16, b16)
+}
+
+// pixel16 converts a colour with 16 bits per channel to a pixel value
+// in format f.
+func (f *PixelFormat) pixel16(r16, g16, b16 uint32) uint32 {
+	if f.TrueColour == 0 {
+		return (inRange(r16, f.RedMax)*colourMapLevels+inRange(g16, f.GreenMax))*colourMapLevels + inRange(b16, f.BlueMax)
+	}
+	return inRange(r16, f.RedMax)<<f.RedShift |
+		inRange(g16, f.GreenMax)<<f.GreenShift |
+		inRange(b16, f.BlueMax)<<f.BlueShift
+}
+
+// rgba converts the pixel value v in format f to a colour.
+func (f *PixelFormat) rgba(v uint32) color.RGBA {
+	if f.TrueColour == 0 {
+		rgb := colourMapEntry(v)
+		return color.RGBA{uint8(rgb[0] >> 8), uint8(rgb[1] >> 8), uint8(rgb[2] >> 8), 0xff}
+	}
+	return color.RGBA{scale8(v>>f.RedShift, f.RedMax), scale8(v>>f.GreenShift, f.GreenMax), scale8(v>>f.BlueShift, f.BlueMax), 0xff}
+}
+
+// translate appends the pixels of rect in img, converted to format f, to
+// dst, row by row. Frames with 16 bits per channel keep them for clients
+// with more than 8, such as those asking for 10 bits per channel.
+func (f *PixelFormat) translate(dst []uint32, img image.Image, rect image.Rectangle) []uint32 {
+	switch img := img.(type) {
+	case *image.RGBA:
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+			for i := 0; i < len(row); i += 4 {
+				dst = append(dst, f.pixel(color.RGBA{row[i], row[i+1], row[i+2], 0xff}))
+			}
+		}
+		return dst
+	case *image.RGBA64:
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+			for i := 0; i < len(row); i += 8 {
+				dst = append(dst, f.pixel16(be16(row[i:]), be16(row[i+2:]), be16(row[i+4:])))
+			}
+		}
+		return dst
+	case *image.NRGBA64:
+		// Premultiplied, as color.NRGBA64.RGBA does.
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+			for i := 0; i < len(row); i += 8 {
+				a := be16(row[i+6:])
+				dst = append(dst, f.pixel16(be16(row[i:])*a/0xffff, be16(row[i+2:])*a/0xffff, be16(row[i+4:])*a/0xffff))
+			}
+		}
+		return dst
+	}
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			dst = append(dst, f.pixel(img.At(x, y)))
+		}
+	}
+	return dst
+}
+
+// fits reports whether the channels of format f lie within its bits per
+// pixel, as up to 10 bits each do in 32.
+func (f *PixelFormat) fits() bool {
+	for _, ch := range [3]struct {
+		max   uint16
+		shift uint8
+	}{{f.RedMax, f.RedShift}, {f.GreenMax, f.GreenShift}, {f.BlueMax, f.BlueShift}} {
+		if int(ch.shift)+bits.Len16(ch.max) > int(f.BPP) {
+			return false
+		}
+	}
+	return true
+}
+
+// be16 returns the big-endian 16-bit value at the start of b.
+func be16(b []byte) uint32 {
+	return uint32(b[0])<<8 | uint32(b[1])
+}
+
+// appendPixel appends the pixel value v to dst, in the byte order and
+// size of format f.
+func (f *PixelFormat) appendPixel(dst []byte, v uint32) []byte {
+	switch f.BPP {
+	case 32:
+		if f.BigEndian != 0 {
+			return append(dst, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+		return append(dst, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	case 16:
+		if f.BigEndian != 0 {
+			return append(dst, byte(v>>8), byte(v))
+		}
+		return append(dst, byte(v), byte(v>>8))
+	}
+	return append(dst, byte(v))
+}
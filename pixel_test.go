@@ -0,0 +1,142 @@
+package rfb_test
+
+import (
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+var (
+	rgb565 = rfb.PixelFormat{
+		BPP: 16, Depth: 16, TrueColour: 1,
+		RedMax: 31, GreenMax: 63, BlueMax: 31,
+		RedShift: 11, GreenShift: 5, BlueShift: 0,
+	}
+	rgb888 = rfb.PixelFormat{
+		BPP: 32, Depth: 24, TrueColour: 1,
+		RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+		RedShift: 16, GreenShift: 8, BlueShift: 0,
+	}
+	rgb101010 = rfb.PixelFormat{
+		BPP: 32, Depth: 30, TrueColour: 1,
+		RedMax: 1023, GreenMax: 1023, BlueMax: 1023,
+		RedShift: 20, GreenShift: 10, BlueShift: 0,
+	}
+)
+
+func bigEndian(pf rfb.PixelFormat) rfb.PixelFormat {
+	pf.BigEndian = 1
+	return pf
+}
+
+// TestPixelBytes checks the bytes on the wire for one pixel.
+func TestPixelBytes(t *testing.T) {
+	col := color.RGBA{0xff, 0x80, 0x00, 0xff}
+	deep := image.NewRGBA64(image.Rect(0, 0, 1, 1))
+	deep.SetRGBA64(0, 0, color.RGBA64{0x8040, 0xffff, 0x0100, 0xffff})
+	translucent := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	translucent.SetNRGBA64(0, 0, color.NRGBA64{0xffff, 0x8000, 0, 0x8000})
+	for _, tt := range []struct {
+		name string
+		pf   rfb.PixelFormat
+		img  image.Image // if nil, col
+		want []byte
+	}{
+		// r = 31, g = 32, b = 0: 0xfc00
+		{"16 bit little-endian", rgb565, nil, []byte{0x00, 0xfc}},
+		{"16 bit big-endian", bigEndian(rgb565), nil, []byte{0xfc, 0x00}},
+		// 0x00ff8000
+		{"32 bit little-endian", rgb888, nil, []byte{0x00, 0x80, 0xff, 0x00}},
+		{"32 bit big-endian", bigEndian(rgb888), nil, []byte{0x00, 0xff, 0x80, 0x00}},
+		// r = 1023, g = 514, b = 0: 0x3ff80800
+		{"30 bit", rgb101010, nil, []byte{0x00, 0x08, 0xf8, 0x3f}},
+		{"30 bit big-endian", bigEndian(rgb101010), nil, []byte{0x3f, 0xf8, 0x08, 0x00}},
+		// r = 513, g = 1023, b = 4: 0x201ffc04
+		{"30 bit from RGBA64", rgb101010, deep, []byte{0x04, 0xfc, 0x1f, 0x20}},
+		// premultiplied: r = 512, g = 256, b = 0: 0x20040000
+		{"30 bit from NRGBA64", rgb101010, translucent, []byte{0x00, 0x00, 0x04, 0x20}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			s := rfb.NewServer(1, 1)
+			go s.Serve(ln)
+			img := tt.img
+			if img == nil {
+				img = solid(1, 1, col)
+			}
+			go func() {
+				c, _ := s.Accept(context.Background())
+				c.Feed <- &rfb.LockableImage{Img: img}
+			}()
+
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			rawHandshake(t, nc)
+
+			msg := []byte{0, 0, 0, 0}
+			msg, _ = binary.Append(msg, binary.BigEndian, tt.pf)
+			msg = append(msg, 0, 0, 0)                      // padding
+			msg = append(msg, 2, 0, 0, 1, 0, 0, 0, 0)       // SetEncodings: Raw
+			msg = append(msg, 3, 0, 0, 0, 0, 0, 0, 1, 0, 1) // FramebufferUpdateRequest
+			nc.Write(msg)
+
+			nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 4+12+len(tt.want))
+			if _, err := io.ReadFull(nc, buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf[16:]; string(got) != string(tt.want) {
+				t.Errorf("pixel = % x; want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPixelRoundTrip checks that the client decodes what the server
+// encodes.
+func TestPixelRoundTrip(t *testing.T) {
+	for _, pf := range []rfb.PixelFormat{rgb565, bigEndian(rgb565), rgb888, bigEndian(rgb888), rgb101010, bigEndian(rgb101010)} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := rfb.NewServer(8, 8)
+		go s.Serve(ln)
+
+		want := image.NewRGBA(image.Rect(0, 0, 8, 8))
+		for i := range want.Pix {
+			want.Pix[i] = 0xff
+		}
+		want.Set(1, 2, color.RGBA{0xff, 0, 0, 0xff})
+		want.Set(3, 4, color.RGBA{0, 0xff, 0, 0xff})
+		want.Set(5, 6, color.RGBA{0, 0, 0xff, 0xff})
+		go func() {
+			c, _ := s.Accept(context.Background())
+			c.Feed <- &rfb.LockableImage{Img: want}
+		}()
+
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{PixelFormat: &pf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		if err := cc.WaitForImage(want.Rect, want, 5*time.Second); err != nil {
+			t.Errorf("%+v: %v", pf, err)
+		}
+	}
+}
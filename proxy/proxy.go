@@ -0,0 +1,183 @@
+// Package proxy relays a backend RFB server to any number of viewers.
+//
+// Updates from the backend are decoded into a local framebuffer and
+// re-encoded by an rfb.Server for every viewer, in the pixel format and
+// with the encodings that viewer negotiated. A backend that only speaks
+// Raw can thus be served to viewers asking for better encodings, and
+// the backend only ever sees a single client.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// maxHistory is the number of backend updates remembered for viewers
+// that fall behind. A viewer further behind is sent the whole screen.
+const maxHistory = 32
+
+// Proxy relays one backend connection. It's an rfb.InputInjector that
+// forwards input to the backend.
+type Proxy struct {
+	backend *rfb.ClientConn
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled on backend updates and errors
+	serial  int        // number of backend updates so far
+	history []update   // damage of the latest updates, oldest first
+	err     error      // why the backend connection ended
+}
+
+// update is the damage of one backend update.
+type update struct {
+	serial int
+	damage []image.Rectangle
+}
+
+// Dial connects to the backend server at address. config may set the
+// pixel format and encodings used towards the backend.
+func Dial(network, address string, config *rfb.ClientConfig) (*Proxy, error) {
+	p := new(Proxy)
+	p.cond = sync.NewCond(&p.mu)
+
+	var cfg rfb.ClientConfig
+	if config != nil {
+		cfg = *config
+	}
+	onUpdate := cfg.OnUpdate
+	cfg.OnUpdate = func(u rfb.UpdateStats) {
+		p.addUpdate(u.Damage)
+		if onUpdate != nil {
+			onUpdate(u)
+		}
+	}
+	cc, err := rfb.Dial(network, address, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	p.backend = cc
+	go p.watch()
+	return p, nil
+}
+
+// Backend returns the connection to the backend server.
+func (p *Proxy) Backend() *rfb.ClientConn {
+	return p.backend
+}
+
+// Close closes the backend connection. Viewers are disconnected on
+// their next update request.
+func (p *Proxy) Close() error {
+	return p.backend.Close()
+}
+
+// Serve accepts viewers on ln and serves them until ln fails.
+func (p *Proxy) Serve(ln net.Listener) error {
+	b := p.backend.Bounds()
+	s := rfb.NewServer(b.Dx(), b.Dy())
+	go func() {
+		for c := range s.Incoming(context.Background()) {
+			go p.ServeConn(c)
+		}
+	}()
+	return s.Serve(ln)
+}
+
+// ServeConn relays the backend to c and c's input to the backend. It
+// returns when c disconnects or the backend fails.
+func (p *Proxy) ServeConn(c *rfb.Conn) error {
+	c.SetFrameSource(&viewer{p: p, seen: -1})
+	return c.ForwardEvents(p)
+}
+
+// InjectKey sends e to the backend.
+func (p *Proxy) InjectKey(e rfb.KeyEvent) error {
+	return p.backend.KeyEvent(e.Key, e.DownFlag != 0)
+}
+
+// InjectPointer sends e to the backend.
+func (p *Proxy) InjectPointer(e rfb.PointerEvent) error {
+	return p.backend.PointerEvent(e.ButtonMask, int(e.X), int(e.Y))
+}
+
+func (p *Proxy) addUpdate(damage []image.Rectangle) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.serial++
+	p.history = append(p.history, update{serial: p.serial, damage: damage})
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+	p.cond.Broadcast()
+}
+
+// watch waits for the backend connection to end and wakes up the
+// viewers.
+func (p *Proxy) watch() {
+	var err error
+	for {
+		err = p.backend.WaitForUpdate(time.Hour)
+		if err != nil && !errors.Is(err, rfb.ErrTimeout) {
+			break
+		}
+	}
+	p.mu.Lock()
+	p.err = err
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// A viewer is the frame source of one viewer connection. It keeps its
+// own copy of the framebuffer so the backend can be updated while the
+// server encodes.
+type viewer struct {
+	p    *Proxy
+	img  *image.RGBA
+	seen int // serial of the last backend update passed on; -1 for none
+}
+
+func (v *viewer) Bounds() image.Rectangle {
+	return v.p.backend.Bounds()
+}
+
+func (v *viewer) NextFrame() (*rfb.LockableImage, error) {
+	p := v.p
+	p.mu.Lock()
+	for v.seen >= 0 && p.serial == v.seen && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.err != nil {
+		p.mu.Unlock()
+		return nil, p.err
+	}
+	b := p.backend.Bounds()
+	var damage []image.Rectangle
+	if v.seen < 0 || len(p.history) == 0 || p.history[0].serial > v.seen+1 {
+		damage = []image.Rectangle{b}
+	} else {
+		for _, u := range p.history {
+			if u.serial > v.seen {
+				damage = append(damage, u.damage...)
+			}
+		}
+	}
+	v.seen = p.serial
+	p.mu.Unlock()
+
+	if v.img == nil || v.img.Rect != b {
+		v.img = image.NewRGBA(b)
+		damage = []image.Rectangle{b}
+	}
+	// The framebuffer may already contain newer updates than v.seen;
+	// their damage is passed on with the next frame.
+	for _, r := range damage {
+		p.backend.ReadRegion(v.img, r)
+	}
+	return &rfb.LockableImage{Img: v.img, Damage: damage}, nil
+}
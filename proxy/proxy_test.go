@@ -0,0 +1,80 @@
+package proxy_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/proxy"
+	"github.com/patdhlk/rfb/rfbtest"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+func TestProxy(t *testing.T) {
+	backend := rfb.NewServer(64, 48)
+	src := rfbtest.NewSource(image.Rect(0, 0, 64, 48))
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := backend.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	addr := rfbtest.Serve(t, backend)
+
+	p, err := proxy.Dial("tcp", addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	bc := <-connc
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go p.Serve(ln)
+
+	v1 := rfbtest.Connect(t, ln.Addr().String())
+	v2 := rfbtest.Connect(t, ln.Addr().String())
+
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	src.Frames <- &rfb.LockableImage{Img: rfbtest.Solid(64, 48, red)}
+	for _, v := range []*rfbtest.Viewer{v1, v2} {
+		if err := v.WaitForPixel(image.Pt(10, 10), red, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next := rfbtest.Solid(64, 48, red)
+	white := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	next.Set(40, 30, white)
+	src.Frames <- &rfb.LockableImage{Img: next}
+	for _, v := range []*rfbtest.Viewer{v1, v2} {
+		if err := v.WaitForImage(next.Rect, next, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := v2.PointerEvent(rfb.ButtonLeft, 3, 4); err != nil {
+		t.Fatal(err)
+	}
+	want := rfb.PointerEvent{ButtonMask: rfb.ButtonLeft, X: 3, Y: 4}
+	select {
+	case e := <-bc.Event:
+		if e != want {
+			t.Errorf("backend got %#v; want %#v", e, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for forwarded pointer event")
+	}
+}
@@ -0,0 +1,468 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+)
+
+// RealVNC's RSA-AES security types. The keys are exchanged with RSA and
+// the credentials sent with AES in EAX mode; the "ne" types only encrypt
+// the handshake, the others the whole connection. The 256 variants use
+// AES-256 and SHA-256 instead of AES-128 and SHA-1.
+const (
+	authRA2      = 5
+	authRA2ne    = 6
+	authRA2256   = 129
+	authRA2ne256 = 130
+)
+
+// RSA-AES credential subtypes.
+const (
+	ra2UserPass = 1
+	ra2Pass     = 2
+)
+
+const (
+	// rsaKeyBits is the size of the keys generated for RSA-AES.
+	rsaKeyBits = 2048
+
+	// ra2MaxMessage is the most plaintext in one encrypted message.
+	ra2MaxMessage = 8192
+)
+
+// ra2Types are the RSA-AES security types, in the order offered.
+var ra2Types = []uint8{authRA2256, authRA2, authRA2ne256, authRA2ne}
+
+// ra2Params returns the AES key size and the hash of RSA-AES type t, and
+// whether it keeps encrypting after the handshake.
+func ra2Params(t uint8) (keySize int, newHash func() hash.Hash, all bool) {
+	switch t {
+	case authRA2256, authRA2ne256:
+		return 32, sha256.New, t == authRA2256
+	}
+	return 16, sha1.New, t == authRA2
+}
+
+// LoadOrCreateRSAKey returns the RSA key in the PEM file name, for
+// Server.RSAKey. If the file doesn't exist, a new key is generated and
+// saved there, so viewers that remember the server's key keep trusting
+// it across restarts.
+func LoadOrCreateRSAKey(name string) (*rsa.PrivateKey, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, err
+		}
+		b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		return key, os.WriteFile(name, b, 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("rfb: no PEM data in %s", name)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("rfb: %s holds a %T, not an RSA key", name, key)
+	}
+	return rsaKey, nil
+}
+
+// rsaKey returns Server.RSAKey, or a key generated once for the server.
+func (s *Server) rsaKey() (*rsa.PrivateKey, error) {
+	if s.RSAKey != nil {
+		return s.RSAKey, nil
+	}
+	s.rsaOnce.Do(func() {
+		s.rsaGenerated, s.rsaErr = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	})
+	return s.rsaGenerated, s.rsaErr
+}
+
+// offersRSAAES reports whether the RSA-AES security types are offered:
+// they need credentials to check.
+func (s *Server) offersRSAAES() bool {
+	return s.RSAAES && (s.Password != "" || s.Authenticate != nil)
+}
+
+// ra2PublicKey returns key as sent in RSA-AES: its size in bits, then
+// the modulus and the exponent, each as long as the key.
+func ra2PublicKey(key *rsa.PublicKey) []byte {
+	size := key.Size()
+	b := binary.BigEndian.AppendUint32(nil, uint32(key.N.BitLen()))
+	b = append(b, key.N.FillBytes(make([]byte, size))...)
+	return append(b, big.NewInt(int64(key.E)).FillBytes(make([]byte, size))...)
+}
+
+// readRA2PublicKey reads a public key sent by ra2PublicKey and returns it
+// with its encoding.
+func readRA2PublicKey(r io.Reader) (*rsa.PublicKey, []byte, error) {
+	var bits uint32
+	if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+		return nil, nil, err
+	}
+	if bits < 1024 || bits > 8192 {
+		return nil, nil, fmt.Errorf("RSA key of %d bits", bits)
+	}
+	size := int(bits+7) / 8
+	b := make([]byte, 4+2*size)
+	binary.BigEndian.PutUint32(b, bits)
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, nil, err
+	}
+	e := new(big.Int).SetBytes(b[4+size:])
+	if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+		return nil, nil, errors.New("bad RSA exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[4 : 4+size]), E: int(e.Int64())}, b, nil
+}
+
+// ra2Hash returns the hash of the two public keys, first and second, as
+// encoded by ra2PublicKey.
+func ra2Hash(newHash func() hash.Hash, first, second []byte) []byte {
+	h := newHash()
+	h.Write(first)
+	h.Write(second)
+	return h.Sum(nil)
+}
+
+// ra2Key returns the AES key for the peer sending first random.
+func ra2Key(newHash func() hash.Hash, keySize int, first, second []byte) []byte {
+	return ra2Hash(newHash, first, second)[:keySize]
+}
+
+// eax is AES in EAX mode, as RSA-AES uses it.
+type eax struct {
+	block  cipher.Block
+	k1, k2 [16]byte // the CMAC subkeys
+}
+
+func newEAX(key []byte) *eax {
+	block, _ := aes.NewCipher(key)
+	e := &eax{block: block}
+	var l [16]byte
+	block.Encrypt(l[:], l[:])
+	e.k1 = gfDouble(l)
+	e.k2 = gfDouble(e.k1)
+	return e
+}
+
+// gfDouble multiplies b by x in GF(2^128), for the CMAC subkeys.
+func gfDouble(b [16]byte) [16]byte {
+	var d [16]byte
+	for i := 0; i < 15; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+	d[15] = b[15] << 1
+	if b[0]&0x80 != 0 {
+		d[15] ^= 0x87
+	}
+	return d
+}
+
+// omac returns the CMAC of data prefixed by the block for tweak t.
+func (e *eax) omac(t byte, data []byte) [16]byte {
+	msg := make([]byte, 16, 16+len(data)+16)
+	msg[15] = t
+	msg = append(msg, data...)
+	last := (len(msg) - 1) / 16 * 16
+	var mac [16]byte
+	for i := 0; i < last; i += 16 {
+		subtle.XORBytes(mac[:], mac[:], msg[i:i+16])
+		e.block.Encrypt(mac[:], mac[:])
+	}
+	var final [16]byte
+	copy(final[:], msg[last:])
+	if len(msg)-last == 16 {
+		subtle.XORBytes(final[:], final[:], e.k1[:])
+	} else {
+		final[len(msg)-last] = 0x80
+		subtle.XORBytes(final[:], final[:], e.k2[:])
+	}
+	subtle.XORBytes(mac[:], mac[:], final[:])
+	e.block.Encrypt(mac[:], mac[:])
+	return mac
+}
+
+// seal returns plaintext encrypted, followed by the tag.
+func (e *eax) seal(nonce, ad, plaintext []byte) []byte {
+	n := e.omac(0, nonce)
+	out := make([]byte, len(plaintext), len(plaintext)+16)
+	cipher.NewCTR(e.block, n[:]).XORKeyStream(out, plaintext)
+	tag := e.tag(n, ad, out)
+	return append(out, tag[:]...)
+}
+
+// open returns the plaintext of ciphertext, followed by its tag, or
+// false if the tag doesn't match.
+func (e *eax) open(nonce, ad, ciphertext []byte) ([]byte, bool) {
+	if len(ciphertext) < 16 {
+		return nil, false
+	}
+	body, tag := ciphertext[:len(ciphertext)-16], ciphertext[len(ciphertext)-16:]
+	n := e.omac(0, nonce)
+	want := e.tag(n, ad, body)
+	if subtle.ConstantTimeCompare(tag, want[:]) != 1 {
+		return nil, false
+	}
+	out := make([]byte, len(body))
+	cipher.NewCTR(e.block, n[:]).XORKeyStream(out, body)
+	return out, true
+}
+
+func (e *eax) tag(n [16]byte, ad, ciphertext []byte) [16]byte {
+	h := e.omac(1, ad)
+	c := e.omac(2, ciphertext)
+	var tag [16]byte
+	subtle.XORBytes(tag[:], n[:], h[:])
+	subtle.XORBytes(tag[:], tag[:], c[:])
+	return tag
+}
+
+// ra2Nonce is the little-endian message counter RSA-AES uses as nonce.
+type ra2Nonce [16]byte
+
+func (n *ra2Nonce) next() {
+	for i := range n {
+		n[i]++
+		if n[i] != 0 {
+			return
+		}
+	}
+}
+
+// ra2Writer encrypts what's written to it into RSA-AES messages: the
+// plaintext length, which is also the associated data, then the
+// ciphertext and the tag.
+type ra2Writer struct {
+	w     io.Writer
+	eax   *eax
+	nonce ra2Nonce
+}
+
+func (w *ra2Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), ra2MaxMessage)
+		msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+n+16), uint16(n))
+		msg = append(msg, w.eax.seal(w.nonce[:], msg[:2], p[:n])...)
+		w.nonce.next()
+		if _, err := w.w.Write(msg); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ra2Reader decrypts the messages written by a ra2Writer.
+type ra2Reader struct {
+	r     io.Reader
+	eax   *eax
+	nonce ra2Nonce
+	buf   []byte // plaintext not read yet
+}
+
+var errRA2Tag = errors.New("rfb: RSA-AES message failed authentication")
+
+func (r *ra2Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		var hdr [2]byte
+		if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		msg := make([]byte, int(binary.BigEndian.Uint16(hdr[:]))+16)
+		if _, err := io.ReadFull(r.r, msg); err != nil {
+			return 0, err
+		}
+		var ok bool
+		if r.buf, ok = r.eax.open(r.nonce[:], hdr[:], msg); !ok {
+			return 0, errRA2Tag
+		}
+		r.nonce.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// authRSAAES runs the RSA-AES security type t and reports whether the
+// client sent valid credentials, and the user name. The connection is
+// left encrypted for the types encrypting everything.
+func (c *Conn) authRSAAES(t uint8) (user string, ok bool) {
+	keySize, newHash, all := ra2Params(t)
+	key, err := c.s.rsaKey()
+	if err != nil {
+		c.failf(ClassInternal, "generating RSA key: %v", err)
+	}
+	serverKey := ra2PublicKey(&key.PublicKey)
+	c.bw.Write(serverKey)
+	c.flush()
+	clientPub, clientKey, err := readRA2PublicKey(c.br)
+	if err != nil {
+		c.failf(ClassMalformed, "reading client RSA key: %v", err)
+	}
+
+	serverRandom := make([]byte, keySize)
+	rand.Read(serverRandom)
+	enc, err := rsa.EncryptPKCS1v15(rand.Reader, clientPub, serverRandom)
+	if err != nil {
+		c.failf(ClassMalformed, "encrypting for the client's RSA key: %v", err)
+	}
+	c.w(uint16(len(enc)))
+	c.bw.Write(enc)
+	c.flush()
+	var n uint16
+	c.read("rsa-aes.random-length", &n)
+	enc = make([]byte, n)
+	c.read("rsa-aes.random", enc)
+	clientRandom, err := rsa.DecryptPKCS1v15(rand.Reader, key, enc)
+	if err != nil || len(clientRandom) != keySize {
+		c.failf(ClassMalformed, "bad client random for RSA-AES")
+	}
+
+	// From here on, everything is encrypted.
+	if c.br.Buffered() != 0 {
+		c.failf(ClassMalformed, "client sent data ahead of the RSA-AES handshake")
+	}
+	c.br.Reset(&ra2Reader{r: c.c, eax: newEAX(ra2Key(newHash, keySize, serverRandom, clientRandom))})
+	c.cw.w = &ra2Writer{w: c.c, eax: newEAX(ra2Key(newHash, keySize, clientRandom, serverRandom))}
+
+	c.bw.Write(ra2Hash(newHash, serverKey, clientKey))
+	c.flush()
+	hash := make([]byte, newHash().Size())
+	c.read("rsa-aes.hash", hash)
+	if subtle.ConstantTimeCompare(hash, ra2Hash(newHash, clientKey, serverKey)) != 1 {
+		c.authFailure()
+		c.failf(ClassAuth, "RSA-AES key hashes don't match")
+	}
+
+	subtype := uint8(ra2Pass)
+	if c.s.Authenticate != nil {
+		subtype = ra2UserPass
+	}
+	c.w(subtype)
+	c.flush()
+	var b [1]byte
+	c.read("rsa-aes.username-length", &b)
+	userb := make([]byte, b[0])
+	c.read("rsa-aes.username", userb)
+	c.read("rsa-aes.password-length", &b)
+	password := make([]byte, b[0])
+	c.read("rsa-aes.password", password)
+	user = string(userb)
+	if c.s.Authenticate != nil {
+		ok = c.s.Authenticate(user, string(password))
+	} else {
+		ok = subtle.ConstantTimeCompare(password, []byte(c.s.Password)) == 1
+	}
+
+	if !all {
+		c.br.Reset(c.c)
+		c.cw.w = c.c
+	}
+	return user, ok
+}
+
+// authRSAAES runs the client side of RSA-AES security type t.
+func (cc *ClientConn) authRSAAES(t uint8, user, password string) error {
+	keySize, newHash, all := ra2Params(t)
+	serverPub, serverKey, err := readRA2PublicKey(cc.br)
+	if err != nil {
+		return fmt.Errorf("rfb: reading server RSA key: %v", err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return err
+	}
+	clientKey := ra2PublicKey(&key.PublicKey)
+	cc.bw.Write(clientKey)
+	if err := cc.bw.Flush(); err != nil {
+		return err
+	}
+
+	var n uint16
+	if err := cc.read(&n); err != nil {
+		return err
+	}
+	enc := make([]byte, n)
+	if _, err := io.ReadFull(cc.br, enc); err != nil {
+		return err
+	}
+	serverRandom, err := rsa.DecryptPKCS1v15(rand.Reader, key, enc)
+	if err != nil || len(serverRandom) != keySize {
+		return errors.New("rfb: bad server random for RSA-AES")
+	}
+	clientRandom := make([]byte, keySize)
+	rand.Read(clientRandom)
+	if enc, err = rsa.EncryptPKCS1v15(rand.Reader, serverPub, clientRandom); err != nil {
+		return err
+	}
+	cc.w(uint16(len(enc)))
+	cc.bw.Write(enc)
+	if err := cc.bw.Flush(); err != nil {
+		return err
+	}
+
+	cc.cr.r = &ra2Reader{r: cc.c, eax: newEAX(ra2Key(newHash, keySize, clientRandom, serverRandom))}
+	cc.bw.Reset(&ra2Writer{w: cc.c, eax: newEAX(ra2Key(newHash, keySize, serverRandom, clientRandom))})
+
+	hash := make([]byte, newHash().Size())
+	if _, err := io.ReadFull(cc.br, hash); err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, ra2Hash(newHash, serverKey, clientKey)) {
+		return errors.New("rfb: RSA-AES key hashes don't match")
+	}
+	cc.bw.Write(ra2Hash(newHash, clientKey, serverKey))
+	var subtype uint8
+	if err := cc.bw.Flush(); err != nil || cc.read(&subtype) != nil {
+		return errors.New("rfb: reading RSA-AES subtype")
+	}
+	if subtype != ra2UserPass {
+		user = ""
+	}
+	if len(user) > 255 || len(password) > 255 {
+		return errors.New("rfb: RSA-AES credentials longer than 255 bytes")
+	}
+	cc.w(uint8(len(user)))
+	cc.bw.WriteString(user)
+	cc.w(uint8(len(password)))
+	cc.bw.WriteString(password)
+	if err := cc.bw.Flush(); err != nil {
+		return err
+	}
+	cc.authenticated = true
+	if !all {
+		cc.cr.r = cc.c
+		cc.bw.Reset(cc.c)
+	}
+	return nil
+}
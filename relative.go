@@ -0,0 +1,66 @@
+package rfb
+
+// encodingQEMUPointerMotion is QEMU's Pointer Motion Change
+// pseudo-encoding, switching the client between absolute and relative
+// pointer events.
+const encodingQEMUPointerMotion = -257
+
+// relativeOffset is added to the deltas of PointerEvent messages in
+// relative mode, so they fit the unsigned fields.
+const relativeOffset = 0x7fff
+
+// RelativePointerEvent is a pointer movement by DX, DY pixels rather
+// than to a position, from a client in relative mode. See
+// Conn.SetRelativePointer.
+type RelativePointerEvent struct {
+	ButtonMask uint8
+	DX, DY     int
+}
+
+// pointerMotion is the pointer mode set with Conn.SetRelativePointer.
+type pointerMotion struct {
+	relative bool // wanted
+	sent     bool // the client was switched to relative mode
+}
+
+// SetRelativePointer switches clients supporting QEMU's Pointer Motion
+// Change pseudo-encoding to sending relative pointer movements, which
+// arrive on Event as RelativePointerEvent instead of PointerEvent, or
+// back to absolute positions. Relative mode suits framebuffers backed by
+// a VM or a game that grabs the pointer, where the client's pointer
+// position means nothing. The switch goes out with the next update,
+// which is sent at once if the client is waiting for one; other clients
+// stay absolute.
+func (c *Conn) SetRelativePointer(relative bool) {
+	c.mu.Lock()
+	c.motion.relative = relative
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// RelativePointer reports whether the client was switched to relative
+// pointer movements.
+func (c *Conn) RelativePointer() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.motion.sent
+}
+
+// motionPendingLocked reports whether the client is to be switched to
+// the other pointer mode. c.mu must be held.
+func (c *Conn) motionPendingLocked() bool {
+	return c.motion.relative != c.motion.sent && c.supportsLocked(encodingQEMUPointerMotion)
+}
+
+// pushMotionLocked writes the Pointer Motion Change pseudo-rectangle.
+// c.mu must be held.
+func (c *Conn) pushMotionLocked() {
+	c.motion.sent = c.motion.relative
+	x := uint16(1) // absolute
+	if c.motion.sent {
+		x = 0
+	}
+	c.w(x)
+	c.w([3]uint16{}) // y, width, height
+	c.w(int32(encodingQEMUPointerMotion))
+}
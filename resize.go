@@ -0,0 +1,164 @@
+package rfb
+
+import (
+	"image"
+	"image/draw"
+	"log"
+)
+
+// supportsLocked reports whether the client announced enc in
+// SetEncodings. c.mu must be held.
+func (c *Conn) supportsLocked(enc int32) bool {
+	for _, e := range c.encodings {
+		if e == enc {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeLocked changes the connection's framebuffer size to size and
+// writes the pseudo-rectangle telling the client, which must be counted
+// in the current update. It reports false if the client can't be told.
+// c.mu must be held.
+func (c *Conn) resizeLocked(size image.Point) bool {
+	var enc int32
+	switch {
+	case c.supportsLocked(encodingExtendedDesktopSize):
+		enc = encodingExtendedDesktopSize
+	case c.supportsLocked(encodingDesktopSize):
+		enc = encodingDesktopSize
+	default:
+		return false
+	}
+	log.Printf("resizing client framebuffer from %dx%d to %dx%d", c.width, c.height, size.X, size.Y)
+	c.width, c.height = size.X, size.Y
+	c.last = nil
+	c.resetHardware()
+
+	c.pushDesktopSizeLocked(enc)
+	return true
+}
+
+// setSize records the size of the latest frame, so new connections
+// start with it.
+func (s *Server) setSize(size image.Point) {
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	s.width, s.height = size.X, size.Y
+}
+
+func (s *Server) size() (w, h int) {
+	s.sizeMu.RLock()
+	defer s.sizeMu.RUnlock()
+	return s.width, s.height
+}
+
+// Resize sets the framebuffer size of all clients to w×h, whatever the
+// size of the frames, as Conn.Resize does for one client. Connections
+// made later start with this size. Resize(0, 0) makes the framebuffer
+// follow the frames again.
+func (s *Server) Resize(w, h int) {
+	s.sizeMu.Lock()
+	s.fixed = image.Pt(max(w, 0), max(h, 0))
+	if w > 0 && h > 0 {
+		s.width, s.height = w, h
+	}
+	s.sizeMu.Unlock()
+
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	for c := range s.live {
+		c.mu.Lock()
+		c.refresh = true
+		c.mu.Unlock()
+	}
+}
+
+// Resize sets the client's framebuffer size to w×h, overriding the
+// server's, for screen resolution changes the frames don't show yet.
+// Clients supporting the DesktopSize or ExtendedDesktopSize
+// pseudo-encoding are resized with the next update; frames of another
+// size are cropped or scaled to fit, depending on the server's
+// SizePolicy. Resize(0, 0) makes the framebuffer follow the frames, or
+// the size set with Server.Resize, again.
+func (c *Conn) Resize(w, h int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fixed = image.Pt(max(w, 0), max(h, 0))
+	c.refresh = true
+}
+
+// targetSizeLocked returns the framebuffer size for a frame of the given
+// size, and whether it was set with Resize. c.mu must be held.
+func (c *Conn) targetSizeLocked(frame image.Point) (size image.Point, fixed bool) {
+	if c.fixed.X > 0 && c.fixed.Y > 0 {
+		return c.fixed, true
+	}
+	c.s.sizeMu.RLock()
+	defer c.s.sizeMu.RUnlock()
+	if f := c.s.fixed; f.X > 0 && f.Y > 0 {
+		return f, true
+	}
+	return frame, false
+}
+
+// A SizePolicy decides how frames are sent whose size differs from the
+// client's framebuffer.
+type SizePolicy int
+
+const (
+	// ResizeOrCrop resizes the client's framebuffer if the client
+	// supports it, and crops or pads the frames otherwise.
+	ResizeOrCrop SizePolicy = iota
+
+	// ResizeOrScale resizes the client's framebuffer if the client
+	// supports it, and scales the frames otherwise.
+	ResizeOrScale
+
+	// Crop never resizes; frames are cropped at the right and bottom
+	// or padded with black.
+	Crop
+
+	// Scale never resizes; frames are scaled to the client's size.
+	Scale
+)
+
+func (p SizePolicy) resizes() bool {
+	return p == ResizeOrCrop || p == ResizeOrScale
+}
+
+func (p SizePolicy) scales() bool {
+	return p == ResizeOrScale || p == Scale
+}
+
+// canResizeLocked reports whether the client supports a desktop size
+// pseudo-encoding. c.mu must be held.
+func (c *Conn) canResizeLocked() bool {
+	return c.supportsLocked(encodingExtendedDesktopSize) || c.supportsLocked(encodingDesktopSize)
+}
+
+// fitFrame returns img cropped, padded or scaled to size according to
+// policy. Frames with 16 bits per channel keep them.
+func fitFrame(img image.Image, size image.Point, policy SizePolicy) draw.Image {
+	var dst draw.Image
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		dst = image.NewRGBA64(image.Rectangle{Max: size})
+	default:
+		dst = image.NewRGBA(image.Rectangle{Max: size})
+	}
+	b := img.Bounds()
+	if !policy.scales() {
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+		return dst
+	}
+	// Nearest neighbour is good enough for an emergency measure.
+	for y := 0; y < size.Y; y++ {
+		sy := b.Min.Y + y*b.Dy()/size.Y
+		for x := 0; x < size.X; x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*b.Dx()/size.X, sy))
+		}
+	}
+	return dst
+}
@@ -2,13 +2,20 @@ package rfb
 
 import (
 	"bufio"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/binary"
-	"fmt"
 	"image"
+	"io"
+	"iter"
 	"log"
+	"math/bits"
 	"net"
-	"strconv"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -21,8 +28,28 @@ const (
 	statusOK     = 0
 	statusFailed = 1
 
-	encodingRaw = 0
-	//encodingCopyRect = 1
+	encodingRaw      = 0
+	encodingCopyRect = 1
+	encodingCoRRE    = 4
+	encodingHextile  = 5
+	encodingTight    = 7
+	encodingZRLE     = 16
+	encodingOpenH264 = 50
+
+	// Pseudo-encodings
+	encodingXCursor              = -240
+	encodingRichCursor           = -239
+	encodingPointerPos           = -232
+	encodingDesktopSize          = -223
+	encodingLastRect             = -224
+	encodingQEMUExtendedKeyEvent = -258
+	encodingExtendedDesktopSize  = -308
+	encodingCursorWithAlpha      = -314
+	encodingVMwareCursor         = 0x574d5664
+
+	// TightPNG is numbered like a pseudo-encoding, but it's a rectangle
+	// encoding.
+	encodingTightPNG = -260
 
 	// Client -> Server
 	cmdSetPixelFormat           = 0
@@ -31,6 +58,12 @@ const (
 	cmdKeyEvent                 = 4
 	cmdPointerEvent             = 5
 	cmdClientCutText            = 6
+	cmdXvp                      = 250
+	cmdSetDesktopSize           = 251
+	cmdQEMU                     = 255
+
+	// QEMU client message subtypes
+	qemuExtendedKeyEvent = 0
 
 	// Server -> Client
 	cmdFramebufferUpdate = 0
@@ -53,43 +86,401 @@ func NewServer(width, height int) *Server {
 }
 
 type Server struct {
-	width, height int
-	conns         chan *Conn // read/write version of Conns
+	sizeMu        sync.RWMutex
+	width, height int          // size of the latest frame; guarded by sizeMu
+	fixed         image.Point  // set with Resize; guarded by sizeMu
+	name          string       // set with SetName; guarded by sizeMu
+	screens       []Screen     // set with SetScreens; guarded by sizeMu
+	goroutines    atomic.Int64 // see ActiveGoroutines
+	conns         chan *Conn   // read/write version of Conns
 
 	// Conns is a channel of incoming connections.
+	//
+	// Deprecated: connections are dropped if the channel's buffer is
+	// full. Use Accept or Incoming instead, and don't mix them with
+	// Conns.
 	Conns <-chan *Conn
+
+	acceptMu sync.Mutex
+	pending  []*Conn       // connections not yet returned by Accept
+	wake     chan struct{} // closed when pending or serving changes
+	serving  int           // number of running Serve calls
+	serveErr error         // why the last Serve call returned
+
+	// Guarded by acceptMu, for Shutdown:
+	listeners map[net.Listener]struct{}
+	live      map[*Conn]struct{} // connections not yet ended
+	closing   bool               // Shutdown was called
+
+	authMu      sync.Mutex
+	authRecords map[string]*authRecord // by address, for AuthLimit; guarded by authMu
+
+	rsaOnce      sync.Once // generates rsaGenerated when RSAKey isn't set
+	rsaGenerated *rsa.PrivateKey
+	rsaErr       error
+
+	// QEMUKeyEvents makes clients that support the QEMU extended key
+	// event extension send QEMUKeyEvent values, which carry scancodes,
+	// instead of KeyEvent.
+	QEMUKeyEvents bool
+
+	// DesktopSizeRequests makes clients' requests to resize the
+	// framebuffer arrive on Conn.Event as DesktopSizeRequest, for the
+	// application to answer. Otherwise, they are rejected.
+	DesktopSizeRequests bool
+
+	// Xvp makes clients supporting the xvp extension offer power
+	// control, whose requests arrive on Conn.Event as XvpEvent.
+	Xvp bool
+
+	// TouchEvents makes clients supporting the gii extension send the
+	// contacts on their touch devices, which arrive on Conn.Event as
+	// TouchEvent.
+	TouchEvents bool
+
+	// Password, if set, makes clients use VNC Authentication instead
+	// of None. Only its first eight characters count, and the protocol
+	// only keeps it from being sent in the clear, so connections should
+	// still be tunneled over untrusted networks. See ReadPasswordFile.
+	Password string
+
+	// Authenticate, if set, checks the user name and password of clients
+	// using the RSA-AES security types, instead of comparing the
+	// password with Password, and makes the server offer Apple Remote
+	// Desktop authentication, which macOS Screen Sharing logs in with,
+	// rather than None.
+	Authenticate func(user, password string) bool
+
+	// RSAAES makes the server offer RealVNC's RSA-AES security types,
+	// which RealVNC viewers use by default, when Password or Authenticate
+	// is set. They encrypt the credentials and, for the types the client
+	// prefers, the whole connection.
+	RSAAES bool
+
+	// MSLogon makes the server offer UltraVNC's MSLogonII security type,
+	// whose user names and passwords, often in domain form, are checked
+	// with Authenticate, when that is set. Its key agreement is weak, so
+	// connections should still be tunneled over untrusted networks.
+	MSLogon bool
+
+	// RSAKey is the server's key for RSA-AES. If nil, a key is generated
+	// for the server's lifetime; viewers that remember keys then warn
+	// after every restart, which a key from LoadOrCreateRSAKey avoids.
+	RSAKey *rsa.PrivateKey
+
+	// TightSecurity makes the server offer TightVNC's security type in
+	// addition to None or VNC Authentication. Its clients negotiate the
+	// same authentication inside it, and learn about the server's
+	// extensions. As it only knows VNC Authentication, it isn't offered
+	// if other types authenticate clients and Password isn't set.
+	TightSecurity bool
+
+	// SecurityHandlers are security types implemented by the application,
+	// offered to 3.7 and 3.8 clients in order before the built-in ones,
+	// which they replace if they share a number. With any set, None is
+	// no longer offered, nor Tight unless Password is set, and 3.3
+	// clients, which can't be offered a choice, are refused unless
+	// Password is set.
+	SecurityHandlers []SecurityHandler
+
+	// SecurityTypes, if set, lists the security types offered, in order
+	// of preference, among those SecurityHandlers and the other options
+	// make available. None, and Tight unless it would let clients around
+	// Authenticate or SecurityHandlers, are available to list even when
+	// other types are configured. 3.3 clients get the first of None and
+	// VNC Authentication listed, or are refused.
+	SecurityTypes []uint8
+
+	// FileSystem, if set, is offered to clients supporting TightVNC's
+	// file transfer extension, which can then list, download and upload
+	// its files and create directories; view-only ones can't change it.
+	// Those clients only learn about
+	// it through TightVNC's security type, which is then offered as if
+	// TightSecurity was set.
+	FileSystem FileSystem
+
+	// ClientCAs, if set, makes the server require connections served over
+	// a *tls.Conn with a client certificate that verifies against it,
+	// which Conn.Identity then reports. The listener's tls.Config must
+	// ask for client certificates, with tls.RequestClientCert or
+	// stricter; other connections are refused before the security types.
+	ClientCAs *x509.CertPool
+
+	// AuthLimit, if set, locks out addresses after repeated failed
+	// authentications.
+	AuthLimit *AuthLimit
+
+	// LenientVersions makes the server accept the ProtocolVersion
+	// messages of viewers that don't follow the specification: later
+	// major versions, like RealVNC's "RFB 004.001", are taken for 3.8,
+	// and anything after the version on its line is ignored.
+	LenientVersions bool
+
+	// AllowConn, if set, is called by Serve with every accepted
+	// connection before anything is sent on it. Connections it returns
+	// false for are closed at once, so it can implement address
+	// allowlists or throttling. It runs in Serve's accept loop, so it
+	// should return quickly. ServeConn's callers do their own checks.
+	AllowConn func(nc net.Conn) bool
+
+	// DeferHandshake makes connections wait for Conn.Start before the
+	// handshake, so the application can choose per-connection options.
+	// Connections are then only available through Accept or Incoming.
+	DeferHandshake bool
+
+	// Workers, if non-zero, limits how many connections encode updates
+	// at once. Connections take turns in order, and one that has encoded
+	// TurnBudget bytes lets the others go first before continuing, so a
+	// slow or expensive client doesn't starve the rest.
+	Workers int
+
+	// TurnBudget is the number of bytes a connection may encode per turn.
+	// If zero, DefaultTurnBudget is used.
+	TurnBudget int
+
+	// SizePolicy decides what happens when a frame's size differs from
+	// the client's framebuffer.
+	SizePolicy SizePolicy
+
+	// SharePolicy decides what happens when a client asks for exclusive
+	// access rather than to share the desktop.
+	SharePolicy SharePolicy
+
+	// OnProtocolError, if set, is called when a client does something
+	// the server can't handle, and decides how to respond to errors that
+	// allow a choice. It's called from the connection's goroutines.
+	OnProtocolError func(*Conn, *ProtocolError) ErrorAction
+
+	// MaxRects limits the number of rectangles per FramebufferUpdate
+	// message. Changes needing more are sent as several updates, each
+	// sent before the next is encoded. If zero, the limit is what the
+	// protocol allows: 65535, or unlimited for clients supporting the
+	// LastRect pseudo-encoding.
+	MaxRects int
+
+	// MaxRectPixels, if non-zero, splits rectangles larger than this
+	// many pixels into bands. Together with MaxRects, it
+	// bounds the memory used for a single update.
+	MaxRectPixels int
+
+	// SuppressUnchanged makes the server remember a hash of every tile
+	// it sent, as the client sees it, and skip changed regions that look
+	// the same after conversion to the client's pixel format. It costs
+	// CPU time, so it only pays off with low-colour clients or sources
+	// that change pixels invisibly.
+	SuppressUnchanged bool
+
+	// AdaptiveEncoding picks an encoding for each rectangle by its
+	// content, solid, low-colour or photographic, among those the
+	// client announced, instead of using the client's preferred
+	// encoding throughout. It costs a pass over each rectangle.
+	AdaptiveEncoding bool
+
+	// Viewers recognizes viewers and their quirks; the first matching
+	// rule applies. If nil, DefaultViewers is used.
+	Viewers []ViewerRule
+
+	// Differ finds the regions to send in incremental updates. If nil,
+	// a TileDiffer with TileSize is used.
+	Differ Differ
+
+	// TileSize is the size of the tiles the default Differ compares and
+	// SuppressUnchanged hashes. Small tiles send less for scattered
+	// changes but cost more per tile; tiles needn't be square. If zero,
+	// tiles are 64×64 pixels.
+	TileSize image.Point
+
+	// StallTimeout, if non-zero, is how long a connection waits for a
+	// frame before its frame source counts as stalled. The client then
+	// sees what StallPolicy or StallImage says until frames arrive again.
+	StallTimeout time.Duration
+	StallPolicy  StallPolicy
+
+	// StallImage, if set, returns the image shown to c while its frame
+	// source is stalled, overriding StallPolicy. last is the last frame
+	// the client got, or nil. It can add a message, for instance.
+	StallImage func(c *Conn, last image.Image) image.Image
+
+	// OnStall, if set, is called when the frame source of c stalls, and
+	// again with stalled false when it recovers.
+	OnStall func(c *Conn, stalled bool)
+
+	// Splash, if set, is shown to clients asking for an update before
+	// there's a frame for them, as white text on a dark background,
+	// instead of keeping them waiting. For example, "Waiting for
+	// desktop…".
+	Splash string
+
+	// SplashImage, if set, returns the image shown instead of Splash, or
+	// nil to wait for the first frame after all.
+	SplashImage func(c *Conn) image.Image
+
+	// HardwareEncoder, if set, is tried first for JPEG and H.264
+	// compression.
+	HardwareEncoder HardwareEncoder
+
+	// AppleScreenSharing, if set, enables the compatibility profile for
+	// macOS's Screen Sharing viewer.
+	AppleScreenSharing *AppleScreenSharing
+
+	// H264Encoder, if set, provides software H.264 compression for
+	// clients asking for the Open H.264 encoding.
+	H264Encoder H264Encoder
+
+	// ShutdownNotice, if set, is sent to the clients' clipboard when the
+	// server shuts down, to tell users why the connection ends.
+	ShutdownNotice string
+
+	schedOnce sync.Once
+	sched     *scheduler
+
+	stats statsTable // of all connections
 }
 
 func (s *Server) Serve(ln net.Listener) error {
+	if !s.listen(ln) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.acceptMu.Lock()
+	s.serving++
+	s.acceptMu.Unlock()
 	for {
 		c, err := ln.Accept()
 		if err != nil {
+			s.acceptMu.Lock()
+			if s.closing {
+				err = ErrServerClosed
+			}
+			delete(s.listeners, ln)
+			s.serving--
+			s.serveErr = err
+			s.wakeLocked()
+			s.acceptMu.Unlock()
 			return err
 		}
+		if s.AllowConn != nil && !s.AllowConn(c) {
+			log.Printf("refused connection from %v", c.RemoteAddr())
+			c.Close()
+			continue
+		}
 		conn := s.newConn(c)
+		s.track(conn) // if not, serving it fails at once
+		s.acceptMu.Lock()
+		s.pending = append(s.pending, conn)
+		s.wakeLocked()
+		s.acceptMu.Unlock()
+		if !s.DeferHandshake {
+			select {
+			case s.conns <- conn:
+			default:
+				// client is behind; doesn't get this updated.
+			}
+		}
+		conn.spawn(conn.serve)
+	}
+}
+
+// ServeConn serves a client connected over a transport that doesn't
+// come with a net.Listener, such as a WebSocket upgraded by an HTTP
+// handler. The connection is returned to the caller rather than through
+// Accept or Conns, so a handler can attach it to a Session directly.
+func (s *Server) ServeConn(nc net.Conn) *Conn {
+	conn := s.newConn(nc)
+	s.track(conn)
+	conn.spawn(conn.serve)
+	return conn
+}
+
+// Accept waits for the next incoming connection. Every connection is
+// returned exactly once, however late Accept is called, unless the
+// client has disconnected in the meantime. Accept returns an error when
+// ctx is done, or when all Serve calls have returned and no connections
+// are left.
+func (s *Server) Accept(ctx context.Context) (*Conn, error) {
+	for {
+		s.acceptMu.Lock()
+		if len(s.pending) > 0 {
+			c := s.pending[0]
+			s.pending = s.pending[1:]
+			s.acceptMu.Unlock()
+			return c, nil
+		}
+		if s.serving == 0 && s.serveErr != nil {
+			err := s.serveErr
+			s.acceptMu.Unlock()
+			return nil, err
+		}
+		if s.wake == nil {
+			s.wake = make(chan struct{})
+		}
+		wake := s.wake
+		s.acceptMu.Unlock()
+
 		select {
-		case s.conns <- conn:
-		default:
-			// client is behind; doesn't get this updated.
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Incoming returns an iterator over incoming connections. It stops when
+// Accept would fail; call Accept to learn why.
+func (s *Server) Incoming(ctx context.Context) iter.Seq[*Conn] {
+	return func(yield func(*Conn) bool) {
+		for {
+			c, err := s.Accept(ctx)
+			if err != nil || !yield(c) {
+				return
+			}
+		}
+	}
+}
+
+// wakeLocked wakes up the Accept calls waiting for a change.
+func (s *Server) wakeLocked() {
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// forget drops c from the live connections and those awaiting Accept
+// after it disconnected.
+func (s *Server) forget(c *Conn) {
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	delete(s.live, c)
+	for i, p := range s.pending {
+		if p == c {
+			s.pending = append(s.pending[:i], s.pending[i+1:]...)
+			return
 		}
-		go conn.serve()
 	}
 }
 
 func (s *Server) newConn(c net.Conn) *Conn {
 	feed := make(chan *LockableImage, 16)
 	event := make(chan interface{}, 16)
+	cw := &countingWriter{w: c}
 	conn := &Conn{
-		s:      s,
-		c:      c,
-		br:     bufio.NewReader(c),
-		bw:     bufio.NewWriter(c),
-		fbupc:  make(chan FrameBufferUpdateRequest, 128),
-		closec: make(chan bool),
-		feed:   feed,
-		Feed:   feed, // the send-only version
-		event:  event,
-		Event:  event, // the recieve-only version
+		s:        s,
+		c:        c,
+		br:       bufio.NewReader(c),
+		cw:       cw,
+		bw:       bufio.NewWriter(cw),
+		fbupc:    newUpdateLatch(),
+		closec:   make(chan struct{}),
+		startc:   make(chan struct{}),
+		initc:    make(chan struct{}),
+		closingc: make(chan struct{}),
+		swapc:    make(chan struct{}, 1),
+		shapec:   make(chan struct{}, 1),
+		feed:     feed,
+		Feed:     feed, // the send-only version
+		event:    event,
+		Event:    event, // the recieve-only version
 	}
 	return conn
 }
@@ -97,47 +488,136 @@ func (s *Server) newConn(c net.Conn) *Conn {
 type LockableImage struct {
 	sync.RWMutex
 	Img image.Image
+
+	// Damage optionally lists the regions of Img that changed since the
+	// previous frame. It's passed to the server's Differ, which by
+	// default trusts it, and compares the frames itself if it's nil.
+	Damage []image.Rectangle
+
+	// Moves optionally lists regions that were copied within the frame
+	// since the previous one (dragged windows, scrolling). They're only
+	// used together with Damage and needn't be repeated there.
+	Moves []Move
+
+	// Cursor optionally gives the area of Img the source drew the mouse
+	// pointer into. When the server compares frames itself and only the
+	// pointer moved, it then sends just the pointer's old and new areas
+	// rather than the tiles around them.
+	Cursor image.Rectangle
+}
+
+// A Move describes a region of a frame whose pixels were copied from
+// another place in the previous frame.
+type Move struct {
+	Src image.Point     // top-left corner of the source region
+	Dst image.Rectangle // where the pixels ended up
 }
 
 type Conn struct {
 	s      *Server
 	c      net.Conn
 	br     *bufio.Reader
+	wmu    sync.Mutex // guards bw once the handshake is done; see writeMessage
+	cw     *countingWriter
 	bw     *bufio.Writer
-	fbupc  chan FrameBufferUpdateRequest
-	closec chan bool // never sent; just closed
-
-	// should only be mutated once during handshake, but then
-	// only read.
+	initc  chan struct{} // closed after ServerInit was sent
+	fbupc  *updateLatch
+	closec chan struct{} // closed when the connection ends; see Done
+
+	startMu  sync.Mutex
+	started  bool          // Start was called; guarded by startMu
+	closed   bool          // Close was called; guarded by startMu
+	startc   chan struct{} // closed by Start
+	closingc chan struct{} // closed by Close
+	opts     StartOptions  // set by Start before startc is closed
+
+	// set during the handshake, then guarded by mu.
 	format PixelFormat
 
-	feed chan *LockableImage
-	mu   sync.RWMutex // guards last
-	last image.Image  // pointer to read only image (the last we've sent to the client)
+	colourMapSent bool // the colour map for format was sent; guarded by mu
+
+	width, height int // framebuffer size as known to the client; guarded by mu
+
+	feed       chan *LockableImage
+	mu         sync.RWMutex          // guards last and source
+	last       image.Image           // pointer to read only image (the last we've sent to the client)
+	cursor     image.Rectangle       // LockableImage.Cursor of last; guarded by mu
+	shape      cursorShape           // set with SetCursor; guarded by mu
+	fixed      image.Point           // set with Resize; guarded by mu
+	screens    []Screen              // set with SetScreens; guarded by mu
+	sentLayout []Screen              // the layout the client knows; guarded by mu
+	sizeReply  sizeReply             // guarded by mu
+	name       string                // set with SetName; guarded by mu
+	sentName   string                // the name the client knows; guarded by mu
+	clip       extClipboard          // guarded by mu
+	ft         fileTransfer          // used by the reading goroutine only
+	gii        map[uint32]*giiDevice // by origin; used by the reading goroutine only
+	pos        pointerPos            // set with SetPointerPos; guarded by mu
+	motion     pointerMotion         // set with SetRelativePointer; guarded by mu
+	extButtons bool                  // the client may send extended buttons; guarded by mu
+	source     FrameSource           // if non-nil, used instead of feed
+	swapc      chan struct{}         // signalled by SetFrameSource
+	shapec     chan struct{}         // signalled by SetCursor, SetPointerPos and SetScreens
 
 	buf8 []uint8 // temporary buffer to avoid generating garbage
 
-	// Feed is the channel to send new frames.
+	err       error                  // why the connection ended; guarded by mu
+	encodings []int32                // as sent by the client in SetEncodings; guarded by mu
+	tiles     map[image.Point]uint64 // tile hashes for Server.SuppressUnchanged; guarded by mu
+	pixbuf    []uint32               // temporary buffer for translated pixels; guarded by mu
+	pseudo    []int32                // pseudo-encodings to acknowledge in the next update; guarded by mu
+	rre       *rreEncoder            // guarded by mu
+	hextile   *hextileEncoder        // guarded by mu
+	refresh   bool                   // send the next frame in full; guarded by mu
+	colour    colourLimit            // guarded by mu
+	tight     *tightEncoder          // guarded by mu
+	encoders  map[int32]Encoder      // guarded by mu
+	zrle      *zrleEncoder           // guarded by mu
+	stats     statsTable
+	obs       observers
+
+	fp         Fingerprint // guarded by mu
+	identity   Identity    // guarded by mu
+	quirks     Quirks      // guarded by mu
+	identified bool        // fp is complete; guarded by mu
+	apple      bool        // the client answered with Apple's version
+	ver        string      // the protocol version agreed on
+	refused    bool        // a failed SecurityResult was sent
+
+	// Feed is the channel to send new frames. Nothing reads it once
+	// the connection has ended, so senders should select on Done too.
 	Feed chan<- *LockableImage
 
 	// Event is a readable channel of events from the client.
-	// The value will be either a KeyEvent or PointerEvent.  The
+	// The value will be a KeyEvent, PointerEvent, RelativePointerEvent,
+	// QEMUKeyEvent or ClipboardEvent, a DesktopSizeRequest if
+	// Server.DesktopSizeRequests is set, an XvpEvent if Server.Xvp is
+	// set, or a TouchEvent if Server.TouchEvents is set. The
 	// channel is closed when the client disconnects.
 	Event <-chan interface{}
 
 	event chan interface{} // internal version of Event
 
-	gotFirstFrame bool
-}
+	inputMu      sync.Mutex // guards sending to and closing event
+	viewOnly     bool       // drop the client's input; guarded by inputMu
+	eventsClosed bool       // guarded by inputMu
+	held         heldInput  // the delivered input held down; guarded by inputMu
 
-func (c *Conn) dimensions() (w, h int) {
-	return c.s.width, c.s.height
+	gotFirstFrame bool
+	splashed      bool // only used by the sending goroutine
+
+	turn  scheduledTurn // only used by the sending goroutine
+	hw    hardwareState // only used by the sending goroutine
+	h264  h264State     // only used by the sending goroutine
+	stall stallState    // only used by the sending goroutine
+	pull  framePull     // only used by the sending goroutine
+	pulls atomic.Int32  // NextFrame calls not returned yet
 }
 
 func (c *Conn) readByte(what string) byte {
 	b, err := c.br.ReadByte()
 	if err != nil {
-		c.failf("reading client byte for %q: %v", what, err)
+		c.failf(ClassIO, "reading client byte for %q: %v", what, err)
 	}
 	return b
 }
@@ -151,7 +631,7 @@ func (c *Conn) readPadding(what string, size int) {
 func (c *Conn) read(what string, v interface{}) {
 	err := binary.Read(c.br, binary.BigEndian, v)
 	if err != nil {
-		c.failf("reading from client into %T for %q: %v", v, what, err)
+		c.failf(ClassIO, "reading from client into %T for %q: %v", v, what, err)
 	}
 }
 
@@ -163,53 +643,67 @@ func (c *Conn) flush() {
 	c.bw.Flush()
 }
 
-func (c *Conn) failf(format string, args ...interface{}) {
-	panic(fmt.Sprintf(format, args...))
+// refuse sends a failed SecurityResult, with the reason if ver allows.
+func (c *Conn) refuse(ver, reason string) {
+	c.refused = true
+	c.w(uint32(statusFailed))
+	if ver >= v8 {
+		// Tell the client why, as 3.8 allows.
+		c.writeReason(reason)
+		return
+	}
+	c.flush()
 }
 
 func (c *Conn) serve() {
+	defer c.s.forget(c)
 	defer c.c.Close()
-	defer close(c.fbupc)
+	defer c.fbupc.close()
 	defer close(c.closec)
-	defer close(c.event)
+	defer c.closeEvents()
+	defer c.abortUpload()
 	defer func() {
 		e := recover()
 		if e != nil {
 			log.Printf("Client disconnect: %v", e)
+			c.recoverErr(e, ClassMalformed)
 		}
 	}()
 
-	c.bw.WriteString("RFB 003.008\n")
+	if !c.awaitStart() {
+		return
+	}
+
+	apple := c.s.AppleScreenSharing
+	if apple != nil {
+		c.bw.WriteString(vApple)
+	} else {
+		c.bw.WriteString(v8)
+	}
 	c.flush()
 	sl, err := c.br.ReadSlice('\n')
 	if err != nil {
-		c.failf("reading client protocol version: %v", err)
+		c.failf(ClassIO, "reading client protocol version: %v", err)
 	}
-	ver := string(sl)
-	log.Printf("client wants: %q", ver)
-	switch ver {
-	case v3, v7, v8: // cool.
-	default:
-		c.failf("bogus client-requested security type %q", ver)
+	log.Printf("client wants: %q", sl)
+	ver, ok := protocolVersion(string(sl), c.s.LenientVersions)
+	if !ok {
+		c.failf(ClassMalformed, "bogus client-requested protocol version %q", sl)
 	}
+	c.apple = apple != nil && string(sl) == vApple
+	c.ver = ver
+	c.mu.Lock()
+	c.fp.Version = ver[6:7] + "." + ver[10:11] // "RFB 003.008\n" -> "3.8"
+	c.fp.Security = authNone
+	c.mu.Unlock()
 
 	// Auth
-	if ver >= v7 {
-		// Just 1 auth type supported: 1 (no auth)
-		c.bw.WriteString("\x01\x01")
-		c.flush()
-		wanted := c.readByte("6.1.2:client requested security-type")
-		if wanted != authNone {
-			c.failf("client wanted auth type %d, not None", int(wanted))
-		}
-	} else {
-		// Old way. Just tell client we're doing no auth.
-		c.w(uint32(authNone))
-		c.flush()
-	}
+	authenticated := c.negotiateSecurity()
 
-	if ver >= v8 {
-		// 6.1.3. SecurityResult
+	if ver >= v8 || authenticated {
+		// 6.1.3. SecurityResult. 3.3 and 3.7 only send it after
+		// authenticating, which None and Tight without authentication
+		// don't.
 		c.w(uint32(statusOK))
 		c.flush()
 	}
@@ -218,23 +712,23 @@ func (c *Conn) serve() {
 
 	// ClientInit
 	wantShared := c.readByte("shared-flag") != 0
-	_ = wantShared
-
-	c.format = PixelFormat{
-		BPP:        16,
-		Depth:      16,
-		BigEndian:  0,
-		TrueColour: 1,
-		RedMax:     0x1f,
-		GreenMax:   0x1f,
-		BlueMax:    0x1f,
-		RedShift:   0xa,
-		GreenShift: 0x5,
-		BlueShift:  0,
+	c.mu.Lock()
+	c.fp.Shared = wantShared
+	c.mu.Unlock()
+	if !wantShared {
+		c.claimExclusive()
 	}
 
+	c.format = c.nativeFormat()
+
 	// 6.3.2. ServerInit
-	width, height := c.dimensions()
+	width, height := c.s.size()
+	if src := c.frameSource(); src != nil {
+		width, height = src.Bounds().Dx(), src.Bounds().Dy()
+	}
+	c.mu.Lock()
+	c.width, c.height = width, height
+	c.mu.Unlock()
 	c.w(uint16(width))
 	c.w(uint16(height))
 	c.w(c.format.BPP)
@@ -250,10 +744,18 @@ func (c *Conn) serve() {
 	c.w(uint8(0)) // pad1
 	c.w(uint8(0)) // pad2
 	c.w(uint8(0)) // pad3
-	serverName := "rfb-go"
+	c.mu.Lock()
+	c.name = c.opts.Name
+	serverName := c.nameLocked()
+	c.sentName = serverName
+	c.mu.Unlock()
 	c.w(int32(len(serverName)))
 	c.bw.WriteString(serverName)
+	if c.fp.Security == authTight {
+		c.writeTightCaps()
+	}
 	c.flush()
+	close(c.initc)
 
 	for {
 		//log.Printf("awaiting command byte from client...")
@@ -270,31 +772,124 @@ func (c *Conn) serve() {
 			c.handlePointerEvent()
 		case cmdKeyEvent:
 			c.handleKeyEvent()
+		case cmdClientCutText:
+			c.handleClientCutText()
+		case cmdXvp:
+			c.handleXvp()
+		case cmdGII:
+			c.handleGII()
+		case cmdFileListRequest, cmdFileDownloadRequest, cmdFileUploadRequest, cmdFileUploadData,
+			cmdFileDownloadCancel, cmdFileUploadFailed, cmdFileCreateDirRequest:
+			c.handleFileTransfer(cmd)
+		case cmdSetDesktopSize:
+			c.handleSetDesktopSize()
+		case cmdQEMU:
+			c.handleQEMUMessage()
 		default:
-			c.failf("unsupported command type %d from client", int(cmd))
+			c.failf(ClassMalformed, "unsupported command type %d from client", int(cmd))
 		}
 	}
 }
 
+// protocolVersion returns the version to speak with a client that sent
+// the ProtocolVersion message s. As the RFB specification asks, unknown
+// 3.x versions, like 3.5 or UltraVNC's 3.6, are taken for 3.3, since
+// their viewers use the 3.3 handshake; versions after 3.8, like Apple's
+// 3.889, are taken for 3.8, the highest the server offered. If lenient
+// is set, later major versions, like RealVNC's 4.1, are taken for 3.8
+// too, and anything between the version and the newline is ignored.
+func protocolVersion(s string, lenient bool) (ver string, ok bool) {
+	if lenient && len(s) > len(v8) {
+		s = s[:len(v8)-1] + "\n"
+	}
+	if len(s) != len(v8) || s[:4] != "RFB " || s[7] != '.' || s[11] != '\n' {
+		return "", false
+	}
+	major, minor := 0, 0
+	for i, b := range []byte(s[4:7] + s[8:11]) {
+		if b < '0' || b > '9' {
+			return "", false
+		}
+		if i < 3 {
+			major = major*10 + int(b-'0')
+		} else {
+			minor = minor*10 + int(b-'0')
+		}
+	}
+	switch {
+	case lenient && major > 3:
+		return v8, true
+	case major != 3:
+		return "", false
+	}
+	switch {
+	case minor >= 8:
+		return v8, true
+	case minor == 7:
+		return v7, true
+	default:
+		return v3, true
+	}
+}
+
 func (c *Conn) pushFramesLoop() {
-	for {
-		select {
-		case ur, ok := <-c.fbupc:
-			if !ok {
-				// Client disconnected.
-				return
+	defer c.closeH264Streams()
+	defer func() {
+		// The sending goroutine mustn't take the whole program down.
+		if e := recover(); e != nil {
+			if _, ok := e.(*ProtocolError); ok {
+				log.Printf("Client disconnect while sending: %v", e)
+			} else {
+				log.Printf("Client disconnect while sending: %v\n%s", e, debug.Stack())
 			}
-			c.pushFrame(ur)
+			c.recoverErr(e, ClassInternal)
+			c.c.Close()
+		}
+	}()
+	for {
+		ur, ok := c.fbupc.take()
+		if !ok {
+			// Client disconnected.
+			return
 		}
+		c.pushFrame(ur)
+		c.notifyObservers()
 	}
 }
 
 func (c *Conn) pushFrame(ur FrameBufferUpdateRequest) {
-	li := <-c.feed
+	if ur.Width == 0 || ur.Height == 0 {
+		// Nothing to wait for.
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.pushEmptyLocked()
+		return
+	}
+
+	li, ok := c.nextFrame()
+	if !ok {
+		return
+	}
 	if li == nil {
+		// No frame, but maybe a new pointer shape or position, name or
+		// layout.
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pendingRectsLocked() > 0 || c.desktopPendingLocked() {
+			c.pushEmptyLocked()
+		}
 		return
 	}
 
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.beginTurn()
+	defer c.endTurn()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -305,110 +900,230 @@ func (c *Conn) pushImage(li *LockableImage, ur FrameBufferUpdateRequest) {
 	li.Lock()
 	defer li.Unlock()
 
+	img, damage, moves, cursor := li.Img, li.Damage, li.Moves, li.Cursor
+	if c.stall.stale {
+		damage, moves = nil, nil
+		c.stall.stale = false
+	}
+	incremental := ur.incremental() && !c.refresh
+	c.refresh = false
+	resized := false
+	size, fixed := c.targetSizeLocked(img.Bounds().Size())
+	if cur := image.Pt(c.width, c.height); size != cur {
+		if (fixed || c.s.SizePolicy.resizes()) && c.canResizeLocked() {
+			if !fixed {
+				c.s.setSize(size)
+			}
+			resized = true
+		} else {
+			size = cur
+		}
+	}
+	if img.Bounds().Size() != size {
+		// The source's damage doesn't apply to the fitted frame.
+		img = fitFrame(img, size, c.s.SizePolicy)
+		damage, moves, cursor = nil, nil, image.Rectangle{}
+	}
+
 	var lastImg = c.last
 
 	var rects []image.Rectangle
-	if ur.incremental() {
-		rects = compareImages(li.Img, lastImg)
+	var copies []Move
+	if resized {
+		rects = append(rects, img.Bounds())
+	} else if incremental && lastImg != nil {
+		rects = clipRects(c.s.differ().Diff(lastImg, img, damage), img.Bounds())
+		if damage == nil {
+			if rc, ok := cursorOnly(lastImg, img, rects, c.cursor, cursor); ok {
+				rects = rc
+			}
+		} else if c.supportsLocked(encodingCopyRect) {
+			copies = clipMoves(moves, img.Bounds())
+		} else {
+			for _, m := range moves {
+				rects = append(rects, clipRects([]image.Rectangle{m.Dst}, img.Bounds())...)
+			}
+		}
 	} else {
-		rects = append(rects, li.Img.Bounds())
+		rects = append(rects, img.Bounds())
 	}
 
-	c.w(uint8(cmdFramebufferUpdate))
-	c.w(uint8(0))           // padding byte
-	c.w(uint16(len(rects))) // number of rectangles
+	if c.s.SuppressUnchanged {
+		c.forgetTilesLocked(copies)
+		rects = c.dropUnchangedLocked(img, rects, incremental && !resized)
+	}
+
+	pseudo := c.pseudo
+	c.pseudo = nil
 
 	//log.Printf("sending %d changed sections", len(rects))
 
-	if c.format.TrueColour == 0 {
-		c.failf("only true-colour supported")
+	c.pushColourMapLocked()
+	rects = splitRects(rects, c.s.MaxRectPixels)
+	plan := c.planRectsLocked(img, rects)
+	c.mirrorLocked(img, copies, rects)
+	maxRects := c.s.MaxRects
+	lastRect := c.supportsLocked(encodingLastRect)
+	if maxRects <= 0 && !lastRect {
+		maxRects = 0xffff
 	}
 
-	// Send rectangles:
-	for _, rect := range rects {
-		c.w(uint16(rect.Min.X)) // x
-		c.w(uint16(rect.Min.Y)) // y
-		c.w(uint16(rect.Dx()))  // width
-		c.w(uint16(rect.Dy()))  // height
-		c.w(int32(encodingRaw))
+	// The pseudo-rectangles and CopyRects go in the first update, which
+	// is sent even if there are no rectangles.
+	extra := len(pseudo) + len(copies)
+	pending := c.pendingRectsLocked()
+	layout := !resized && c.desktopPendingLocked()
+	if resized || layout {
+		extra++
+	}
+	extra += pending
+	for first := true; first || len(plan) > 0; first = false {
+		n := len(plan)
+		if maxRects > 0 && n+extra > maxRects {
+			n = max(maxRects-extra, 0)
+		}
+		chunk := plan[:n]
+		plan = plan[n:]
+		// Clients supporting LastRect read 0xffff as "until LastRect".
+		useLastRect := lastRect && n+extra >= 0xffff
+
+		c.w(uint8(cmdFramebufferUpdate))
+		c.w(uint8(0)) // padding byte
+		if useLastRect {
+			c.w(uint16(0xffff)) // terminated by LastRect
+		} else {
+			c.w(uint16(n + extra)) // number of rectangles
+		}
+
+		for _, enc := range pseudo {
+			c.w(uint16(0)) // x
+			c.w(uint16(0)) // y
+			c.w(uint16(0)) // width
+			c.w(uint16(0)) // height
+			c.w(enc)
+		}
+		if resized {
+			c.resizeLocked(img.Bounds().Size())
+		} else if layout {
+			c.pushDesktopSizeLocked(encodingExtendedDesktopSize)
+		}
+		if pending > 0 {
+			c.pushPendingLocked()
+		}
+		for _, m := range copies {
+			c.pushCopyRectLocked(m)
+		}
 
-		// note: this doesn't work right now (pushRGBAScreensThousandsLocked() directly accesses the pixel buffer, ignoring the SubImage() boundaries)
-		/*rgba, isRGBA := li.Img.(*image.RGBA)
-		if isRGBA && c.format.isScreensThousands() {
-			// Fast path.
-			rgba = rgba.SubImage(rect).(*image.RGBA)
-			c.pushRGBAScreensThousandsLocked(rgba)
-		} else {*/
-		c.pushGenericLocked(li.Img, rect)
-		//}
+		// Send rectangles:
+		for _, p := range chunk {
+			c.pushRectLocked(p.enc, p.e, img, p.rect)
+			c.yieldTurn()
+		}
+		if useLastRect {
+			c.w([4]uint16{}) // x, y, width, height
+			c.w(int32(encodingLastRect))
+		}
+		c.flush()
+		if len(plan) > 0 {
+			c.sendTurn()
+		}
+		pseudo, copies, resized, layout, pending, extra = nil, nil, false, false, 0, 0
+	}
+
+	c.last = img
+	c.cursor = cursor
+}
+
+// pendingRectsLocked returns the number of pseudo-rectangles the next
+// update carries for the pointer and the desktop name. c.mu must be held.
+func (c *Conn) pendingRectsLocked() int {
+	n := c.pointerRectsLocked()
+	if c.namePendingLocked() {
+		n++
+	}
+	return n
+}
+
+// pushPendingLocked writes the pseudo-rectangles counted by
+// pendingRectsLocked. c.mu must be held.
+func (c *Conn) pushPendingLocked() {
+	c.pushPointerLocked()
+	if c.namePendingLocked() {
+		c.pushNameLocked()
+	}
+}
+
+// pushEmptyLocked sends an update without rectangles, apart from pending
+// pseudo-encodings.
+func (c *Conn) pushEmptyLocked() {
+	pseudo := c.pseudo
+	c.pseudo = nil
+	c.pushColourMapLocked()
+	c.w(uint8(cmdFramebufferUpdate))
+	c.w(uint8(0)) // padding byte
+	pending := c.pendingRectsLocked()
+	layout := c.desktopPendingLocked()
+	n := len(pseudo) + pending
+	if layout {
+		n++
+	}
+	c.w(uint16(n))
+	for _, enc := range pseudo {
+		c.w([4]uint16{}) // x, y, width, height
+		c.w(enc)
+	}
+	if layout {
+		c.pushDesktopSizeLocked(encodingExtendedDesktopSize)
+	}
+	if pending > 0 {
+		c.pushPendingLocked()
 	}
 	c.flush()
+}
 
-	c.last = li.Img
-}
-
-func (c *Conn) pushRGBAScreensThousandsLocked(im *image.RGBA) {
-	var u16 uint16
-	pixels := len(im.Pix) / 4
-	if len(c.buf8) < pixels*2 {
-		c.buf8 = make([]byte, pixels*2)
-	}
-	out := c.buf8[:]
-	isBigEndian := c.format.BigEndian != 0
-	for i, v8 := range im.Pix {
-		switch i % 4 {
-		case 0: // red
-			u16 = uint16(v8&248) << 7 // 3 masked bits + 7 shifted == redshift of 10
-		case 1: // green
-			u16 |= uint16(v8&248) << 2 // redshift of 5
-		case 2: // blue
-			u16 |= uint16(v8 >> 3)
-		case 3: // alpha, unused.  use this to just move the dest
-			hb, lb := uint8(u16>>8), uint8(u16)
-			if isBigEndian {
-				out[0] = hb
-				out[1] = lb
-			} else {
-				out[0] = lb
-				out[1] = hb
-			}
-			out = out[2:]
-		}
+// pushRectLocked sends rect of im as a rectangle with encoding enc,
+// using Encoder e, or as Raw if e falls back.
+func (c *Conn) pushRectLocked(enc int32, e Encoder, im image.Image, rect image.Rectangle) {
+	if c.format.BPP != 8 && c.format.BPP != 16 && c.format.BPP != 32 {
+		c.failf(ClassUnsupported, "BPP of %d", c.format.BPP)
+	}
+	start := time.Now()
+	sent := c.sentLocked()
+	w := &rectWriter{c: c, rect: rect, enc: enc}
+	err := encode(e, w, c.format, im, rect)
+	if err == ErrFallback && !w.started {
+		enc = encodingRaw
+		w.enc = enc
+		err = encode(c.encoderLocked(enc), w, c.format, im, rect)
+	}
+	if p, ok := err.(encoderPanic); ok {
+		c.failf(ClassInternal, "encoding rectangle %v with encoding %d: %v\n%s", rect, enc, p.v, p.stack)
 	}
-	c.bw.Write(c.buf8[:pixels*2])
+	if err != nil {
+		c.failf(ClassIO, "encoding rectangle %v with encoding %d: %v", rect, enc, err)
+	}
+	w.header() // for empty payloads
+	pixels := int64(rect.Dx() * rect.Dy())
+	c.recordLocked(EncodingStats{
+		Encoding: enc,
+		Rects:    1,
+		Pixels:   pixels,
+		RawBytes: pixels * int64(c.format.BPP/8),
+		Bytes:    c.sentLocked() - sent - 12, // without the header
+		Duration: time.Since(start),
+	})
 }
 
-// pushGenericLocked is the slow path generic implementation that works on
-// any image.Image concrete type and any client-requested pixel format.
-// If you're lucky, you never end in this path.
-func (c *Conn) pushGenericLocked(im image.Image, rect image.Rectangle) {
+// pushRawLocked writes rect of im in the client's pixel format to w, as
+// the payload of a Raw rectangle.
+func (c *Conn) pushRawLocked(w io.Writer, im image.Image, rect image.Rectangle) {
 	for y := rect.Min.Y; y < rect.Max.Y; y++ {
-		for x := rect.Min.X; x < rect.Max.X; x++ {
-			col := im.At(x, y)
-			r16, g16, b16, _ := col.RGBA()
-			r16 = inRange(r16, c.format.RedMax)
-			g16 = inRange(g16, c.format.GreenMax)
-			b16 = inRange(b16, c.format.BlueMax)
-			var u32 uint32 = (r16 << c.format.RedShift) |
-				(g16 << c.format.GreenShift) |
-				(b16 << c.format.BlueShift)
-			var v interface{}
-			switch c.format.BPP {
-			case 32:
-				v = u32
-			case 16:
-				v = uint16(u32)
-			case 8:
-				v = uint8(u32)
-			default:
-				c.failf("TODO: BPP of %d", c.format.BPP)
-			}
-			if c.format.BigEndian != 0 {
-				binary.Write(c.bw, binary.BigEndian, v)
-			} else {
-				binary.Write(c.bw, binary.LittleEndian, v)
-			}
+		c.pixbuf = c.translateLocked(c.pixbuf[:0], im, image.Rect(rect.Min.X, y, rect.Max.X, y+1))
+		c.buf8 = c.buf8[:0]
+		for _, v := range c.pixbuf {
+			c.buf8 = c.format.appendPixel(c.buf8, v)
 		}
+		w.Write(c.buf8)
 	}
 }
 
@@ -419,15 +1134,6 @@ type PixelFormat struct {
 	RedShift, GreenShift, BlueShift uint8
 }
 
-// Is the format requested by the OS X "Screens" app's "Thousands" mode.
-func (f *PixelFormat) isScreensThousands() bool {
-	// Note: Screens asks for Depth 16; RealVNC asks for Depth 15 (which is more accurate)
-	// Accept either. Same format.
-	return f.BPP == 16 && (f.Depth == 16 || f.Depth == 15) && f.TrueColour != 0 &&
-		f.RedMax == 0x1f && f.GreenMax == 0x1f && f.BlueMax == 0x1f &&
-		f.RedShift == 10 && f.GreenShift == 5 && f.BlueShift == 0
-}
-
 // 6.4.1
 func (c *Conn) handleSetPixelFormat() {
 	log.Printf("handling setpixel format")
@@ -445,7 +1151,23 @@ func (c *Conn) handleSetPixelFormat() {
 	c.read("pixelformat.blueshift", &pf.BlueShift)
 	c.readPadding("SetPixelFormat pixel format padding", 3)
 	log.Printf("Client wants pixel format: %#v", pf)
-	c.format = pf
+	switch {
+	case pf.BPP != 8 && pf.BPP != 16 && pf.BPP != 32:
+		c.reject(ClassUnsupported, "pixel format with %d bits per pixel", pf.BPP)
+		return
+	case !pf.fits():
+		c.reject(ClassUnsupported, "pixel format with channels beyond its %d bits per pixel", pf.BPP)
+		return
+	}
+	if pf.TrueColour == 0 {
+		pf = colourMapFormat(pf)
+	}
+	c.mu.Lock()
+	c.format = c.quirkFormat(pf)
+	c.colourMapSent = false
+	c.tiles = nil    // hashed in the old format
+	c.shape.sent = 0 // in the old format
+	c.mu.Unlock()
 
 	// TODO: send PixelFormat event? would clients care?
 }
@@ -464,6 +1186,39 @@ func (c *Conn) handleSetEncodings() {
 	}
 	log.Printf("Client encodings: %#v", encType)
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.identified {
+		c.identifyLocked(encType)
+	}
+	c.encodings = c.quirkEncodings(encType)
+	if c.cursorPendingLocked() || c.extButtonsPendingLocked() {
+		// The pointer shape has to go out in another pseudo-encoding,
+		// or extended buttons be confirmed.
+		c.wakeShape()
+	}
+	c.clip.caps = 0
+	for _, t := range encType {
+		switch t {
+		case encodingQEMUExtendedKeyEvent:
+			// Clients only send extended key events once we've
+			// confirmed we understand them.
+			if c.s.QEMUKeyEvents {
+				c.pseudo = append(c.pseudo, t)
+			}
+		case encodingGII:
+			if c.s.TouchEvents {
+				c.spawn(c.sendGIIVersion)
+			}
+		case encodingXvp:
+			if c.s.Xvp {
+				c.spawn(c.sendXvpInit)
+			}
+		case encodingExtendedClipboard:
+			// The client answers with its caps.
+			c.spawn(c.sendClipboardCaps)
+		}
+	}
 }
 
 // 6.4.3
@@ -478,7 +1233,7 @@ func (r *FrameBufferUpdateRequest) incremental() bool { return r.IncrementalFlag
 func (c *Conn) handleUpdateRequest() {
 	if !c.gotFirstFrame {
 		c.gotFirstFrame = true
-		go c.pushFramesLoop()
+		c.spawn(c.pushFramesLoop)
 	}
 
 	var req FrameBufferUpdateRequest
@@ -487,7 +1242,15 @@ func (c *Conn) handleUpdateRequest() {
 	c.read("framebuffer-update.y", &req.Y)
 	c.read("framebuffer-update.width", &req.Width)
 	c.read("framebuffer-update.height", &req.Height)
-	c.fbupc <- req
+	c.mu.RLock()
+	fb := image.Rect(0, 0, c.width, c.height)
+	c.mu.RUnlock()
+	if !req.rect().In(fb) {
+		if c.reject(ClassBadRequest, "update request for %v outside the %v framebuffer", req.rect(), fb.Size()) == ActionEmptyUpdate {
+			req.Width, req.Height = 0, 0
+		}
+	}
+	c.fbupc.put(req)
 }
 
 // 6.4.4
@@ -502,42 +1265,95 @@ func (c *Conn) handleKeyEvent() {
 	c.read("key-event.downflag", &req.DownFlag)
 	c.readPadding("key-event.padding", 2)
 	c.read("key-event.key", &req.Key)
-	select {
-	case c.event <- req:
-	default:
-		// Client's too slow.
-	}
+	c.deliverInput(req)
 }
 
 // 6.4.5
 type PointerEvent struct {
 	ButtonMask uint8
 	X, Y       uint16
+
+	// ExtButtonMask holds the buttons from 9 up, which only clients
+	// supporting the ExtendedMouseButtons pseudo-encoding send.
+	ExtButtonMask uint8
 }
 
+// Bits of PointerEvent.ButtonMask.
+const (
+	ButtonLeft = 1 << iota
+	ButtonMiddle
+	ButtonRight
+	WheelUp
+	WheelDown
+	WheelLeft
+	WheelRight
+	ButtonBack // button 8
+)
+
+// Bits of PointerEvent.ExtButtonMask.
+const (
+	ButtonForward = 1 << iota // button 9
+)
+
 // 6.4.5
 func (c *Conn) handlePointerEvent() {
 	var req PointerEvent
 	c.read("pointer-event.mask", &req.ButtonMask)
 	c.read("pointer-event.x", &req.X)
 	c.read("pointer-event.y", &req.Y)
-	select {
-	case c.event <- req:
+	c.mu.RLock()
+	extended := c.extButtons
+	c.mu.RUnlock()
+	if extended && req.ButtonMask&0x80 != 0 {
+		// Bit 7 flags the extended mask, with the buttons from 8 up.
+		buttons := uint16(req.ButtonMask&0x7f) | uint16(c.readByte("pointer-event.extended-mask"))<<7
+		req.ButtonMask, req.ExtButtonMask = uint8(buttons), uint8(buttons>>8)
+	}
+	if c.RelativePointer() {
+		c.deliverInput(RelativePointerEvent{
+			ButtonMask: req.ButtonMask,
+			DX:         int(req.X) - relativeOffset,
+			DY:         int(req.Y) - relativeOffset,
+		})
+		return
+	}
+	c.deliverInput(req)
+}
+
+// QEMUKeyEvent is a key event carrying the scancode of the key in
+// addition to the keysym. Clients only send it if Server.QEMUKeyEvents is
+// set.
+type QEMUKeyEvent struct {
+	DownFlag uint16
+	Key      uint32 // keysym
+	Keycode  uint32 // XT scancode; extended keys have the 0xe0 prefix replaced by the high bit
+}
+
+// QEMU client message
+func (c *Conn) handleQEMUMessage() {
+	subtype := c.readByte("qemu.submessage-type")
+	switch subtype {
+	case qemuExtendedKeyEvent:
+		var req QEMUKeyEvent
+		c.read("qemu-key-event.downflag", &req.DownFlag)
+		c.read("qemu-key-event.keysym", &req.Key)
+		c.read("qemu-key-event.keycode", &req.Keycode)
+		c.deliverInput(req)
 	default:
-		// Client's too slow.
+		c.failf(ClassMalformed, "unsupported QEMU message subtype %d from client", int(subtype))
 	}
 }
 
-// compareImages -- chops the images in 64x64 squares and returns a list of changed sections
+// compareImages -- chops the images in sections of the given size and returns a list of changed sections
 //
 // note: this will only work if the application sends us references to different Image objects
 // each time
-func compareImages(oldImg image.Image, newImg image.Image) []image.Rectangle {
+func compareImages(oldImg image.Image, newImg image.Image, sectionSize image.Point) []image.Rectangle {
 	var rc []image.Rectangle
 
 	// prechecks
 	if oldImg == nil && newImg == nil {
-		panic("can't compare two nil images")
+		return nil
 	} else if oldImg == nil {
 		// first frame -> everything's changed
 		rc = append(rc, newImg.Bounds())
@@ -546,7 +1362,8 @@ func compareImages(oldImg image.Image, newImg image.Image) []image.Rectangle {
 		// by pushing a nil image, the app code's telling us there have been no changes -> return empty list
 		return []image.Rectangle{}
 	} else if newImg.Bounds() != oldImg.Bounds() {
-		panic("images have different sizes")
+		// different sizes -> everything's changed
+		return []image.Rectangle{newImg.Bounds()}
 	}
 
 	var minInt = func(a, b int) int { // helper function
@@ -556,22 +1373,21 @@ func compareImages(oldImg image.Image, newImg image.Image) []image.Rectangle {
 		return b
 	}
 
-	const sectionSize = 64
 	bounds := newImg.Bounds()
-	for sectionTop := bounds.Min.Y; sectionTop < bounds.Max.Y; sectionTop += sectionSize {
+	for sectionTop := bounds.Min.Y; sectionTop < bounds.Max.Y; sectionTop += sectionSize.Y {
 		var changedSections = map[int]struct{}{} // x coordinates (sectionLeft) of the sections already in rc
 
-		for y := sectionTop; y < bounds.Max.Y; y++ { // row by row
+		var sectionEnd = minInt(sectionTop+sectionSize.Y, bounds.Max.Y)
+		for y := sectionTop; y < sectionEnd; y++ { // row by row
 			for x := bounds.Min.X; x < bounds.Max.X; x++ {
-				var sectionLeft = x - (x % sectionSize)
+				var sectionLeft = x - (x % sectionSize.X)
 				if _, exists := changedSections[sectionLeft]; exists {
 					continue
 				}
 				if oldImg.At(x, y) != newImg.At(x, y) {
 					// add changed section to rc
-					var sectionRight = minInt(sectionLeft+sectionSize, bounds.Max.X)
-					var sectionBottom = minInt(sectionTop+sectionSize, bounds.Max.Y)
-					rc = append(rc, image.Rect(sectionLeft, sectionTop, sectionRight, sectionBottom))
+					var sectionRight = minInt(sectionLeft+sectionSize.X, bounds.Max.X)
+					rc = append(rc, image.Rect(sectionLeft, sectionTop, sectionRight, sectionEnd))
 					changedSections[sectionLeft] = struct{}{}
 				}
 			}
@@ -581,12 +1397,10 @@ func compareImages(oldImg image.Image, newImg image.Image) []image.Rectangle {
 	return rc
 }
 
+// inRange scales the 16-bit colour component v to 0..max.
 func inRange(v uint32, max uint16) uint32 {
-	switch max {
-	case 0x1f: // 5 bits
-		return v >> (16 - 5)
-	case 0x03: // 2 bits
-		return v >> (16 - 2)
+	if max&(max+1) == 0 { // all ones, the common case
+		return v >> (16 - bits.OnesCount16(max))
 	}
-	panic("todo; max value = " + strconv.Itoa(int(max)))
+	return v * uint32(max) / 0xffff
 }
@@ -0,0 +1,219 @@
+// Package rfbtest provides utilities for end-to-end tests of applications
+// embedding an rfb.Server: connect a real client and assert on what it
+// receives.
+package rfbtest
+
+import (
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+var update = flag.Bool("rfbtest.update", false, "rewrite golden files instead of comparing against them")
+
+// Timeout is how long assertions wait for the expected framebuffer
+// contents to arrive.
+var Timeout = 5 * time.Second
+
+// Serve serves s on a loopback listener for the duration of the test and
+// returns the address to connect to.
+func Serve(t testing.TB, s *rfb.Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("rfbtest: listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.Serve(ln)
+	return ln.Addr().String()
+}
+
+// Viewer is a client connected to the server under test.
+type Viewer struct {
+	*rfb.ClientConn
+	t testing.TB
+}
+
+// Connect connects a viewer to the server at addr. It's closed when the
+// test ends.
+func Connect(t testing.TB, addr string) *Viewer {
+	t.Helper()
+	cc, err := rfb.Dial("tcp", addr, nil)
+	if err != nil {
+		t.Fatalf("rfbtest: connecting to %s: %v", addr, err)
+	}
+	t.Cleanup(func() { cc.Close() })
+	return &Viewer{ClientConn: cc, t: t}
+}
+
+// AssertRegion waits until region of the framebuffer matches want (its
+// top-left corner aligned with region.Min), with each colour channel
+// allowed to be off by tolerance. Servers usually reduce the colour
+// depth, so a tolerance of a few steps is normal. The test fails if the
+// region doesn't match within Timeout.
+func (v *Viewer) AssertRegion(region image.Rectangle, want image.Image, tolerance uint8) {
+	v.t.Helper()
+	deadline := time.Now().Add(Timeout)
+	var msg string
+	for {
+		got := v.Screenshot()
+		if !region.In(got.Rect) {
+			v.t.Fatalf("rfbtest: region %v outside of framebuffer %v", region, got.Rect)
+		}
+		w := image.NewRGBA(region)
+		draw.Draw(w, region, want, want.Bounds().Min, draw.Src)
+		if msg = Diff(got.SubImage(region), w, tolerance); msg == "" {
+			return
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			break
+		}
+		if err := v.WaitForUpdate(left); err != nil {
+			break
+		}
+	}
+	v.t.Errorf("rfbtest: framebuffer region %v: %s", region, msg)
+}
+
+// AssertGolden waits until the framebuffer matches the PNG file at path
+// (relative paths are taken to be in testdata). If the test is run with
+// -rfbtest.update, the file is written instead, after waiting for the
+// framebuffer to settle.
+func (v *Viewer) AssertGolden(path string, tolerance uint8) {
+	v.t.Helper()
+	if !filepath.IsAbs(path) {
+		path = filepath.Join("testdata", path)
+	}
+	if *update {
+		for v.WaitForUpdate(200*time.Millisecond) == nil {
+		}
+		if err := WriteGolden(path, v.Screenshot()); err != nil {
+			v.t.Fatalf("rfbtest: %v", err)
+		}
+		return
+	}
+	want, err := ReadGolden(path)
+	if err != nil {
+		v.t.Fatalf("rfbtest: %v (run with -rfbtest.update to create it)", err)
+	}
+	if b := v.Bounds(); want.Bounds() != b {
+		v.t.Fatalf("rfbtest: golden file %s is %v, framebuffer is %v", path, want.Bounds(), b)
+	}
+	v.AssertRegion(want.Bounds(), want, tolerance)
+}
+
+// AssertEqual fails the test if got and want differ by more than
+// tolerance in any colour channel.
+func AssertEqual(t testing.TB, got, want image.Image, tolerance uint8) {
+	t.Helper()
+	if msg := Diff(got, want, tolerance); msg != "" {
+		t.Errorf("rfbtest: images differ: %s", msg)
+	}
+}
+
+// Diff compares two images, ignoring alpha, and describes the
+// differences. It returns "" if they match within tolerance.
+func Diff(got, want image.Image, tolerance uint8) string {
+	if got.Bounds().Size() != want.Bounds().Size() {
+		return fmt.Sprintf("size %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	gb, wb := got.Bounds(), want.Bounds()
+	bad := 0
+	var first string
+	for y := 0; y < gb.Dy(); y++ {
+		for x := 0; x < gb.Dx(); x++ {
+			gr, gg, gbl, _ := got.At(gb.Min.X+x, gb.Min.Y+y).RGBA()
+			wr, wg, wbl, _ := want.At(wb.Min.X+x, wb.Min.Y+y).RGBA()
+			if far(gr, wr, tolerance) || far(gg, wg, tolerance) || far(gbl, wbl, tolerance) {
+				if bad == 0 {
+					first = fmt.Sprintf("pixel (%d,%d) is #%02x%02x%02x, want #%02x%02x%02x",
+						gb.Min.X+x, gb.Min.Y+y, gr>>8, gg>>8, gbl>>8, wr>>8, wg>>8, wbl>>8)
+				}
+				bad++
+			}
+		}
+	}
+	switch bad {
+	case 0:
+		return ""
+	case 1:
+		return first
+	}
+	return fmt.Sprintf("%s (and %d more pixels differ)", first, bad-1)
+}
+
+func far(a, b uint32, tolerance uint8) bool {
+	a, b = a>>8, b>>8
+	if a < b {
+		a, b = b, a
+	}
+	return a-b > uint32(tolerance)
+}
+
+// ReadGolden reads a PNG file.
+func ReadGolden(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// WriteGolden writes img as a PNG file, creating directories as needed.
+func WriteGolden(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Source is a FrameSource for the server under test, returning the
+// frames sent on Frames.
+type Source struct {
+	Rect   image.Rectangle
+	Frames chan *rfb.LockableImage
+}
+
+// NewSource returns a Source of frames with the given bounds. Frames
+// has room for one frame, so a test can send the next before the server
+// asks for it.
+func NewSource(bounds image.Rectangle) *Source {
+	return &Source{Rect: bounds, Frames: make(chan *rfb.LockableImage, 1)}
+}
+
+// Bounds returns s.Rect.
+func (s *Source) Bounds() image.Rectangle { return s.Rect }
+
+// NextFrame returns the next frame sent on s.Frames.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	return <-s.Frames, nil
+}
+
+// Solid returns a w×h image filled with c.
+func Solid(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
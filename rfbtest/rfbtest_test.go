@@ -0,0 +1,99 @@
+package rfbtest
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"github.com/patdhlk/rfb"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+}
+
+// staticSource serves the same image over and over; the server finds no
+// changes after the first frame.
+type staticSource struct{ img image.Image }
+
+func (s staticSource) Bounds() image.Rectangle { return s.img.Bounds() }
+
+func (s staticSource) NextFrame() (*rfb.LockableImage, error) {
+	return &rfb.LockableImage{Img: s.img}, nil
+}
+
+func checkerboard(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/8+y/8)%2 == 0 {
+				img.Set(x, y, color.RGBA{0xf0, 0x80, 0x10, 0xff})
+			} else {
+				img.Set(x, y, color.White)
+			}
+		}
+	}
+	return img
+}
+
+func serve(t *testing.T, img image.Image) *Viewer {
+	s := rfb.NewServer(img.Bounds().Dx(), img.Bounds().Dy())
+	addr := Serve(t, s)
+	go func() {
+		for c := range s.Incoming(context.Background()) {
+			c.SetFrameSource(staticSource{img})
+		}
+	}()
+	return Connect(t, addr)
+}
+
+func TestAssertRegion(t *testing.T) {
+	img := checkerboard(64, 48)
+	v := serve(t, img)
+	v.AssertRegion(image.Rect(8, 8, 40, 32), img.SubImage(image.Rect(8, 8, 40, 32)), 8)
+}
+
+func TestAssertGolden(t *testing.T) {
+	img := checkerboard(32, 32)
+	golden := filepath.Join(t.TempDir(), "board.png")
+	if err := WriteGolden(golden, img); err != nil {
+		t.Fatal(err)
+	}
+	serve(t, img).AssertGolden(golden, 8)
+}
+
+func TestDiff(t *testing.T) {
+	a := checkerboard(16, 16)
+	b := checkerboard(16, 16)
+	if msg := Diff(a, b, 0); msg != "" {
+		t.Errorf("identical images differ: %s", msg)
+	}
+	b.Set(3, 4, color.RGBA{0xf4, 0x80, 0x10, 0xff})
+	if msg := Diff(a, b, 4); msg != "" {
+		t.Errorf("images within tolerance differ: %s", msg)
+	}
+	if msg := Diff(a, b, 3); msg == "" {
+		t.Error("images outside tolerance match")
+	}
+}
+
+func TestSource(t *testing.T) {
+	s := rfb.NewServer(32, 24)
+	addr := Serve(t, s)
+	src := NewSource(image.Rect(0, 0, 32, 24))
+	go func() {
+		for c := range s.Incoming(context.Background()) {
+			c.SetFrameSource(src)
+		}
+	}()
+	v := Connect(t, addr)
+	for _, c := range []color.RGBA{{0xff, 0, 0, 0xff}, {0, 0, 0xff, 0xff}} {
+		img := Solid(32, 24, c)
+		src.Frames <- &rfb.LockableImage{Img: img}
+		v.AssertRegion(img.Rect, img, 8)
+	}
+}
@@ -0,0 +1,194 @@
+// Package robotgo adapts github.com/go-vgo/robotgo to the rfb package: a
+// FrameSource capturing the main screen and an InputInjector replaying
+// client input.
+//
+// It's meant for applications that already depend on robotgo. It has its
+// own dependency manifest, so the rfb package itself doesn't pull in
+// robotgo and its cgo requirements.
+package robotgo
+
+import (
+	"image"
+	"image/draw"
+	"strconv"
+	"sync"
+	"time"
+
+	rg "github.com/go-vgo/robotgo"
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/keysym"
+)
+
+// DefaultInterval is the capture interval used by NewSource (30 fps).
+const DefaultInterval = time.Second / 30
+
+// Source is a FrameSource polling the main screen. It doesn't know what
+// changed, so every frame is a new image for the server to compare.
+type Source struct {
+	// Interval is the minimum time between two captures.
+	Interval time.Duration
+
+	bounds image.Rectangle
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// NewSource returns a source for the main screen.
+func NewSource() *Source {
+	w, h := rg.GetScreenSize()
+	return &Source{
+		Interval: DefaultInterval,
+		bounds:   image.Rect(0, 0, w, h),
+	}
+}
+
+// Bounds returns the screen size.
+func (s *Source) Bounds() image.Rectangle {
+	return s.bounds
+}
+
+// NextFrame waits for the capture interval to pass and grabs the screen.
+func (s *Source) NextFrame() (*rfb.LockableImage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if wait := time.Until(s.next); wait > 0 {
+		time.Sleep(wait)
+	}
+	s.next = time.Now().Add(s.Interval)
+
+	img, err := rg.CaptureImg(0, 0, s.bounds.Dx(), s.bounds.Dy())
+	if err != nil {
+		return nil, err
+	}
+	// robotgo's image type varies by platform and version; the server's
+	// fast paths want RGBA at the origin.
+	rgba := image.NewRGBA(s.bounds)
+	draw.Draw(rgba, s.bounds, img, img.Bounds().Min, draw.Src)
+	return &rfb.LockableImage{Img: rgba}, nil
+}
+
+// robotgo key names for keysyms without a printable character.
+var keyNames = map[uint32]string{
+	keysym.BackSpace:  "backspace",
+	keysym.Tab:        "tab",
+	keysym.Return:     "enter",
+	keysym.KPEnter:    "enter",
+	keysym.Escape:     "esc",
+	keysym.Delete:     "delete",
+	keysym.Insert:     "insert",
+	keysym.Home:       "home",
+	keysym.End:        "end",
+	keysym.PageUp:     "pageup",
+	keysym.PageDown:   "pagedown",
+	keysym.Left:       "left",
+	keysym.Right:      "right",
+	keysym.Up:         "up",
+	keysym.Down:       "down",
+	keysym.Print:      "printscreen",
+	keysym.CapsLock:   "capslock",
+	keysym.ShiftL:     "lshift",
+	keysym.ShiftR:     "rshift",
+	keysym.ControlL:   "lctrl",
+	keysym.ControlR:   "rctrl",
+	keysym.AltL:       "lalt",
+	keysym.AltR:       "ralt",
+	keysym.MetaL:      "lcmd",
+	keysym.MetaR:      "rcmd",
+	keysym.SuperL:     "lcmd",
+	keysym.SuperR:     "rcmd",
+	keysym.KPAdd:      "num_plus",
+	keysym.KPSubtract: "num_minus",
+	keysym.KPMultiply: "num_mul",
+	keysym.KPDivide:   "num_div",
+	keysym.KPDecimal:  "num_dec",
+	' ':               "space",
+}
+
+func init() {
+	for i := uint32(0); i < 10; i++ {
+		keyNames[keysym.KP0+i] = "num" + strconv.Itoa(int(i))
+	}
+	for i := uint32(0); i < 24; i++ {
+		keyNames[keysym.F1+i] = "f" + strconv.Itoa(int(i)+1)
+	}
+}
+
+// Injector is an InputInjector on top of robotgo. Pointer coordinates map
+// one to one to screen coordinates.
+type Injector struct {
+	mu      sync.Mutex
+	buttons uint8
+}
+
+// NewInjector returns an injector.
+func NewInjector() *Injector {
+	return &Injector{}
+}
+
+// InjectKey presses or releases the key for e.Key. Characters robotgo
+// has no key for are typed as Unicode on press.
+func (inj *Injector) InjectKey(e rfb.KeyEvent) error {
+	state := "up"
+	if e.DownFlag != 0 {
+		state = "down"
+	}
+	if name, ok := keyNames[e.Key]; ok {
+		return rg.KeyToggle(name, state)
+	}
+	r := keysym.ToRune(e.Key)
+	switch {
+	case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		return rg.KeyToggle(string(r), state)
+	case r >= 'A' && r <= 'Z':
+		return rg.KeyToggle(string(r-'A'+'a'), state)
+	case r > 0 && e.DownFlag != 0:
+		rg.UnicodeType(uint32(r))
+	}
+	return nil
+}
+
+// InjectPointer moves the pointer and presses or releases buttons as
+// necessary. Wheel "buttons" are turned into scrolling when pressed.
+func (inj *Injector) InjectPointer(e rfb.PointerEvent) error {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	rg.Move(int(e.X), int(e.Y))
+	pressed := e.ButtonMask &^ inj.buttons
+	released := inj.buttons &^ e.ButtonMask
+	inj.buttons = e.ButtonMask
+
+	for i, name := range []string{"left", "center", "right"} {
+		mask := uint8(1) << uint(i)
+		if pressed&mask != 0 {
+			if err := rg.Toggle(name); err != nil {
+				return err
+			}
+		}
+		if released&mask != 0 {
+			if err := rg.Toggle(name, "up"); err != nil {
+				return err
+			}
+		}
+	}
+
+	var dx, dy int
+	if pressed&(1<<3) != 0 {
+		dy++
+	}
+	if pressed&(1<<4) != 0 {
+		dy--
+	}
+	if pressed&(1<<5) != 0 {
+		dx--
+	}
+	if pressed&(1<<6) != 0 {
+		dx++
+	}
+	if dx != 0 || dy != 0 {
+		rg.Scroll(dx, dy)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"image"
+	"iter"
+)
+
+// maxCoRRESize is the largest width and height of a CoRRE rectangle,
+// whose subrectangles have 8-bit coordinates.
+const maxCoRRESize = 255
+
+// rreEncoder holds buffers reused across CoRRE rectangles.
+type rreEncoder struct {
+	counts  map[uint32]int
+	covered []bool
+	out     []byte
+}
+
+// encodeCoRRELocked returns the CoRRE payload for rect of im, a
+// background colour with subrectangles on top, or nil if Raw would be
+// smaller. rect must be at most maxCoRRESize pixels on each side.
+func (c *Conn) encodeCoRRELocked(im image.Image, rect image.Rectangle) []byte {
+	e := c.rre
+	if e == nil {
+		e = &rreEncoder{counts: make(map[uint32]int)}
+		c.rre = e
+	}
+	f := &c.format
+	c.pixbuf = f.translate(c.pixbuf[:0], im, rect)
+	w, h := rect.Dx(), rect.Dy()
+	if len(e.covered) < w*h {
+		e.covered = make([]bool, w*h)
+	}
+
+	rawSize := w * h * int(f.BPP) / 8
+	bg, _ := background(c.pixbuf, e.counts)
+	out := append(e.out[:0], 0, 0, 0, 0) // number of subrectangles
+	out = f.appendPixel(out, bg)
+	n := 0
+	for v, r := range subrects(c.pixbuf, w, h, bg, e.covered) {
+		if len(out) >= rawSize {
+			break
+		}
+		out = f.appendPixel(out, v)
+		out = append(out, byte(r.Min.X), byte(r.Min.Y), byte(r.Dx()), byte(r.Dy()))
+		n++
+	}
+	e.out = out
+	if len(out) >= rawSize {
+		return nil
+	}
+	binary.BigEndian.PutUint32(out, uint32(n))
+	return out
+}
+
+// tileRects splits rects into tiles of at most size×size pixels.
+func tileRects(rects []image.Rectangle, size int) []image.Rectangle {
+	var rc []image.Rectangle
+	for _, r := range rects {
+		for y := r.Min.Y; y < r.Max.Y; y += size {
+			for x := r.Min.X; x < r.Max.X; x += size {
+				rc = append(rc, image.Rect(x, y, min(x+size, r.Max.X), min(y+size, r.Max.Y)))
+			}
+		}
+	}
+	return rc
+}
+
+// background returns the most common of the pixels, the natural
+// background for RRE-style encodings, and the number of distinct values.
+// Ties are broken by value so the output doesn't depend on map order.
+// counts is scratch space.
+func background(px []uint32, counts map[uint32]int) (bg uint32, colours int) {
+	clear(counts)
+	for _, v := range px {
+		counts[v]++
+	}
+	n := 0
+	for v, k := range counts {
+		if k > n || k == n && v < bg {
+			bg, n = v, k
+		}
+	}
+	return bg, len(counts)
+}
+
+// subrects covers the pixels of a w×h region that differ from bg with
+// rectangles of a single colour, each grown right and then down from its
+// top-left pixel, in row order. covered is scratch space of at least w×h
+// elements.
+func subrects(px []uint32, w, h int, bg uint32, covered []bool) iter.Seq2[uint32, image.Rectangle] {
+	return func(yield func(uint32, image.Rectangle) bool) {
+		clear(covered[:w*h])
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				v := px[y*w+x]
+				if v == bg || covered[y*w+x] {
+					continue
+				}
+				x2 := x + 1
+				for x2 < w && px[y*w+x2] == v && !covered[y*w+x2] {
+					x2++
+				}
+				y2 := y + 1
+			rows:
+				for ; y2 < h; y2++ {
+					for i := x; i < x2; i++ {
+						if px[y2*w+i] != v || covered[y2*w+i] {
+							break rows
+						}
+					}
+				}
+				for yy := y; yy < y2; yy++ {
+					for i := x; i < x2; i++ {
+						covered[yy*w+i] = true
+					}
+				}
+				if !yield(v, image.Rect(x, y, x2, y2)) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package rfb
+
+import (
+	"bytes"
+	"sync"
+)
+
+// DefaultTurnBudget is the number of bytes a connection may encode per
+// turn when Server.Workers is set.
+const DefaultTurnBudget = 256 << 10
+
+// A scheduler hands out a fixed number of encoding slots to connections
+// in the order they asked for them.
+type scheduler struct {
+	mu    sync.Mutex
+	free  int
+	queue []chan struct{} // waiting connections, first come first served
+}
+
+func newScheduler(workers int) *scheduler {
+	return &scheduler{free: workers}
+}
+
+// acquire blocks until the caller may encode.
+func (s *scheduler) acquire() {
+	s.mu.Lock()
+	if s.free > 0 && len(s.queue) == 0 {
+		s.free--
+		s.mu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	s.queue = append(s.queue, ch)
+	s.mu.Unlock()
+	<-ch
+}
+
+// release passes the caller's slot on to the longest waiting connection.
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.queue) > 0 {
+		close(s.queue[0])
+		s.queue = s.queue[1:]
+		return
+	}
+	s.free++
+}
+
+// waiting reports whether any connection is waiting for a slot.
+func (s *scheduler) waiting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue) > 0
+}
+
+func (s *Server) scheduler() *scheduler {
+	if s.Workers <= 0 {
+		return nil
+	}
+	s.schedOnce.Do(func() { s.sched = newScheduler(s.Workers) })
+	return s.sched
+}
+
+// scheduledTurn is the state of a connection encoding under the
+// server's scheduler.
+type scheduledTurn struct {
+	sched *scheduler
+	out   bytes.Buffer // the encoded update, written after the turn
+	start int          // length of out when the current turn began
+}
+
+// beginTurn waits for an encoding slot and redirects the connection's
+// writes to memory, so a slow network doesn't hold up the slot. It does
+// nothing if the server doesn't schedule encoding.
+func (c *Conn) beginTurn() {
+	sched := c.s.scheduler()
+	if sched == nil {
+		return
+	}
+	t := &c.turn
+	t.sched = sched
+	sched.acquire()
+	c.bw.Flush()
+	c.bw.Reset(&t.out)
+	t.start = 0
+}
+
+// yieldTurn lets other connections encode if this one has used up its
+// budget for the turn.
+func (c *Conn) yieldTurn() {
+	t := &c.turn
+	if t.sched == nil {
+		return
+	}
+	budget := c.s.TurnBudget
+	if budget <= 0 {
+		budget = DefaultTurnBudget
+	}
+	if t.out.Len()+c.bw.Buffered()-t.start < budget || !t.sched.waiting() {
+		return
+	}
+	c.bw.Flush()
+	t.sched.release()
+	t.sched.acquire()
+	t.start = t.out.Len()
+}
+
+// endTurn gives the slot back and sends the encoded update.
+func (c *Conn) endTurn() {
+	t := &c.turn
+	if t.sched == nil {
+		return
+	}
+	c.bw.Flush()
+	t.sched.release()
+	t.sched = nil
+	c.bw.Reset(c.cw)
+	t.out.WriteTo(c.cw)
+	t.out.Reset()
+}
+
+// sendTurn sends what was encoded so far during the current turn, giving
+// other connections the slot in the meantime.
+func (c *Conn) sendTurn() {
+	t := &c.turn
+	if t.sched == nil {
+		return
+	}
+	c.bw.Flush()
+	t.sched.release()
+	t.out.WriteTo(c.cw)
+	t.out.Reset()
+	t.sched.acquire()
+	t.start = 0
+}
@@ -0,0 +1,116 @@
+package rfb_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestServerWorkers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := rfb.NewServer(64, 64)
+	s.Workers = 1
+	s.TurnBudget = 1024 // a few rectangles per turn
+	go s.Serve(ln)
+
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	frame := solid(64, 64, blue)
+	for x := 0; x < 64; x += 2 {
+		frame.Set(x, x, color.White) // lots of small rectangles
+	}
+	go func() {
+		for c := range s.Incoming(context.Background()) {
+			src := &chanSource{bounds: frame.Rect, frames: make(chan *rfb.LockableImage, 1)}
+			src.frames <- &rfb.LockableImage{Img: frame}
+			c.SetFrameSource(src)
+		}
+	}()
+
+	var ccs []*rfb.ClientConn
+	for i := 0; i < 3; i++ {
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		ccs = append(ccs, cc)
+	}
+	for i, cc := range ccs {
+		if err := cc.WaitForImage(frame.Rect, frame, 5*time.Second); err != nil {
+			t.Errorf("client %d: %v", i, err)
+		}
+	}
+}
+
+func TestServerWorkersSlowClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	s := rfb.NewServer(1024, 1024)
+	s.Workers = 1
+	go s.Serve(ln)
+
+	// A client asking for 4 MB of Raw pixels and never reading them.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rawHandshake(t, nc)
+	nc.Write([]byte{0, 0, 0, 0, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0}) // 32 bits per pixel
+	nc.Write([]byte{3, 0, 0, 0, 0, 0, 4, 0, 4, 0})                                        // the whole framebuffer
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := solid(1024, 1024, color.RGBA{0xff, 0, 0, 0xff})
+	src := &chanSource{bounds: big.Rect, frames: make(chan *rfb.LockableImage, 1)}
+	src.frames <- &rfb.LockableImage{Img: big}
+	c.SetFrameSource(src)
+
+	type client struct {
+		cc  *rfb.ClientConn
+		src *chanSource
+	}
+	var clients []client
+	for i := 0; i < 2; i++ {
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+		c, err := s.Accept(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &chanSource{bounds: image.Rect(0, 0, 64, 64), frames: make(chan *rfb.LockableImage, 1)}
+		c.SetFrameSource(src)
+		clients = append(clients, client{cc, src})
+	}
+
+	// The stalled client keeps its update, not the encoding slot, so
+	// the others keep up with their frames.
+	for _, col := range []color.RGBA{{0, 0, 0xff, 0xff}, {0, 0xff, 0, 0xff}, {0xff, 0xff, 0xff, 0xff}} {
+		for _, cl := range clients {
+			cl.src.frames <- &rfb.LockableImage{Img: solid(64, 64, col)}
+		}
+		for i, cl := range clients {
+			if err := cl.cc.WaitForPixel(image.Pt(5, 5), col, 2*time.Second); err != nil {
+				t.Fatalf("client %d, %v: %v", i, col, err)
+			}
+		}
+	}
+}
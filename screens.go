@@ -0,0 +1,229 @@
+package rfb
+
+import (
+	"image"
+	"log"
+	"slices"
+)
+
+// A Screen is one monitor of the desktop, for viewers that show each on
+// a monitor of their own. It's sent to clients supporting the
+// ExtendedDesktopSize pseudo-encoding.
+type Screen struct {
+	ID    uint32          // identifies the screen across layout changes
+	Rect  image.Rectangle // the part of the framebuffer it shows
+	Flags uint32          // unused by the protocol so far; sent as is
+}
+
+// SetScreens declares the monitor layout of the desktop, for all
+// clients, as Conn.SetScreens does for one. A nil layout is a single
+// screen covering the framebuffer.
+func (s *Server) SetScreens(screens []Screen) {
+	s.sizeMu.Lock()
+	s.screens = slices.Clone(screens)
+	s.sizeMu.Unlock()
+
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	for c := range s.live {
+		c.wakeShape()
+	}
+}
+
+// SetScreens declares the monitor layout of the desktop for this
+// client, overriding the server's. Clients supporting the
+// ExtendedDesktopSize pseudo-encoding are told with the next update,
+// which is sent at once if the client is waiting for one, and again
+// whenever the framebuffer is resized. Screens are clipped to the
+// framebuffer; if none are left, a single screen covers it. A nil layout
+// returns to the server's.
+func (c *Conn) SetScreens(screens []Screen) {
+	c.mu.Lock()
+	c.screens = slices.Clone(screens)
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// layoutLocked returns the screens to send for the current framebuffer
+// size. c.mu must be held.
+func (c *Conn) layoutLocked() []Screen {
+	screens := c.screens
+	if screens == nil {
+		c.s.sizeMu.RLock()
+		screens = c.s.screens
+		c.s.sizeMu.RUnlock()
+	}
+	fb := image.Rect(0, 0, c.width, c.height)
+	var layout []Screen
+	for _, sc := range screens {
+		if sc.Rect = sc.Rect.Intersect(fb); !sc.Rect.Empty() {
+			layout = append(layout, sc)
+		}
+	}
+	if len(layout) == 0 || len(layout) > 0xff {
+		layout = []Screen{{Rect: fb}}
+	}
+	return layout
+}
+
+// layoutPendingLocked reports whether the client is to be told about a
+// changed layout. c.mu must be held.
+func (c *Conn) layoutPendingLocked() bool {
+	return c.supportsLocked(encodingExtendedDesktopSize) && !slices.Equal(c.layoutLocked(), c.sentLayout)
+}
+
+// pushDesktopSizeLocked writes a pseudo-rectangle with the framebuffer
+// size, and for ExtendedDesktopSize the layout and the pending answer to
+// a SetDesktopSize message, which must be counted in the current update.
+// c.mu must be held.
+func (c *Conn) pushDesktopSizeLocked(enc int32) {
+	var reason, status uint16 // server-side change, no error
+	if enc == encodingExtendedDesktopSize && c.replyReadyLocked() {
+		reason, status = 1, uint16(c.sizeReply.status) // client's request
+		c.sizeReply.pending = false
+	}
+	c.w(reason) // x for DesktopSize
+	c.w(status) // y for DesktopSize
+	c.w(uint16(c.width))
+	c.w(uint16(c.height))
+	c.w(enc)
+	if enc != encodingExtendedDesktopSize {
+		return
+	}
+	layout := c.layoutLocked()
+	c.w(uint8(len(layout))) // number-of-screens
+	c.w([3]uint8{})         // padding
+	for _, sc := range layout {
+		c.w(sc.ID)
+		c.w(uint16(sc.Rect.Min.X))
+		c.w(uint16(sc.Rect.Min.Y))
+		c.w(uint16(sc.Rect.Dx()))
+		c.w(uint16(sc.Rect.Dy()))
+		c.w(sc.Flags)
+	}
+	c.sentLayout = layout
+}
+
+// DesktopSizeRequest is a client asking for another framebuffer size and
+// monitor layout, as viewers do when their window is resized. It's sent
+// on Conn.Event if Server.DesktopSizeRequests is set, and has to be
+// answered with Accept or Reject.
+type DesktopSizeRequest struct {
+	Width, Height int
+	Screens       []Screen
+
+	c *Conn
+}
+
+// A DesktopSizeStatus is why a DesktopSizeRequest was rejected.
+type DesktopSizeStatus uint16
+
+const (
+	DesktopSizeProhibited     DesktopSizeStatus = 1 // resizing isn't allowed
+	DesktopSizeOutOfResources DesktopSizeStatus = 2 // the server can't resize now
+	DesktopSizeInvalid        DesktopSizeStatus = 3 // the layout is invalid
+)
+
+// Accept resizes the client's framebuffer to the requested size and
+// layout, as Conn.Resize and Conn.SetScreens would, and tells the client
+// with the next update. The application is expected to change its frames
+// to match, typically by resizing a virtual display; until then they're
+// cropped or scaled.
+func (r DesktopSizeRequest) Accept() {
+	c := r.c
+	c.mu.Lock()
+	c.fixed = image.Pt(r.Width, r.Height)
+	c.screens = slices.Clone(r.Screens)
+	c.sizeReply = sizeReply{pending: true, size: c.fixed}
+	c.refresh = true
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// Reject tells the client its request was refused, with the next update,
+// which is sent at once if the client is waiting for one.
+func (r DesktopSizeRequest) Reject(status DesktopSizeStatus) {
+	r.c.replyDesktopSize(status)
+}
+
+// sizeReply is the pending answer to a SetDesktopSize message.
+type sizeReply struct {
+	pending bool
+	status  DesktopSizeStatus // 0 if accepted
+	size    image.Point       // the accepted size
+}
+
+// replyDesktopSize queues the answer to a SetDesktopSize message
+// rejected with status.
+func (c *Conn) replyDesktopSize(status DesktopSizeStatus) {
+	c.mu.Lock()
+	c.sizeReply = sizeReply{pending: true, status: status}
+	c.mu.Unlock()
+	c.wakeShape()
+}
+
+// replyReadyLocked reports whether the answer to a SetDesktopSize
+// message can go out: a rejection at once, an acceptance with the size
+// it accepted. c.mu must be held.
+func (c *Conn) replyReadyLocked() bool {
+	r := c.sizeReply
+	return r.pending && (r.status != 0 || r.size == image.Pt(c.width, c.height))
+}
+
+// desktopPendingLocked reports whether an ExtendedDesktopSize
+// pseudo-rectangle is to go out without resizing the client: the layout
+// changed, or a SetDesktopSize message is answered. Both wait while an
+// accepted size isn't applied yet. c.mu must be held.
+func (c *Conn) desktopPendingLocked() bool {
+	if c.sizeReply.pending {
+		return c.replyReadyLocked()
+	}
+	return c.layoutPendingLocked()
+}
+
+// handleSetDesktopSize reads a SetDesktopSize message and passes it to
+// the application, or rejects it.
+func (c *Conn) handleSetDesktopSize() {
+	c.readPadding("set-desktop-size.padding", 1)
+	var msg struct {
+		Width, Height uint16
+		Screens       uint8
+		Pad           uint8
+	}
+	c.read("set-desktop-size", &msg)
+	req := DesktopSizeRequest{Width: int(msg.Width), Height: int(msg.Height), c: c}
+	fb := image.Rect(0, 0, req.Width, req.Height)
+	valid := !fb.Empty() && msg.Screens > 0
+	for range msg.Screens {
+		var sc struct {
+			ID         uint32
+			X, Y, W, H uint16
+			Flags      uint32
+		}
+		c.read("set-desktop-size.screen", &sc)
+		r := image.Rect(int(sc.X), int(sc.Y), int(sc.X)+int(sc.W), int(sc.Y)+int(sc.H))
+		valid = valid && !r.Empty() && r.In(fb)
+		req.Screens = append(req.Screens, Screen{ID: sc.ID, Rect: r, Flags: sc.Flags})
+	}
+	log.Printf("client asks for a %dx%d desktop with %d screens", req.Width, req.Height, len(req.Screens))
+	switch {
+	case !valid:
+		c.replyDesktopSize(DesktopSizeInvalid)
+		return
+	case !c.s.DesktopSizeRequests:
+		c.replyDesktopSize(DesktopSizeProhibited)
+		return
+	}
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.viewOnly || c.eventsClosed {
+		c.replyDesktopSize(DesktopSizeProhibited)
+		return
+	}
+	select {
+	case c.event <- req:
+	default:
+		// The application is behind.
+		c.replyDesktopSize(DesktopSizeOutOfResources)
+	}
+}
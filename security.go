@@ -0,0 +1,294 @@
+package rfb
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// A SecurityHandler implements a security type for Server.SecurityHandlers.
+// It runs once the client has picked the type, up to the SecurityResult,
+// which the server sends.
+type SecurityHandler interface {
+	// Type returns the security type number offered to clients.
+	Type() uint8
+
+	// Handshake runs the security type's exchange with the client,
+	// through c.SecurityStream. An error refuses the client, with the
+	// error's text as the reason for 3.8 clients.
+	Handshake(c *Conn) error
+}
+
+// SecurityStream returns the stream to the client for a
+// SecurityHandler's Handshake. Writes are sent at once. It mustn't be
+// used once Handshake has returned.
+func (c *Conn) SecurityStream() io.ReadWriter {
+	return securityStream{c}
+}
+
+type securityStream struct{ c *Conn }
+
+func (s securityStream) Read(p []byte) (int, error) {
+	return s.c.br.Read(p)
+}
+
+func (s securityStream) Write(p []byte) (int, error) {
+	n, err := s.c.bw.Write(p)
+	if err == nil {
+		err = s.c.bw.Flush()
+	}
+	return n, err
+}
+
+// builtinSecurity is a security type implemented by the package. Its
+// failures end the connection through failf, so run only reports
+// whether the client authenticated, which 3.7 clients only get a
+// SecurityResult for.
+type builtinSecurity struct {
+	t   uint8
+	run func(c *Conn) (authenticated bool)
+}
+
+func (b builtinSecurity) Type() uint8 { return b.t }
+
+func (b builtinSecurity) Handshake(c *Conn) error {
+	b.run(c)
+	return nil
+}
+
+// authFailed counts a failed authentication and refuses the client.
+func authFailed(c *Conn, format string, args ...any) {
+	c.authFailure()
+	c.refuse(c.ver, "authentication failed")
+	c.failf(ClassAuth, format, args...)
+}
+
+var (
+	securityNone = builtinSecurity{authNone, func(*Conn) bool { return false }}
+	securityVNC  = builtinSecurity{authVNC, func(c *Conn) bool {
+		if !c.authVNC() {
+			authFailed(c, "VNC authentication failed")
+		}
+		return true
+	}}
+	securityARD = builtinSecurity{authARD, func(c *Conn) bool {
+		user, ok := c.authARD()
+		if !ok {
+			authFailed(c, "ARD authentication failed for user %q", user)
+		}
+		c.SetUser(user)
+		return true
+	}}
+	securityMSLogonII = builtinSecurity{authMSLogonII, func(c *Conn) bool {
+		user, ok := c.authMSLogon()
+		if !ok {
+			authFailed(c, "MSLogonII authentication failed for user %q", user)
+		}
+		c.SetUser(user)
+		return true
+	}}
+	securityTight = builtinSecurity{authTight, func(c *Conn) bool {
+		return c.tightSecurity(c.ver)
+	}}
+)
+
+// securityRSAAES returns the handler of RSA-AES type t.
+func securityRSAAES(t uint8) builtinSecurity {
+	return builtinSecurity{t, func(c *Conn) bool {
+		user, ok := c.authRSAAES(t)
+		if !ok {
+			authFailed(c, "RSA-AES authentication failed for user %q", user)
+		}
+		c.SetUser(user)
+		return true
+	}}
+}
+
+// securityNames are the names of the built-in security types, for
+// Capabilities.
+var securityNames = map[uint8]string{
+	authNone:      "None",
+	authVNC:       "VNC Authentication",
+	authRA2:       "RA2",
+	authRA2ne:     "RA2ne",
+	authTight:     "Tight",
+	authARD:       "ARD",
+	authMSLogonII: "MSLogonII",
+	authRA2256:    "RA2_256",
+	authRA2ne256:  "RA2ne_256",
+}
+
+// securityName returns the name of h's security type: the built-in
+// one's, or what h's String method returns.
+func securityName(h SecurityHandler) string {
+	if s, ok := h.(fmt.Stringer); ok {
+		return s.String()
+	}
+	if name, ok := securityNames[h.Type()]; ok {
+		return name
+	}
+	return fmt.Sprintf("SecurityType%d", h.Type())
+}
+
+// securityHandlers returns the security types offered to clients other
+// than Apple's, in the order of Server.SecurityTypes if set, or else of
+// preference: Server.SecurityHandlers, then the RSA-AES types if Server.RSAAES is
+// set, Apple Remote Desktop authentication if Server.Authenticate is
+// set, and MSLogonII if Server.MSLogon is set too, VNC Authentication if
+// Server.Password is set, None if nothing else is, and Tight if
+// Server.TightSecurity is set or the server has a FileSystem. A handler
+// in Server.SecurityHandlers replaces the built-in type it shares its
+// number with. Tight is left out if it would let clients around the
+// other types' authentication.
+func (s *Server) securityHandlers() []SecurityHandler {
+	var handlers []SecurityHandler
+	if s.offersRSAAES() {
+		for _, t := range ra2Types {
+			handlers = append(handlers, securityRSAAES(t))
+		}
+	}
+	if s.Authenticate != nil {
+		handlers = append(handlers, securityARD)
+		if s.MSLogon {
+			handlers = append(handlers, securityMSLogonII)
+		}
+	}
+	if s.Password != "" {
+		handlers = append(handlers, securityVNC)
+	}
+	if len(handlers) == 0 && len(s.SecurityHandlers) == 0 {
+		handlers = append(handlers, securityNone)
+	}
+	tight := !s.tightBypasses()
+	if tight && (s.TightSecurity || s.FileSystem != nil) {
+		handlers = append(handlers, securityTight)
+	}
+	if len(s.SecurityTypes) > 0 {
+		handlers = append(handlers, securityNone)
+		if tight {
+			handlers = append(handlers, securityTight)
+		}
+	}
+	handlers = slices.DeleteFunc(handlers, func(b SecurityHandler) bool {
+		return slices.ContainsFunc(s.SecurityHandlers, func(h SecurityHandler) bool { return h.Type() == b.Type() })
+	})
+	handlers = append(slices.Clone(s.SecurityHandlers), handlers...)
+	if len(s.SecurityTypes) > 0 {
+		var listed []SecurityHandler
+		for _, t := range s.SecurityTypes {
+			i := slices.IndexFunc(handlers, func(h SecurityHandler) bool { return h.Type() == t })
+			if i >= 0 && !slices.ContainsFunc(listed, func(h SecurityHandler) bool { return h.Type() == t }) {
+				listed = append(listed, handlers[i])
+			}
+		}
+		handlers = listed
+	}
+	return handlers
+}
+
+// negotiateSecurity offers the security types to a 3.7 or 3.8 client,
+// or picks one for a 3.3 client, and runs it. It reports whether the
+// client authenticated.
+func (c *Conn) negotiateSecurity() (authenticated bool) {
+	handlers := c.s.securityHandlers()
+	if c.apple && c.ardCheck() != nil {
+		// Apple's viewers only get the type they expect, if the
+		// credentials can be checked.
+		handlers = []SecurityHandler{securityARD}
+	}
+	types := make([]uint8, len(handlers))
+	for i, h := range handlers {
+		types[i] = h.Type()
+	}
+	if c.lockedOut() {
+		c.refuseSecurity("too many authentication failures")
+		c.failf(ClassAuth, "address %s is locked out", c.authAddr())
+	}
+	if c.s.ClientCAs != nil {
+		c.verifyClientCert()
+	}
+	var i int
+	if c.ver >= v7 {
+		c.w(uint8(len(types)))
+		if len(types) == 0 {
+			c.writeReason("no security types available")
+			c.failf(ClassInternal, "no security types to offer")
+		}
+		c.w(types)
+		c.flush()
+		wanted := c.readByte("6.1.2:client requested security-type")
+		if i = slices.Index(types, wanted); i < 0 || wanted == 0 {
+			c.mu.Lock()
+			c.fp.Security = wanted
+			c.mu.Unlock()
+			if c.ver >= v8 {
+				c.refuse(c.ver, "unsupported security type")
+			}
+			c.failf(ClassUnsupported, "client wanted auth type %d", int(wanted))
+		}
+	} else {
+		// 3.3 only knows None and VNC Authentication, and the server
+		// picks the type, sending it as a word; 0 refuses the client.
+		i = slices.IndexFunc(types, func(t uint8) bool { return t == authNone || t == authVNC })
+		if i < 0 {
+			c.refuseSecurity("security type unavailable to RFB 3.3")
+			c.failf(ClassUnsupported, "3.3 client can't use the server's security types")
+		}
+		c.w(uint32(types[i]))
+		c.flush()
+	}
+	c.mu.Lock()
+	c.fp.Security = types[i]
+	c.mu.Unlock()
+	h := handlers[i]
+	authenticated = c.runSecurity(h)
+	c.setIdentity(h)
+	if authenticated {
+		c.authSuccess()
+	}
+	return authenticated
+}
+
+// runSecurity runs the security type h, which the client picked, and
+// reports whether the client authenticated. If it fails without having
+// refused the client, such as on a malformed message, the client is
+// refused with the error, so viewers show why rather than a reset
+// connection.
+func (c *Conn) runSecurity(h SecurityHandler) bool {
+	defer func() {
+		if e := recover(); e != nil {
+			if pe, ok := e.(*ProtocolError); ok && pe.Class != ClassIO && !c.refused {
+				c.refuse(c.ver, pe.Msg)
+			}
+			panic(e)
+		}
+	}()
+	if b, ok := h.(builtinSecurity); ok {
+		return b.run(c)
+	}
+	if err := h.Handshake(c); err != nil {
+		c.authFailure()
+		c.refuse(c.ver, err.Error())
+		c.failf(ClassAuth, "security type %d: %v", int(h.Type()), err)
+	}
+	return true
+}
+
+// refuseSecurity refuses the client before the security types, like a
+// server without any, with reason.
+func (c *Conn) refuseSecurity(reason string) {
+	if c.ver >= v7 {
+		c.w(uint8(0))
+	} else {
+		c.w(uint32(0))
+	}
+	c.writeReason(reason)
+}
+
+// writeReason writes a u32 length and reason, after which the client
+// is refused, and flushes it.
+func (c *Conn) writeReason(reason string) {
+	c.w(uint32(len(reason)))
+	c.bw.WriteString(reason)
+	c.flush()
+}
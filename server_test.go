@@ -0,0 +1,2422 @@
+package rfb_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math/big"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestServerAccept(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rfb.NewServer(16, 16)
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	// More clients than the deprecated Conns channel can hold, connected
+	// before anyone accepts.
+	const n = 20
+	for i := 0; i < n; i++ {
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seen := make(map[*rfb.Conn]bool)
+	for c := range s.Incoming(ctx) {
+		seen[c] = true
+		if len(seen) == n {
+			break
+		}
+	}
+	if len(seen) != n {
+		t.Fatalf("accepted %d connections; want %d", len(seen), n)
+	}
+
+	ln.Close()
+	<-served
+	if _, err := s.Accept(context.Background()); err == nil {
+		t.Error("Accept succeeded after Serve returned")
+	}
+}
+
+// rawHandshake performs the client side of an RFB 3.8 handshake with no
+// security on c.
+func rawHandshake(t *testing.T, c net.Conn) {
+	t.Helper()
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "RFB 003.008\n")
+	if _, err := io.ReadFull(c, buf[:2]); err != nil { // one security type
+		t.Fatal(err)
+	}
+	c.Write([]byte{1})                                 // None
+	if _, err := io.ReadFull(c, buf[:4]); err != nil { // SecurityResult
+		t.Fatal(err)
+	}
+	c.Write([]byte{1}) // shared
+	init := make([]byte, 24)
+	if _, err := io.ReadFull(c, init); err != nil {
+		t.Fatal(err)
+	}
+	name := make([]byte, binary.BigEndian.Uint32(init[20:]))
+	if _, err := io.ReadFull(c, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerUpdateRequestFlood(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rawHandshake(t, nc)
+
+	// Nothing is ever fed, so no request can be answered. The server must
+	// still read the key event behind them.
+	var msgs []byte
+	for i := 0; i < 1000; i++ {
+		msgs = append(msgs, 3, 1, 0, 0, 0, 0, 0, 16, 0, 16)
+	}
+	msgs = append(msgs, 4, 1, 0, 0, 0, 0, 0, 'x')
+	go nc.Write(msgs)
+
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-c.Event:
+		if want := (rfb.KeyEvent{DownFlag: 1, Key: 'x'}); e != want {
+			t.Errorf("got %#v; want %#v", e, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("key event wasn't delivered behind many update requests")
+	}
+}
+
+func TestServerDeferHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(1, 1)
+	s.DeferHandshake = true
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 40, 30), frames: make(chan *rfb.LockableImage, 1)}
+	pf := &rfb.PixelFormat{
+		BPP: 32, Depth: 24, TrueColour: 1,
+		RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff,
+		RedShift: 16, GreenShift: 8, BlueShift: 0,
+	}
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		connc <- c
+	}()
+
+	type dialResult struct {
+		cc  *rfb.ClientConn
+		err error
+	}
+	dialc := make(chan dialResult, 1)
+	go func() {
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		dialc <- dialResult{cc, err}
+	}()
+
+	c := <-connc
+	if err := c.Start(src, &rfb.StartOptions{Name: "deferred", PixelFormat: pf, ViewOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(nil, nil); err != rfb.ErrAlreadyStarted {
+		t.Errorf("second Start = %v; want ErrAlreadyStarted", err)
+	}
+	r := <-dialc
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	cc := r.cc
+	defer cc.Close()
+	if got := cc.Name(); got != "deferred" {
+		t.Errorf("Name() = %q; want %q", got, "deferred")
+	}
+	if got := cc.Bounds(); got != src.bounds {
+		t.Errorf("Bounds() = %v; want %v", got, src.bounds)
+	}
+
+	// 24-bit colour survives the trip unchanged.
+	col := color.RGBA{0x12, 0x34, 0x56, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(40, 30, col)}
+	if err := cc.WaitForPixel(image.Pt(3, 3), col, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	cc.KeyEvent('a', true)
+	select {
+	case e := <-c.Event:
+		t.Errorf("view-only connection delivered %#v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServerSuppressUnchanged(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(100, 100)
+	s.SuppressUnchanged = true
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 100, 100), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnUpdate: func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	next := func(img image.Image) rfb.UpdateStats {
+		src.frames <- &rfb.LockableImage{Img: img}
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		panic("unreachable")
+	}
+
+	next(solid(100, 100, color.RGBA{0, 0, 0xf8, 0xff}))
+
+	// A change lost in the client's 5 bits per channel.
+	if u := next(solid(100, 100, color.RGBA{0, 0, 0xf9, 0xff})); u.Rects != 0 {
+		t.Errorf("invisible change sent %d rectangles; want 0", u.Rects)
+	}
+
+	// A visible change in a single tile.
+	img := solid(100, 100, color.RGBA{0, 0, 0xf9, 0xff})
+	img.Set(70, 70, color.White)
+	if u := next(img); len(u.Damage) != 1 || u.Damage[0] != image.Rect(64, 64, 100, 100) {
+		t.Errorf("visible change sent %v; want the bottom right tile", u.Damage)
+	}
+}
+
+func TestServerProtocolErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	errc := make(chan *rfb.ProtocolError, 10)
+	s.OnProtocolError = func(c *rfb.Conn, err *rfb.ProtocolError) rfb.ErrorAction {
+		errc <- err
+		if err.Class == rfb.ClassUnsupported {
+			return rfb.ActionIgnore
+		}
+		return rfb.ActionEmptyUpdate
+	}
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rawHandshake(t, nc)
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A 24-bit pixel format, which is ignored.
+	nc.Write([]byte{0, 0, 0, 0, 24, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0})
+	if err := <-errc; err.Class != rfb.ClassUnsupported {
+		t.Errorf("got %v; want an unsupported request", err)
+	}
+
+	// An update request beyond the framebuffer gets an empty update.
+	nc.Write([]byte{3, 0, 0, 0, 0, 0, 0, 32, 0, 32})
+	if err := <-errc; err.Class != rfb.ClassBadRequest {
+		t.Errorf("got %v; want a bad request", err)
+	}
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "\x00\x00\x00\x00" {
+		t.Errorf("got % x; want an empty update", buf)
+	}
+
+	// An unknown message closes the connection.
+	nc.Write([]byte{99})
+	if err := <-errc; err.Class != rfb.ClassMalformed {
+		t.Errorf("got %v; want a malformed message", err)
+	}
+	if _, err := nc.Read(buf); err == nil {
+		t.Error("connection still open after malformed message")
+	}
+	for range c.Event {
+	}
+	var perr *rfb.ProtocolError
+	if !errors.As(c.Err(), &perr) || perr.Class != rfb.ClassMalformed {
+		t.Errorf("Err() = %v; want a malformed message", c.Err())
+	}
+}
+
+func TestServerBell(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(64, 64)
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 64, 64), frames: make(chan *rfb.LockableImage)}
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	bells := make(chan bool, 100)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnBell: func() { bells <- true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+
+	// Ring while updates are being sent; neither may corrupt the other.
+	const n = 50
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := c.Bell(); err != nil {
+				t.Error(err)
+			}
+		}
+		done <- true
+	}()
+	var last *image.RGBA
+	for i := 0; i < 10; i++ {
+		last = solid(64, 64, color.RGBA{uint8(i%2) * 0xff, 0, 0xff, 0xff})
+		src.frames <- &rfb.LockableImage{Img: last}
+	}
+	<-done
+	if err := cc.WaitForImage(last.Rect, last, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case <-bells:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d bells; want %d", i, n)
+		}
+	}
+}
+
+func TestServerMaxRects(t *testing.T) {
+	for _, encodings := range [][]int32{
+		{0},       // Raw
+		{0, -224}, // Raw, LastRect
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := rfb.NewServer(64, 64)
+		s.MaxRects = 3
+		s.MaxRectPixels = 64 * 8
+		go s.Serve(ln)
+
+		src := &chanSource{bounds: image.Rect(0, 0, 64, 64), frames: make(chan *rfb.LockableImage, 1)}
+		go func() {
+			c, _ := s.Accept(context.Background())
+			c.SetFrameSource(src)
+		}()
+		updates := make(chan rfb.UpdateStats, 10)
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+			Encodings: encodings,
+			OnUpdate:  func(u rfb.UpdateStats) { updates <- u },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		// The full frame is split into 8 bands, sent as 3+3+2.
+		img := solid(64, 64, color.RGBA{0xff, 0, 0, 0xff})
+		src.frames <- &rfb.LockableImage{Img: img}
+		for _, want := range []int{3, 3, 2} {
+			select {
+			case u := <-updates:
+				if len(u.Damage) != want {
+					t.Errorf("encodings %v: got %d rectangles; want %d", encodings, len(u.Damage), want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for update")
+			}
+		}
+		if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestServerLastRect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(300, 220)
+	s.MaxRectPixels = 1 // 66000 rectangles, more than a header can count
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 300, 220), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnUpdate: func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	img := solid(300, 220, color.RGBA{0, 0xff, 0, 0xff})
+	src.frames <- &rfb.LockableImage{Img: img}
+	select {
+	case u := <-updates:
+		if len(u.Damage) != 300*220 {
+			t.Errorf("got %d rectangles in one update; want %d", len(u.Damage), 300*220)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+}
+
+func TestServerCopyRect(t *testing.T) {
+	pattern := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 100; x++ {
+			var c color.RGBA
+			if x%8 < 4 {
+				c.R = 0xff
+			}
+			if y%6 < 3 {
+				c.G = 0xff
+			}
+			if (x+y)%10 < 5 {
+				c.B = 0xff
+			}
+			c.A = 0xff
+			pattern.SetRGBA(x, y, c)
+		}
+	}
+	// Scrolled down by 5 rows, with a white band coming in at the top.
+	scrolled := solid(100, 100, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	copy(scrolled.Pix[scrolled.PixOffset(0, 5):], pattern.Pix[:pattern.PixOffset(0, 95)])
+
+	for _, tt := range []struct {
+		encodings []int32
+		maxBytes  int64
+	}{
+		{[]int32{1, 0}, 100 * 5 * 4 * 2}, // CopyRect, Raw: only the band is sent raw
+		{[]int32{0}, 100 * 100 * 4 * 2},  // Raw
+	} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := rfb.NewServer(100, 100)
+		go s.Serve(ln)
+
+		src := &chanSource{bounds: image.Rect(0, 0, 100, 100), frames: make(chan *rfb.LockableImage, 1)}
+		go func() {
+			c, _ := s.Accept(context.Background())
+			c.SetFrameSource(src)
+		}()
+		updates := make(chan rfb.UpdateStats, 10)
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+			Encodings: tt.encodings,
+			OnUpdate:  func(u rfb.UpdateStats) { updates <- u },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		next := func(li *rfb.LockableImage) rfb.UpdateStats {
+			src.frames <- li
+			select {
+			case u := <-updates:
+				return u
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for update")
+			}
+			panic("unreachable")
+		}
+		next(&rfb.LockableImage{Img: pattern})
+		u := next(&rfb.LockableImage{
+			Img:    scrolled,
+			Damage: []image.Rectangle{image.Rect(0, 0, 100, 5)},
+			Moves:  []rfb.Move{{Src: image.Pt(0, 0), Dst: image.Rect(0, 5, 100, 100)}},
+		})
+		if u.Rects != 2 || u.Bytes > tt.maxBytes {
+			t.Errorf("encodings %v: got %d rectangles in %d bytes; want 2 in at most %d", tt.encodings, u.Rects, u.Bytes, tt.maxBytes)
+		}
+		if err := cc.WaitForImage(scrolled.Rect, scrolled, 5*time.Second); err != nil {
+			t.Errorf("encodings %v: %v", tt.encodings, err)
+		}
+	}
+}
+
+func TestServerCursorOnly(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(200, 200)
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 200, 200), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnUpdate: func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	// frame draws a 10×10 pointer at p.
+	frame := func(p image.Point) *rfb.LockableImage {
+		img := solid(200, 200, color.RGBA{0, 0, 0xff, 0xff})
+		r := image.Rectangle{p, p.Add(image.Pt(10, 10))}
+		draw.Draw(img, r, image.NewUniform(color.White), image.Point{}, draw.Src)
+		return &rfb.LockableImage{Img: img, Cursor: r}
+	}
+	next := func(li *rfb.LockableImage) rfb.UpdateStats {
+		src.frames <- li
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		panic("unreachable")
+	}
+
+	next(frame(image.Pt(60, 60)))
+	li := frame(image.Pt(70, 62))
+	u := next(li)
+	area := image.Rect(60, 60, 80, 72)
+	for _, r := range u.Damage {
+		if !r.In(area) {
+			t.Errorf("sent %v; want only parts of the pointer's areas %v", r, area)
+		}
+	}
+	if err := cc.WaitForImage(li.Img.Bounds(), li.Img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other changes are sent as usual.
+	li = frame(image.Pt(70, 62))
+	li.Img.(*image.RGBA).Set(150, 150, color.White)
+	u = next(li)
+	if len(u.Damage) != 1 || u.Damage[0] != image.Rect(128, 128, 192, 192) {
+		t.Errorf("sent %v; want the changed tile", u.Damage)
+	}
+}
+
+// funcDiffer is a Differ calling a function.
+type funcDiffer func(old, new image.Image, hint []image.Rectangle) []image.Rectangle
+
+func (f funcDiffer) Diff(old, new image.Image, hint []image.Rectangle) []image.Rectangle {
+	return f(old, new, hint)
+}
+
+func TestServerDiffer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(100, 100)
+	hints := make(chan []image.Rectangle, 10)
+	s.Differ = funcDiffer(func(old, new image.Image, hint []image.Rectangle) []image.Rectangle {
+		hints <- hint
+		return []image.Rectangle{image.Rect(90, 90, 110, 110)}
+	})
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 100, 100), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnUpdate: func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	next := func(li *rfb.LockableImage) rfb.UpdateStats {
+		src.frames <- li
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		panic("unreachable")
+	}
+
+	// The first update is complete; there's nothing to compare with.
+	img := solid(100, 100, color.RGBA{0xff, 0, 0, 0xff})
+	if u := next(&rfb.LockableImage{Img: img}); len(u.Damage) != 1 || u.Damage[0] != img.Rect {
+		t.Errorf("first update sent %v", u.Damage)
+	}
+	if len(hints) != 0 {
+		t.Error("Differ called for the first update")
+	}
+
+	for _, damage := range [][]image.Rectangle{nil, {image.Rect(0, 0, 10, 10)}} {
+		u := next(&rfb.LockableImage{Img: img, Damage: damage})
+		if len(u.Damage) != 1 || u.Damage[0] != image.Rect(90, 90, 100, 100) {
+			t.Errorf("damage %v: sent %v; want the Differ's result, clipped", damage, u.Damage)
+		}
+		if hint := <-hints; len(hint) != len(damage) || damage != nil && hint[0] != damage[0] {
+			t.Errorf("damage %v: Differ got hint %v", damage, hint)
+		}
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(100, 80)
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 100, 80), frames: make(chan *rfb.LockableImage, 1)}
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		Encodings: []int32{16}, // ZRLE
+		OnUpdate:  func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+
+	src.frames <- &rfb.LockableImage{Img: solid(100, 80, color.RGBA{0xff, 0, 0, 0xff})}
+	var u rfb.UpdateStats
+	select {
+	case u = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for update")
+	}
+
+	for _, stats := range [][]rfb.EncodingStats{c.Stats(), s.Stats()} {
+		if len(stats) != 1 {
+			t.Fatalf("got stats %+v; want one encoding", stats)
+		}
+		st := stats[0]
+		if st.Encoding != 16 || st.Rects != 1 || st.Pixels != 100*80 || st.RawBytes != 100*80*2 {
+			t.Errorf("got stats %+v", st)
+		}
+		// The update adds a header of 4 bytes, and 12 for the rectangle.
+		if st.Bytes != u.Bytes-16 {
+			t.Errorf("stats count %d bytes; the update had %d", st.Bytes, u.Bytes)
+		}
+		if st.Ratio() < 10 {
+			t.Errorf("ratio %.1f for a solid frame", st.Ratio())
+		}
+	}
+}
+
+func TestServerStall(t *testing.T) {
+	for _, policy := range []rfb.StallPolicy{rfb.StallFreeze, rfb.StallBlank} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		s := rfb.NewServer(16, 16)
+		s.StallTimeout = 100 * time.Millisecond
+		s.StallPolicy = policy
+		stalls := make(chan bool, 10)
+		s.OnStall = func(c *rfb.Conn, stalled bool) { stalls <- stalled }
+		go s.Serve(ln)
+
+		src := &chanSource{bounds: image.Rect(0, 0, 16, 16), frames: make(chan *rfb.LockableImage, 1)}
+		go func() {
+			c, _ := s.Accept(context.Background())
+			c.SetFrameSource(src)
+		}()
+		cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cc.Close()
+
+		red := color.RGBA{0xff, 0, 0, 0xff}
+		src.frames <- &rfb.LockableImage{Img: solid(16, 16, red)}
+		if err := cc.WaitForPixel(image.Pt(1, 1), red, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		// The source stops.
+		select {
+		case stalled := <-stalls:
+			if !stalled {
+				t.Fatalf("policy %v: OnStall reported recovery first", policy)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("policy %v: stall not reported", policy)
+		}
+		want := color.RGBA{0, 0, 0, 0xff}
+		if policy == rfb.StallFreeze {
+			want = red
+		}
+		if err := cc.WaitForPixel(image.Pt(1, 1), want, 5*time.Second); err != nil {
+			t.Errorf("policy %v: %v", policy, err)
+		}
+
+		// And recovers. The frame's damage is relative to the red
+		// frame, so it's ignored if the client got a stall image.
+		green := color.RGBA{0, 0xff, 0, 0xff}
+		damage := []image.Rectangle{image.Rect(0, 0, 1, 1)}
+		src.frames <- &rfb.LockableImage{Img: solid(16, 16, green), Damage: damage}
+		if stalled := <-stalls; stalled {
+			t.Errorf("policy %v: OnStall reported another stall", policy)
+		}
+		want = green
+		if policy == rfb.StallFreeze {
+			want = red
+		}
+		if err := cc.WaitForPixel(image.Pt(0, 0), green, 5*time.Second); err != nil {
+			t.Errorf("policy %v: %v", policy, err)
+		}
+		if err := cc.WaitForPixel(image.Pt(1, 1), want, 5*time.Second); err != nil {
+			t.Errorf("policy %v: %v", policy, err)
+		}
+	}
+}
+
+// chanObserver is an Observer sending what it observes on channels.
+type chanObserver struct {
+	updates chan []image.Rectangle
+	pixels  chan color.RGBA // at (50, 50) of each update
+	events  chan interface{}
+}
+
+func (o *chanObserver) Update(fb *image.RGBA, rects []image.Rectangle) {
+	o.updates <- append([]image.Rectangle(nil), rects...)
+	o.pixels <- fb.RGBAAt(50, 50)
+}
+
+func (o *chanObserver) Event(e interface{}) { o.events <- e }
+
+func TestServerObserve(t *testing.T) {
+	cc, c, src := startServer(t, 100, 80)
+	o := &chanObserver{
+		updates: make(chan []image.Rectangle, 10),
+		pixels:  make(chan color.RGBA, 10),
+		events:  make(chan interface{}, 10),
+	}
+	stop := c.Observe(o)
+
+	next := func(want []image.Rectangle, wantPixel color.RGBA) {
+		t.Helper()
+		select {
+		case rects := <-o.updates:
+			if len(rects) != len(want) || rects[0] != want[0] {
+				t.Errorf("observed rectangles %v; want %v", rects, want)
+			}
+			if px := <-o.pixels; px != wantPixel {
+				t.Errorf("observed pixel %v; want %v", px, wantPixel)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for observed update")
+		}
+	}
+
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	img := solid(100, 80, red)
+	src.frames <- &rfb.LockableImage{Img: img}
+	next([]image.Rectangle{img.Rect}, red)
+
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	img2 := solid(100, 80, red)
+	damage := image.Rect(40, 40, 60, 60)
+	draw.Draw(img2, damage, image.NewUniform(blue), image.Point{}, draw.Src)
+	src.frames <- &rfb.LockableImage{Img: img2, Damage: []image.Rectangle{damage}}
+	next([]image.Rectangle{damage}, blue)
+
+	if err := cc.PointerEvent(0, 5, 6); err != nil {
+		t.Fatal(err)
+	}
+	want := rfb.PointerEvent{X: 5, Y: 6}
+	for _, ch := range []<-chan interface{}{o.events, c.Event} {
+		select {
+		case e := <-ch:
+			if e != want {
+				t.Errorf("got event %#v; want %#v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	}
+
+	stop()
+	src.frames <- &rfb.LockableImage{Img: img}
+	if err := cc.WaitForPixel(image.Pt(50, 50), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := cc.PointerEvent(0, 7, 8); err != nil {
+		t.Fatal(err)
+	}
+	<-c.Event
+	if len(o.updates) != 0 || len(o.events) != 0 {
+		t.Error("observer still called after stop")
+	}
+}
+
+func TestServerSplash(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(200, 100)
+	s.Splash = "Waiting for desktop…"
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 200, 100), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	if err := cc.WaitForUpdate(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	shot := cc.Screenshot()
+	bg := shot.RGBAAt(0, 0)
+	if bg == (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("splash background is black")
+	}
+	text := 0
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			if shot.RGBAAt(x, y) != bg {
+				text++
+			}
+		}
+	}
+	if text == 0 {
+		t.Error("splash screen has no text")
+	}
+
+	// The first frame's damage doesn't cover the splash screen.
+	img := solid(200, 100, color.RGBA{0xff, 0, 0, 0xff})
+	src.frames <- &rfb.LockableImage{Img: img, Damage: []image.Rectangle{image.Rect(0, 0, 1, 1)}}
+	if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerTileSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(100, 80)
+	s.TileSize = image.Pt(32, 16)
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 100, 80), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+	}()
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnUpdate: func(u rfb.UpdateStats) { updates <- u },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+
+	next := func(img image.Image) rfb.UpdateStats {
+		src.frames <- &rfb.LockableImage{Img: img}
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+		}
+		panic("unreachable")
+	}
+	next(solid(100, 80, color.RGBA{0xff, 0, 0, 0xff}))
+	img := solid(100, 80, color.RGBA{0xff, 0, 0, 0xff})
+	img.Set(40, 20, color.White)
+	img.Set(99, 79, color.White)
+	u := next(img)
+	want := []image.Rectangle{image.Rect(32, 16, 64, 32), image.Rect(96, 64, 100, 80)}
+	if len(u.Damage) != len(want) || u.Damage[0] != want[0] || u.Damage[1] != want[1] {
+		t.Errorf("sent %v; want %v", u.Damage, want)
+	}
+}
+
+func TestServerCapabilities(t *testing.T) {
+	has := func(l []rfb.Capability, n int32) bool {
+		for _, c := range l {
+			if c.Number == n {
+				return true
+			}
+		}
+		return false
+	}
+	s := rfb.NewServer(10, 10)
+	caps := s.Capabilities()
+	for _, enc := range []int32{0, 1, 5, 7, 16} {
+		if !has(caps.Encodings, enc) {
+			t.Errorf("encoding %d missing from %v", enc, caps.Encodings)
+		}
+	}
+	if !has(caps.SecurityTypes, 1) {
+		t.Errorf("security type None missing from %v", caps.SecurityTypes)
+	}
+	if !has(caps.Messages, 251) {
+		t.Errorf("SetDesktopSize missing from %v", caps.Messages)
+	}
+	if has(caps.PseudoEncodings, -258) || has(caps.Messages, 255) {
+		t.Error("QEMU extensions listed without QEMUKeyEvents")
+	}
+	s.QEMUKeyEvents = true
+	caps = s.Capabilities()
+	if !has(caps.PseudoEncodings, -258) || !has(caps.Messages, 255) {
+		t.Errorf("QEMU extensions missing: %v, %v", caps.PseudoEncodings, caps.Messages)
+	}
+}
+
+func TestServerViewers(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(10, 10)
+	s.Viewers = []rfb.ViewerRule{
+		{Viewer: "other", Match: func(f rfb.Fingerprint) bool { return f.Announces(16) }},
+		{
+			Viewer: "test",
+			Match:  func(f rfb.Fingerprint) bool { return f.Version == "3.8" && f.Announces(-224) },
+			Quirks: rfb.Quirks{RGB555: true, NoLastRect: true},
+		},
+	}
+	go s.Serve(ln)
+
+	src := &chanSource{bounds: image.Rect(0, 0, 10, 10), frames: make(chan *rfb.LockableImage, 1)}
+	src.frames <- &rfb.LockableImage{Img: solid(10, 10, color.RGBA{0, 0xff, 0, 0xff})}
+	connc := make(chan *rfb.Conn, 1)
+	go func() {
+		c, _ := s.Accept(context.Background())
+		c.SetFrameSource(src)
+		connc <- c
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		PixelFormat: &rgb565,
+		Encodings:   []int32{0, -224},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c := <-connc
+	if err := cc.WaitForUpdate(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	fp := c.Fingerprint()
+	if fp.Version != "3.8" || fp.Security != 1 || !fp.Shared || fp.Viewer != "test" || len(fp.Encodings) != 2 {
+		t.Errorf("got fingerprint %+v", fp)
+	}
+	// Green, sent as RGB555 but read as RGB565, is half as bright.
+	if got, want := cc.Screenshot().RGBAAt(5, 5), (color.RGBA{0, 125, 0, 0xff}); got != want {
+		t.Errorf("got pixel %v; want %v for RGB555", got, want)
+	}
+}
+
+func TestServerLegacyVersions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(300, 200)
+	go s.Serve(ln)
+
+	for _, tt := range []struct {
+		client, version string
+	}{
+		{"RFB 003.003\n", "3.3"},
+		{"RFB 003.005\n", "3.3"},
+		{"RFB 003.006\n", "3.3"}, // UltraVNC
+		{"RFB 003.889\n", "3.8"}, // Apple
+	} {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		buf := make([]byte, 12)
+		if _, err := io.ReadFull(nc, buf); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(nc, tt.client)
+		if tt.version == "3.3" {
+			// The security type as a word, and no SecurityResult.
+			if _, err := io.ReadFull(nc, buf[:4]); err != nil {
+				t.Fatal(err)
+			}
+			if got := binary.BigEndian.Uint32(buf); got != 1 {
+				t.Errorf("%q: got security type %d; want None", tt.client, got)
+			}
+		} else {
+			if _, err := io.ReadFull(nc, buf[:2]); err != nil {
+				t.Fatal(err)
+			}
+			nc.Write([]byte{1})
+			if _, err := io.ReadFull(nc, buf[:4]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nc.Write([]byte{1}) // shared
+		init := make([]byte, 24)
+		if _, err := io.ReadFull(nc, init); err != nil {
+			t.Fatal(err)
+		}
+		if w, h := binary.BigEndian.Uint16(init), binary.BigEndian.Uint16(init[2:]); w != 300 || h != 200 {
+			t.Errorf("%q: ServerInit has size %dx%d; want 300x200", tt.client, w, h)
+		}
+		c, err := s.Accept(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Fingerprint().Version; got != tt.version {
+			t.Errorf("%q: spoke version %s; want %s", tt.client, got, tt.version)
+		}
+	}
+
+	// Other major versions aren't RFB as we know it.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	buf := make([]byte, 12)
+	io.ReadFull(nc, buf)
+	io.WriteString(nc, "RFB 004.001\n")
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := nc.Read(buf); err == nil {
+		t.Errorf("server answered version 4.1 with %q", buf[:n])
+	}
+}
+
+func TestServerLenientVersions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.LenientVersions = true
+	go s.Serve(ln)
+
+	for _, client := range []string{"RFB 004.001\n", "RFB 003.008 extra\n", "RFB 005.000\r\n"} {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 12)
+		io.ReadFull(nc, buf)
+		io.WriteString(nc, client)
+		// The 3.8 security types, not a dropped connection.
+		if _, err := io.ReadFull(nc, buf[:2]); err != nil || buf[0] != 1 || buf[1] != 1 {
+			t.Errorf("%q: got %v, %v; want the security type None", client, buf[:2], err)
+		}
+	}
+
+	// Other versions before 3.3 still aren't RFB.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	buf := make([]byte, 12)
+	io.ReadFull(nc, buf)
+	io.WriteString(nc, "RFB 002.000\n")
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := nc.Read(buf); err == nil {
+		t.Errorf("server answered version 2.0 with %q", buf[:n])
+	}
+}
+
+// nextEvent returns the next input event of c, or nil once the client
+// disconnected.
+func nextEvent(t *testing.T, c *rfb.Conn) interface{} {
+	t.Helper()
+	select {
+	case e := <-c.Event:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for an input event")
+		return nil
+	}
+}
+
+func TestServerReleaseHeld(t *testing.T) {
+	cc, c, _ := startServer(t, 100, 80)
+	cc.KeyEvent(0xffe3, true) // Control_L
+	cc.KeyEvent('a', true)
+	cc.KeyEvent('a', false)
+	cc.PointerEvent(rfb.ButtonLeft, 10, 20)
+	for range 4 {
+		nextEvent(t, c)
+	}
+
+	// Going view-only releases Ctrl and the button.
+	c.SetViewOnly(true)
+	for _, want := range []interface{}{rfb.KeyEvent{Key: 0xffe3}, rfb.PointerEvent{X: 10, Y: 20}} {
+		if e := nextEvent(t, c); e != want {
+			t.Errorf("got %#v; want release %#v", e, want)
+		}
+	}
+	o := &chanObserver{events: make(chan interface{}, 10)}
+	c.Observe(o)
+	cc.KeyEvent('b', true)
+	<-o.events // the server got it
+	c.SetViewOnly(false)
+	cc.KeyEvent(0xffe1, true) // Shift_L
+	if e, want := nextEvent(t, c), (rfb.KeyEvent{DownFlag: 1, Key: 0xffe1}); e != want {
+		t.Errorf("got %#v; want %#v, not the view-only input", e, want)
+	}
+
+	// So does disconnecting.
+	cc.Close()
+	if e, want := nextEvent(t, c), (rfb.KeyEvent{Key: 0xffe1}); e != want {
+		t.Errorf("got %#v; want release %#v", e, want)
+	}
+	if e := nextEvent(t, c); e != nil {
+		t.Errorf("got %#v after the releases; want Event closed", e)
+	}
+}
+
+func TestServerColourDepth(t *testing.T) {
+	updates := make(chan rfb.UpdateStats, 10)
+	cc, c, src := startServerConfig(t, 64, 64, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{16}, // ZRLE
+		OnUpdate:    func(u rfb.UpdateStats) { updates <- u },
+	})
+	gradient := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			gradient.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8(x + y), 0xff})
+		}
+	}
+	send := func() rfb.UpdateStats {
+		t.Helper()
+		src.frames <- &rfb.LockableImage{Img: gradient}
+		select {
+		case u := <-updates:
+			return u
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for update")
+			return rfb.UpdateStats{}
+		}
+	}
+
+	full := send()
+	c.SetColourDepth(8)
+	reduced := send()
+	if reduced.Bytes >= full.Bytes {
+		t.Errorf("8-bit colour took %d bytes, full colour %d", reduced.Bytes, full.Bytes)
+	}
+	colours := make(map[color.RGBA]bool)
+	fb := cc.Screenshot()
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			colours[fb.RGBAAt(x, y)] = true
+		}
+	}
+	if len(colours) > 256 {
+		t.Errorf("client shows %d colours at depth 8", len(colours))
+	}
+	if got := fb.RGBAAt(63, 63); got.R != 0xff {
+		t.Errorf("brightest red is %d; want levels spanning to 255", got.R)
+	}
+
+	// Lifting the limit restores the colours, although the frame is
+	// the same.
+	c.SetColourDepth(0)
+	send()
+	if err := cc.WaitForImage(gradient.Rect, gradient, time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerColourMap(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rawHandshake(t, nc)
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &chanSource{bounds: image.Rect(0, 0, 16, 16), frames: make(chan *rfb.LockableImage, 1)}
+	c.SetFrameSource(src)
+
+	nc.Write([]byte{0, 0, 0, 0, 8, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}) // 8-bit colour map
+	nc.Write([]byte{2, 0, 0, 1, 0, 0, 0, 0})                                     // Raw
+	nc.Write([]byte{3, 0, 0, 0, 0, 0, 0, 16, 0, 16})                             // full update
+	src.frames <- &rfb.LockableImage{Img: solid(16, 16, color.RGBA{0xff, 0x66, 0, 0xff})}
+
+	nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	hdr := make([]byte, 6)
+	if _, err := io.ReadFull(nc, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr[0] != 1 || binary.BigEndian.Uint16(hdr[2:]) != 0 {
+		t.Fatalf("got message %v; want SetColourMapEntries from colour 0", hdr)
+	}
+	entries := make([]byte, 6*int(binary.BigEndian.Uint16(hdr[4:])))
+	if _, err := io.ReadFull(nc, entries); err != nil {
+		t.Fatal(err)
+	}
+
+	update := make([]byte, 4+12+16*16)
+	if _, err := io.ReadFull(nc, update); err != nil {
+		t.Fatal(err)
+	}
+	if update[0] != 0 || binary.BigEndian.Uint16(update[2:]) != 1 {
+		t.Fatalf("got update header %v; want one rectangle", update[:4])
+	}
+	i := int(update[16])
+	for _, v := range update[16:] {
+		if int(v) != i {
+			t.Fatalf("solid frame sent as pixels %d and %d", i, v)
+		}
+	}
+	if 6*i >= len(entries) {
+		t.Fatalf("pixel %d is beyond the %d colours", i, len(entries)/6)
+	}
+	e := entries[6*i:]
+	got := color.RGBA{e[0], e[2], e[4], 0xff}
+	if want := (color.RGBA{0xff, 0x66, 0, 0xff}); got != want {
+		t.Errorf("pixel %d is %v; want %v", i, got, want)
+	}
+}
+
+func TestServerSharePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		policy     rfb.SharePolicy
+		refused    bool // the exclusive client
+		disconnect bool // the shared client
+	}{
+		{"always shared", rfb.AlwaysShared, false, false},
+		{"disconnect others", rfb.DisconnectOthers, false, true},
+		{"refuse exclusive", rfb.RefuseExclusive, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ln.Close() })
+			s := rfb.NewServer(16, 16)
+			s.SharePolicy = tt.policy
+			go s.Serve(ln)
+
+			shared, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { shared.Close() })
+			exclusive, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{Exclusive: true})
+			if (err != nil) != tt.refused {
+				t.Errorf("exclusive client got %v; want refused %v", err, tt.refused)
+			}
+			if err == nil {
+				t.Cleanup(func() { exclusive.Close() })
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for shared.Err() == nil && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if disconnected := shared.Err() != nil; disconnected != tt.disconnect {
+				t.Errorf("shared client disconnected %v; want %v", disconnected, tt.disconnect)
+			}
+		})
+	}
+}
+
+func TestServerSetCursor(t *testing.T) {
+	type shape struct {
+		img     *image.RGBA
+		hotspot image.Point
+	}
+	shapes := make(chan shape, 10)
+	cc, c, src := startServerConfig(t, 20, 20, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{0, -239},
+		OnCursor:    func(img *image.RGBA, hotspot image.Point) { shapes <- shape{img, hotspot} },
+	})
+	next := func() shape {
+		t.Helper()
+		select {
+		case s := <-shapes:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the pointer shape")
+			return shape{}
+		}
+	}
+
+	// The shape goes out without waiting for a frame.
+	arrow := solid(4, 3, color.RGBA{0xff, 0, 0, 0xff})
+	arrow.Set(3, 0, color.Transparent)
+	c.SetCursor(arrow, image.Pt(1, 2))
+	s := next()
+	if s.hotspot != image.Pt(1, 2) || s.img == nil || s.img.Rect != image.Rect(0, 0, 4, 3) {
+		t.Fatalf("got shape %v with hotspot %v", s.img, s.hotspot)
+	}
+	if got := s.img.RGBAAt(0, 0); got != (color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Errorf("pixel (0, 0) is %v; want opaque red", got)
+	}
+	if got := s.img.RGBAAt(3, 0); got.A != 0 {
+		t.Errorf("pixel (3, 0) is %v; want transparent", got)
+	}
+
+	// Frames still arrive, and so does hiding the pointer.
+	img := solid(20, 20, color.RGBA{0, 0xff, 0, 0xff})
+	src.frames <- &rfb.LockableImage{Img: img}
+	if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.SetCursor(nil, image.Point{})
+	if s := next(); s.img != nil {
+		t.Errorf("got shape %v; want a hidden pointer", s.img.Rect)
+	}
+}
+
+func TestServerXCursor(t *testing.T) {
+	shapes := make(chan *image.RGBA, 10)
+	_, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{0, -240},
+		OnCursor:    func(img *image.RGBA, hotspot image.Point) { shapes <- img },
+	})
+
+	// Dark pixels become the foreground, light ones the background,
+	// each in their average colour.
+	arrow := solid(3, 2, color.RGBA{0x10, 0x10, 0x10, 0xff})
+	arrow.Set(1, 0, color.RGBA{0x30, 0x30, 0x30, 0xff})
+	arrow.Set(0, 1, color.White)
+	arrow.Set(2, 1, color.Transparent)
+	c.SetCursor(arrow, image.Pt(0, 0))
+	var got *image.RGBA
+	select {
+	case got = <-shapes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the pointer shape")
+	}
+	if got == nil || got.Rect != image.Rect(0, 0, 3, 2) {
+		t.Fatalf("got shape %v", got)
+	}
+	dark := color.RGBA{0x18, 0x18, 0x18, 0xff}
+	for _, p := range []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{0, 0, dark},
+		{1, 0, dark},
+		{0, 1, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+		{2, 1, color.RGBA{}},
+	} {
+		if c := got.RGBAAt(p.x, p.y); c != p.want {
+			t.Errorf("pixel (%d, %d) is %v; want %v", p.x, p.y, c, p.want)
+		}
+	}
+}
+
+func TestServerCursorWithAlpha(t *testing.T) {
+	shapes := make(chan *image.RGBA, 10)
+	cc, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{0, -240, -239, -314},
+		OnCursor:    func(img *image.RGBA, hotspot image.Point) { shapes <- img },
+	})
+	next := func() *image.RGBA {
+		t.Helper()
+		select {
+		case img := <-shapes:
+			return img
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the pointer shape")
+			return nil
+		}
+	}
+
+	shadow := color.RGBA{0x20, 0, 0, 0x40}
+	arrow := solid(2, 2, color.RGBA{0xff, 0, 0, 0xff})
+	arrow.Set(1, 1, shadow)
+	c.SetCursor(arrow, image.Pt(0, 0))
+	if got := next(); got == nil || got.RGBAAt(1, 1) != shadow {
+		t.Fatalf("got shape %v; want the translucent pixel kept", got)
+	}
+
+	// Without CursorWithAlpha, the shape is sent again as RichCursor.
+	if err := cc.SetEncodings([]int32{0, -240, -239}); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got == nil || got.RGBAAt(1, 1).A != 0 || got.RGBAAt(0, 0) != arrow.RGBAAt(0, 0) {
+		t.Errorf("got shape %v; want the translucent pixel hidden", got)
+	}
+
+	c.SetCursor(nil, image.Point{})
+	if got := next(); got != nil {
+		t.Errorf("got shape %v; want a hidden pointer", got.Rect)
+	}
+}
+
+func TestServerPointerPos(t *testing.T) {
+	moves := make(chan image.Point, 10)
+	shapes := make(chan *image.RGBA, 10)
+	_, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{
+		PixelFormat:  &rgb888,
+		Encodings:    []int32{0, -239, -232},
+		OnCursor:     func(img *image.RGBA, hotspot image.Point) { shapes <- img },
+		OnPointerPos: func(p image.Point) { moves <- p },
+	})
+	next := func() image.Point {
+		t.Helper()
+		select {
+		case p := <-moves:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the pointer position")
+			return image.Point{}
+		}
+	}
+
+	// Both go out without waiting for a frame.
+	c.SetCursor(solid(2, 2, color.RGBA{0xff, 0, 0, 0xff}), image.Point{})
+	c.SetPointerPos(image.Pt(5, 7))
+	if p := next(); p != image.Pt(5, 7) {
+		t.Errorf("pointer moved to %v; want (5, 7)", p)
+	}
+	select {
+	case <-shapes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the pointer shape")
+	}
+
+	c.SetPointerPos(image.Pt(19, 0))
+	if p := next(); p != image.Pt(19, 0) {
+		t.Errorf("pointer moved to %v; want (19, 0)", p)
+	}
+}
+
+func TestServerRelativePointer(t *testing.T) {
+	cc, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{Encodings: []int32{0, -257}})
+	next := func() interface{} {
+		t.Helper()
+		select {
+		case e := <-c.Event:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for an event")
+			return nil
+		}
+	}
+
+	c.SetRelativePointer(true)
+	for deadline := time.Now().Add(5 * time.Second); !cc.RelativePointer(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client wasn't switched to relative mode")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !c.RelativePointer() {
+		t.Error("RelativePointer() = false after the switch")
+	}
+	cc.MovePointer(rfb.ButtonLeft, -3, 5)
+	if e, want := next(), (rfb.RelativePointerEvent{ButtonMask: rfb.ButtonLeft, DX: -3, DY: 5}); e != want {
+		t.Errorf("got %#v; want %#v", e, want)
+	}
+
+	// Back to absolute positions; the button is released on the way.
+	c.SetRelativePointer(false)
+	for deadline := time.Now().Add(5 * time.Second); cc.RelativePointer(); {
+		if time.Now().After(deadline) {
+			t.Fatal("client wasn't switched back to absolute mode")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cc.PointerEvent(0, 4, 6)
+	if e, want := next(), (rfb.PointerEvent{X: 4, Y: 6}); e != want {
+		t.Errorf("got %#v; want %#v", e, want)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rfb.NewServer(20, 20)
+	s.ShutdownNotice = "Server restarting"
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ln) }()
+
+	clip := make(chan string, 1)
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+		OnCutText: func(text string) { clip <- text },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := solid(20, 20, color.RGBA{0xff, 0, 0, 0xff})
+	c.Feed <- &rfb.LockableImage{Img: img}
+	if err := cc.WaitForImage(img.Rect, img, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != rfb.ErrServerClosed {
+		t.Errorf("Serve returned %v; want ErrServerClosed", err)
+	}
+	select {
+	case text := <-clip:
+		if text != "Server restarting" {
+			t.Errorf("got notice %q", text)
+		}
+	default:
+		t.Error("no shutdown notice")
+	}
+	if err := cc.WaitForUpdate(5 * time.Second); err == nil || cc.Err() == nil {
+		t.Errorf("client still connected after Shutdown")
+	}
+
+	// Feeding goroutines see the connection end rather than block.
+	for range 100 {
+		select {
+		case c.Feed <- &rfb.LockableImage{Img: img}:
+		case <-c.Done():
+		}
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed after Shutdown")
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.ActiveGoroutines() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after Shutdown", s.ActiveGoroutines())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServerVMwareCursor(t *testing.T) {
+	shapes := make(chan *image.RGBA, 10)
+	_, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{
+		PixelFormat: &rgb888,
+		Encodings:   []int32{0, -239, 0x574d5664},
+		OnCursor:    func(img *image.RGBA, hotspot image.Point) { shapes <- img },
+	})
+	next := func() *image.RGBA {
+		t.Helper()
+		select {
+		case img := <-shapes:
+			return img
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for the pointer shape")
+			return nil
+		}
+	}
+
+	// Preferred to RichCursor, as it keeps translucent pixels.
+	arrow := solid(2, 2, color.RGBA{0, 0xff, 0, 0xff})
+	arrow.Set(1, 1, color.RGBA{0x20, 0, 0, 0x40})
+	c.SetCursor(arrow, image.Point{})
+	got := next()
+	if got == nil || got.RGBAAt(0, 0) != arrow.RGBAAt(0, 0) {
+		t.Fatalf("got shape %v", got)
+	}
+	if p := got.RGBAAt(1, 1); p.A != 0x40 || p.R < 0x1f || p.R > 0x21 {
+		t.Errorf("translucent pixel is %v; want %v", p, arrow.RGBAAt(1, 1))
+	}
+
+	c.SetCursor(nil, image.Point{})
+	if got := next(); got != nil {
+		t.Errorf("got shape %v; want a hidden pointer", got.Rect)
+	}
+}
+
+func TestServerXvp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Xvp = true
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	rawHandshake(t, nc)
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 4)
+	nc.Write([]byte{2, 0, 0, 1, 0xff, 0xff, 0xfe, 0xcb}) // xvp, -309
+	if _, err := io.ReadFull(nc, msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{250, 0, 1, 1}; !bytes.Equal(msg, want) {
+		t.Fatalf("got %v; want XVP_INIT %v", msg, want)
+	}
+
+	nc.Write([]byte{250, 0, 1, 3})
+	select {
+	case e := <-c.Event:
+		if e != rfb.XvpReboot {
+			t.Fatalf("got event %#v; want XvpReboot", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no xvp event")
+	}
+	if err := c.FailXvp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(nc, msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{250, 0, 1, 0}; !bytes.Equal(msg, want) {
+		t.Errorf("got %v; want XVP_FAIL %v", msg, want)
+	}
+
+	// View-only clients can't power anything off.
+	c.SetViewOnly(true)
+	nc.Write([]byte{250, 0, 1, 2})
+	if _, err := io.ReadFull(nc, msg); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{250, 0, 1, 0}; !bytes.Equal(msg, want) {
+		t.Errorf("got %v; want XVP_FAIL %v", msg, want)
+	}
+}
+
+func TestServerTouch(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.TouchEvents = true
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	rawHandshake(t, nc)
+	c, err := s.Accept(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := func(want []byte) {
+		t.Helper()
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(nc, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %v; want %v", got, want)
+		}
+	}
+	event := func(want rfb.TouchEvent) {
+		t.Helper()
+		select {
+		case e := <-c.Event:
+			if e != want {
+				t.Fatalf("got event %#v; want %#v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no touch event")
+		}
+	}
+	le := binary.LittleEndian
+
+	nc.Write([]byte{2, 0, 0, 1, 0xff, 0xff, 0xfe, 0xcf}) // gii, -305
+	reply([]byte{253, 0x81, 0, 4, 0, 1, 0, 1})
+
+	// A little-endian device with position, contact and pressure
+	// valuators.
+	dev := make([]byte, 56)
+	copy(dev, "touchscreen")
+	le.PutUint32(dev[48:], 4)
+	for i, short := range []string{"X", "Y", "ID", "P"} {
+		v := make([]byte, 116)
+		le.PutUint32(v, uint32(i))
+		copy(v[79:], short)
+		le.PutUint32(v[92:], 1024) // range max
+		dev = append(dev, v...)
+	}
+	msg := append([]byte{253, 2}, le.AppendUint16(nil, uint16(len(dev)))...)
+	nc.Write(append(msg, dev...))
+	reply([]byte{253, 0x82, 0, 4, 0, 0, 0, 1})
+
+	valuators := func(typ uint8, first uint32, values ...int32) []byte {
+		e := []byte{uint8(16 + 4*len(values)), typ, 0, 0}
+		e = le.AppendUint32(e, 1) // origin
+		e = le.AppendUint32(e, first)
+		e = le.AppendUint32(e, uint32(len(values)))
+		for _, v := range values {
+			e = le.AppendUint32(e, uint32(v))
+		}
+		return e
+	}
+	events := append(valuators(13, 0, 100, 50, 7, 512), valuators(12, 0, 10)...)
+	msg = append([]byte{253, 0}, le.AppendUint16(nil, uint16(len(events)))...)
+	nc.Write(append(msg, events...))
+	event(rfb.TouchEvent{Device: 1, ID: 7, X: 100, Y: 50, Pressure: 0.5})
+	event(rfb.TouchEvent{Device: 1, ID: 7, X: 110, Y: 50, Pressure: 0.5})
+
+	// The contact is lifted when the client loses its input.
+	c.SetViewOnly(true)
+	event(rfb.TouchEvent{Device: 1, ID: 7, X: 110, Y: 50})
+}
+
+func TestServerExtendedMouseButtons(t *testing.T) {
+	cc, c, _ := startServerConfig(t, 20, 20, &rfb.ClientConfig{Encodings: []int32{0, -316}})
+	for deadline := time.Now().Add(5 * time.Second); !cc.ExtendedMouseButtons(); {
+		if time.Now().After(deadline) {
+			t.Fatal("server didn't confirm extended mouse buttons")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, want := range []rfb.PointerEvent{
+		{ButtonMask: rfb.ButtonBack | rfb.WheelLeft, X: 3, Y: 4},
+		{ButtonMask: rfb.ButtonLeft, X: 5, Y: 6, ExtButtonMask: rfb.ButtonForward},
+		{X: 7, Y: 8},
+	} {
+		cc.ExtendedPointerEvent(want.ButtonMask, want.ExtButtonMask, int(want.X), int(want.Y))
+		select {
+		case e := <-c.Event:
+			if e != want {
+				t.Errorf("got %#v; want %#v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for a pointer event")
+		}
+	}
+}
+
+func TestServerPassword(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	go s.Serve(ln)
+
+	for _, password := range []string{"", "wrong"} {
+		if cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{Password: password}); err == nil {
+			cc.Close()
+			t.Errorf("connected with password %q", password)
+		}
+	}
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+
+	// 3.3, where the server picks VNC Authentication.
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	io.ReadFull(nc, buf[:12])
+	io.WriteString(nc, "RFB 003.003\n")
+	if _, err := io.ReadFull(nc, buf[:4]); err != nil || binary.BigEndian.Uint32(buf) != 2 {
+		t.Fatalf("got security type %v, %v; want VNC Authentication", buf[:4], err)
+	}
+	if _, err := io.ReadFull(nc, buf); err != nil {
+		t.Fatal(err)
+	}
+	// The key is the password with the bits of each byte reversed.
+	block, _ := des.NewCipher([]byte{0xce, 0xa6, 0xc6, 0x4e, 0xa6, 0x2e, 0, 0})
+	block.Encrypt(buf, buf)
+	block.Encrypt(buf[8:], buf[8:])
+	nc.Write(buf)
+	if _, err := io.ReadFull(nc, buf[:4]); err != nil || binary.BigEndian.Uint32(buf) != 0 {
+		t.Errorf("got SecurityResult %v, %v; want OK", buf[:4], err)
+	}
+}
+
+func TestServerRSAAES(t *testing.T) {
+	dir := t.TempDir()
+	key, err := rfb.LoadOrCreateRSAKey(filepath.Join(dir, "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.RSAAES = true
+	s.RSAKey = key
+	s.Authenticate = func(user, password string) bool {
+		return user == "alice" && password == "secret"
+	}
+	go s.Serve(ln)
+
+	for _, config := range []rfb.ClientConfig{{User: "alice", Password: "wrong"}, {User: "bob", Password: "secret"}} {
+		if cc, err := rfb.Dial("tcp", ln.Addr().String(), &config); err == nil {
+			cc.Close()
+			t.Errorf("connected as %q with password %q", config.User, config.Password)
+		}
+	}
+	src := &chanSource{bounds: image.Rect(0, 0, 16, 16), frames: make(chan *rfb.LockableImage, 1)}
+	go func() {
+		if c, err := s.Accept(context.Background()); err == nil {
+			c.SetFrameSource(src)
+		}
+	}()
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{User: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	// The whole connection is encrypted; updates still arrive.
+	blue := color.RGBA{0, 0, 0xff, 0xff}
+	src.frames <- &rfb.LockableImage{Img: solid(16, 16, blue)}
+	if err := cc.WaitForPixel(image.Pt(8, 8), blue, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := rfb.LoadOrCreateRSAKey(filepath.Join(dir, "key.pem"))
+	if err != nil || !again.Equal(key) {
+		t.Errorf("LoadOrCreateRSAKey didn't load the saved key: %v", err)
+	}
+}
+
+func TestServerAuthLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	s.AuthLimit = &rfb.AuthLimit{Failures: 2, Lockout: time.Minute}
+	go s.Serve(ln)
+	addr := ln.Addr().String()
+
+	cc, err := rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "wrong"})
+	if err == nil {
+		cc.Close()
+		t.Fatal("connected with the wrong password")
+	}
+	// A success forgets the failures.
+	cc, err = rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+	for range 2 {
+		if cc, err := rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "wrong"}); err == nil {
+			cc.Close()
+			t.Fatal("connected with the wrong password")
+		}
+	}
+	_, err = rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "secret"})
+	if err == nil || !strings.Contains(err.Error(), "too many authentication failures") {
+		t.Errorf("got %v after two failures; want a lockout", err)
+	}
+}
+
+func TestServerAuthLimitDefault(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	s.AuthLimit = &rfb.AuthLimit{}
+	go s.Serve(ln)
+	addr := ln.Addr().String()
+
+	for i := range rfb.DefaultAuthFailures {
+		_, err := rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "wrong"})
+		if err == nil {
+			t.Fatal("connected with the wrong password")
+		}
+		if strings.Contains(err.Error(), "too many authentication failures") {
+			t.Fatalf("locked out after %d failures; want %d", i, rfb.DefaultAuthFailures)
+		}
+	}
+	_, err = rfb.Dial("tcp", addr, &rfb.ClientConfig{Password: "secret"})
+	if err == nil || !strings.Contains(err.Error(), "too many authentication failures") {
+		t.Errorf("got %v after %d failures; want a lockout", err, rfb.DefaultAuthFailures)
+	}
+}
+
+func TestServerSecurityResultReason(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	s.Authenticate = func(user, password string) bool { return false }
+	go s.Serve(ln)
+
+	// pick connects with version ver and picks security type st, then
+	// sends msg.
+	pick := func(ver string, st byte, msg []byte) net.Conn {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nc.Close() })
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 12)
+		io.ReadFull(nc, buf)
+		io.WriteString(nc, ver)
+		io.ReadFull(nc, buf[:1])
+		io.ReadFull(nc, make([]byte, buf[0]))
+		nc.Write([]byte{st})
+		switch st {
+		case 2:
+			io.ReadFull(nc, make([]byte, 16)) // challenge
+		case 30:
+			io.ReadFull(nc, make([]byte, 4+2*128)) // ARD parameters
+		}
+		nc.Write(msg)
+		return nc
+	}
+	// result reads a SecurityResult and, if withReason, the reason.
+	result := func(nc net.Conn, withReason bool) (uint32, string) {
+		var status uint32
+		if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+			t.Fatal(err)
+		}
+		if !withReason {
+			if n, err := nc.Read(make([]byte, 1)); n != 0 || err == nil {
+				t.Errorf("read %d bytes after the SecurityResult, %v; want the connection closed", n, err)
+			}
+			return status, ""
+		}
+		var n uint32
+		binary.Read(nc, binary.BigEndian, &n)
+		b := make([]byte, n)
+		io.ReadFull(nc, b)
+		return status, string(b)
+	}
+
+	nc := pick("RFB 003.008\n", 2, make([]byte, 16))
+	if status, reason := result(nc, true); status != 1 || reason != "authentication failed" {
+		t.Errorf("3.8 wrong password: got SecurityResult %d %q", status, reason)
+	}
+	// 3.7 has no reason.
+	nc = pick("RFB 003.007\n", 2, make([]byte, 16))
+	if status, _ := result(nc, false); status != 1 {
+		t.Errorf("3.7 wrong password: got SecurityResult %d", status)
+	}
+	// A malformed exchange is reported too.
+	nc = pick("RFB 003.008\n", 30, make([]byte, 128+128))
+	if status, reason := result(nc, true); status != 1 || !strings.Contains(reason, "public key") {
+		t.Errorf("bad ARD key: got SecurityResult %d %q", status, reason)
+	}
+}
+
+func TestServer33SecurityType(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config func(s *rfb.Server)
+		want   uint32 // security type the server picks; 0 refuses
+	}{
+		{"none", func(*rfb.Server) {}, 1},
+		{"password", func(s *rfb.Server) { s.Password = "secret" }, 2},
+		{"none preferred", func(s *rfb.Server) {
+			s.Password = "secret"
+			s.SecurityTypes = []uint8{1, 2}
+		}, 1},
+		{"user names only", func(s *rfb.Server) {
+			s.Authenticate = func(user, password string) bool { return true }
+		}, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			s := rfb.NewServer(16, 16)
+			tt.config(s)
+			go s.Serve(ln)
+			nc, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer nc.Close()
+			nc.SetDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 12)
+			io.ReadFull(nc, buf)
+			io.WriteString(nc, "RFB 003.003\n")
+			var st uint32
+			if err := binary.Read(nc, binary.BigEndian, &st); err != nil || st != tt.want {
+				t.Fatalf("got security type %d, %v; want %d", st, err, tt.want)
+			}
+			if st == 0 {
+				var n uint32
+				binary.Read(nc, binary.BigEndian, &n)
+				reason := make([]byte, n)
+				if _, err := io.ReadFull(nc, reason); err != nil || len(reason) == 0 {
+					t.Errorf("got reason %q, %v", reason, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	// vncpasswd's fixed key, with the bits of each byte reversed.
+	block, _ := des.NewCipher([]byte{0xe8, 0x4a, 0xd6, 0x60, 0xc4, 0x72, 0x1a, 0xe0})
+	b := make([]byte, 8)
+	block.Encrypt(b, []byte("secret\x00\x00"))
+	name := filepath.Join(t.TempDir(), "passwd")
+	os.WriteFile(name, b, 0o600)
+	if got, err := rfb.ReadPasswordFile(name); err != nil || got != "secret" {
+		t.Errorf("ReadPasswordFile = %q, %v; want secret", got, err)
+	}
+}
+
+// acceptIdentity returns the Identity of the next connection accepted by
+// s that passes the security negotiation, skipping refused ones.
+func acceptIdentity(t *testing.T, s *rfb.Server) rfb.Identity {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		c, err := s.Accept(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for c.Err() == nil && c.Identity().Method == "" && ctx.Err() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		if id := c.Identity(); id.Method != "" {
+			return id
+		}
+	}
+}
+
+// tokenSecurity is a custom security type: the client sends a 5-byte
+// token.
+type tokenSecurity struct{}
+
+func (tokenSecurity) Type() uint8    { return 200 }
+func (tokenSecurity) String() string { return "Token" }
+
+func (tokenSecurity) Handshake(c *rfb.Conn) error {
+	token := make([]byte, 5)
+	if _, err := io.ReadFull(c.SecurityStream(), token); err != nil {
+		return err
+	}
+	if string(token) != "token" {
+		return errors.New("bad token")
+	}
+	c.SetUser("token-user")
+	return nil
+}
+
+func TestServerSecurityHandler(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	s.SecurityHandlers = []rfb.SecurityHandler{tokenSecurity{}}
+	go s.Serve(ln)
+	if got := s.Capabilities().SecurityTypes; len(got) != 2 || got[0] != (rfb.Capability{Number: 200, Name: "Token"}) || got[1].Number != 2 {
+		t.Errorf("security types %v; want Token, then VNC Authentication", got)
+	}
+
+	login := func(token string) (status uint32, reason string) {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nc.Close() })
+		nc.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 12)
+		io.ReadFull(nc, buf)
+		io.WriteString(nc, "RFB 003.008\n")
+		if _, err := io.ReadFull(nc, buf[:3]); err != nil || !bytes.Equal(buf[:3], []byte{2, 200, 2}) {
+			t.Fatalf("got security types %v, %v; want [200 2]", buf[:3], err)
+		}
+		nc.Write(append([]byte{200}, token...))
+		if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+			t.Fatal(err)
+		}
+		if status != 0 {
+			var n uint32
+			binary.Read(nc, binary.BigEndian, &n)
+			b := make([]byte, n)
+			io.ReadFull(nc, b)
+			reason = string(b)
+		} else {
+			nc.Write([]byte{1}) // ClientInit
+		}
+		return status, reason
+	}
+	if status, reason := login("wrong"); status != 1 || reason != "bad token" {
+		t.Errorf("wrong token: got SecurityResult %d %q; want failed with the handler's reason", status, reason)
+	}
+	if status, _ := login("token"); status != 0 {
+		t.Errorf("got SecurityResult %d; want OK", status)
+	}
+	if got := acceptIdentity(t, s); got.User != "token-user" || got.Method != "Token" || got.TLS != nil {
+		t.Errorf("got identity %+v; want token-user with Token", got)
+	}
+
+	// The built-in types are still there.
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+func TestServerAllowConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	allow := make(chan bool, 2)
+	allow <- false
+	allow <- true
+	s.AllowConn = func(nc net.Conn) bool {
+		if _, ok := nc.RemoteAddr().(*net.TCPAddr); !ok {
+			t.Errorf("AllowConn got address %v", nc.RemoteAddr())
+		}
+		return <-allow
+	}
+	go s.Serve(ln)
+
+	if cc, err := rfb.Dial("tcp", ln.Addr().String(), nil); err == nil {
+		cc.Close()
+		t.Error("refused connection got through")
+	}
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+func TestServerSecurityTypes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.Password = "secret"
+	// Tight, then VNC Authentication, then None for viewers without a
+	// password; RSA-AES isn't configured, so it's left out.
+	s.SecurityTypes = []uint8{16, 2, 5, 1}
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 12)
+	io.ReadFull(nc, buf)
+	io.WriteString(nc, "RFB 003.008\n")
+	if _, err := io.ReadFull(nc, buf[:4]); err != nil || !bytes.Equal(buf[:4], []byte{3, 16, 2, 1}) {
+		t.Fatalf("got security types %v, %v; want [16 2 1]", buf[:4], err)
+	}
+
+	// The client picks None.
+	cc, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+}
+
+// msLogon logs in to addr as an UltraVNC viewer with MSLogonII and
+// returns the SecurityResult.
+func msLogon(t *testing.T, addr, user, password string) uint32 {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 12)
+	io.ReadFull(nc, buf)
+	io.WriteString(nc, "RFB 003.008\n")
+	io.ReadFull(nc, buf[:1])
+	types := make([]byte, buf[0])
+	if _, err := io.ReadFull(nc, types); err != nil || !bytes.Contains(types, []byte{113}) {
+		t.Fatalf("server offered security types %v, %v; want MSLogonII", types, err)
+	}
+	nc.Write([]byte{113})
+	var dh struct{ Gen, Mod, Resp uint64 }
+	if err := binary.Read(nc, binary.BigEndian, &dh); err != nil {
+		t.Fatal(err)
+	}
+	gen, mod := new(big.Int).SetUint64(dh.Gen), new(big.Int).SetUint64(dh.Mod)
+	priv := big.NewInt(0x12345)
+	key := new(big.Int).Exp(new(big.Int).SetUint64(dh.Resp), priv, mod).FillBytes(make([]byte, 8))
+	desKey := make([]byte, 8)
+	for i, b := range key {
+		desKey[i] = bits.Reverse8(b)
+	}
+	block, _ := des.NewCipher(desKey)
+	creds := make([]byte, 256+64)
+	copy(creds, user)
+	copy(creds[256:], password)
+	cipher.NewCBCEncrypter(block, key).CryptBlocks(creds[:256], creds[:256])
+	cipher.NewCBCEncrypter(block, key).CryptBlocks(creds[256:], creds[256:])
+	binary.Write(nc, binary.BigEndian, new(big.Int).Exp(gen, priv, mod).Uint64())
+	nc.Write(creds)
+	var status uint32
+	if err := binary.Read(nc, binary.BigEndian, &status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestServerMSLogon(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.MSLogon = true
+	s.Authenticate = func(user, password string) bool {
+		return user == `CORP\alice` && password == "secret"
+	}
+	go s.Serve(ln)
+
+	if status := msLogon(t, ln.Addr().String(), `CORP\alice`, "wrong"); status != 1 {
+		t.Errorf("wrong password: got SecurityResult %d; want failed", status)
+	}
+	if status := msLogon(t, ln.Addr().String(), `CORP\alice`, "secret"); status != 0 {
+		t.Errorf("got SecurityResult %d; want OK", status)
+	}
+}
+
+func TestServerTightSecurity(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.TightSecurity = true
+	s.Password = "secret"
+	go s.Serve(ln)
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	nc.SetDeadline(time.Now().Add(5 * time.Second))
+	read := func(n int) []byte {
+		t.Helper()
+		b := make([]byte, n)
+		if _, err := io.ReadFull(nc, b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	read(12)
+	io.WriteString(nc, "RFB 003.008\n")
+	if types := read(3); !bytes.Equal(types, []byte{2, 2, 16}) {
+		t.Fatalf("got security types %v; want VNC Authentication and Tight", types)
+	}
+	nc.Write([]byte{16})
+	if tunnels := read(20); binary.BigEndian.Uint32(tunnels) != 1 || !bytes.Equal(tunnels[8:], []byte("TGHTNOTUNNEL")) {
+		t.Fatalf("got tunnel types %q; want NOTUNNEL", tunnels)
+	}
+	nc.Write([]byte{0, 0, 0, 0})
+	if auths := read(20); binary.BigEndian.Uint32(auths) != 1 || !bytes.Equal(auths[4:], []byte("\x00\x00\x00\x02STDVVNCAUTH_")) {
+		t.Fatalf("got auth types %q; want VNC Authentication", auths)
+	}
+	nc.Write([]byte{0, 0, 0, 2})
+	challenge := read(16)
+	block, _ := des.NewCipher([]byte{0xce, 0xa6, 0xc6, 0x4e, 0xa6, 0x2e, 0, 0}) // "secret", bits reversed
+	block.Encrypt(challenge, challenge)
+	block.Encrypt(challenge[8:], challenge[8:])
+	nc.Write(challenge)
+	if result := read(4); binary.BigEndian.Uint32(result) != 0 {
+		t.Fatalf("got SecurityResult %v; want OK", result)
+	}
+	nc.Write([]byte{1})
+	init := read(24)
+	read(int(binary.BigEndian.Uint32(init[20:])))
+	hdr := read(8)
+	if server, client := binary.BigEndian.Uint16(hdr), binary.BigEndian.Uint16(hdr[2:]); server != 0 || client != 0 {
+		t.Errorf("got %d server and %d client message types; want none without a FileSystem", server, client)
+	}
+	if encodings := read(16 * int(binary.BigEndian.Uint16(hdr[4:]))); !bytes.Contains(encodings, []byte("TGHTTIGHT___")) {
+		t.Errorf("encoding capabilities %q lack Tight", encodings)
+	}
+}
@@ -0,0 +1,232 @@
+package rfb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultGrace is how long a SessionStore keeps a disconnected session.
+const DefaultGrace = 2 * time.Minute
+
+// ErrUnknownSession is returned by SessionStore.Resume for tokens that
+// don't name a live session.
+var ErrUnknownSession = errors.New("rfb: unknown or expired session")
+
+// A SessionStore keeps logical sessions alive across reconnects. A
+// session outlives its connection by a grace period, during which a new
+// connection presenting the session's token continues it with the same
+// frame source, options and clipboard.
+//
+// How the client presents the token depends on the transport; a
+// WebSocket URL parameter or the password of VNC authentication are
+// typical. The server must have DeferHandshake set, so the session can
+// be chosen before the handshake. Connections over transports without a
+// listener are handed to the server with Server.ServeConn, and a client
+// switching transports while connected moves over with Session.Migrate.
+type SessionStore struct {
+	// Grace is how long disconnected sessions are kept. If zero,
+	// DefaultGrace is used.
+	Grace time.Duration
+
+	// OnExpire, if set, is called when a session is dropped after its
+	// grace period.
+	OnExpire func(*Session)
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// A Session is a logical session that can span several connections.
+type Session struct {
+	store  *SessionStore
+	token  string
+	source FrameSource
+	opts   StartOptions
+
+	mu        sync.Mutex
+	conn      *Conn       // the current connection, or nil
+	expiry    *time.Timer // running while disconnected
+	clipboard string      // latest clipboard text for the client
+	hasClip   bool
+}
+
+// New creates a session with a fresh token. src and opts are used for
+// every connection of the session.
+func (st *SessionStore) New(src FrameSource, opts *StartOptions) (*Session, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s := &Session{store: st, token: base64.RawURLEncoding.EncodeToString(b), source: src}
+	if opts != nil {
+		s.opts = *opts
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.sessions == nil {
+		st.sessions = make(map[string]*Session)
+	}
+	st.sessions[s.token] = s
+	return s, nil
+}
+
+// Resume returns the session named by token. The caller then attaches
+// the new connection with Session.Start.
+func (st *SessionStore) Resume(token string) (*Session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.sessions[token]
+	if !ok {
+		return nil, ErrUnknownSession
+	}
+	return s, nil
+}
+
+// Remove ends s at once, closing its connection if any.
+func (st *SessionStore) Remove(s *Session) {
+	st.mu.Lock()
+	delete(st.sessions, s.token)
+	st.mu.Unlock()
+
+	s.mu.Lock()
+	c := s.conn
+	s.conn = nil
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Token returns the secret that resumes the session.
+func (s *Session) Token() string {
+	return s.token
+}
+
+// Conn returns the session's current connection, or nil while it's
+// disconnected.
+func (s *Session) Conn() *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn
+}
+
+// Start attaches c, a connection waiting for Conn.Start, to the session
+// and starts it. A connection still attached, typically one whose
+// network path died without the server noticing, is closed.
+func (s *Session) Start(c *Conn) error {
+	s.attach(c)
+	if err := c.Start(s.source, &s.opts); err != nil {
+		s.detach(c)
+		return err
+	}
+	s.watch(c)
+	return nil
+}
+
+// Migrate moves the session to c, a connection waiting for Conn.Start,
+// typically one over another transport or a better network path. Unlike
+// Start, it keeps the current connection until c's handshake is done, so
+// the client keeps its view if the new path fails. On error, the
+// session stays on its current connection. Closing c aborts the
+// migration.
+func (s *Session) Migrate(c *Conn) error {
+	if s.Conn() == nil {
+		return s.Start(c)
+	}
+	if err := c.Start(s.source, &s.opts); err != nil {
+		return err
+	}
+	select {
+	case <-c.initc:
+	case <-c.closec:
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrConnClosed
+	}
+	s.attach(c)
+	s.watch(c)
+	return nil
+}
+
+// attach makes c the session's connection, closing the previous one,
+// and sends c the pending clipboard text once it's started.
+func (s *Session) attach(c *Conn) {
+	s.mu.Lock()
+	old := s.conn
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.conn = c
+	clip, hasClip := s.clipboard, s.hasClip
+	s.mu.Unlock()
+	if old != nil && old != c {
+		old.Close()
+	}
+	if hasClip {
+		seq := c.clipTurn()
+		c.spawn(func() { c.sendClipboard(seq, clip, true) })
+	}
+}
+
+// watch detaches c from the session when it disconnects.
+func (s *Session) watch(c *Conn) {
+	c.spawn(func() {
+		<-c.closec
+		s.detach(c)
+	})
+}
+
+// SetClipboard records text as the clipboard content for the client and
+// sends it to the current connection, if any. A resuming connection gets
+// the latest text.
+func (s *Session) SetClipboard(text string) {
+	s.mu.Lock()
+	s.clipboard, s.hasClip = text, true
+	c := s.conn
+	s.mu.Unlock()
+	if c != nil {
+		c.SetClipboard(text)
+	}
+}
+
+// detach starts the grace period after c disconnected, unless the
+// session moved on to another connection.
+func (s *Session) detach(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != c {
+		return
+	}
+	s.conn = nil
+	grace := s.store.Grace
+	if grace == 0 {
+		grace = DefaultGrace
+	}
+	s.expiry = time.AfterFunc(grace, s.expire)
+}
+
+func (s *Session) expire() {
+	s.mu.Lock()
+	if s.conn != nil {
+		s.mu.Unlock()
+		return // resumed in the meantime
+	}
+	st := s.store
+	st.mu.Lock()
+	_, ok := st.sessions[s.token]
+	delete(st.sessions, s.token)
+	st.mu.Unlock()
+	s.mu.Unlock()
+
+	if ok && st.OnExpire != nil {
+		st.OnExpire(s)
+	}
+}
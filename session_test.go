@@ -0,0 +1,177 @@
+package rfb_test
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+func TestSessionResume(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(1, 1)
+	s.DeferHandshake = true
+	go s.Serve(ln)
+
+	expired := make(chan *rfb.Session, 1)
+	store := &rfb.SessionStore{Grace: 200 * time.Millisecond, OnExpire: func(s *rfb.Session) { expired <- s }}
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	src := &chanSource{bounds: image.Rect(0, 0, 8, 8), frames: make(chan *rfb.LockableImage, 10)}
+	sess, err := store.New(src, &rfb.StartOptions{Name: "session"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// connect dials, and attaches the connection to the session with the
+	// given token.
+	connect := func(token string, clip chan string) (*rfb.ClientConn, error) {
+		go func() {
+			c, err := s.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			sess, err := store.Resume(token)
+			if err != nil {
+				c.Close()
+				return
+			}
+			sess.Start(c)
+		}()
+		return rfb.Dial("tcp", ln.Addr().String(), &rfb.ClientConfig{
+			OnCutText: func(text string) { clip <- text },
+		})
+	}
+
+	clip1 := make(chan string, 10)
+	cc, err := connect(sess.Token(), clip1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.frames <- &rfb.LockableImage{Img: solid(8, 8, red)}
+	if err := cc.WaitForPixel(image.Pt(1, 1), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cc.Close()
+
+	// While disconnected, the clipboard changes.
+	for sess.Conn() != nil {
+		time.Sleep(time.Millisecond)
+	}
+	sess.SetClipboard("grüße")
+
+	clip2 := make(chan string, 10)
+	cc, err = connect(sess.Token(), clip2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if cc.Name() != "session" {
+		t.Errorf("resumed session has name %q", cc.Name())
+	}
+	// The old connection may still be waiting for a frame, too.
+	src.frames <- &rfb.LockableImage{Img: solid(8, 8, red)}
+	src.frames <- &rfb.LockableImage{Img: solid(8, 8, red)}
+	if err := cc.WaitForPixel(image.Pt(1, 1), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case text := <-clip2:
+		if text != "grüße" {
+			t.Errorf("clipboard = %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("pending clipboard wasn't sent on resume")
+	}
+
+	// After the grace period, the session is gone.
+	cc.Close()
+	select {
+	case s := <-expired:
+		if s != sess {
+			t.Error("wrong session expired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session didn't expire")
+	}
+	if _, err := store.Resume(sess.Token()); err != rfb.ErrUnknownSession {
+		t.Errorf("Resume after expiry = %v; want ErrUnknownSession", err)
+	}
+}
+
+func TestSessionMigrate(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(1, 1)
+	s.DeferHandshake = true
+	go s.Serve(ln)
+
+	store := &rfb.SessionStore{}
+	src := &chanSource{bounds: image.Rect(0, 0, 8, 8), frames: make(chan *rfb.LockableImage, 10)}
+	sess, err := store.New(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Remove(sess)
+	go func() {
+		c, err := s.Accept(context.Background())
+		if err == nil {
+			sess.Start(c)
+		}
+	}()
+	cc1, err := rfb.Dial("tcp", ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc1.Close()
+	old := sess.Conn()
+
+	// A migration whose handshake fails leaves the session alone.
+	p1, p2 := net.Pipe()
+	c := s.ServeConn(p1)
+	p2.Close()
+	if err := sess.Migrate(c); err == nil {
+		t.Error("migration to a closed connection succeeded")
+	}
+	if sess.Conn() != old {
+		t.Error("failed migration changed the session's connection")
+	}
+
+	// The client moves to another transport.
+	p1, p2 = net.Pipe()
+	c = s.ServeConn(p1)
+	errc := make(chan error, 1)
+	go func() { errc <- sess.Migrate(c) }()
+	cc2, err := rfb.NewClientConn(p2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc2.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if sess.Conn() != c {
+		t.Error("session isn't on the new connection")
+	}
+	for cc1.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	// The old connection may still be waiting for a frame, too.
+	src.frames <- &rfb.LockableImage{Img: solid(8, 8, red)}
+	src.frames <- &rfb.LockableImage{Img: solid(8, 8, red)}
+	if err := cc2.WaitForPixel(image.Pt(1, 1), red, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
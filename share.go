@@ -0,0 +1,52 @@
+package rfb
+
+import "log"
+
+// A SharePolicy decides what happens when a client asks, with the shared
+// flag of its ClientInit, for the desktop to itself.
+type SharePolicy int
+
+const (
+	// AlwaysShared ignores the flag: every client joins the others.
+	AlwaysShared SharePolicy = iota
+
+	// DisconnectOthers disconnects the other clients when one asks for
+	// exclusive access, as most VNC servers do by default.
+	DisconnectOthers
+
+	// RefuseExclusive disconnects a client asking for exclusive access
+	// if other clients are connected, and leaves them be.
+	RefuseExclusive
+)
+
+// claimExclusive applies Server.SharePolicy to c, which asked for
+// exclusive access. Only clients past their handshake count as
+// connected.
+func (c *Conn) claimExclusive() {
+	s := c.s
+	if s.SharePolicy == AlwaysShared {
+		return
+	}
+	s.acceptMu.Lock()
+	var others []*Conn
+	for oc := range s.live {
+		select {
+		case <-oc.initc:
+			if oc != c {
+				others = append(others, oc)
+			}
+		default:
+		}
+	}
+	s.acceptMu.Unlock()
+	if len(others) == 0 {
+		return
+	}
+	if s.SharePolicy == RefuseExclusive {
+		c.failf(ClassUnsupported, "exclusive access refused: %d other clients connected", len(others))
+	}
+	log.Printf("client %v wants exclusive access; disconnecting %d others", c.c.RemoteAddr(), len(others))
+	for _, oc := range others {
+		oc.Close()
+	}
+}
@@ -0,0 +1,132 @@
+package rfb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("rfb: server closed")
+
+// Shutdown stops the server gracefully. It closes the listeners, making
+// Serve return ErrServerClosed, and ends all connections cleanly: the
+// update being sent is finished, ShutdownNotice follows if set, and the
+// server closes its side. The connection is then dropped once the client
+// closed its side too, or when ctx is done. From then on, frames sent on
+// a connection's Feed are discarded, so goroutines feeding it don't
+// block.
+//
+// Shutdown returns when all connections are gone, or ctx's error if it's
+// done first.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.acceptMu.Lock()
+	s.closing = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	var conns []*Conn
+	for c := range s.live {
+		conns = append(conns, c)
+	}
+	s.acceptMu.Unlock()
+
+	done := make(chan struct{}, len(conns))
+	for _, c := range conns {
+		c.spawn(func() {
+			c.shutdown(ctx, s.ShutdownNotice)
+			done <- struct{}{}
+		})
+	}
+	for range conns {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// shutdown ends the connection for Server.Shutdown.
+func (c *Conn) shutdown(ctx context.Context, notice string) {
+	c.spawn(c.discardFeed)
+	select {
+	case <-c.initc:
+	case <-c.closec:
+		return
+	default:
+		// Still in the handshake, so nothing to finish.
+		c.Close()
+		<-c.closec
+		return
+	}
+
+	// Holding wmu waits for the update being sent, and keeps later ones
+	// from starting before the output is gone.
+	c.wmu.Lock()
+	if notice != "" {
+		c.writeClipboard(notice, false)
+	}
+	c.bw.Flush()
+	c.cw.w = io.Discard
+	if cw, ok := c.c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		c.c.Close()
+	}
+	c.wmu.Unlock()
+	log.Printf("Shutting down client connection")
+
+	select {
+	case <-c.closec:
+	case <-ctx.Done():
+		c.Close()
+		<-c.closec
+	}
+}
+
+// discardFeed drops the frames sent on Feed after Shutdown, until the
+// connection has ended; senders then see Done.
+func (c *Conn) discardFeed() {
+	for {
+		select {
+		case <-c.feed:
+		case <-c.closec:
+			return
+		}
+	}
+}
+
+// track adds c to the live connections, or closes it if the server is
+// shutting down. It reports whether c was added.
+func (s *Server) track(c *Conn) bool {
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	if s.closing {
+		c.c.Close()
+		return false
+	}
+	if s.live == nil {
+		s.live = make(map[*Conn]struct{})
+	}
+	s.live[c] = struct{}{}
+	return true
+}
+
+// listen registers ln for Shutdown to close. It reports false if the
+// server is shutting down already.
+func (s *Server) listen(ln net.Listener) bool {
+	s.acceptMu.Lock()
+	defer s.acceptMu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
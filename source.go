@@ -0,0 +1,192 @@
+package rfb
+
+import (
+	"image"
+	"log"
+	"time"
+)
+
+// A FrameSource produces the frames sent to a client. It's the pull-based
+// alternative to sending images on Conn.Feed yourself.
+type FrameSource interface {
+	// Bounds returns the size of the frames produced by the source.
+	Bounds() image.Rectangle
+
+	// NextFrame blocks until a new frame is available and returns it.
+	// It's called once per framebuffer update, from the connection's
+	// sending goroutine. If the returned image's Damage is non-nil, it
+	// lists the regions that changed since the previous frame, and the
+	// default Differ skips its own comparison.
+	NextFrame() (*LockableImage, error)
+}
+
+// SetFrameSource makes the connection pull its frames from src instead
+// of Feed, or from Feed again if src is nil. It can be called at any
+// time, for instance to switch from a login screen to the desktop: the
+// next update then sends the new source's frame in full, resizing the
+// client's framebuffer if the size changed and the SizePolicy allows.
+// A NextFrame call on the previous source that's still waiting is
+// abandoned, and its frame dropped.
+func (c *Conn) SetFrameSource(src FrameSource) {
+	c.mu.Lock()
+	c.source = src
+	c.refresh = true
+	c.mu.Unlock()
+	select {
+	case c.swapc <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Conn) frameSource() FrameSource {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.source
+}
+
+// frameResult is the outcome of a FrameSource.NextFrame call.
+type frameResult struct {
+	li  *LockableImage
+	err error
+}
+
+// framePull is a connection's outstanding NextFrame call. It's only used
+// by the sending goroutine.
+type framePull struct {
+	src    FrameSource
+	result chan frameResult
+}
+
+// nextFrame waits for the connection's next frame, from its frame source
+// or Feed. If the server has a StallTimeout and no frame arrives in time,
+// it reports the stall and returns the image to show meanwhile, unless
+// the policy is to freeze. Before the first frame, it returns the
+// server's splash screen if there's one. ok is false if the connection
+// is to end.
+func (c *Conn) nextFrame() (li *LockableImage, ok bool) {
+	var timeout <-chan time.Time
+	if c.s.StallTimeout > 0 && !c.stall.stalled {
+		timeout = time.After(c.s.StallTimeout)
+	}
+	splash := c.wantSplash()
+	for {
+		var frames chan frameResult
+		var feed <-chan *LockableImage
+		if src := c.frameSource(); src != nil {
+			p := &c.pull
+			if p.result == nil || p.src != src {
+				// A call that outlives the wait is picked up next time,
+				// unless the source was swapped out.
+				if c.pulls.Load() >= maxPulls {
+					c.failf(ClassInternal, "%d NextFrame calls not returning", maxPulls)
+				}
+				p.src, p.result = src, make(chan frameResult, 1)
+				result := p.result
+				c.pulls.Add(1)
+				c.spawn(func() {
+					defer c.pulls.Add(-1)
+					li, err := pullFrame(src)
+					result <- frameResult{li, err}
+				})
+			}
+			frames = p.result
+		} else {
+			feed = c.feed
+		}
+		if splash {
+			// Show the splash screen unless a frame is ready.
+			splash = false
+			select {
+			case r := <-frames:
+				c.pull.result = nil
+				return c.gotFrame(r)
+			case li := <-feed:
+				return c.gotFrame(frameResult{li: li})
+			default:
+				if li := c.splashFrame(); li != nil {
+					return li, true
+				}
+			}
+		}
+		select {
+		case r := <-frames:
+			c.pull.result = nil
+			return c.gotFrame(r)
+		case li := <-feed:
+			return c.gotFrame(frameResult{li: li})
+		case <-c.swapc:
+		case <-c.shapec:
+			c.mu.RLock()
+			pending := c.pendingRectsLocked() > 0 || c.desktopPendingLocked()
+			c.mu.RUnlock()
+			if pending {
+				return nil, true // for an update with just pseudo-rectangles
+			}
+		case <-c.closec:
+			return nil, false
+		case <-timeout:
+			timeout = nil
+			if li := c.stallFrame(); li != nil {
+				return li, true
+			}
+		}
+	}
+}
+
+// gotFrame handles the result of waiting for a frame.
+func (c *Conn) gotFrame(r frameResult) (*LockableImage, bool) {
+	if r.err != nil {
+		log.Printf("frame source failed: %v", r.err)
+		c.c.Close()
+		return nil, false
+	}
+	st := &c.stall
+	if st.stalled {
+		st.stalled = false
+		log.Printf("frame source recovered")
+		if c.s.OnStall != nil {
+			c.s.OnStall(c, false)
+		}
+	}
+	// The source's damage is relative to a frame the client doesn't
+	// have if it got a stall image or splash screen.
+	st.stale, st.shown = st.stale || st.shown, false
+	return r.li, true
+}
+
+// clipRects returns the parts of rects that lie within bounds, dropping
+// empty ones.
+func clipRects(rects []image.Rectangle, bounds image.Rectangle) []image.Rectangle {
+	var rc []image.Rectangle
+	for _, r := range rects {
+		r = r.Intersect(bounds)
+		if !r.Empty() {
+			rc = append(rc, r)
+		}
+	}
+	return rc
+}
+
+// splitRects splits rectangles of more than maxPixels pixels into
+// horizontal bands, and the bands into pieces if a single row is too
+// large. maxPixels <= 0 means no limit.
+func splitRects(rects []image.Rectangle, maxPixels int) []image.Rectangle {
+	if maxPixels <= 0 {
+		return rects
+	}
+	var out []image.Rectangle
+	for _, r := range rects {
+		if r.Dx()*r.Dy() <= maxPixels {
+			out = append(out, r)
+			continue
+		}
+		w := min(r.Dx(), maxPixels)
+		h := max(maxPixels/r.Dx(), 1)
+		for y := r.Min.Y; y < r.Max.Y; y += h {
+			for x := r.Min.X; x < r.Max.X; x += w {
+				out = append(out, image.Rect(x, y, min(x+w, r.Max.X), min(y+h, r.Max.Y)))
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package rfb
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// splashBackground is the colour behind Server.Splash.
+var splashBackground = color.RGBA{0x20, 0x28, 0x38, 0xff}
+
+// wantSplash reports whether the connection should show a splash screen
+// rather than wait for its first frame.
+func (c *Conn) wantSplash() bool {
+	if c.splashed || c.s.Splash == "" && c.s.SplashImage == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.last == nil
+}
+
+// splashFrame returns the splash screen to send before the first frame,
+// or nil if SplashImage declines.
+func (c *Conn) splashFrame() *LockableImage {
+	c.splashed = true
+	var img image.Image
+	if c.s.SplashImage != nil {
+		img = c.s.SplashImage(c)
+	} else {
+		c.mu.RLock()
+		size := image.Pt(c.width, c.height)
+		c.mu.RUnlock()
+		rgba := image.NewRGBA(image.Rectangle{Max: size})
+		draw.Draw(rgba, rgba.Rect, image.NewUniform(splashBackground), image.Point{}, draw.Src)
+		drawText(rgba, c.s.Splash, color.White)
+		img = rgba
+	}
+	if img == nil {
+		return nil
+	}
+	c.stall.shown = true
+	return &LockableImage{Img: img}
+}
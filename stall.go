@@ -0,0 +1,66 @@
+package rfb
+
+import (
+	"image"
+	"log"
+)
+
+// A StallPolicy decides what clients see while their frame source is
+// stalled; see Server.StallTimeout.
+type StallPolicy int
+
+const (
+	StallFreeze StallPolicy = iota // keep showing the last frame
+	StallDim                       // show the last frame darkened
+	StallBlank                     // show a black screen
+)
+
+// stallState tracks a connection's frame source health. It's only used
+// by the sending goroutine.
+type stallState struct {
+	stalled bool // no frame arrived within Server.StallTimeout
+	shown   bool // a stall image or splash screen was sent
+	stale   bool // the client's image isn't the source's previous frame
+}
+
+// stallFrame reports a stall and returns the frame to show meanwhile,
+// or nil to keep the client's image.
+func (c *Conn) stallFrame() *LockableImage {
+	c.stall.stalled = true
+	log.Printf("no frame for %v; frame source stalled", c.s.StallTimeout)
+	if c.s.OnStall != nil {
+		c.s.OnStall(c, true)
+	}
+
+	c.mu.RLock()
+	last, size := c.last, image.Pt(c.width, c.height)
+	c.mu.RUnlock()
+	var img image.Image
+	switch {
+	case c.s.StallImage != nil:
+		img = c.s.StallImage(c, last)
+	case c.s.StallPolicy == StallDim && last != nil:
+		img = dim(last)
+	case c.s.StallPolicy == StallBlank:
+		img = image.NewRGBA(image.Rectangle{Max: size})
+	}
+	if img == nil {
+		return nil
+	}
+	c.stall.shown = true
+	return &LockableImage{Img: img}
+}
+
+// dim returns a copy of img at half brightness.
+func dim(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			i := out.PixOffset(x, y)
+			out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] = uint8(r>>9), uint8(g>>9), uint8(bl>>9), 0xff
+		}
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package rfb
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultName is the desktop name sent to clients unless Server.SetName,
+// StartOptions or Conn.SetName say otherwise.
+const DefaultName = "rfb-go"
+
+// StartOptions are the per-connection settings decided by the
+// application before the handshake when Server.DeferHandshake is set.
+type StartOptions struct {
+	// Name is the desktop name shown by the client; see Conn.SetName,
+	// which changes it later. If empty, the server's is used.
+	Name string
+
+	// PixelFormat is the server's native pixel format announced in
+	// ServerInit, which clients use unless they ask for another. It
+	// must be a true-colour format. If nil, 16-bit colour is used.
+	PixelFormat *PixelFormat
+
+	// ViewOnly drops all input from the client, and refuses its file
+	// uploads and new directories. Conn.SetViewOnly changes it later.
+	ViewOnly bool
+
+	// ColourDepth, if non-zero, limits the colours sent to the client;
+	// see Conn.SetColourDepth, which changes it later.
+	ColourDepth int
+}
+
+// Errors returned by Conn.Start.
+var (
+	ErrNotDeferred    = errors.New("rfb: server doesn't defer handshakes")
+	ErrAlreadyStarted = errors.New("rfb: connection already started")
+	ErrConnClosed     = errors.New("rfb: connection closed")
+)
+
+// Start lets the handshake of a connection accepted by a server with
+// DeferHandshake set proceed. src, if non-nil, becomes the connection's
+// frame source, and its bounds are announced as the framebuffer size.
+func (c *Conn) Start(src FrameSource, opts *StartOptions) error {
+	if !c.s.DeferHandshake {
+		return ErrNotDeferred
+	}
+	if opts == nil {
+		opts = &StartOptions{}
+	}
+	if opts.PixelFormat != nil && opts.PixelFormat.TrueColour == 0 {
+		return errors.New("rfb: native pixel format must be true-colour")
+	}
+	c.startMu.Lock()
+	defer c.startMu.Unlock()
+	switch {
+	case c.started:
+		return ErrAlreadyStarted
+	case c.closed:
+		return ErrConnClosed
+	}
+	if src != nil {
+		c.SetFrameSource(src)
+	}
+	c.opts = *opts
+	c.SetColourDepth(opts.ColourDepth)
+	c.inputMu.Lock()
+	c.viewOnly = opts.ViewOnly
+	c.inputMu.Unlock()
+	c.started = true
+	close(c.startc)
+	return nil
+}
+
+// Done returns a channel that's closed when the connection has ended,
+// whether the client disconnected, Close was called or the server shut
+// down. Goroutines sending on Feed should select on it, as nothing reads
+// Feed afterwards.
+func (c *Conn) Done() <-chan struct{} {
+	return c.closec
+}
+
+// Close disconnects the client. It also ends a connection waiting for
+// Start.
+func (c *Conn) Close() error {
+	c.startMu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closingc)
+	}
+	c.startMu.Unlock()
+	return c.c.Close()
+}
+
+// awaitStart blocks until the application calls Start or Close, if the
+// server defers handshakes. It reports whether to go on.
+func (c *Conn) awaitStart() bool {
+	if !c.s.DeferHandshake {
+		return true
+	}
+	select {
+	case <-c.startc:
+		return true
+	case <-c.closingc:
+		return false
+	}
+}
+
+// nativeFormat returns the pixel format announced in ServerInit.
+func (c *Conn) nativeFormat() PixelFormat {
+	if pf := c.opts.PixelFormat; pf != nil {
+		return *pf
+	}
+	if c.apple {
+		return appleFormat
+	}
+	return PixelFormat{
+		BPP:        16,
+		Depth:      16,
+		BigEndian:  0,
+		TrueColour: 1,
+		RedMax:     0x1f,
+		GreenMax:   0x1f,
+		BlueMax:    0x1f,
+		RedShift:   0xa,
+		GreenShift: 0x5,
+		BlueShift:  0,
+	}
+}
+
+// deliverInput passes an input event from the client to the observers,
+// and to the application unless the connection is view-only.
+func (c *Conn) deliverInput(e interface{}) {
+	c.observeEvent(e)
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.viewOnly || c.eventsClosed {
+		return
+	}
+	select {
+	case c.event <- e:
+		c.held.track(e)
+	default:
+		// Client's too slow.
+	}
+}
+
+// releaseWait is how long the events releasing held keys and buttons
+// wait for room in Event. Unlike client input, they aren't dropped right
+// away when the application is behind.
+const releaseWait = time.Second
+
+// SetViewOnly changes whether the client's input is passed on, which
+// StartOptions.ViewOnly sets initially. Making a connection view-only
+// releases the keys and buttons it holds, by sending the release events
+// to Event, so none stay stuck.
+func (c *Conn) SetViewOnly(viewOnly bool) {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if viewOnly && !c.viewOnly {
+		c.releaseHeldLocked()
+	}
+	c.viewOnly = viewOnly
+}
+
+// isViewOnly reports whether the client's input is dropped, which also
+// keeps it from changing Server.FileSystem.
+func (c *Conn) isViewOnly() bool {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	return c.viewOnly
+}
+
+// releaseHeldLocked sends the events releasing the held keys and buttons.
+// c.inputMu must be held.
+func (c *Conn) releaseHeldLocked() {
+	if c.eventsClosed {
+		return
+	}
+	for _, e := range c.held.release() {
+		select {
+		case c.event <- e:
+		case <-time.After(releaseWait):
+			return
+		}
+	}
+}
+
+// closeEvents releases what the client holds and closes Event, once it
+// disconnected.
+func (c *Conn) closeEvents() {
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if !c.viewOnly {
+		c.releaseHeldLocked()
+	}
+	c.eventsClosed = true
+	close(c.event)
+}
@@ -0,0 +1,100 @@
+package rfb
+
+import (
+	"cmp"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EncodingStats sums up the rectangles sent with one encoding.
+type EncodingStats struct {
+	Encoding int32         // the encoding number, as in SetEncodings
+	Rects    int           // number of rectangles
+	Pixels   int64         // pixels covered by the rectangles
+	RawBytes int64         // size of the pixels in the client's format
+	Bytes    int64         // size of the rectangles' payload as sent
+	Duration time.Duration // time spent encoding
+}
+
+// Ratio returns the compression ratio, RawBytes/Bytes, or 0 if nothing
+// was sent.
+func (s EncodingStats) Ratio() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.Bytes)
+}
+
+// statsTable accumulates EncodingStats per encoding.
+type statsTable struct {
+	mu sync.Mutex
+	m  map[int32]*EncodingStats
+}
+
+func (t *statsTable) add(s EncodingStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m == nil {
+		t.m = make(map[int32]*EncodingStats)
+	}
+	sum, ok := t.m[s.Encoding]
+	if !ok {
+		sum = &EncodingStats{Encoding: s.Encoding}
+		t.m[s.Encoding] = sum
+	}
+	sum.Rects += s.Rects
+	sum.Pixels += s.Pixels
+	sum.RawBytes += s.RawBytes
+	sum.Bytes += s.Bytes
+	sum.Duration += s.Duration
+}
+
+func (t *statsTable) list() []EncodingStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var l []EncodingStats
+	for _, s := range t.m {
+		l = append(l, *s)
+	}
+	slices.SortFunc(l, func(a, b EncodingStats) int { return cmp.Compare(a.Encoding, b.Encoding) })
+	return l
+}
+
+// Stats returns statistics of the rectangles sent to the client so far,
+// one entry per encoding used, ordered by encoding number.
+func (c *Conn) Stats() []EncodingStats {
+	return c.stats.list()
+}
+
+// Stats returns the sum of Conn.Stats over all connections the server
+// has had.
+func (s *Server) Stats() []EncodingStats {
+	return s.stats.list()
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// sentLocked returns the number of bytes the connection has written,
+// including those still buffered.
+func (c *Conn) sentLocked() int64 {
+	return c.cw.n + int64(c.turn.out.Len()) + int64(c.bw.Buffered())
+}
+
+// recordLocked adds a rectangle to the connection's and the server's
+// statistics.
+func (c *Conn) recordLocked(s EncodingStats) {
+	c.stats.add(s)
+	c.s.stats.add(s)
+}
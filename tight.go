@@ -0,0 +1,260 @@
+package rfb
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Tight limits rectangles to tightMaxWidth pixels across; larger ones
+// are also split into pieces of at most tightMaxPixels, as other servers
+// do, to bound the size of the compressed data.
+const (
+	tightMaxWidth  = 2048
+	tightMaxPixels = 65536
+)
+
+// Tight compression control byte. The low four bits reset zlib streams;
+// basic compression has the stream number in bits 4 and 5.
+const (
+	tightFill           = 0x80
+	tightJPEG           = 0x90
+	tightPNG            = 0xa0 // TightPNG only
+	tightExplicitFilter = 0x40
+)
+
+// Tight filters.
+const (
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+)
+
+// Tight zlib streams, one per kind of data, as TightVNC uses them.
+const (
+	tightStreamFull    = 0
+	tightStreamMono    = 1
+	tightStreamIndexed = 2
+)
+
+// Data shorter than tightMinToCompress bytes is sent without zlib.
+const tightMinToCompress = 12
+
+// JPEG quality level pseudo-encodings, 0 to 9. Clients announcing one
+// accept lossy JPEG rectangles.
+const (
+	encodingQualityLevel0 = -32
+	encodingQualityLevel9 = -23
+)
+
+// tightJPEGQuality maps quality levels to image/jpeg qualities, as
+// TightVNC does.
+var tightJPEGQuality = [10]int{5, 10, 15, 25, 37, 50, 60, 70, 75, 80}
+
+// tightMinJPEGPixels is the smallest rectangle sent as JPEG; for smaller
+// ones, the JPEG headers outweigh the savings.
+const tightMinJPEGPixels = 1024
+
+// tpixel reports whether format f uses 3-byte Tight pixels: red, green
+// and blue, in that order, for 32-bit pixels with 8-bit channels.
+func (f *PixelFormat) tpixel() bool {
+	return f.TrueColour != 0 && f.BPP == 32 && f.Depth == 24 &&
+		f.RedMax == 255 && f.GreenMax == 255 && f.BlueMax == 255
+}
+
+// tightEncoder holds a connection's four zlib streams, which span all
+// its Tight rectangles.
+type tightEncoder struct {
+	z    [4]zstream
+	data []byte       // uncompressed data
+	pix  []byte       // scratch space for one pixel
+	jpeg bytes.Buffer // JPEG rectangle
+	png  bytes.Buffer // PNG rectangle
+}
+
+// jpegQualityLocked returns the JPEG quality for the level the client
+// asked for with a quality level pseudo-encoding. ok is false if it
+// didn't, or its pixel format is too coarse for JPEG to pay off or a
+// colour map.
+func (c *Conn) jpegQualityLocked() (quality int, ok bool) {
+	if c.format.BPP < 16 || c.format.TrueColour == 0 {
+		return 0, false
+	}
+	for _, enc := range c.encodings {
+		if enc >= encodingQualityLevel0 && enc <= encodingQualityLevel9 {
+			return tightJPEGQuality[enc-encodingQualityLevel0], true
+		}
+	}
+	return 0, false
+}
+
+// pushTightLocked sends rect of im as the payload of a Tight rectangle,
+// using a fill for solid rectangles, the palette filter for few colours
+// and JPEG or the copy filter otherwise. TightPNG, as used by noVNC,
+// replaces the filters with PNG.
+func (c *Conn) pushTightLocked(w io.Writer, im image.Image, rect image.Rectangle, usePNG bool) {
+	e := c.tight
+	if e == nil {
+		e = &tightEncoder{}
+		c.tight = e
+	}
+	c.pixbuf = c.translateLocked(c.pixbuf[:0], im, rect)
+	px := c.pixbuf
+	if run(px) == len(px) {
+		w.Write([]byte{tightFill})
+		w.Write(e.appendTPixel(nil, &c.format, px[0]))
+		return
+	}
+
+	width, height := rect.Dx(), rect.Dy()
+	pal := newPalette(px, maxPaletteSize)
+	if pal != nil && len(pal.colours) > 2 && (c.format.BPP == 8 || len(px) < 2*len(pal.colours)) {
+		pal = nil // indexes wouldn't be smaller than pixels
+	}
+	if quality, ok := c.jpegQualityLocked(); ok && pal == nil && len(px) >= tightMinJPEGPixels {
+		if data := c.encodeJPEGLocked(im, rect, quality); data != nil {
+			w.Write([]byte{tightJPEG})
+			w.Write(appendCompactLength(nil, len(data)))
+			w.Write(data)
+			return
+		}
+	}
+	if usePNG {
+		w.Write([]byte{tightPNG})
+		data := e.encodePNG(&c.format, px, rect)
+		w.Write(appendCompactLength(nil, len(data)))
+		w.Write(data)
+		return
+	}
+	var stream int
+	data := e.data[:0]
+	switch {
+	case pal == nil:
+		stream = tightStreamFull
+		w.Write([]byte{byte(stream << 4)})
+		for _, v := range px {
+			data = e.appendTPixel(data, &c.format, v)
+		}
+	default:
+		stream = tightStreamIndexed
+		if len(pal.colours) == 2 {
+			stream = tightStreamMono
+		}
+		w.Write([]byte{byte(stream<<4 | tightExplicitFilter)})
+		w.Write([]byte{tightFilterPalette})
+		w.Write([]byte{byte(len(pal.colours) - 1)})
+		var head []byte
+		for _, v := range pal.colours {
+			head = e.appendTPixel(head, &c.format, v)
+		}
+		w.Write(head)
+		if stream == tightStreamMono {
+			// One bit per pixel, from the top bit; rows start on a
+			// byte boundary.
+			for y := 0; y < height; y++ {
+				var b byte
+				nb := 0
+				for _, v := range px[y*width : y*width+width] {
+					b = b<<1 | byte(pal.index[v])
+					if nb++; nb == 8 {
+						data = append(data, b)
+						b, nb = 0, 0
+					}
+				}
+				if nb > 0 {
+					data = append(data, b<<(8-nb))
+				}
+			}
+		} else {
+			for _, v := range px {
+				data = append(data, byte(pal.index[v]))
+			}
+		}
+	}
+	e.data = data
+	c.pushTightDataLocked(w, stream, data)
+}
+
+// pushTightDataLocked sends the data of a basic compression rectangle,
+// compressed with the given zlib stream unless it's short.
+func (c *Conn) pushTightDataLocked(w io.Writer, stream int, data []byte) {
+	if len(data) < tightMinToCompress {
+		w.Write(data)
+		return
+	}
+	z := &c.tight.z[stream]
+	z.write(data, c.compressLevelLocked())
+	out := z.flush()
+	w.Write(appendCompactLength(nil, len(out)))
+	w.Write(out)
+}
+
+// encodeJPEGLocked compresses rect of im as JPEG, in hardware if the
+// server has an encoder for it. It returns nil if that fails.
+func (c *Conn) encodeJPEGLocked(im image.Image, rect image.Rectangle, quality int) []byte {
+	if data, ok := c.encodeHardwareJPEG(im, rect, quality); ok {
+		return data
+	}
+	rgba := image.NewRGBA(rect)
+	draw.Draw(rgba, rect, im, rect.Min, draw.Src)
+	e := c.tight
+	e.jpeg.Reset()
+	if err := jpeg.Encode(&e.jpeg, rgba, &jpeg.Options{Quality: quality}); err != nil {
+		return nil
+	}
+	return e.jpeg.Bytes()
+}
+
+// encodePNG returns the pixels of rect, in format f, as PNG, using a
+// palette if there are few colours.
+func (e *tightEncoder) encodePNG(f *PixelFormat, px []uint32, rect image.Rectangle) []byte {
+	b := image.Rectangle{Max: rect.Size()}
+	var img image.Image
+	if pal := newPalette(px, 256); pal != nil {
+		p := image.NewPaletted(b, nil)
+		for _, v := range pal.colours {
+			p.Palette = append(p.Palette, f.rgba(v))
+		}
+		for i, v := range px {
+			p.Pix[i] = uint8(pal.index[v])
+		}
+		img = p
+	} else {
+		rgba := image.NewRGBA(b)
+		for i, v := range px {
+			col := f.rgba(v)
+			rgba.Pix[4*i], rgba.Pix[4*i+1], rgba.Pix[4*i+2], rgba.Pix[4*i+3] = col.R, col.G, col.B, col.A
+		}
+		img = rgba
+	}
+	e.png.Reset()
+	enc := png.Encoder{CompressionLevel: png.BestSpeed}
+	enc.Encode(&e.png, img) // only fails writing
+	return e.png.Bytes()
+}
+
+// appendTPixel appends v as a Tight pixel in format f.
+func (e *tightEncoder) appendTPixel(dst []byte, f *PixelFormat, v uint32) []byte {
+	if f.tpixel() {
+		return append(dst, byte(v>>f.RedShift), byte(v>>f.GreenShift), byte(v>>f.BlueShift))
+	}
+	e.pix = f.appendPixel(e.pix[:0], v)
+	return append(dst, e.pix...)
+}
+
+// appendCompactLength appends n in Tight's compact representation: one
+// to three bytes of 7, 7 and 8 bits, least significant first, where a
+// set top bit means another byte follows.
+func appendCompactLength(dst []byte, n int) []byte {
+	if n < 0x80 {
+		return append(dst, byte(n))
+	}
+	dst = append(dst, byte(n)|0x80)
+	if n < 0x4000 {
+		return append(dst, byte(n>>7))
+	}
+	return append(dst, byte(n>>7)|0x80, byte(n>>14))
+}
@@ -0,0 +1,136 @@
+package rfb
+
+import "slices"
+
+// authTight is TightVNC's security type. It negotiates a tunnel and an
+// authentication type from lists of capabilities and, once the
+// connection is set up, lists the server's message types and encodings,
+// which is how TightVNC viewers learn about extensions like file
+// transfer.
+const authTight = 16
+
+// tightNoTunnel is the code of the only tunnel type offered, none.
+const tightNoTunnel = 0
+
+// tightCapability is an entry in the lists of the Tight security type.
+type tightCapability struct {
+	Code   int32
+	Vendor [4]byte
+	Name   [8]byte
+}
+
+func tightCap(code int32, vendor, name string) tightCapability {
+	c := tightCapability{Code: code}
+	copy(c.Vendor[:], vendor)
+	copy(c.Name[:], name)
+	return c
+}
+
+// tightEncodings are the TightVNC names of the encodings the server may
+// support, including ones only RegisterEncoder can add.
+var tightEncodings = map[int32]tightCapability{
+	encodingCopyRect:       tightCap(encodingCopyRect, "STDV", "COPYRECT"),
+	2:                      tightCap(2, "STDV", "RRE_____"),
+	encodingCoRRE:          tightCap(encodingCoRRE, "STDV", "CORRE___"),
+	encodingHextile:        tightCap(encodingHextile, "STDV", "HEXTILE_"),
+	6:                      tightCap(6, "TRDV", "ZLIB____"),
+	encodingTight:          tightCap(encodingTight, "TGHT", "TIGHT___"),
+	8:                      tightCap(8, "TRDV", "ZLIBHEX_"),
+	encodingCompressLevel0: tightCap(encodingCompressLevel0, "TGHT", "COMPRLVL"),
+	encodingQualityLevel0:  tightCap(encodingQualityLevel0, "TGHT", "JPEGQLVL"),
+	encodingXCursor:        tightCap(encodingXCursor, "TGHT", "X11CURSR"),
+	encodingRichCursor:     tightCap(encodingRichCursor, "TGHT", "RCHCURSR"),
+	encodingPointerPos:     tightCap(encodingPointerPos, "TGHT", "POINTPOS"),
+	encodingLastRect:       tightCap(encodingLastRect, "TGHT", "LASTRECT"),
+	encodingDesktopSize:    tightCap(encodingDesktopSize, "TGHT", "NEWFBSIZ"),
+}
+
+// tightAuthTypes returns the authentication types offered inside the
+// Tight security type. None is offered by sending no types at all, as
+// TightVNC servers do.
+func (c *Conn) tightAuthTypes() []tightCapability {
+	if c.s.Password != "" {
+		return []tightCapability{tightCap(authVNC, "STDV", "VNCAUTH_")}
+	}
+	return nil
+}
+
+// tightBypasses reports whether Tight, which can only ask for
+// Server.Password, would let clients around the authentication of the
+// server's other security types.
+func (s *Server) tightBypasses() bool {
+	return s.Password == "" && (s.Authenticate != nil || len(s.SecurityHandlers) > 0)
+}
+
+// tightSecurity runs the Tight security type's handshake and reports
+// whether the client authenticated.
+func (c *Conn) tightSecurity(ver string) bool {
+	c.w(uint32(1))
+	c.w(tightCap(tightNoTunnel, "TGHT", "NOTUNNEL"))
+	c.flush()
+	var tunnel int32
+	c.read("tight.tunnel-type", &tunnel)
+	if tunnel != tightNoTunnel {
+		c.refuse(ver, "unsupported tunnel type")
+		c.failf(ClassUnsupported, "client wanted Tight tunnel type %d", tunnel)
+	}
+
+	auths := c.tightAuthTypes()
+	if c.s.tightBypasses() {
+		// Negotiation leaves Tight out then.
+		c.refuse(ver, "authentication required")
+		c.failf(ClassAuth, "Tight without authentication on a server requiring it")
+	}
+	c.w(uint32(len(auths)))
+	c.w(auths)
+	c.flush()
+	if len(auths) == 0 {
+		return false
+	}
+	var code int32
+	c.read("tight.auth-type", &code)
+	if !slices.ContainsFunc(auths, func(a tightCapability) bool { return a.Code == code }) {
+		c.refuse(ver, "unsupported authentication type")
+		c.failf(ClassUnsupported, "client wanted Tight authentication type %d", code)
+	}
+	// VNC Authentication is the only type offered.
+	if !c.authVNC() {
+		authFailed(c, "VNC authentication failed")
+	}
+	return true
+}
+
+// writeTightCaps writes the Tight security type's lists of message
+// types and encodings, which follow ServerInit.
+func (c *Conn) writeTightCaps() {
+	var server, client []tightCapability
+	if c.s.FileSystem != nil {
+		server = append(server,
+			tightCap(cmdFileListData, "TGHT", "FTS_LSDT"),
+			tightCap(cmdFileDownloadData, "TGHT", "FTS_DNDT"),
+			tightCap(cmdFileUploadCancel, "TGHT", "FTS_UPCN"),
+			tightCap(cmdFileDownloadFailed, "TGHT", "FTS_DNFL"))
+		client = append(client,
+			tightCap(cmdFileListRequest, "TGHT", "FTC_LSRQ"),
+			tightCap(cmdFileDownloadRequest, "TGHT", "FTC_DNRQ"),
+			tightCap(cmdFileUploadRequest, "TGHT", "FTC_UPRQ"),
+			tightCap(cmdFileUploadData, "TGHT", "FTC_UPDT"),
+			tightCap(cmdFileDownloadCancel, "TGHT", "FTC_DNCN"),
+			tightCap(cmdFileUploadFailed, "TGHT", "FTC_UPFL"),
+			tightCap(cmdFileCreateDirRequest, "TGHT", "FTC_FCDR"))
+	}
+	caps := c.s.Capabilities()
+	var encodings []tightCapability
+	for _, e := range append(caps.Encodings, caps.PseudoEncodings...) {
+		if tc, ok := tightEncodings[e.Number]; ok {
+			encodings = append(encodings, tc)
+		}
+	}
+	c.w(uint16(len(server)))
+	c.w(uint16(len(client)))
+	c.w(uint16(len(encodings)))
+	c.w(uint16(0)) // padding
+	c.w(server)
+	c.w(client)
+	c.w(encodings)
+}
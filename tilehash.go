@@ -0,0 +1,56 @@
+package rfb
+
+import (
+	"hash/fnv"
+	"image"
+)
+
+// tileHash hashes region r of img after conversion to the client's pixel
+// format. c.mu must be held.
+func (c *Conn) tileHashLocked(img image.Image, r image.Rectangle) uint64 {
+	c.pixbuf = c.translateLocked(c.pixbuf[:0], img, r)
+	h := fnv.New64a()
+	var b [4]byte
+	for _, v := range c.pixbuf {
+		b[0], b[1], b[2], b[3] = byte(v), byte(v>>8), byte(v>>16), byte(v>>24)
+		h.Write(b[:])
+	}
+	return h.Sum64()
+}
+
+// dropUnchangedLocked splits rects at tile boundaries and drops the
+// pieces of tiles that look the same to the client as when they were
+// last sent. For non-incremental updates, it only remembers the tiles.
+// c.mu must be held.
+func (c *Conn) dropUnchangedLocked(img image.Image, rects []image.Rectangle, incremental bool) []image.Rectangle {
+	if !incremental || c.tiles == nil {
+		c.tiles = make(map[image.Point]uint64)
+	}
+	bounds := img.Bounds()
+	size := c.s.tileSize()
+	var out []image.Rectangle
+	for _, r := range rects {
+		for ty := r.Min.Y - r.Min.Y%size.Y; ty < r.Max.Y; ty += size.Y {
+			for tx := r.Min.X - r.Min.X%size.X; tx < r.Max.X; tx += size.X {
+				tile := image.Rect(tx, ty, tx+size.X, ty+size.Y).Intersect(bounds)
+				piece := r.Intersect(tile)
+				if piece.Empty() {
+					continue
+				}
+				// The client has the rest of the tile already, assuming
+				// the damage was accurate, so the whole tile is hashed.
+				key := tile.Min
+				sum := c.tileHashLocked(img, tile)
+				if old, ok := c.tiles[key]; ok && old == sum && incremental {
+					continue
+				}
+				c.tiles[key] = sum
+				out = append(out, piece)
+			}
+		}
+	}
+	if !incremental {
+		return rects
+	}
+	return out
+}
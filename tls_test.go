@@ -0,0 +1,101 @@
+package rfb_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/patdhlk/rfb"
+)
+
+// issue returns a certificate for name signed by parent, or
+// self-signed if parent is nil.
+func issue(t *testing.T, name string, usage x509.ExtKeyUsage, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerClientCAs(t *testing.T) {
+	ca := issue(t, "ca", x509.ExtKeyUsageAny, nil)
+	other := issue(t, "other", x509.ExtKeyUsageAny, nil)
+	serverCert := issue(t, "localhost", x509.ExtKeyUsageServerAuth, &ca)
+	alice := issue(t, "alice", x509.ExtKeyUsageClientAuth, &ca)
+	mallory := issue(t, "mallory", x509.ExtKeyUsageClientAuth, &other)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := rfb.NewServer(16, 16)
+	s.ClientCAs = x509.NewCertPool()
+	s.ClientCAs.AddCert(ca.Leaf)
+	go s.Serve(ln)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	dial := func(certs ...tls.Certificate) (*rfb.ClientConn, error) {
+		nc, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      roots,
+			Certificates: certs,
+		})
+		if err != nil {
+			return nil, err
+		}
+		cc, err := rfb.NewClientConn(nc, nil)
+		if err != nil {
+			nc.Close()
+		}
+		return cc, err
+	}
+
+	for _, certs := range [][]tls.Certificate{nil, {mallory}} {
+		if cc, err := dial(certs...); err == nil {
+			cc.Close()
+			t.Errorf("connected with certificates %v", certs)
+		}
+	}
+	cc, err := dial(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	id := acceptIdentity(t, s)
+	if id.Certificate == nil || id.Certificate.Subject.CommonName != "alice" || id.TLS == nil {
+		t.Errorf("got identity %+v; want alice's certificate", id)
+	}
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"github.com/patdhlk/rfb"
+	"github.com/patdhlk/rfb/keymap"
+)
+
+// Input receives the input of viewers. It's implemented by the VMM, which
+// forwards it to the guest's emulated keyboard and tablet.
+type Input interface {
+	// Key presses or releases a key. The scancode is the XT scancode in
+	// QEMU's encoding (extended keys have the 0xe0 prefix replaced by
+	// the high bit) or 0 if the viewer only sent a keysym; the VMM
+	// then has to map the keysym itself.
+	Key(down bool, keysym, scancode uint32)
+
+	// Pointer moves the absolute pointer (a tablet, from the guest's
+	// point of view) and sets the button state. See rfb.PointerEvent
+	// for the bits of buttons.
+	Pointer(x, y int, buttons uint8)
+}
+
+// RelativeInput is implemented by Input of VMMs that also emulate a
+// relative pointing device, a mouse, for guests without tablet support.
+// It receives the movements of viewers switched to relative mode with
+// rfb.Conn.SetRelativePointer.
+type RelativeInput interface {
+	Input
+
+	// RelativePointer moves the mouse by dx, dy and sets the button
+	// state.
+	RelativePointer(dx, dy int, buttons uint8)
+}
+
+// PowerControl is implemented by Input of VMMs that let viewers shut
+// down, reboot or reset the guest. It receives the requests of viewers
+// supporting the xvp extension; the server should have Xvp set.
+type PowerControl interface {
+	Input
+
+	// Power carries out op. If it fails, the viewer is told.
+	Power(op rfb.XvpEvent) error
+}
+
+// ServeInput delivers the events of c to in until the viewer
+// disconnects. The server should have QEMUKeyEvents set, so viewers
+// supporting it send scancodes; guests don't know about keysyms.
+func ServeInput(c *rfb.Conn, in Input) {
+	ServeInputLayout(c, in, nil)
+}
+
+// ServeInputLayout is ServeInput for a guest using keyboard layout l.
+// Key events without a scancode are translated to the scancodes that
+// type their keysym on l, pressing or releasing Shift and AltGr as
+// needed, so the VMM always gets a scancode for keys l has. With a nil
+// layout, it's ServeInput.
+func ServeInputLayout(c *rfb.Conn, in Input, l *keymap.Layout) {
+	var tr *keymap.Translator
+	if l != nil {
+		tr = keymap.NewTranslator(l)
+	}
+	for e := range c.Event {
+		switch e := e.(type) {
+		case rfb.QEMUKeyEvent:
+			in.Key(e.DownFlag != 0, e.Key, e.Keycode)
+		case rfb.KeyEvent:
+			if tr == nil {
+				in.Key(e.DownFlag != 0, e.Key, 0)
+				continue
+			}
+			for _, k := range tr.Translate(e.DownFlag != 0, e.Key) {
+				in.Key(k.Down, k.Keysym, k.Scancode)
+			}
+		case rfb.PointerEvent:
+			in.Pointer(int(e.X), int(e.Y), e.ButtonMask)
+		case rfb.RelativePointerEvent:
+			if rel, ok := in.(RelativeInput); ok {
+				rel.RelativePointer(e.DX, e.DY, e.ButtonMask)
+			}
+		case rfb.XvpEvent:
+			pc, ok := in.(PowerControl)
+			if !ok || pc.Power(e) != nil {
+				c.FailXvp()
+			}
+		}
+	}
+}
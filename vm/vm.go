@@ -0,0 +1,160 @@
+// Package vm serves the display of a virtual machine over RFB, making the
+// rfb package usable as the VNC front-end of a VMM.
+//
+// The VMM owns the guest framebuffer (typically a virtio-gpu resource or a
+// shared-memory scanout) and calls Display.Flush whenever the guest
+// reports dirty rectangles. Each viewer gets its own FrameSource that
+// only copies what changed. Input goes back to the VMM through the Input
+// interface, including the scancodes of QEMU extended key events.
+package vm
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"sync"
+
+	"github.com/patdhlk/rfb"
+)
+
+// ErrClosed is returned by a viewer's NextFrame once the display was
+// closed.
+var ErrClosed = errors.New("vm: display closed")
+
+// ErrDetached is returned by a viewer's NextFrame once its source was
+// detached.
+var ErrDetached = errors.New("vm: source detached")
+
+// Display is a guest display that can be served to any number of
+// viewers.
+type Display struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	scanout image.Image
+	viewers map[*viewer]struct{}
+	closed  bool
+}
+
+// NewDisplay returns a display showing scanout. The VMM keeps writing to
+// scanout and calls Flush for the regions it changed.
+func NewDisplay(scanout image.Image) *Display {
+	d := &Display{
+		scanout: scanout,
+		viewers: make(map[*viewer]struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// Bounds returns the size of the current scanout.
+func (d *Display) Bounds() image.Rectangle {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.scanout.Bounds()
+}
+
+// Flush marks regions of the scanout as changed, as the guest does with
+// virtio-gpu's RESOURCE_FLUSH. Viewers pick them up with their next
+// frame.
+func (d *Display) Flush(dirty ...image.Rectangle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	bounds := d.scanout.Bounds()
+	for v := range d.viewers {
+		for _, r := range dirty {
+			if r = r.Intersect(bounds); !r.Empty() {
+				v.damage = append(v.damage, r)
+			}
+		}
+	}
+	d.cond.Broadcast()
+}
+
+// SetScanout replaces the scanout, e.g. after the guest changed its video
+// mode or switched resources. Everything is considered dirty.
+func (d *Display) SetScanout(scanout image.Image) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.scanout = scanout
+	for v := range d.viewers {
+		v.damage = append(v.damage[:0], scanout.Bounds())
+	}
+	d.cond.Broadcast()
+}
+
+// Close wakes up all viewers waiting for frames; they return ErrClosed.
+func (d *Display) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	d.cond.Broadcast()
+}
+
+// Source returns a FrameSource for one viewer. Release it with Detach
+// once the viewer disconnected.
+func (d *Display) Source() rfb.FrameSource {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v := &viewer{d: d, damage: []image.Rectangle{d.scanout.Bounds()}}
+	d.viewers[v] = struct{}{}
+	return v
+}
+
+// Detach stops tracking damage for a source returned by Source. A
+// NextFrame call waiting on it returns ErrDetached.
+func (d *Display) Detach(src rfb.FrameSource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := src.(*viewer); ok {
+		delete(d.viewers, v)
+		v.detached = true
+		d.cond.Broadcast()
+	}
+}
+
+// viewer is the per-connection FrameSource of a Display. It copies the
+// dirty parts of the scanout into a private frame, so the guest can keep
+// drawing while the frame is encoded.
+type viewer struct {
+	d        *Display
+	frame    *image.RGBA
+	damage   []image.Rectangle // guarded by d.mu
+	detached bool              // guarded by d.mu
+}
+
+func (v *viewer) Bounds() image.Rectangle {
+	return v.d.Bounds()
+}
+
+func (v *viewer) NextFrame() (*rfb.LockableImage, error) {
+	d := v.d
+	d.mu.Lock()
+	for len(v.damage) == 0 && !d.closed && !v.detached {
+		d.cond.Wait()
+	}
+	switch {
+	case d.closed:
+		d.mu.Unlock()
+		return nil, ErrClosed
+	case v.detached:
+		d.mu.Unlock()
+		return nil, ErrDetached
+	}
+	damage := v.damage
+	v.damage = nil
+	scanout := d.scanout
+	d.mu.Unlock()
+
+	bounds := scanout.Bounds()
+	if v.frame == nil || v.frame.Rect != bounds.Sub(bounds.Min) {
+		v.frame = image.NewRGBA(bounds.Sub(bounds.Min))
+		damage = []image.Rectangle{bounds}
+	}
+	rects := make([]image.Rectangle, 0, len(damage))
+	for _, r := range damage {
+		dst := r.Sub(bounds.Min)
+		draw.Draw(v.frame, dst, scanout, r.Min, draw.Src)
+		rects = append(rects, dst)
+	}
+	return &rfb.LockableImage{Img: v.frame, Damage: rects}, nil
+}
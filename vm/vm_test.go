@@ -0,0 +1,64 @@
+package vm
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestDisplayFlush(t *testing.T) {
+	scanout := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	d := NewDisplay(scanout)
+	src := d.Source()
+	defer d.Detach(src)
+
+	li, err := src.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []image.Rectangle{scanout.Rect}; len(li.Damage) != 1 || li.Damage[0] != want[0] {
+		t.Fatalf("first frame damage = %v; want %v", li.Damage, want)
+	}
+
+	red := color.RGBA{0xff, 0, 0, 0xff}
+	scanout.Set(10, 20, red)
+	dirty := image.Rect(8, 16, 16, 24)
+	d.Flush(dirty, image.Rect(100, 100, 110, 110)) // the latter is off screen
+
+	li, err = src.NextFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(li.Damage) != 1 || li.Damage[0] != dirty {
+		t.Errorf("damage = %v; want [%v]", li.Damage, dirty)
+	}
+	if got := li.Img.At(10, 20); got != red {
+		t.Errorf("pixel = %v; want %v", got, red)
+	}
+}
+
+func TestDisplayDetach(t *testing.T) {
+	d := NewDisplay(image.NewRGBA(image.Rect(0, 0, 64, 48)))
+	src := d.Source()
+	if _, err := src.NextFrame(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next call waits for damage, until the source is detached.
+	errc := make(chan error, 1)
+	go func() {
+		_, err := src.NextFrame()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	d.Detach(src)
+	select {
+	case err := <-errc:
+		if err != ErrDetached {
+			t.Errorf("NextFrame returned %v; want ErrDetached", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NextFrame still waiting after Detach")
+	}
+}
@@ -0,0 +1,72 @@
+package rfb
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+// authVNC is VNC Authentication, a DES challenge-response with a
+// password of up to eight characters.
+const authVNC = 2
+
+// passwdKey is the fixed key vncpasswd obfuscates password files with.
+var passwdKey = []byte{23, 82, 107, 6, 35, 78, 88, 7}
+
+// vncDESKey returns the DES key for password: its first eight bytes,
+// zero-padded, with the bits of each reversed, as VNC has always used
+// them.
+func vncDESKey(password []byte) []byte {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		key[i] = bits.Reverse8(b)
+	}
+	return key
+}
+
+// vncAuthResponse returns the response to challenge for password.
+func vncAuthResponse(password string, challenge []byte) []byte {
+	block, _ := des.NewCipher(vncDESKey([]byte(password)))
+	resp := make([]byte, len(challenge))
+	for i := 0; i+des.BlockSize <= len(challenge); i += des.BlockSize {
+		block.Encrypt(resp[i:], challenge[i:])
+	}
+	return resp
+}
+
+// ReadPasswordFile returns the password in a file written by vncpasswd,
+// for Server.Password.
+func ReadPasswordFile(name string) (string, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < des.BlockSize {
+		return "", errors.New("rfb: password file too short")
+	}
+	block, _ := des.NewCipher(vncDESKey(passwdKey))
+	block.Decrypt(b, b[:des.BlockSize])
+	return string(bytes.TrimRight(b[:des.BlockSize], "\x00")), nil
+}
+
+// authVNC runs VNC Authentication and reports whether the client knew
+// Server.Password.
+func (c *Conn) authVNC() bool {
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		c.failf(ClassIO, "generating challenge: %v", err)
+	}
+	c.bw.Write(challenge)
+	c.flush()
+	resp := make([]byte, 16)
+	if _, err := io.ReadFull(c.br, resp); err != nil {
+		c.failf(ClassIO, "reading VNC authentication response: %v", err)
+	}
+	return subtle.ConstantTimeCompare(resp, vncAuthResponse(c.s.Password, challenge)) == 1
+}
@@ -0,0 +1,90 @@
+package rfb
+
+import "log"
+
+// encodingXvp is the pseudo-encoding of clients supporting the xvp
+// extension, which lets them ask for the machine behind the framebuffer
+// to be shut down, rebooted or reset.
+const encodingXvp = -309
+
+// xvp message codes. xvpInit and xvpFail go to the client, the others
+// come from it.
+const (
+	xvpFail = 0
+	xvpInit = 1
+
+	xvpVersion = 1
+)
+
+// XvpEvent is a client asking for the machine behind the framebuffer,
+// typically a virtual machine, to be powered off, rebooted or reset. It's
+// sent on Conn.Event if Server.Xvp is set. If the operation can't be
+// done, the application should tell the client with Conn.FailXvp.
+type XvpEvent uint8
+
+const (
+	XvpShutdown XvpEvent = 2 // shut down cleanly
+	XvpReboot   XvpEvent = 3 // reboot cleanly
+	XvpReset    XvpEvent = 4 // reset at once, like a reset button
+)
+
+func (e XvpEvent) String() string {
+	switch e {
+	case XvpShutdown:
+		return "shutdown"
+	case XvpReboot:
+		return "reboot"
+	case XvpReset:
+		return "reset"
+	}
+	return "unknown"
+}
+
+// FailXvp tells the client that its last XvpEvent couldn't be done.
+func (c *Conn) FailXvp() error {
+	return c.writeMessage(func() {
+		c.writeXvp(xvpFail)
+	})
+}
+
+// sendXvpInit tells a client supporting xvp that it may send requests.
+func (c *Conn) sendXvpInit() {
+	c.writeMessage(func() {
+		c.writeXvp(xvpInit)
+	})
+}
+
+// writeXvp writes an xvp message with code. c.wmu must be held.
+func (c *Conn) writeXvp(code uint8) {
+	c.w(uint8(cmdXvp))
+	c.w(uint8(0)) // padding
+	c.w(uint8(xvpVersion))
+	c.w(code)
+}
+
+func (c *Conn) handleXvp() {
+	c.readPadding("xvp.padding", 1)
+	version := c.readByte("xvp.version")
+	e := XvpEvent(c.readByte("xvp.code"))
+	log.Printf("client asks for xvp %v", e)
+	switch {
+	case version != xvpVersion || e < XvpShutdown || e > XvpReset:
+		c.reject(ClassUnsupported, "xvp version %d code %d", version, uint8(e))
+		return
+	case !c.s.Xvp:
+		c.FailXvp()
+		return
+	}
+	c.inputMu.Lock()
+	defer c.inputMu.Unlock()
+	if c.viewOnly || c.eventsClosed {
+		c.FailXvp()
+		return
+	}
+	select {
+	case c.event <- e:
+	default:
+		// The application is behind.
+		c.FailXvp()
+	}
+}
@@ -0,0 +1,217 @@
+package rfb
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+// zrleTileSize is the edge length of ZRLE tiles.
+const zrleTileSize = 64
+
+// ZRLE tile subencodings. Packed palettes use their size, 2 to 16, and
+// palette RLE zrleRLE plus the size.
+const (
+	zrleRaw   = 0
+	zrleSolid = 1
+	zrleRLE   = 128
+)
+
+// cpixel returns the size of a ZRLE compressed pixel in format f, and
+// the offset of its bytes within the pixel as sent in Raw. Compressed
+// pixels drop the unused byte of 32-bit formats with a depth of 24 or
+// less.
+func (f *PixelFormat) cpixel() (size, offset int) {
+	if f.TrueColour == 0 || f.BPP != 32 || f.Depth > 24 {
+		return int(f.BPP) / 8, 0
+	}
+	used := uint32(f.RedMax)<<f.RedShift | uint32(f.GreenMax)<<f.GreenShift | uint32(f.BlueMax)<<f.BlueShift
+	switch {
+	case used&0xff000000 == 0: // least significant three bytes
+		if f.BigEndian != 0 {
+			return 3, 1
+		}
+		return 3, 0
+	case used&0xff == 0: // most significant three bytes
+		if f.BigEndian != 0 {
+			return 3, 0
+		}
+		return 3, 1
+	}
+	return 4, 0
+}
+
+// zrleEncoder holds a connection's zlib stream, which spans all its
+// ZRLE rectangles.
+type zrleEncoder struct {
+	z    zstream
+	tile []byte // uncompressed tile
+	pix  []byte // scratch space for one pixel
+
+	// Finding a tile's palette is the costly part of encoding it. For
+	// photo-like content, palettes rarely win, so after a run of tiles
+	// without a win the search is skipped for a while, except for
+	// clients whose format prefers palettes.
+	paletteTries, paletteWins int
+	skipPalette               int // tiles left to skip
+}
+
+// Palette search feedback: after paletteProbe tiles without a palette
+// subencoding winning, skip the search for paletteSkip tiles.
+const (
+	paletteProbe = 256
+	paletteSkip  = 1024
+)
+
+// pushZRLELocked sends rect of im as the payload of a ZRLE rectangle.
+func (c *Conn) pushZRLELocked(w io.Writer, im image.Image, rect image.Rectangle) {
+	e := c.zrle
+	if e == nil {
+		e = &zrleEncoder{}
+		c.zrle = e
+	}
+	level := c.compressLevelLocked()
+	for ty := rect.Min.Y; ty < rect.Max.Y; ty += zrleTileSize {
+		for tx := rect.Min.X; tx < rect.Max.X; tx += zrleTileSize {
+			t := image.Rect(tx, ty, min(tx+zrleTileSize, rect.Max.X), min(ty+zrleTileSize, rect.Max.Y))
+			c.pixbuf = c.translateLocked(c.pixbuf[:0], im, t)
+			e.tile = e.encodeTile(e.tile[:0], &c.format, c.pixbuf, t.Dx(), t.Dy())
+			e.z.write(e.tile, level)
+		}
+	}
+	out := e.z.flush()
+	binary.Write(w, binary.BigEndian, uint32(len(out)))
+	w.Write(out)
+}
+
+// encodeTile appends the smallest encoding of a w×h tile with the given
+// pixels to dst.
+func (e *zrleEncoder) encodeTile(dst []byte, f *PixelFormat, px []uint32, w, h int) []byte {
+	size, off := f.cpixel()
+	cpixel := func(dst []byte, v uint32) []byte {
+		e.pix = f.appendPixel(e.pix[:0], v)
+		return append(dst, e.pix[off:off+size]...)
+	}
+	if run(px) == len(px) {
+		return cpixel(append(dst, zrleSolid), px[0])
+	}
+	var pal *palette
+	searched := e.skipPalette == 0 || f.prefersPalette()
+	if searched {
+		pal = newPalette(px, maxPaletteSize)
+	} else {
+		e.skipPalette--
+	}
+
+	// Work out the size of each encoding from the runs.
+	var plainRLE, paletteRLE int
+	for i := 0; i < len(px); {
+		n := run(px[i:])
+		plainRLE += size + runBytes(n)
+		paletteRLE++
+		if n > 1 {
+			paletteRLE += runBytes(n)
+		}
+		i += n
+	}
+	sub, best := zrleRaw, len(px)*size
+	if plainRLE < best {
+		sub, best = zrleRLE, plainRLE
+	}
+	if pal != nil {
+		n := len(pal.colours)
+		if paletteRLE += n * size; paletteRLE < best {
+			sub, best = zrleRLE+n, paletteRLE
+		}
+		if n <= 16 {
+			packed := n*size + h*((w*pal.bitsPerIndex()+7)/8)
+			if packed < best {
+				sub, best = n, packed
+			}
+		}
+	}
+
+	if searched {
+		e.paletteTries++
+		if sub != zrleRaw && sub != zrleRLE {
+			e.paletteWins++
+		}
+		if e.paletteTries == paletteProbe {
+			if e.paletteWins == 0 {
+				e.skipPalette = paletteSkip
+			}
+			e.paletteTries, e.paletteWins = 0, 0
+		}
+	}
+
+	dst = append(dst, byte(sub))
+	switch {
+	case sub == zrleRaw:
+		for _, v := range px {
+			dst = cpixel(dst, v)
+		}
+	case sub == zrleRLE:
+		for i := 0; i < len(px); {
+			n := run(px[i:])
+			dst = appendRunLength(cpixel(dst, px[i]), n)
+			i += n
+		}
+	case sub > zrleRLE:
+		for _, v := range pal.colours {
+			dst = cpixel(dst, v)
+		}
+		for i := 0; i < len(px); {
+			n := run(px[i:])
+			if n == 1 {
+				dst = append(dst, byte(pal.index[px[i]]))
+			} else {
+				dst = appendRunLength(append(dst, byte(pal.index[px[i]]|128)), n)
+			}
+			i += n
+		}
+	default: // packed palette
+		for _, v := range pal.colours {
+			dst = cpixel(dst, v)
+		}
+		bits := pal.bitsPerIndex()
+		for y := 0; y < h; y++ {
+			// Rows start on a byte boundary, indexes from the top bit.
+			var b byte
+			nb := 0
+			for _, v := range px[y*w : y*w+w] {
+				b = b<<bits | byte(pal.index[v])
+				if nb += bits; nb == 8 {
+					dst = append(dst, b)
+					b, nb = 0, 0
+				}
+			}
+			if nb > 0 {
+				dst = append(dst, b<<(8-nb))
+			}
+		}
+	}
+	return dst
+}
+
+// run returns the length of the run of equal pixels px starts with.
+func run(px []uint32) int {
+	n := 1
+	for n < len(px) && px[n] == px[0] {
+		n++
+	}
+	return n
+}
+
+// runBytes returns the size of the run length n, as sent by ZRLE.
+func runBytes(n int) int {
+	return (n-1)/255 + 1
+}
+
+// appendRunLength appends the run length n, as sent by ZRLE: n-1 as a
+// sum of bytes, all but the last of them 255.
+func appendRunLength(dst []byte, n int) []byte {
+	for n--; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
@@ -0,0 +1,62 @@
+package rfb
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+)
+
+// A zstream is one of a connection's zlib streams, which span all the
+// rectangles of an encoding. The compression level can change between
+// rectangles: after a flush, the deflate data continues with blocks from
+// a compressor for the new level, which decompressors take as part of
+// the same stream.
+type zstream struct {
+	out   bytes.Buffer // compressed data of the current rectangle
+	fw    *flate.Writer
+	level int
+}
+
+// write compresses data at the given level.
+func (z *zstream) write(data []byte, level int) {
+	if z.fw == nil || level != z.level {
+		if z.fw == nil {
+			z.out.Write([]byte{0x78, 0x9c}) // zlib header: deflate, 32K window
+		}
+		fw, err := flate.NewWriter(&z.out, level)
+		if err != nil {
+			fw, _ = flate.NewWriter(&z.out, flate.DefaultCompression)
+		}
+		z.fw, z.level = fw, level
+	}
+	z.fw.Write(data)
+}
+
+// flush ends the current rectangle's data and returns it; it's valid
+// until the next write.
+func (z *zstream) flush() []byte {
+	if z.fw == nil {
+		return nil // nothing written yet
+	}
+	z.fw.Flush()
+	b := z.out.Bytes()
+	z.out.Reset()
+	return b
+}
+
+// Compression level pseudo-encodings, 0 to 9.
+const (
+	encodingCompressLevel0 = -256
+	encodingCompressLevel9 = -247
+)
+
+// compressLevelLocked returns the zlib level the client asked for with
+// a compression level pseudo-encoding, or the default.
+func (c *Conn) compressLevelLocked() int {
+	for _, enc := range c.encodings {
+		if enc >= encodingCompressLevel0 && enc <= encodingCompressLevel9 {
+			return int(enc - encodingCompressLevel0)
+		}
+	}
+	return zlib.DefaultCompression
+}